@@ -555,6 +555,47 @@ func (c *Client) Ping() error {
 	}
 }
 
+// UpdateWillTopic sends a WILLTOPICUPD packet to the MQTT-SN gateway. An empty
+// topic deletes the will. On success, the ClientConfig's will topic, QoS and
+// retain flag are updated accordingly so that they are used on reconnect.
+func (c *Client) UpdateWillTopic(topic string, qos uint8, retain bool) error {
+	if qos > 2 {
+		return fmt.Errorf("invalid will qos: %d", qos)
+	}
+	transaction := newWillTopicUpdTransaction(c)
+	willTopicUpd := pkts1.NewWillTopicUpd(topic, qos, retain)
+	c.transactions.StoreByType(pkts.WILLTOPICUPD, transaction)
+	transaction.Proceed(nil, willTopicUpd)
+	if err := c.send(willTopicUpd); err != nil {
+		transaction.Fail(err)
+	}
+	select {
+	case <-transaction.Done():
+		return transaction.Err()
+	case <-c.groupCtx.Done():
+		return c.group.Wait()
+	}
+}
+
+// UpdateWillMessage sends a WILLMSGUPD packet to the MQTT-SN gateway. On
+// success, the ClientConfig's will payload is updated accordingly so that it
+// is used on reconnect.
+func (c *Client) UpdateWillMessage(payload []byte) error {
+	transaction := newWillMsgUpdTransaction(c)
+	willMsgUpd := pkts1.NewWillMsgUpd(payload)
+	c.transactions.StoreByType(pkts.WILLMSGUPD, transaction)
+	transaction.Proceed(nil, willMsgUpd)
+	if err := c.send(willMsgUpd); err != nil {
+		transaction.Fail(err)
+	}
+	select {
+	case <-transaction.Done():
+		return transaction.Err()
+	case <-c.groupCtx.Done():
+		return c.group.Wait()
+	}
+}
+
 // Sleep informs the MQTT-SN gateway that the client is going to sleep.
 func (c *Client) Sleep(duration time.Duration) error {
 	transaction := newSleepTransaction(c, duration)
@@ -1590,6 +1590,76 @@ func TestPing(t *testing.T) {
 	wg.Wait()
 }
 
+func TestUpdateWill(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	willTopic := "will/topic"
+	willPayload := []byte("will message")
+
+	stp := newTestSetup(t, clientID)
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --WILLTOPICUPD--> GW
+		willTopicUpd := stp.recv().(*pkts1.WillTopicUpd)
+		assert.Equal(willTopic, willTopicUpd.WillTopic)
+		assert.Equal(uint8(1), willTopicUpd.QOS)
+		assert.Equal(true, willTopicUpd.Retain)
+
+		// client <--WILLTOPICRESP-- GW
+		stp.send(pkts1.NewWillTopicResp(pkts1.RC_ACCEPTED))
+
+		// client --WILLMSGUPD--> GW
+		willMsgUpd := stp.recv().(*pkts1.WillMsgUpd)
+		assert.Equal(willPayload, willMsgUpd.WillMsg)
+
+		// client <--WILLMSGRESP-- GW
+		stp.send(pkts1.NewWillMsgResp(pkts1.RC_ACCEPTED))
+
+		// client --WILLMSGUPD--> GW
+		stp.recv()
+
+		// client <--WILLMSGRESP-- GW
+		stp.send(pkts1.NewWillMsgResp(pkts1.RC_CONGESTION))
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	if err := stp.client.UpdateWillTopic(willTopic, 1, true); err != nil {
+		stp.t.Fatal(err)
+	}
+	assert.Equal(willTopic, stp.client.cfg.WillTopic)
+	assert.Equal(uint8(1), stp.client.cfg.WillQOS)
+	assert.Equal(true, stp.client.cfg.WillRetained)
+
+	if err := stp.client.UpdateWillMessage(willPayload); err != nil {
+		stp.t.Fatal(err)
+	}
+	assert.Equal(willPayload, stp.client.cfg.WillPayload)
+
+	err := stp.client.UpdateWillMessage([]byte("rejected"))
+	assert.Error(err)
+	assert.Equal(willPayload, stp.client.cfg.WillPayload)
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+
+	wg.Wait()
+}
+
 func TestSleep(t *testing.T) {
 	assert := assert.New(t)
 
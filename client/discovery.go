@@ -0,0 +1,214 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pkts "github.com/energostack/bisquitt/packets"
+	pkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+// A gateway is considered unavailable if this many successive ADVERTISE
+// packets are missed.
+// See N_ADV in MQTT-SN specification v. 1.2, chapter 6.1.
+const advertiseMissLimit = 2
+
+type DiscoveryConfig struct {
+	// Address is a broadcast or multicast address the SEARCHGW packet is sent
+	// to (e.g. "225.1.1.1:1884").
+	Address *net.UDPAddr
+	// Radius is the broadcast radius of the SEARCHGW packet.
+	Radius uint8
+	// GatewayPort is the MQTT-SN port of the discovered gateways. The
+	// MQTT-SN 1.2 gateways do not include their address in the GWINFO packet
+	// and usually send ADVERTISE and GWINFO from a different port than they
+	// listen on. If GatewayPort is zero, the source port of the received
+	// packet is used. A port included in the GWINFO gateway address takes
+	// precedence.
+	GatewayPort int
+	// ListenAdvertise controls whether the ADVERTISE packets sent to the
+	// Address should be collected, too. Otherwise, only ADVERTISE packets
+	// sent directly to the searching client are collected.
+	ListenAdvertise bool
+}
+
+// DiscoveredGateway describes a gateway found by DiscoverGateways.
+type DiscoveredGateway struct {
+	GatewayID uint8
+	// Address is the MQTT-SN address of the gateway, usable in Client.Dial.
+	Address *net.UDPAddr
+	// ResponseTime is the time between SEARCHGW was sent and the first
+	// GWINFO or ADVERTISE packet from the gateway was received.
+	ResponseTime time.Duration
+	// LastSeen is the time the last packet from the gateway was received.
+	LastSeen time.Time
+	// Expires is the time when the gateway should be considered
+	// unavailable unless another ADVERTISE is received. It is zero if no
+	// ADVERTISE was received from the gateway.
+	Expires time.Time
+}
+
+// Alive reports whether the gateway can be considered available at the time
+// "now" according to the ADVERTISE packets received.
+func (g *DiscoveredGateway) Alive(now time.Time) bool {
+	return g.Expires.IsZero() || now.Before(g.Expires)
+}
+
+type discoveryPacket struct {
+	pkt  pkts.Packet
+	addr *net.UDPAddr
+	time time.Time
+}
+
+// DiscoverGateways sends a SEARCHGW packet and collects GWINFO and ADVERTISE
+// responses until ctx is done. The gateways still alive at that time are
+// returned ranked by the response time, the fastest first.
+func DiscoverGateways(ctx context.Context, log util.Logger, cfg *DiscoveryConfig) ([]*DiscoveredGateway, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	pktCh := make(chan discoveryPacket)
+	go discoveryReceiveLoop(ctx, log, conn, pktCh)
+
+	if cfg.ListenAdvertise {
+		var advConn *net.UDPConn
+		if cfg.Address.IP.IsMulticast() {
+			advConn, err = net.ListenMulticastUDP("udp", nil, cfg.Address)
+		} else {
+			advConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: cfg.Address.Port})
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer advConn.Close()
+		go discoveryReceiveLoop(ctx, log, advConn, pktCh)
+	}
+
+	searchGw := pkts1.NewSearchGw(cfg.Radius)
+	buf, err := searchGw.Pack()
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("%s <- %v", cfg.Address, searchGw)
+	start := time.Now()
+	if _, err := conn.WriteToUDP(buf, cfg.Address); err != nil {
+		return nil, err
+	}
+
+	gateways := make(map[string]*DiscoveredGateway)
+	for {
+		select {
+		case p := <-pktCh:
+			var gatewayID uint8
+			var advertiseDuration time.Duration
+			var gatewayAddr *net.UDPAddr
+			switch pkt := p.pkt.(type) {
+			case *pkts1.GwInfo:
+				gatewayID = pkt.GatewayID
+				// GWINFO sent by a client on behalf of a gateway contains
+				// the gateway address.
+				if len(pkt.GatewayAddress) > 0 {
+					var ok bool
+					if gatewayAddr, ok = parseGatewayAddress(pkt.GatewayAddress); !ok {
+						log.Debug("Invalid gateway address %q from %s", pkt.GatewayAddress, p.addr)
+					}
+				}
+			case *pkts1.Advertise:
+				gatewayID = pkt.GatewayID
+				advertiseDuration = time.Duration(pkt.Duration) * time.Second
+			default:
+				continue
+			}
+
+			addr := &net.UDPAddr{IP: p.addr.IP, Port: p.addr.Port, Zone: p.addr.Zone}
+			if cfg.GatewayPort != 0 {
+				addr.Port = cfg.GatewayPort
+			}
+			if gatewayAddr != nil {
+				addr.IP, addr.Zone = gatewayAddr.IP, gatewayAddr.Zone
+				if gatewayAddr.Port != 0 {
+					addr.Port = gatewayAddr.Port
+				}
+			}
+			gw, ok := gateways[addr.String()]
+			if !ok {
+				gw = &DiscoveredGateway{
+					Address:      addr,
+					ResponseTime: p.time.Sub(start),
+				}
+				gateways[addr.String()] = gw
+			}
+			gw.GatewayID = gatewayID
+			gw.LastSeen = p.time
+			if advertiseDuration > 0 {
+				gw.Expires = p.time.Add(advertiseMissLimit * advertiseDuration)
+			}
+
+		case <-ctx.Done():
+			now := time.Now()
+			var result []*DiscoveredGateway
+			for _, gw := range gateways {
+				if gw.Alive(now) {
+					result = append(result, gw)
+				}
+			}
+			sort.Slice(result, func(i, j int) bool {
+				return result[i].ResponseTime < result[j].ResponseTime
+			})
+			return result, nil
+		}
+	}
+}
+
+// parseGatewayAddress parses the GWINFO gateway address. The MQTT-SN
+// specification does not define its format. A textual IP address with an
+// optional port ("192.168.0.1", "192.168.0.1:1883", "[::1]:1883") and a raw
+// 4 or 16 byte IP address are accepted. The Port is zero if not included.
+func parseGatewayAddress(b []byte) (*net.UDPAddr, bool) {
+	s := string(b)
+	if ip := net.ParseIP(s); ip != nil {
+		return &net.UDPAddr{IP: ip}, true
+	}
+	if host, portStr, err := net.SplitHostPort(s); err == nil {
+		ip, zone, _ := strings.Cut(host, "%")
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if parsedIP := net.ParseIP(ip); parsedIP != nil && err == nil {
+			return &net.UDPAddr{IP: parsedIP, Port: int(port), Zone: zone}, true
+		}
+	}
+	if len(b) == net.IPv4len || len(b) == net.IPv6len {
+		return &net.UDPAddr{IP: net.IP(append([]byte(nil), b...))}, true
+	}
+	return nil, false
+}
+
+func discoveryReceiveLoop(ctx context.Context, log util.Logger, conn *net.UDPConn, pktCh chan<- discoveryPacket) {
+	buf := make([]byte, pkts1.MaxPacketLen)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// The connection was closed.
+			return
+		}
+		pkt, err := pkts1.ReadPacket(bytes.NewReader(buf[:n]))
+		if err != nil {
+			log.Debug("Invalid packet from %s: %s", addr, err)
+			continue
+		}
+		log.Debug("%s -> %v", addr, pkt)
+		select {
+		case pktCh <- discoveryPacket{pkt, addr, time.Now()}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	pkts "github.com/energostack/bisquitt/packets"
+	pkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestDiscoverGateways(t *testing.T) {
+	assert := assert.New(t)
+
+	// gw1 answers SEARCHGW with GWINFO, gw2 sends ADVERTISE directly to
+	// the searching client a bit sooner.
+	gw1 := listenTestUDP(t)
+	defer gw1.Close()
+	gw2 := listenTestUDP(t)
+	defer gw2.Close()
+
+	go func() {
+		buf := make([]byte, maxTestPktLength)
+		_, clientAddr, err := gw1.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		writeTestUDP(t, gw2, pkts1.NewAdvertise(2, 60), clientAddr)
+		time.Sleep(50 * time.Millisecond)
+		writeTestUDP(t, gw1, pkts1.NewGwInfo(1, nil), clientAddr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	gateways, err := DiscoverGateways(ctx, util.NewDebugLogger("discovery"), &DiscoveryConfig{
+		Address: gw1.LocalAddr().(*net.UDPAddr),
+		Radius:  1,
+	})
+	assert.NoError(err)
+	if !assert.Len(gateways, 2) {
+		return
+	}
+
+	assert.Equal(uint8(2), gateways[0].GatewayID)
+	assert.Equal(gw2.LocalAddr().String(), gateways[0].Address.String())
+	assert.False(gateways[0].Expires.IsZero())
+	assert.True(gateways[0].Alive(time.Now()))
+
+	assert.Equal(uint8(1), gateways[1].GatewayID)
+	assert.Equal(gw1.LocalAddr().String(), gateways[1].Address.String())
+	assert.True(gateways[1].Expires.IsZero())
+	assert.Less(gateways[0].ResponseTime, gateways[1].ResponseTime)
+}
+
+// A GWINFO sent by another client contains the gateway address.
+func TestDiscoverGatewaysAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	client := listenTestUDP(t)
+	defer client.Close()
+
+	go func() {
+		buf := make([]byte, maxTestPktLength)
+		_, searchAddr, err := client.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		writeTestUDP(t, client, pkts1.NewGwInfo(1, []byte("192.0.2.1:1884")), searchAddr)
+		writeTestUDP(t, client, pkts1.NewGwInfo(2, []byte("192.0.2.2")), searchAddr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	gateways, err := DiscoverGateways(ctx, util.NewDebugLogger("discovery"), &DiscoveryConfig{
+		Address:     client.LocalAddr().(*net.UDPAddr),
+		GatewayPort: 1883,
+	})
+	assert.NoError(err)
+	if !assert.Len(gateways, 2) {
+		return
+	}
+	addresses := []string{gateways[0].Address.String(), gateways[1].Address.String()}
+	assert.ElementsMatch([]string{"192.0.2.1:1884", "192.0.2.2:1883"}, addresses)
+}
+
+func TestParseGatewayAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, ok := parseGatewayAddress([]byte("[::1]:1883"))
+	assert.True(ok)
+	assert.Equal("[::1]:1883", addr.String())
+	addr, ok = parseGatewayAddress([]byte{192, 0, 2, 1})
+	assert.True(ok)
+	assert.Equal("192.0.2.1:0", addr.String())
+	_, ok = parseGatewayAddress([]byte("gateway.example.com:1883"))
+	assert.False(ok)
+}
+
+func TestDiscoveredGatewayAlive(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	gw := &DiscoveredGateway{}
+	assert.True(gw.Alive(now))
+
+	gw.Expires = now.Add(time.Second)
+	assert.True(gw.Alive(now))
+	assert.False(gw.Alive(now.Add(2 * time.Second)))
+}
+
+func listenTestUDP(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func writeTestUDP(t *testing.T, conn *net.UDPConn, pkt pkts.Packet, addr *net.UDPAddr) {
+	buf, err := pkt.Pack()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := conn.WriteToUDP(buf, addr); err != nil {
+		t.Error(err)
+	}
+}
@@ -295,6 +295,26 @@ func (c *Client) handlePacket(pktx pkts.Packet) error {
 		willMsg := pkts1.NewWillMsg(c.cfg.WillPayload)
 		return c.send(willMsg)
 
+	case *pkts1.WillTopicResp:
+		transactionx, _ := c.transactions.GetByType(pkts.WILLTOPICUPD)
+		transaction, ok := transactionx.(*willTopicUpdTransaction)
+		if !ok {
+			c.log.Error("Unexpected transaction type %T for packet: %v", transactionx, pkt)
+			return nil
+		}
+		transaction.WillTopicResp(pkt)
+		return nil
+
+	case *pkts1.WillMsgResp:
+		transactionx, _ := c.transactions.GetByType(pkts.WILLMSGUPD)
+		transaction, ok := transactionx.(*willMsgUpdTransaction)
+		if !ok {
+			c.log.Error("Unexpected transaction type %T for packet: %v", transactionx, pkt)
+			return nil
+		}
+		transaction.WillMsgResp(pkt)
+		return nil
+
 	case *pkts1.Pingresp:
 		transactionx, ok := c.transactions.GetByType(pkts.PINGREQ)
 		if !ok {
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"fmt"
+
+	pkts "github.com/energostack/bisquitt/packets"
+	pkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/transactions"
+)
+
+type willMsgUpdTransaction struct {
+	*transaction
+}
+
+func newWillMsgUpdTransaction(client *Client) *willMsgUpdTransaction {
+	tLog := client.log.WithTag("WILLMSGUPD")
+	tLog.Debug("Created.")
+	return &willMsgUpdTransaction{
+		transaction: &transaction{
+			RetryTransaction: transactions.NewRetryTransaction(
+				client.groupCtx, client.cfg.RetryDelay, client.cfg.RetryCount,
+				func(lastPkt interface{}) error {
+					tLog.Debug("Resend.")
+					return client.send(lastPkt.(pkts.Packet))
+				},
+				func() {
+					client.transactions.DeleteByType(pkts.WILLMSGUPD)
+					tLog.Debug("Deleted.")
+				},
+			),
+			client: client,
+			log:    tLog,
+		},
+	}
+}
+
+func (t *willMsgUpdTransaction) WillMsgResp(willMsgResp *pkts1.WillMsgResp) {
+	if willMsgResp.ReturnCode != pkts1.RC_ACCEPTED {
+		t.Fail(fmt.Errorf("will message update rejected with code %d", willMsgResp.ReturnCode))
+		return
+	}
+
+	willMsgUpd := t.Data.(*pkts1.WillMsgUpd)
+	t.client.cfg.WillPayload = willMsgUpd.WillMsg
+	t.Success()
+}
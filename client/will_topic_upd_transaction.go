@@ -0,0 +1,51 @@
+package client
+
+import (
+	"fmt"
+
+	pkts "github.com/energostack/bisquitt/packets"
+	pkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/transactions"
+)
+
+type willTopicUpdTransaction struct {
+	*transaction
+}
+
+func newWillTopicUpdTransaction(client *Client) *willTopicUpdTransaction {
+	tLog := client.log.WithTag("WILLTOPICUPD")
+	tLog.Debug("Created.")
+	return &willTopicUpdTransaction{
+		transaction: &transaction{
+			RetryTransaction: transactions.NewRetryTransaction(
+				client.groupCtx, client.cfg.RetryDelay, client.cfg.RetryCount,
+				func(lastPkt interface{}) error {
+					tLog.Debug("Resend.")
+					return client.send(lastPkt.(pkts.Packet))
+				},
+				func() {
+					client.transactions.DeleteByType(pkts.WILLTOPICUPD)
+					tLog.Debug("Deleted.")
+				},
+			),
+			client: client,
+			log:    tLog,
+		},
+	}
+}
+
+func (t *willTopicUpdTransaction) WillTopicResp(willTopicResp *pkts1.WillTopicResp) {
+	if willTopicResp.ReturnCode != pkts1.RC_ACCEPTED {
+		t.Fail(fmt.Errorf("will topic update rejected with code %d", willTopicResp.ReturnCode))
+		return
+	}
+
+	willTopicUpd := t.Data.(*pkts1.WillTopicUpd)
+	t.client.cfg.WillTopic = willTopicUpd.WillTopic
+	t.client.cfg.WillQOS = willTopicUpd.QOS
+	t.client.cfg.WillRetained = willTopicUpd.Retain
+	if willTopicUpd.WillTopic == "" {
+		t.client.cfg.WillPayload = nil
+	}
+	t.Success()
+}
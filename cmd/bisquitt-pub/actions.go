@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"os"
 	"os/signal"
 	"path"
@@ -193,6 +196,14 @@ func handleAction() cli.ActionFunc {
 			client.Close()
 		}()
 
+		if c.IsSet(DiscoverFlag) {
+			address, err := discoverGateway(c, logger, brokerPort)
+			if err != nil {
+				return err
+			}
+			brokerAddress = address
+		}
+
 		if err := client.Dial(brokerAddress); err != nil {
 			return fmt.Errorf("cannot connect to MQTT-SN broker: %s", err)
 		}
@@ -225,3 +236,35 @@ func handleAction() cli.ActionFunc {
 		return nil
 	}
 }
+
+// discoverGateway searches for MQTT-SN gateways and returns the address of
+// the fastest responding one. The gateways are expected to listen on the
+// given port.
+func discoverGateway(c *cli.Context, logger util.Logger, port int) (string, error) {
+	if c.Uint(DiscoveryRadiusFlag) > 255 {
+		return "", fmt.Errorf("discovery radius must be 0-255, got %d", c.Uint(DiscoveryRadiusFlag))
+	}
+	address, err := net.ResolveUDPAddr("udp", c.String(DiscoverFlag))
+	if err != nil {
+		return "", fmt.Errorf(`parsing "--%s" failed: %s`, DiscoverFlag, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration(DiscoveryTimeoutFlag))
+	defer cancel()
+	gateways, err := snClient.DiscoverGateways(ctx, logger, &snClient.DiscoveryConfig{
+		Address:         address,
+		Radius:          uint8(c.Uint(DiscoveryRadiusFlag)),
+		GatewayPort:     port,
+		ListenAdvertise: c.Bool(DiscoveryAdvertiseFlag),
+	})
+	if err != nil {
+		return "", fmt.Errorf("gateway discovery failed: %s", err)
+	}
+	if len(gateways) == 0 {
+		return "", errors.New("no MQTT-SN gateway found")
+	}
+	for _, gw := range gateways {
+		logger.Debug("Found gateway %d at %s (response time %s)", gw.GatewayID, gw.Address, gw.ResponseTime)
+	}
+	return gateways[0].Address.String(), nil
+}
@@ -38,6 +38,10 @@ const (
 	WillRetainFlag              = "will-retain"
 	UserFlag                    = "user"
 	PasswordFlag                = "password"
+	DiscoverFlag                = "discover"
+	DiscoveryTimeoutFlag        = "discovery-timeout"
+	DiscoveryRadiusFlag         = "discovery-radius"
+	DiscoveryAdvertiseFlag      = "discovery-advertise"
 )
 
 func init() {
@@ -269,6 +273,36 @@ var Application = cli.App{
 				"PASSWORD",
 			},
 		},
+		&cli.StringFlag{
+			Name:  DiscoverFlag,
+			Usage: fmt.Sprintf("discover a gateway by sending SEARCHGW to the given broadcast or multicast address (e.g. 225.1.1.1:1884), overrides --%s", HostFlag),
+			EnvVars: []string{
+				"DISCOVER",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  DiscoveryTimeoutFlag,
+			Usage: "how long to wait for gateways' responses",
+			Value: 3 * time.Second,
+			EnvVars: []string{
+				"DISCOVERY_TIMEOUT",
+			},
+		},
+		&cli.UintFlag{
+			Name:  DiscoveryRadiusFlag,
+			Usage: "SEARCHGW broadcast radius (0-255)",
+			Value: 1,
+			EnvVars: []string{
+				"DISCOVERY_RADIUS",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  DiscoveryAdvertiseFlag,
+			Usage: fmt.Sprintf("collect also ADVERTISE packets sent to the --%s address", DiscoverFlag),
+			EnvVars: []string{
+				"DISCOVERY_ADVERTISE",
+			},
+		},
 	},
 	UseShortOptionHandling: true,
 	HideHelpCommand:        true,
@@ -4,148 +4,347 @@ import (
 	"context"
 	"crypto"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/patrickmn/go-cache"
+	"github.com/pion/dtls/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
 
 	"github.com/energostack/bisquitt/gateway"
+	snPkts1 "github.com/energostack/bisquitt/packets1"
 	"github.com/energostack/bisquitt/topics"
 	"github.com/energostack/bisquitt/util"
 	cryptoutils "github.com/energostack/bisquitt/util/crypto"
 	"github.com/energostack/bisquitt/util/platform"
 )
 
-func handleAction() cli.ActionFunc {
-	return func(c *cli.Context) error {
-		useDTLS := c.Bool(DtlsFlag)
-		useSelfSigned := c.Bool(SelfSignedFlag)
-		usePSK := c.Bool(PskFlag)
-		pskCacheExpiration := c.Duration(PskCacheExpirationFlag)
-		pskIdentity := c.String(PskIdentityFlag)
-		pskAPITimeout := c.Duration(PSKAPITimeoutFlag)
-		pskAPIBasicAuthUsername := c.String(PSKAPIBasicAuthUsernameFlag)
-		pskAPIBasicAuthPassword := c.String(PSKAPIBasicAuthPasswordFlag)
-		pskAPIEndpoint := c.String(PSKAPIEndpointFlag)
-		certFile := c.Path(CertFlag)
-		keyFile := c.Path(KeyFlag)
-		debug := c.Bool(DebugFlag)
-		syslog := c.Bool(SyslogFlag)
+// gatewaySetup is the gateway configuration parsed from the flags, the
+// environment variables and the configuration file.
+type gatewaySetup struct {
+	cfg            *gateway.GatewayConfig
+	listeners      []gateway.ListenerConfig
+	useCertificate bool
+}
 
-		if useDTLS && ((certFile == "" || keyFile == "") && !useSelfSigned) && !usePSK {
-			return fmt.Errorf(`options "--%s" and "--%s" are mandatory when using DTLS. Use "--%s" to generate self-signed certificate.`,
-				CertFlag, KeyFlag, SelfSignedFlag)
-		}
+// newGatewaySetup parses and validates the configuration. The MQTT broker
+// host name is resolved only if resolve is true so that the configuration
+// can be checked without DNS.
+func newGatewaySetup(c *cli.Context, resolve bool) (*gatewaySetup, error) {
+	listeners, err := newListeners(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 && (c.IsSet(HostFlag) || c.IsSet(PortFlag)) {
+		return nil, fmt.Errorf(`"--%s" cannot be combined with "--%s" and "--%s"`, ListenerFlag, HostFlag, PortFlag)
+	}
 
-		var certificate *tls.Certificate
-		var privateKey crypto.PrivateKey
-		if certFile != "" && keyFile != "" {
-			cert, err := cryptoutils.LoadCertificate(certFile)
-			if err != nil {
-				return fmt.Errorf("cannot load a certificate from file '%s': %s", certFile, err)
-			}
-			certificate = cert
+	useDTLS := c.Bool(DtlsFlag)
+	authEnabled := c.Bool(AuthFlag)
+	for _, listener := range listeners {
+		useDTLS = useDTLS || listener.UseDTLS
+		authEnabled = authEnabled || listener.AuthEnabled
+	}
+	useSelfSigned := c.Bool(SelfSignedFlag)
+	usePSK := c.Bool(PskFlag)
+	useCertificate := useDTLS && (!usePSK || c.Bool(CertAndPSKFlag))
+	pskCacheExpiration := c.Duration(PskCacheExpirationFlag)
+	pskIdentity := c.String(PskIdentityFlag)
+	pskAPITimeout := c.Duration(PSKAPITimeoutFlag)
+	pskAPIBasicAuthUsername := c.String(PSKAPIBasicAuthUsernameFlag)
+	pskAPIBasicAuthPassword := c.String(PSKAPIBasicAuthPasswordFlag)
+	pskAPIEndpoint := c.String(PSKAPIEndpointFlag)
+	certFile := c.Path(CertFlag)
+	keyFile := c.Path(KeyFlag)
 
-			key, err := cryptoutils.LoadKey(keyFile)
-			if err != nil {
-				return fmt.Errorf("cannot load a private key from file '%s': %s", keyFile, err)
-			}
-			privateKey = key
+	if usePSK && len(c.StringSlice(PskFileFlag)) == 0 && pskAPIEndpoint == "" {
+		return nil, fmt.Errorf(`"--%s" or "--%s" is required when using PSK`, PskFileFlag, PSKAPIEndpointFlag)
+	}
+
+	if c.Bool(CertAndPSKFlag) && !usePSK {
+		return nil, fmt.Errorf(`"--%s" requires "--%s"`, CertAndPSKFlag, PskFlag)
+	}
+
+	if useCertificate && (certFile == "" || keyFile == "") && !useSelfSigned {
+		return nil, fmt.Errorf(`options "--%s" and "--%s" are mandatory when using DTLS. Use "--%s" to generate self-signed certificate.`,
+			CertFlag, KeyFlag, SelfSignedFlag)
+	}
+
+	certificate, privateKey, err := loadCertificate(c)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCert, err := newClientCertConfig(c, useCertificate)
+	if err != nil {
+		return nil, err
+	}
+
+	var cipherSuites []dtls.CipherSuiteID
+	if c.IsSet(CipherSuiteFlag) {
+		if !useDTLS {
+			return nil, fmt.Errorf(`"--%s" requires DTLS`, CipherSuiteFlag)
+		}
+		cipherSuites, err = gateway.ParseCipherSuites(c.StringSlice(CipherSuiteFlag))
+		if err != nil {
+			return nil, fmt.Errorf(`parsing "--%s" failed: %s`, CipherSuiteFlag, err)
 		}
+	}
 
-		authEnabled := c.Bool(AuthFlag)
-		if authEnabled && !useDTLS && !c.Bool(InsecureFlag) {
-			return fmt.Errorf(`Using plain text auth without DTLS is insecure. Use "--%s" to use anyway.`, InsecureFlag)
+	var authenticators map[string]gateway.Authenticator
+	if authEnabled {
+		var err error
+		authenticators, err = newAuthenticators(c)
+		if err != nil {
+			return nil, err
+		}
+		plainAuth := !useDTLS
+		for _, listener := range listeners {
+			plainAuth = plainAuth || (listener.AuthEnabled && !listener.UseDTLS)
 		}
+		if _, ok := authenticators[snPkts1.AUTH_PLAIN]; ok && plainAuth && !c.Bool(InsecureFlag) {
+			return nil, fmt.Errorf(`Using plain text auth without DTLS is insecure. Use "--%s" to use anyway.`, InsecureFlag)
+		}
+	}
 
-		predefinedTopics := topics.PredefinedTopics{}
+	predefinedTopics, err := newPredefinedTopics(c)
+	if err != nil {
+		return nil, err
+	}
 
-		if c.IsSet(PredefinedTopicsFileFlag) {
-			v, err := topics.ReadPredefinedTopicsFile(c.Path(PredefinedTopicsFileFlag))
-			if err != nil {
-				return err
-			}
-			predefinedTopics = v
-		}
-		if c.IsSet(PredefinedTopicFlag) {
-			v, err := topics.ParsePredefinedTopicOptions(c.StringSlice(PredefinedTopicFlag)...)
-			if err != nil {
-				return fmt.Errorf(`parsing "--%s" failed: %s`, PredefinedTopicFlag, err)
-			}
-			predefinedTopics.Merge(v)
+	var acl *gateway.ACL
+	if c.IsSet(ACLFileFlag) {
+		v, err := gateway.ReadACLFile(c.Path(ACLFileFlag))
+		if err != nil {
+			return nil, fmt.Errorf(`reading "--%s" failed: %s`, ACLFileFlag, err)
 		}
+		acl = v
+	}
+
+	identityBinding := gateway.IdentityBinding{
+		ClientIDTemplate: c.String(ClientIDTemplateFlag),
+		MqttUsername:     c.Bool(IdentityUsernameFlag),
+	}
+	if identityBinding.ClientIDTemplate != "" && !strings.Contains(identityBinding.ClientIDTemplate, "%i") {
+		return nil, fmt.Errorf(`"--%s" must contain "%%i"`, ClientIDTemplateFlag)
+	}
+	if (identityBinding.ClientIDTemplate != "" || identityBinding.MqttUsername) && !useDTLS {
+		return nil, fmt.Errorf(`"--%s" and "--%s" require DTLS`, ClientIDTemplateFlag, IdentityUsernameFlag)
+	}
+
+	host := c.String(HostFlag)
+	port := c.Int(PortFlag)
+	if useDTLS && !c.IsSet(PortFlag) {
+		port = 8883
+	}
 
-		host := c.String(HostFlag)
-		port := c.Int(PortFlag)
-		if useDTLS && !c.IsSet(PortFlag) {
-			port = 8883
+	mqttBrokerHost := c.String(MqttHostFlag)
+	mqttBrokerPort := c.Int(MqttPortFlag)
+	if c.Bool(MqttTLSFlag) && !c.IsSet(MqttPortFlag) {
+		mqttBrokerPort = 8883
+	}
+
+	var mqttTLSConfig *tls.Config
+	if c.Bool(MqttTLSFlag) {
+		var err error
+		mqttTLSConfig, err = newMqttTLSConfig(c, mqttBrokerHost)
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		mqttBrokerHost := c.String(MqttHostFlag)
-		mqttBrokerPort := c.Int(MqttPortFlag)
+	// In MQTT, a username and password can be set or unset. At least the
+	// password can also be empty:
+	//
+	// The Password field contains 0 to 65535 bytes of binary data
+	// [MQTT 3.1.1 specification, chapter 3.1.3.5 Password]
+	//
+	// We are using the `*string` default value `nil` as a value for "unset".
+	var mqttUser *string
+	if c.IsSet(MqttUserFlag) {
+		mqttUser2 := c.String(MqttUserFlag)
+		mqttUser = &mqttUser2
+	}
+	var mqttPassword []byte
+	if c.IsSet(MqttPasswordFlag) {
+		mqttPassword = []byte(c.String(MqttPasswordFlag))
+	}
 
-		// In MQTT, a username and password can be set or unset. At least the
-		// password can also be empty:
-		//
-		// The Password field contains 0 to 65535 bytes of binary data
-		// [MQTT 3.1.1 specification, chapter 3.1.3.5 Password]
-		//
-		// We are using the `*string` default value `nil` as a value for "unset".
-		var mqttUser *string
-		if c.IsSet(MqttUserFlag) {
-			mqttUser2 := c.String(MqttUserFlag)
-			mqttUser = &mqttUser2
+	if c.IsSet(MqttPasswordFileFlag) {
+		var err error
+		mqttPassword, err = ioutil.ReadFile(c.Path(MqttPasswordFileFlag))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read password file: %s", err)
 		}
-		var mqttPassword []byte
-		if c.IsSet(MqttPasswordFlag) {
-			mqttPassword = []byte(c.String(MqttPasswordFlag))
+	}
+
+	var mqttBrokerAddress *net.TCPAddr
+	if resolve {
+		mqttBrokerAddress, err = net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", mqttBrokerHost, mqttBrokerPort))
+		if err != nil {
+			return nil, err
 		}
+	}
+	mqttConnectionTimeout := c.Duration(MqttTimeoutFlag)
 
-		if c.IsSet(MqttPasswordFileFlag) {
-			var err error
-			mqttPassword, err = ioutil.ReadFile(c.Path(MqttPasswordFileFlag))
+	var mqttDialer gateway.MqttDialer
+	if c.IsSet(MqttWebSocketURLFlag) {
+		mqttURL, err := url.Parse(c.String(MqttWebSocketURLFlag))
+		if err != nil {
+			return nil, fmt.Errorf(`parsing "--%s" failed: %s`, MqttWebSocketURLFlag, err)
+		}
+		webSocketDialer := &gateway.WebSocketDialer{
+			URL:     mqttURL.String(),
+			Timeout: mqttConnectionTimeout,
+		}
+		switch mqttURL.Scheme {
+		case "ws":
+		case "wss":
+			webSocketDialer.TLSConfig, err = newMqttTLSConfig(c, mqttURL.Hostname())
 			if err != nil {
-				return fmt.Errorf("cannot read password file: %s", err)
+				return nil, err
 			}
+		default:
+			return nil, fmt.Errorf(`"--%s" scheme must be "ws" or "wss", got %q`, MqttWebSocketURLFlag, mqttURL.Scheme)
+		}
+		mqttDialer = webSocketDialer
+	}
+
+	mqttVersion := c.Uint(MqttVersionFlag)
+	if mqttVersion != uint(gateway.MqttVersion311) && mqttVersion != uint(gateway.MqttVersion5) {
+		return nil, fmt.Errorf(`"--%s" must be %d (MQTT 3.1.1) or %d (MQTT 5), got %d`,
+			MqttVersionFlag, gateway.MqttVersion311, gateway.MqttVersion5, mqttVersion)
+	}
+	mqttProtocolVersion := uint8(mqttVersion)
+
+	performanceLogTime := c.Duration(PerformanceLogTimeFlag)
+
+	if c.Uint(GatewayIDFlag) > 255 {
+		return nil, fmt.Errorf(`"--%s" must be 0-255, got %d`, GatewayIDFlag, c.Uint(GatewayIDFlag))
+	}
+	gatewayID := uint8(c.Uint(GatewayIDFlag))
+	var advertiseAddress *net.UDPAddr
+	if c.IsSet(AdvertiseAddressFlag) {
+		advertiseAddress, err = net.ResolveUDPAddr("udp", c.String(AdvertiseAddressFlag))
+		if err != nil {
+			return nil, fmt.Errorf(`parsing "--%s" failed: %s`, AdvertiseAddressFlag, err)
+		}
+	}
+	advertiseInterval := c.Duration(AdvertiseIntervalFlag)
+	aggregating := c.Bool(AggregatingFlag)
+	aggregatorClientID := c.String(AggregatorClientIDFlag)
+	sleepBufferPolicy, err := gateway.ParseBufferOverflowPolicy(c.String(SleepBufferPolicyFlag))
+	if err != nil {
+		return nil, fmt.Errorf(`parsing "--%s" failed: %s`, SleepBufferPolicyFlag, err)
+	}
+	if c.Uint(SleepBufferMessagesFlag) == 0 || c.Uint(SleepBufferBytesFlag) == 0 {
+		return nil, fmt.Errorf(`"--%s" and "--%s" must be positive`, SleepBufferMessagesFlag, SleepBufferBytesFlag)
+	}
+	sleepBuffer := gateway.SleepBufferConfig{
+		MaxMessages: int(c.Uint(SleepBufferMessagesFlag)),
+		MaxBytes:    int(c.Uint(SleepBufferBytesFlag)),
+		Policy:      sleepBufferPolicy,
+		Expiry:      c.Duration(SleepBufferExpiryFlag),
+	}
+	clientTimeoutFactor := c.Float64(ClientTimeoutFactorFlag)
+	if clientTimeoutFactor < 1 {
+		return nil, fmt.Errorf(`"--%s" must be at least 1`, ClientTimeoutFactorFlag)
+	}
+	var sessionStore gateway.SessionStore
+	if c.IsSet(SessionStoreDirFlag) {
+		sessionStore, err = gateway.NewFileSessionStore(c.Path(SessionStoreDirFlag), c.Duration(SessionExpiryFlag))
+		if err != nil {
+			return nil, fmt.Errorf("cannot create session store: %s", err)
 		}
+	} else {
+		sessionStore = gateway.NewMemorySessionStore(c.Duration(SessionExpiryFlag))
+	}
+
+	gwConfig := &gateway.GatewayConfig{
+		MqttBrokerAddress:       mqttBrokerAddress,
+		MqttConnectionTimeout:   mqttConnectionTimeout,
+		MqttUser:                mqttUser,
+		MqttPassword:            mqttPassword,
+		MqttTLSConfig:           mqttTLSConfig,
+		MqttDialer:              mqttDialer,
+		MqttProtocolVersion:     mqttProtocolVersion,
+		Aggregating:             aggregating,
+		AggregatorClientID:      aggregatorClientID,
+		SessionStore:            sessionStore,
+		SleepBuffer:             sleepBuffer,
+		ClientTimeoutFactor:     clientTimeoutFactor,
+		ACL:                     acl,
+		IdentityBinding:         identityBinding,
+		ClientCert:              clientCert,
+		UseDTLS:                 useDTLS,
+		UsePSK:                  usePSK,
+		UseCertificate:          useCertificate,
+		CipherSuites:            cipherSuites,
+		PSKKeys:                 cache.New(pskCacheExpiration, 5*time.Minute),
+		PSKCacheExpiration:      pskCacheExpiration,
+		PSKIdentityHint:         pskIdentity,
+		PSKAPITimeout:           pskAPITimeout,
+		PSKAPIBasicAuthUsername: pskAPIBasicAuthUsername,
+		PSKAPIBasicAuthPassword: pskAPIBasicAuthPassword,
+		PSKAPIEndpoint:          pskAPIEndpoint,
+		SelfSigned:              useSelfSigned,
+		Certificate:             certificate,
+		PrivateKey:              privateKey,
+		PerformanceLogTime:      performanceLogTime,
+		PredefinedTopics:        predefinedTopics,
+		AuthEnabled:             authEnabled,
+		Authenticators:          authenticators,
+		RetryDelay:              c.Duration(RetryDelayFlag),
+		RetryCount:              c.Uint(RetryCountFlag),
+		DrainTimeout:            c.Duration(DrainTimeoutFlag),
+		GatewayID:               gatewayID,
+		AdvertiseAddress:        advertiseAddress,
+		AdvertiseInterval:       advertiseInterval,
+	}
 
-		mqttBrokerAddress, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", mqttBrokerHost, mqttBrokerPort))
+	if len(listeners) == 0 {
+		listeners = []gateway.ListenerConfig{{
+			Address:     net.JoinHostPort(host, strconv.Itoa(port)),
+			UseDTLS:     useDTLS,
+			AuthEnabled: authEnabled,
+		}}
+	}
+
+	return &gatewaySetup{
+		cfg:            gwConfig,
+		listeners:      listeners,
+		useCertificate: useCertificate,
+	}, nil
+}
+
+func handleAction() cli.ActionFunc {
+	return func(c *cli.Context) error {
+		setup, err := newGatewaySetup(c, true)
 		if err != nil {
 			return err
 		}
-		mqttConnectionTimeout := c.Duration(MqttTimeoutFlag)
-
-		performanceLogTime := c.Duration(PerformanceLogTimeFlag)
-
-		gwConfig := &gateway.GatewayConfig{
-			MqttBrokerAddress:       mqttBrokerAddress,
-			MqttConnectionTimeout:   mqttConnectionTimeout,
-			MqttUser:                mqttUser,
-			MqttPassword:            mqttPassword,
-			UseDTLS:                 useDTLS,
-			UsePSK:                  usePSK,
-			PSKKeys:                 cache.New(pskCacheExpiration, 5*time.Minute),
-			PSKCacheExpiration:      pskCacheExpiration,
-			PSKIdentityHint:         pskIdentity,
-			PSKAPITimeout:           pskAPITimeout,
-			PSKAPIBasicAuthUsername: pskAPIBasicAuthUsername,
-			PSKAPIBasicAuthPassword: pskAPIBasicAuthPassword,
-			PSKAPIEndpoint:          pskAPIEndpoint,
-			SelfSigned:              useSelfSigned,
-			Certificate:             certificate,
-			PrivateKey:              privateKey,
-			PerformanceLogTime:      performanceLogTime,
-			PredefinedTopics:        predefinedTopics,
-			AuthEnabled:             authEnabled,
-			RetryDelay:              10 * time.Second,
-			RetryCount:              4,
+		adminToken, err := newAdminToken(c)
+		if err != nil {
+			return err
 		}
+		gwConfig := setup.cfg
+		usePSK := c.Bool(PskFlag)
+		debug := c.Bool(DebugFlag)
+		syslog := c.Bool(SyslogFlag)
 
 		logTag := "gw"
 		var logger util.Logger
@@ -167,23 +366,23 @@ func handleAction() cli.ActionFunc {
 		signal.Notify(signalCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
 
 		ctx, cancel := context.WithCancel(context.Background())
-
-		go func() {
-			s := "signal"
-			switch <-signalCh {
-			case syscall.SIGTERM:
-				s = "SIGTERM"
-			case syscall.SIGHUP:
-				s = "SIGHUP"
-			case syscall.SIGINT:
-				s = "SIGINT"
-			}
-			logger.Info("%s caught", s)
-			cancel()
-		}()
+		defer cancel()
 
 		logger.Info("%s version %s starting", c.App.Name, c.App.Version)
 
+		var pskFiles []*gateway.FilePSKProvider
+		if usePSK {
+			gwConfig.PSKProvider, pskFiles, err = newPSKProvider(c, logger)
+			if err != nil {
+				return err
+			}
+			gwConfig.PSKNegativeCacheExpiration = c.Duration(PskNegativeCacheFlag)
+			if c.String(PSKAPIEndpointFlag) == "" {
+				// Files need no cache.
+				gwConfig.PSKKeys = nil
+			}
+		}
+
 		if c.IsSet(GroupFlag) || c.IsSet(UserFlag) {
 			if c.IsSet(GroupFlag) {
 				group := c.String(GroupFlag)
@@ -212,6 +411,408 @@ func handleAction() cli.ActionFunc {
 
 		gw := gateway.NewGateway(logger, gwConfig)
 
-		return gw.ListenAndServe(ctx, fmt.Sprintf("%s:%d", host, port))
+		go func() {
+			for {
+				s := "signal"
+				switch <-signalCh {
+				case syscall.SIGTERM:
+					s = "SIGTERM"
+				case syscall.SIGHUP:
+					logger.Info("SIGHUP caught, reloading configuration")
+					if err := reloadGateway(c, gw, pskFiles, setup.useCertificate); err != nil {
+						logger.Error("Configuration reload failed: %s", err)
+					}
+					continue
+				case syscall.SIGINT:
+					s = "SIGINT"
+				}
+				logger.Info("%s caught", s)
+				cancel()
+				return
+			}
+		}()
+
+		// The opt-in servers are bound before the gateway starts so that
+		// a server which cannot be started fails the startup.
+		if c.IsSet(MetricsAddressFlag) {
+			listener, err := net.Listen("tcp", c.String(MetricsAddressFlag))
+			if err != nil {
+				return fmt.Errorf("cannot start metrics server: %s", err)
+			}
+			go func() {
+				if err := serveMetrics(ctx, listener, gw, logger); err != nil {
+					logger.Error("Metrics server error: %s", err)
+				}
+			}()
+		}
+
+		if c.IsSet(AdminAddressFlag) {
+			listener, err := listenAdmin(c.String(AdminAddressFlag))
+			if err != nil {
+				return fmt.Errorf("cannot start admin API server: %s", err)
+			}
+			go func() {
+				if err := serveAdmin(ctx, listener, adminToken, gw, logger); err != nil {
+					logger.Error("Admin API server error: %s", err)
+				}
+			}()
+		}
+
+		return gw.Serve(ctx, setup.listeners)
+	}
+}
+
+// newPSKProvider creates the PSK provider chain. The file providers are
+// returned for reloading.
+func newPSKProvider(c *cli.Context, logger util.Logger) (gateway.PSKProvider, []*gateway.FilePSKProvider, error) {
+	var chain gateway.PSKProviderChain
+	var files []*gateway.FilePSKProvider
+	for _, file := range c.StringSlice(PskFileFlag) {
+		provider, err := gateway.NewFilePSKProvider(file, c.Duration(PskFileReloadIntervalFlag), logger.WithTag("psk"))
+		if err != nil {
+			return nil, nil, fmt.Errorf(`reading "--%s" failed: %s`, PskFileFlag, err)
+		}
+		chain = append(chain, provider)
+		files = append(files, provider)
+	}
+
+	if c.IsSet(PSKAPIEndpointFlag) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if c.IsSet(PSKAPICAFileFlag) {
+			caFile := c.Path(PSKAPICAFileFlag)
+			certs, err := cryptoutils.LoadX509Certificate(caFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("parsing a CA certificate '%s' failed: %s", caFile, err)
+			}
+			transport.TLSClientConfig = &tls.Config{RootCAs: x509.NewCertPool()}
+			for _, cert := range certs {
+				transport.TLSClientConfig.RootCAs.AddCert(cert)
+			}
+		}
+		chain = append(chain, &gateway.HTTPPSKProvider{
+			Endpoint:    c.String(PSKAPIEndpointFlag),
+			Username:    c.String(PSKAPIBasicAuthUsernameFlag),
+			Password:    c.String(PSKAPIBasicAuthPasswordFlag),
+			BearerToken: c.String(PSKAPIBearerTokenFlag),
+			Client: &http.Client{
+				Transport: transport,
+				Timeout:   c.Duration(PSKAPITimeoutFlag),
+			},
+			Retries:    c.Int(PSKAPIRetriesFlag),
+			RetryDelay: c.Duration(PSKAPIRetryDelayFlag),
+			Log:        logger.WithTag("psk"),
+		})
+	}
+
+	if len(chain) == 1 {
+		return chain[0], files, nil
+	}
+	return chain, files, nil
+}
+
+// newClientCertConfig reads the client certificate CAs, CRLs and options.
+func newClientCertConfig(c *cli.Context, useCertificate bool) (gateway.ClientCertConfig, error) {
+	var cfg gateway.ClientCertConfig
+	caFiles := c.StringSlice(ClientCAFileFlag)
+	caDirs := c.StringSlice(ClientCADirFlag)
+	crlFiles := c.StringSlice(ClientCRLFileFlag)
+	haveCAs := len(caFiles) > 0 || len(caDirs) > 0
+
+	mode := "none"
+	if haveCAs {
+		mode = "required"
+	}
+	if c.IsSet(ClientAuthFlag) {
+		mode = c.String(ClientAuthFlag)
+	}
+	var err error
+	cfg.Auth, err = gateway.ParseClientAuth(mode)
+	if err != nil {
+		return cfg, fmt.Errorf(`parsing "--%s" failed: %s`, ClientAuthFlag, err)
+	}
+	if cfg.Auth == dtls.NoClientCert {
+		if haveCAs || len(crlFiles) > 0 {
+			return cfg, fmt.Errorf(`"--%s", "--%s" and "--%s" require client certificate verification`,
+				ClientCAFileFlag, ClientCADirFlag, ClientCRLFileFlag)
+		}
+		return cfg, nil
+	}
+	if !useCertificate {
+		return cfg, fmt.Errorf(`"--%s" requires DTLS with a certificate`, ClientAuthFlag)
+	}
+	if !haveCAs {
+		return cfg, fmt.Errorf(`"--%s" or "--%s" is required to verify client certificates`, ClientCAFileFlag, ClientCADirFlag)
+	}
+	cfg.CAs, err = gateway.LoadCertPool(caFiles, caDirs)
+	if err != nil {
+		return cfg, fmt.Errorf("cannot load client CA certificates: %s", err)
+	}
+	for _, file := range crlFiles {
+		crls, err := gateway.ReadCRLFile(file)
+		if err != nil {
+			return cfg, fmt.Errorf(`reading "--%s" failed: %s`, ClientCRLFileFlag, err)
+		}
+		cfg.CRLs = append(cfg.CRLs, crls...)
+	}
+	return cfg, nil
+}
+
+// newAuthenticators creates the AUTH authenticators of the enabled methods.
+func newAuthenticators(c *cli.Context) (map[string]gateway.Authenticator, error) {
+	authenticators := make(map[string]gateway.Authenticator)
+	for _, method := range c.StringSlice(AuthMethodFlag) {
+		switch method {
+		case snPkts1.AUTH_PLAIN:
+			authenticators[method] = gateway.PlainAuthenticator{}
+
+		case snPkts1.AUTH_SCRAM_SHA_256:
+			if !c.IsSet(AuthScramFileFlag) {
+				return nil, fmt.Errorf(`"--%s" is required by %s`, AuthScramFileFlag, method)
+			}
+			credentials, err := gateway.ReadScramCredentialsFile(c.Path(AuthScramFileFlag))
+			if err != nil {
+				return nil, fmt.Errorf(`reading "--%s" failed: %s`, AuthScramFileFlag, err)
+			}
+			authenticator, err := gateway.NewScramAuthenticator(credentials)
+			if err != nil {
+				return nil, err
+			}
+			authenticators[method] = authenticator
+
+		case snPkts1.AUTH_JWT:
+			if !c.IsSet(AuthJWTKeyFileFlag) {
+				return nil, fmt.Errorf(`"--%s" is required by %s`, AuthJWTKeyFileFlag, method)
+			}
+			authenticator := &gateway.JWTAuthenticator{
+				Issuer:        c.String(AuthJWTIssuerFlag),
+				Audience:      c.String(AuthJWTAudienceFlag),
+				UsernameClaim: c.String(AuthJWTUsernameClaimFlag),
+				ForwardToken:  c.Bool(AuthJWTForwardTokenFlag),
+			}
+			for _, file := range c.StringSlice(AuthJWTKeyFileFlag) {
+				key, err := gateway.ReadJWTKeyFile(file)
+				if err != nil {
+					return nil, fmt.Errorf(`reading "--%s" failed: %s`, AuthJWTKeyFileFlag, err)
+				}
+				authenticator.Keys = append(authenticator.Keys, key)
+			}
+			authenticators[method] = authenticator
+
+		default:
+			return nil, fmt.Errorf(`unknown "--%s": %q`, AuthMethodFlag, method)
+		}
+	}
+	return authenticators, nil
+}
+
+// loadCertificate loads the DTLS certificate and key files if given.
+func loadCertificate(c *cli.Context) (*tls.Certificate, crypto.PrivateKey, error) {
+	certFile := c.Path(CertFlag)
+	keyFile := c.Path(KeyFlag)
+	if certFile == "" || keyFile == "" {
+		return nil, nil, nil
+	}
+	certificate, err := cryptoutils.LoadCertificate(certFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load a certificate from file '%s': %s", certFile, err)
+	}
+	privateKey, err := cryptoutils.LoadKey(keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load a private key from file '%s': %s", keyFile, err)
+	}
+	return certificate, privateKey, nil
+}
+
+// newPredefinedTopics reads the predefined topics file and options.
+func newPredefinedTopics(c *cli.Context) (topics.PredefinedTopics, error) {
+	predefinedTopics := topics.PredefinedTopics{}
+
+	if c.IsSet(PredefinedTopicsFileFlag) {
+		v, err := topics.ReadPredefinedTopicsFile(c.Path(PredefinedTopicsFileFlag))
+		if err != nil {
+			return nil, err
+		}
+		predefinedTopics = v
+	}
+	if c.IsSet(PredefinedTopicFlag) {
+		v, err := topics.ParsePredefinedTopicOptions(c.StringSlice(PredefinedTopicFlag)...)
+		if err != nil {
+			return nil, fmt.Errorf(`parsing "--%s" failed: %s`, PredefinedTopicFlag, err)
+		}
+		predefinedTopics.Merge(v)
+	}
+	return predefinedTopics, nil
+}
+
+// reloadGateway reloads the DTLS certificate and key, the client CAs and
+// CRLs, the gateway and listener predefined topics and the PSK files. The gateway keeps its current
+// configuration if any of the files cannot be loaded.
+func reloadGateway(c *cli.Context, gw *gateway.Gateway, pskFiles []*gateway.FilePSKProvider, useCertificate bool) error {
+	reloadable := &gateway.Reloadable{}
+	var err error
+	if useCertificate {
+		reloadable.Certificate, reloadable.PrivateKey, err = loadCertificate(c)
+		if err != nil {
+			return err
+		}
+	}
+	reloadable.ClientCert, err = newClientCertConfig(c, useCertificate)
+	if err != nil {
+		return err
+	}
+	reloadable.PredefinedTopics, err = newPredefinedTopics(c)
+	if err != nil {
+		return err
+	}
+	listeners, err := newListeners(c)
+	if err != nil {
+		return err
+	}
+	for _, listener := range listeners {
+		reloadable.ListenerPredefinedTopics = append(reloadable.ListenerPredefinedTopics, listener.PredefinedTopics)
+	}
+	for _, provider := range pskFiles {
+		file, err := provider.Read()
+		if err != nil {
+			return err
+		}
+		reloadable.PSKFiles = append(reloadable.PSKFiles, file)
+	}
+	return gw.Reload(reloadable)
+}
+
+// newMqttTLSConfig creates the MQTT broker connection TLS configuration.
+func newMqttTLSConfig(c *cli.Context, mqttBrokerHost string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         mqttBrokerHost,
+		InsecureSkipVerify: c.Bool(MqttInsecureFlag),
+	}
+	if c.IsSet(MqttServerNameFlag) {
+		tlsConfig.ServerName = c.String(MqttServerNameFlag)
+	}
+
+	if c.IsSet(MqttCAFileFlag) {
+		caFile := c.Path(MqttCAFileFlag)
+		certs, err := cryptoutils.LoadX509Certificate(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("parsing a CA certificate '%s' failed: %s", caFile, err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		for _, cert := range certs {
+			tlsConfig.RootCAs.AddCert(cert)
+		}
+	}
+
+	certFile := c.Path(MqttCertFlag)
+	keyFile := c.Path(MqttKeyFlag)
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf(`options "--%s" and "--%s" must be used together`, MqttCertFlag, MqttKeyFlag)
+	}
+	if certFile != "" {
+		certificate, err := cryptoutils.LoadKeyAndCertificate(keyFile, certFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load MQTT client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{*certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// serveMetrics serves the gateway and Go runtime metrics in the Prometheus
+// format on the listener until ctx is cancelled.
+func serveMetrics(ctx context.Context, listener net.Listener, gw *gateway.Gateway, logger util.Logger) error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		gw.Collector(),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Handler: mux,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	logger.Info("Serving metrics on %s", listener.Addr())
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// newAdminToken returns the admin API bearer token, empty if none. The admin
+// API can only be served on a Unix socket or a loopback TCP address without
+// a token.
+func newAdminToken(c *cli.Context) (string, error) {
+	token := c.String(AdminTokenFlag)
+	if c.IsSet(AdminTokenFileFlag) {
+		data, err := os.ReadFile(c.Path(AdminTokenFileFlag))
+		if err != nil {
+			return "", fmt.Errorf(`reading "--%s" failed: %s`, AdminTokenFileFlag, err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	address := c.String(AdminAddressFlag)
+	if address == "" || token != "" || strings.HasPrefix(address, "unix:") {
+		return token, nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf(`parsing "--%s" failed: %s`, AdminAddressFlag, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf(`"--%s" %q is not a loopback address, "--%s" or "--%s" is required`,
+			AdminAddressFlag, address, AdminTokenFlag, AdminTokenFileFlag)
+	}
+	return token, nil
+}
+
+// listenAdmin listens on a TCP address or, with the "unix:" prefix, on a Unix
+// socket accessible to the owner and group only.
+func listenAdmin(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	// Remove a stale socket of a previous run.
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serveAdmin serves the admin API on the listener until ctx is cancelled.
+// The requests must carry the token if it is not empty.
+func serveAdmin(ctx context.Context, listener net.Listener, token string, gw *gateway.Gateway, logger util.Logger) error {
+	handler := gw.AdminHandler()
+	if token != "" {
+		handler = gateway.RequireBearerToken(handler, token)
+	}
+	server := &http.Server{
+		Handler: handler,
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	logger.Info("Serving admin API on %s", listener.Addr())
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
 	}
+	return nil
 }
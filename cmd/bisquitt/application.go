@@ -7,16 +7,27 @@ import (
 	"github.com/urfave/cli/v2"
 
 	"github.com/energostack/bisquitt"
+	"github.com/energostack/bisquitt/gateway"
+	snPkts1 "github.com/energostack/bisquitt/packets1"
 	"github.com/energostack/bisquitt/util/platform"
 )
 
 const (
+	ConfigFlag                  = "config"
 	MqttHostFlag                = "mqtt-host"
 	MqttPortFlag                = "mqtt-port"
 	MqttUserFlag                = "mqtt-user"
 	MqttPasswordFlag            = "mqtt-password"
 	MqttPasswordFileFlag        = "mqtt-password-file"
 	MqttTimeoutFlag             = "mqtt-timeout"
+	MqttTLSFlag                 = "mqtt-tls"
+	MqttCAFileFlag              = "mqtt-cafile"
+	MqttCertFlag                = "mqtt-cert"
+	MqttKeyFlag                 = "mqtt-key"
+	MqttServerNameFlag          = "mqtt-server-name"
+	MqttInsecureFlag            = "mqtt-insecure"
+	MqttWebSocketURLFlag        = "mqtt-websocket-url"
+	MqttVersionFlag             = "mqtt-version"
 	HostFlag                    = "host"
 	PortFlag                    = "port"
 	DtlsFlag                    = "dtls"
@@ -27,9 +38,22 @@ const (
 	PSKAPIBasicAuthUsernameFlag = "psk-api-basic-auth-username"
 	PSKAPIBasicAuthPasswordFlag = "psk-api-basic-auth-password"
 	PSKAPIEndpointFlag          = "psk-api-endpoint"
+	PSKAPIBearerTokenFlag       = "psk-api-bearer-token"
+	PSKAPICAFileFlag            = "psk-api-cafile"
+	PSKAPIRetriesFlag           = "psk-api-retries"
+	PSKAPIRetryDelayFlag        = "psk-api-retry-delay"
+	PskNegativeCacheFlag        = "psk-negative-cache-expiration"
+	PskFileFlag                 = "psk-file"
+	PskFileReloadIntervalFlag   = "psk-file-reload-interval"
 	SelfSignedFlag              = "self-signed"
 	CertFlag                    = "cert"
 	KeyFlag                     = "key"
+	CertAndPSKFlag              = "cert-and-psk"
+	CipherSuiteFlag             = "dtls-cipher-suite"
+	ClientAuthFlag              = "client-auth"
+	ClientCAFileFlag            = "client-ca-file"
+	ClientCADirFlag             = "client-ca-dir"
+	ClientCRLFileFlag           = "client-crl-file"
 	PredefinedTopicFlag         = "predefined-topic"
 	PredefinedTopicsFileFlag    = "predefined-topics-file"
 	SyslogFlag                  = "syslog"
@@ -37,8 +61,38 @@ const (
 	PerformanceLogTimeFlag      = "performance-log-time"
 	InsecureFlag                = "insecure"
 	AuthFlag                    = "auth"
+	AuthMethodFlag              = "auth-method"
+	AuthScramFileFlag           = "auth-scram-file"
+	AuthJWTKeyFileFlag          = "auth-jwt-key-file"
+	AuthJWTIssuerFlag           = "auth-jwt-issuer"
+	AuthJWTAudienceFlag         = "auth-jwt-audience"
+	AuthJWTUsernameClaimFlag    = "auth-jwt-username-claim"
+	AuthJWTForwardTokenFlag     = "auth-jwt-forward-token"
 	UserFlag                    = "user"
 	GroupFlag                   = "group"
+	GatewayIDFlag               = "gateway-id"
+	AdvertiseAddressFlag        = "advertise-address"
+	AdvertiseIntervalFlag       = "advertise-interval"
+	MetricsAddressFlag          = "metrics-address"
+	AdminAddressFlag            = "admin-address"
+	AdminTokenFlag              = "admin-token"
+	AdminTokenFileFlag          = "admin-token-file"
+	AggregatingFlag             = "aggregating"
+	AggregatorClientIDFlag      = "aggregator-client-id"
+	SessionStoreDirFlag         = "session-store-dir"
+	SessionExpiryFlag           = "session-expiry"
+	SleepBufferMessagesFlag     = "sleep-buffer-messages"
+	SleepBufferBytesFlag        = "sleep-buffer-bytes"
+	SleepBufferPolicyFlag       = "sleep-buffer-policy"
+	SleepBufferExpiryFlag       = "sleep-buffer-expiry"
+	ClientTimeoutFactorFlag     = "client-timeout-factor"
+	ACLFileFlag                 = "acl-file"
+	ClientIDTemplateFlag        = "client-id-template"
+	IdentityUsernameFlag        = "identity-username"
+	RetryDelayFlag              = "retry-delay"
+	RetryCountFlag              = "retry-count"
+	DrainTimeoutFlag            = "drain-timeout"
+	ListenerFlag                = "listener"
 )
 
 var Application = cli.App{
@@ -48,6 +102,13 @@ var Application = cli.App{
 	Version:     bisquitt.Version(),
 	Description: "A transparent MQTT-SN gateway with DTLS support.",
 	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:  ConfigFlag,
+			Usage: `YAML or TOML (*.toml) configuration file with the flag names as keys (flags and environment variables take precedence)`,
+			EnvVars: []string{
+				"CONFIG_FILE",
+			},
+		},
 		&cli.StringFlag{
 			Name:  MqttHostFlag,
 			Usage: "MQTT broker host",
@@ -93,6 +154,63 @@ var Application = cli.App{
 				"MQTT_TIMEOUT",
 			},
 		},
+		&cli.BoolFlag{
+			Name:  MqttTLSFlag,
+			Usage: "use TLS for MQTT broker connection",
+			EnvVars: []string{
+				"MQTT_TLS",
+			},
+		},
+		&cli.PathFlag{
+			Name:  MqttCAFileFlag,
+			Usage: "CA certificates file for MQTT broker connection (system CAs are used by default)",
+			EnvVars: []string{
+				"MQTT_CA_FILE",
+			},
+		},
+		&cli.PathFlag{
+			Name:  MqttCertFlag,
+			Usage: "client certificate file for MQTT broker connection",
+			EnvVars: []string{
+				"MQTT_CERT",
+			},
+		},
+		&cli.PathFlag{
+			Name:  MqttKeyFlag,
+			Usage: "client private key file for MQTT broker connection",
+			EnvVars: []string{
+				"MQTT_KEY",
+			},
+		},
+		&cli.StringFlag{
+			Name:  MqttServerNameFlag,
+			Usage: "MQTT broker server name for SNI and certificate verification (MQTT host by default)",
+			EnvVars: []string{
+				"MQTT_SERVER_NAME",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  MqttInsecureFlag,
+			Usage: "do not verify MQTT broker certificate",
+			EnvVars: []string{
+				"MQTT_INSECURE",
+			},
+		},
+		&cli.StringFlag{
+			Name:  MqttWebSocketURLFlag,
+			Usage: `connect to MQTT broker over WebSocket ("ws://..." or "wss://..."), overrides "--mqtt-host", "--mqtt-port" and "--mqtt-tls"`,
+			EnvVars: []string{
+				"MQTT_WEBSOCKET_URL",
+			},
+		},
+		&cli.UintFlag{
+			Name:  MqttVersionFlag,
+			Usage: "MQTT protocol version used for MQTT broker connection (4 = MQTT 3.1.1, 5 = MQTT 5)",
+			Value: 4,
+			EnvVars: []string{
+				"MQTT_VERSION",
+			},
+		},
 		&cli.StringFlag{
 			Name:  HostFlag,
 			Usage: "host to listen on",
@@ -109,6 +227,13 @@ var Application = cli.App{
 				"PORT",
 			},
 		},
+		&cli.StringSliceFlag{
+			Name:  ListenerFlag,
+			Usage: fmt.Sprintf(`listener, can be repeated, replaces "--%s" and "--%s" (format: udp|dtls://HOST[:PORT][?auth=BOOL&predefined-topics-file=PATH])`, HostFlag, PortFlag),
+			EnvVars: []string{
+				"LISTENERS",
+			},
+		},
 		&cli.BoolFlag{
 			Name:  DtlsFlag,
 			Usage: "use DTLS",
@@ -167,6 +292,59 @@ var Application = cli.App{
 				"PSK_API_ENDPOINT",
 			},
 		},
+		&cli.StringFlag{
+			Name:  PSKAPIBearerTokenFlag,
+			Usage: "PSKKeys API bearer token",
+			EnvVars: []string{
+				"PSK_API_BEARER_TOKEN",
+			},
+		},
+		&cli.PathFlag{
+			Name:  PSKAPICAFileFlag,
+			Usage: "CA certificate file to verify the PSKKeys API server",
+			EnvVars: []string{
+				"PSK_API_CAFILE",
+			},
+		},
+		&cli.IntFlag{
+			Name:  PSKAPIRetriesFlag,
+			Usage: "PSKKeys API retries after a network or server error",
+			Value: 2,
+			EnvVars: []string{
+				"PSK_API_RETRIES",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  PSKAPIRetryDelayFlag,
+			Usage: "PSKKeys API delay between retries",
+			Value: 200 * time.Millisecond,
+			EnvVars: []string{
+				"PSK_API_RETRY_DELAY",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  PskNegativeCacheFlag,
+			Usage: "how long unknown PSK identities are cached",
+			Value: 30 * time.Second,
+			EnvVars: []string{
+				"PSK_NEGATIVE_CACHE_EXPIRATION",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  PskFileFlag,
+			Usage: "YAML or CSV (*.csv) file with PSK identities and hex encoded keys, used before the PSKKeys API",
+			EnvVars: []string{
+				"PSK_FILES",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  PskFileReloadIntervalFlag,
+			Usage: "how often PSK files are checked for changes (0 disables the reload)",
+			Value: 10 * time.Second,
+			EnvVars: []string{
+				"PSK_FILE_RELOAD_INTERVAL",
+			},
+		},
 		&cli.BoolFlag{
 			Name:  SelfSignedFlag,
 			Usage: "generate self-signed certificate",
@@ -188,6 +366,48 @@ var Application = cli.App{
 				"KEY_FILE",
 			},
 		},
+		&cli.BoolFlag{
+			Name:  CertAndPSKFlag,
+			Usage: "accept certificate DTLS handshakes in addition to PSK",
+			EnvVars: []string{
+				"CERT_AND_PSK_ENABLED",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  CipherSuiteFlag,
+			Usage: "DTLS cipher suite in the order of preference, e.g. TLS_PSK_WITH_AES_128_CCM_8 or TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256",
+			EnvVars: []string{
+				"DTLS_CIPHER_SUITES",
+			},
+		},
+		&cli.StringFlag{
+			Name:  ClientAuthFlag,
+			Usage: `DTLS client certificate verification: "none", "optional" or "required" (default "required" if a client CA is given, "none" otherwise)`,
+			EnvVars: []string{
+				"CLIENT_AUTH",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  ClientCAFileFlag,
+			Usage: "CA bundle file to verify DTLS client certificates",
+			EnvVars: []string{
+				"CLIENT_CA_FILES",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  ClientCADirFlag,
+			Usage: "directory with CA certificates (*.pem, *.crt) to verify DTLS client certificates",
+			EnvVars: []string{
+				"CLIENT_CA_DIRS",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  ClientCRLFileFlag,
+			Usage: "certificate revocation list file (PEM or DER) checked for DTLS client certificates",
+			EnvVars: []string{
+				"CLIENT_CRL_FILES",
+			},
+		},
 		&cli.StringSliceFlag{
 			Name:  PredefinedTopicFlag,
 			Usage: fmt.Sprintf("predefined topic, takes precedence over --%s (format: clientID;topicName;topicID)", PredefinedTopicsFileFlag),
@@ -202,6 +422,27 @@ var Application = cli.App{
 				"PREDEFINED_TOPICS_FILE",
 			},
 		},
+		&cli.PathFlag{
+			Name:  ACLFileFlag,
+			Usage: "file with topic access rules (everything is allowed if not set)",
+			EnvVars: []string{
+				"ACL_FILE",
+			},
+		},
+		&cli.StringFlag{
+			Name:  ClientIDTemplateFlag,
+			Usage: `require ClientID to match the DTLS client identity (PSK identity or certificate CN/SAN) substituted for "%i"`,
+			EnvVars: []string{
+				"CLIENT_ID_TEMPLATE",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  IdentityUsernameFlag,
+			Usage: "use the DTLS client identity as MQTT username",
+			EnvVars: []string{
+				"IDENTITY_USERNAME",
+			},
+		},
 		&cli.BoolFlag{
 			Name:  SyslogFlag,
 			Usage: "log to syslog",
@@ -218,7 +459,7 @@ var Application = cli.App{
 		},
 		&cli.DurationFlag{
 			Name:  PerformanceLogTimeFlag,
-			Usage: "performance log frequency",
+			Usage: "statistics log frequency (0 = disabled)",
 			Value: 0,
 			EnvVars: []string{
 				"PERFORMANCE_LOG_TIME",
@@ -239,6 +480,57 @@ var Application = cli.App{
 				"AUTH",
 			},
 		},
+		&cli.StringSliceFlag{
+			Name:  AuthMethodFlag,
+			Usage: `enabled AUTH method ("PLAIN", "SCRAM-SHA-256" or "JWT")`,
+			Value: cli.NewStringSlice(snPkts1.AUTH_PLAIN),
+			EnvVars: []string{
+				"AUTH_METHODS",
+			},
+		},
+		&cli.PathFlag{
+			Name:  AuthScramFileFlag,
+			Usage: "file with SCRAM-SHA-256 credentials",
+			EnvVars: []string{
+				"AUTH_SCRAM_FILE",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  AuthJWTKeyFileFlag,
+			Usage: "file with a JWT verification key (PEM public key or certificate, HMAC secret otherwise)",
+			EnvVars: []string{
+				"AUTH_JWT_KEY_FILES",
+			},
+		},
+		&cli.StringFlag{
+			Name:  AuthJWTIssuerFlag,
+			Usage: "required JWT issuer",
+			EnvVars: []string{
+				"AUTH_JWT_ISSUER",
+			},
+		},
+		&cli.StringFlag{
+			Name:  AuthJWTAudienceFlag,
+			Usage: "required JWT audience",
+			EnvVars: []string{
+				"AUTH_JWT_AUDIENCE",
+			},
+		},
+		&cli.StringFlag{
+			Name:  AuthJWTUsernameClaimFlag,
+			Usage: "JWT claim used as MQTT username",
+			Value: "sub",
+			EnvVars: []string{
+				"AUTH_JWT_USERNAME_CLAIM",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  AuthJWTForwardTokenFlag,
+			Usage: "use JWT as MQTT password",
+			EnvVars: []string{
+				"AUTH_JWT_FORWARD_TOKEN",
+			},
+		},
 		&cli.StringFlag{
 			Name:  UserFlag,
 			Usage: "run gateway as a user",
@@ -257,7 +549,159 @@ var Application = cli.App{
 			},
 			Hidden: !platform.HasSetGroup(),
 		},
+		&cli.UintFlag{
+			Name:  GatewayIDFlag,
+			Usage: "gateway ID sent in ADVERTISE and GWINFO packets (0-255)",
+			Value: 1,
+			EnvVars: []string{
+				"GATEWAY_ID",
+			},
+		},
+		&cli.StringFlag{
+			Name:  AdvertiseAddressFlag,
+			Usage: "broadcast or multicast address for gateway discovery (e.g. 225.1.1.1:1884), discovery is disabled if not set",
+			EnvVars: []string{
+				"ADVERTISE_ADDRESS",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  AdvertiseIntervalFlag,
+			Usage: "ADVERTISE packets interval, use 0 to answer SEARCHGW only",
+			Value: 15 * time.Minute,
+			EnvVars: []string{
+				"ADVERTISE_INTERVAL",
+			},
+		},
+		&cli.StringFlag{
+			Name:  MetricsAddressFlag,
+			Usage: `address to serve Prometheus metrics on at "/metrics" (e.g. ":9090"), disabled if empty`,
+			EnvVars: []string{
+				"METRICS_ADDRESS",
+			},
+		},
+		&cli.StringFlag{
+			Name:  AdminAddressFlag,
+			Usage: `address to serve the admin API on (e.g. "127.0.0.1:9091" or "unix:/run/bisquitt/admin.sock"), disabled if empty; a non-loopback TCP address requires a token`,
+			EnvVars: []string{
+				"ADMIN_ADDRESS",
+			},
+		},
+		&cli.StringFlag{
+			Name:  AdminTokenFlag,
+			Usage: "bearer token required by the admin API",
+			EnvVars: []string{
+				"ADMIN_TOKEN",
+			},
+		},
+		&cli.PathFlag{
+			Name:  AdminTokenFileFlag,
+			Usage: "file containing the bearer token required by the admin API",
+			EnvVars: []string{
+				"ADMIN_TOKEN_FILE",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  AggregatingFlag,
+			Usage: "aggregating gateway mode, all clients share one MQTT broker connection",
+			EnvVars: []string{
+				"AGGREGATING",
+			},
+		},
+		&cli.StringFlag{
+			Name:  AggregatorClientIDFlag,
+			Usage: "MQTT client ID of the shared MQTT broker connection in the aggregating mode",
+			Value: "bisquitt",
+			EnvVars: []string{
+				"AGGREGATOR_CLIENT_ID",
+			},
+		},
+		&cli.PathFlag{
+			Name:  SessionStoreDirFlag,
+			Usage: "directory to store persistent client sessions in, sessions are kept in memory if not set",
+			EnvVars: []string{
+				"SESSION_STORE_DIR",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  SessionExpiryFlag,
+			Usage: "stored persistent client session expiration after the last change (0 = never)",
+			Value: gateway.DefaultSessionExpiry,
+			EnvVars: []string{
+				"SESSION_EXPIRY",
+			},
+		},
+		&cli.UintFlag{
+			Name:  SleepBufferMessagesFlag,
+			Usage: "maximum number of packets buffered for a sleeping client",
+			Value: gateway.DefaultSleepBufferMaxMessages,
+			EnvVars: []string{
+				"SLEEP_BUFFER_MESSAGES",
+			},
+		},
+		&cli.UintFlag{
+			Name:  SleepBufferBytesFlag,
+			Usage: "maximum size of packets buffered for a sleeping client in bytes",
+			Value: gateway.DefaultSleepBufferMaxBytes,
+			EnvVars: []string{
+				"SLEEP_BUFFER_BYTES",
+			},
+		},
+		&cli.StringFlag{
+			Name:  SleepBufferPolicyFlag,
+			Usage: `sleeping client buffer overflow policy ("drop-oldest", "drop-newest" or "drop-qos0")`,
+			Value: gateway.DropOldest.String(),
+			EnvVars: []string{
+				"SLEEP_BUFFER_POLICY",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  SleepBufferExpiryFlag,
+			Usage: "buffered packets for a sleeping client expiration (0 = never)",
+			Value: 0,
+			EnvVars: []string{
+				"SLEEP_BUFFER_EXPIRY",
+			},
+		},
+		&cli.Float64Flag{
+			Name:  ClientTimeoutFactorFlag,
+			Usage: "a client silent longer than its keepalive or sleep duration multiplied by this factor is considered lost",
+			Value: gateway.DefaultClientTimeoutFactor,
+			EnvVars: []string{
+				"CLIENT_TIMEOUT_FACTOR",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  RetryDelayFlag,
+			Usage: "delay before a packet is retransmitted to a client (T_RETRY in MQTT-SN specification)",
+			Value: 10 * time.Second,
+			EnvVars: []string{
+				"RETRY_DELAY",
+			},
+		},
+		&cli.UintFlag{
+			Name:  RetryCountFlag,
+			Usage: "number of retransmissions to a client (N_RETRY in MQTT-SN specification)",
+			Value: 4,
+			EnvVars: []string{
+				"RETRY_COUNT",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  DrainTimeoutFlag,
+			Usage: "on shutdown, stop accepting clients and wait this long for the pending messages to be delivered, disconnect immediately if 0",
+			EnvVars: []string{
+				"DRAIN_TIMEOUT",
+			},
+		},
+	},
+	Commands: []*cli.Command{
+		{
+			Name:   "check-config",
+			Usage:  "validate the configuration and print the effective configuration",
+			Action: handleCheckConfig(),
+		},
 	},
 	HideHelpCommand: true,
+	Before:          loadConfigFile,
 	Action:          handleAction(),
 }
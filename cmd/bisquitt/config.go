@@ -0,0 +1,185 @@
+// Configuration file.
+//
+// The configuration file is a YAML file or, if its name ends with ".toml",
+// a TOML file. The keys are the flag names. Nested sections are joined with
+// "-", so "mqtt: {host: broker}" is the same as "mqtt-host: broker". Lists
+// are used for the flags which can be repeated. The flags and the
+// environment variables take precedence over the file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/energostack/bisquitt/util"
+)
+
+// Flags hidden in the printed configuration.
+var secretFlags = map[string]bool{
+	MqttPasswordFlag:            true,
+	AdminTokenFlag:              true,
+	PSKAPIBasicAuthPasswordFlag: true,
+	PSKAPIBearerTokenFlag:       true,
+}
+
+// loadConfigFile sets the flags which are not set yet from the configuration
+// file.
+func loadConfigFile(c *cli.Context) error {
+	file := c.Path(ConfigFlag)
+	if file == "" {
+		return nil
+	}
+	values, err := readConfigFile(file)
+	if err != nil {
+		return fmt.Errorf(`reading "--%s" failed: %s`, ConfigFlag, err)
+	}
+	if err := applyConfig(c, values); err != nil {
+		return fmt.Errorf(`reading "--%s" failed: %s: %s`, ConfigFlag, file, err)
+	}
+	return nil
+}
+
+// readConfigFile reads the configuration file into a flag name => value map.
+func readConfigFile(file string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var tree map[string]interface{}
+	if strings.EqualFold(filepath.Ext(file), ".toml") {
+		err = toml.Unmarshal(data, &tree)
+	} else {
+		err = yaml.Unmarshal(data, &tree)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+	values := make(map[string]interface{})
+	flattenConfig("", tree, values)
+	return values, nil
+}
+
+func flattenConfig(prefix string, tree map[string]interface{}, values map[string]interface{}) {
+	for key, value := range tree {
+		if prefix != "" {
+			key = prefix + "-" + key
+		}
+		if subtree, ok := value.(map[string]interface{}); ok {
+			flattenConfig(key, subtree, values)
+			continue
+		}
+		values[key] = value
+	}
+}
+
+// isConfigFlag reports whether the flag can be set in the configuration file.
+func isConfigFlag(flag cli.Flag) bool {
+	return flag != cli.HelpFlag && flag != cli.VersionFlag && flag.Names()[0] != ConfigFlag
+}
+
+// applyConfig sets the flags which are not set by the command line or the
+// environment variables.
+func applyConfig(c *cli.Context, values map[string]interface{}) error {
+	flags := make(map[string]cli.Flag)
+	for _, flag := range c.App.Flags {
+		if !isConfigFlag(flag) {
+			continue
+		}
+		for _, name := range flag.Names() {
+			flags[name] = flag
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		flag, ok := flags[key]
+		if !ok {
+			return fmt.Errorf("unknown key %q", key)
+		}
+		value := values[key]
+		if value == nil {
+			return fmt.Errorf("key %q has no value", key)
+		}
+		items, isList := value.([]interface{})
+		if _, isSlice := flag.(*cli.StringSliceFlag); isList && !isSlice {
+			return fmt.Errorf("key %q must not be a list", key)
+		} else if !isList {
+			items = []interface{}{value}
+		}
+		if c.IsSet(key) {
+			continue
+		}
+		for _, item := range items {
+			if err := c.Set(key, fmt.Sprint(item)); err != nil {
+				return fmt.Errorf("key %q: invalid value %q: %s", key, fmt.Sprint(item), err)
+			}
+		}
+	}
+	return nil
+}
+
+func handleCheckConfig() cli.ActionFunc {
+	return func(c *cli.Context) error {
+		if _, err := newGatewaySetup(c, false); err != nil {
+			return err
+		}
+		if c.Bool(PskFlag) {
+			if _, _, err := newPSKProvider(c, util.NewProductionLogger("check-config")); err != nil {
+				return err
+			}
+		}
+		return printConfig(c, os.Stdout)
+	}
+}
+
+// printConfig prints the effective configuration in the configuration file
+// format. Secrets are hidden.
+func printConfig(c *cli.Context, w io.Writer) error {
+	config := &yaml.Node{Kind: yaml.MappingNode}
+	for _, flag := range c.App.Flags {
+		if !isConfigFlag(flag) {
+			continue
+		}
+		name := flag.Names()[0]
+		var value interface{}
+		switch flag.(type) {
+		case *cli.StringSliceFlag:
+			value = c.StringSlice(name)
+		case *cli.DurationFlag:
+			value = c.Duration(name).String()
+		default:
+			value = c.Value(name)
+		}
+		if secretFlags[name] && c.String(name) != "" {
+			value = "********"
+		}
+		var key, valueNode yaml.Node
+		if err := key.Encode(name); err != nil {
+			return err
+		}
+		if err := valueNode.Encode(value); err != nil {
+			return err
+		}
+		config.Content = append(config.Content, &key, &valueNode)
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(config); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+)
+
+// newTestFlags returns copies of the application flags. The flags keep the
+// values set from the environment variables so they cannot be shared by
+// several application runs.
+func newTestFlags() []cli.Flag {
+	flags := make([]cli.Flag, 0, len(Application.Flags))
+	for _, flag := range Application.Flags {
+		value := reflect.ValueOf(flag).Elem()
+		flagCopy := reflect.New(value.Type())
+		flagCopy.Elem().Set(value)
+		flags = append(flags, flagCopy.Interface().(cli.Flag))
+	}
+	return flags
+}
+
+// runConfigTest runs the application flags with the given arguments and
+// configuration file and returns the resulting flag values.
+func runConfigTest(t *testing.T, args []string, fileName, config string, flags ...string) map[string]interface{} {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), fileName)
+	if err := os.WriteFile(file, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]interface{})
+	app := &cli.App{
+		Flags:  newTestFlags(),
+		Before: loadConfigFile,
+		Action: func(c *cli.Context) error {
+			for _, flag := range flags {
+				values[flag] = c.Value(flag)
+			}
+			return nil
+		},
+	}
+	args = append([]string{"bisquitt", "--" + ConfigFlag, file}, args...)
+	if err := app.Run(args); err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestFlattenConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	values := make(map[string]interface{})
+	flattenConfig("", map[string]interface{}{
+		"mqtt": map[string]interface{}{
+			"host": "broker",
+			"tls": map[string]interface{}{
+				"enabled": true,
+			},
+		},
+		"listener": []interface{}{"udp://[::]"},
+	}, values)
+	assert.Equal(map[string]interface{}{
+		"mqtt-host":        "broker",
+		"mqtt-tls-enabled": true,
+		"listener":         []interface{}{"udp://[::]"},
+	}, values)
+}
+
+func TestApplyConfigPrecedence(t *testing.T) {
+	assert := assert.New(t)
+
+	config := "mqtt:\n  host: file-host\n  port: 1884\n  user: file-user\n"
+
+	values := runConfigTest(t, nil, "bisquitt.yaml", config, MqttHostFlag, MqttPortFlag, MqttUserFlag)
+	assert.Equal("file-host", values[MqttHostFlag])
+	assert.Equal(1884, values[MqttPortFlag])
+	assert.Equal("file-user", values[MqttUserFlag])
+
+	t.Setenv("MQTT_HOST", "env-host")
+	t.Setenv("MQTT_PORT", "1885")
+	values = runConfigTest(t, nil, "bisquitt.yaml", config, MqttHostFlag, MqttPortFlag, MqttUserFlag)
+	assert.Equal("env-host", values[MqttHostFlag])
+	assert.Equal(1885, values[MqttPortFlag])
+	assert.Equal("file-user", values[MqttUserFlag])
+
+	values = runConfigTest(t, []string{"--" + MqttHostFlag, "flag-host"}, "bisquitt.yaml", config,
+		MqttHostFlag, MqttPortFlag, MqttUserFlag)
+	assert.Equal("flag-host", values[MqttHostFlag])
+	assert.Equal(1885, values[MqttPortFlag])
+	assert.Equal("file-user", values[MqttUserFlag])
+}
+
+func TestApplyConfigTOML(t *testing.T) {
+	assert := assert.New(t)
+
+	values := runConfigTest(t, nil, "bisquitt.toml", "[mqtt]\nhost = \"toml-host\"\n", MqttHostFlag)
+	assert.Equal("toml-host", values[MqttHostFlag])
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	app := &cli.App{
+		Flags: newTestFlags(),
+		Action: func(c *cli.Context) error {
+			assert.Error(applyConfig(c, map[string]interface{}{"no-such-flag": 1}))
+			assert.Error(applyConfig(c, map[string]interface{}{MqttHostFlag: nil}))
+			assert.Error(applyConfig(c, map[string]interface{}{MqttHostFlag: []interface{}{"a", "b"}}))
+			assert.Error(applyConfig(c, map[string]interface{}{MqttPortFlag: "port"}))
+			return nil
+		},
+	}
+	if err := app.Run([]string{"bisquitt"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The configuration is checked without DNS.
+func TestCheckConfigNoResolve(t *testing.T) {
+	assert := assert.New(t)
+
+	app := &cli.App{
+		Flags: newTestFlags(),
+		Action: func(c *cli.Context) error {
+			setup, err := newGatewaySetup(c, false)
+			if assert.NoError(err) {
+				assert.Nil(setup.cfg.MqttBrokerAddress)
+			}
+			return nil
+		},
+	}
+	if err := app.Run([]string{"bisquitt", "--" + MqttHostFlag, "no-such-host.invalid"}); err != nil {
+		t.Fatal(err)
+	}
+}
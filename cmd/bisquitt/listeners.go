@@ -0,0 +1,86 @@
+// Listeners.
+//
+// The "--listener" option can be repeated to serve several listeners at
+// once. The format is "udp://HOST:PORT" or "dtls://HOST:PORT" (an IPv6 HOST
+// is enclosed in brackets) with optional query parameters:
+//
+//	auth                    require MQTT-SN AUTH (true or false, "--auth" by default)
+//	predefined-topics-file  the listener predefined topics file, replaces the
+//	                        gateway predefined topics (reloaded on SIGHUP)
+//
+// E.g. "udp://192.168.0.1:1883" and "dtls://[::]:8883?auth=true". The
+// default PORT is 1883 for UDP and 8883 for DTLS. DTLS listeners use the
+// gateway DTLS options.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/energostack/bisquitt/gateway"
+	"github.com/energostack/bisquitt/topics"
+)
+
+// newListeners parses the "--listener" options.
+func newListeners(c *cli.Context) ([]gateway.ListenerConfig, error) {
+	specs := c.StringSlice(ListenerFlag)
+	listeners := make([]gateway.ListenerConfig, 0, len(specs))
+	for _, spec := range specs {
+		listener, err := parseListener(spec, c.Bool(AuthFlag))
+		if err != nil {
+			return nil, fmt.Errorf(`parsing "--%s" failed: %q: %s`, ListenerFlag, spec, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func parseListener(spec string, authEnabled bool) (gateway.ListenerConfig, error) {
+	listener := gateway.ListenerConfig{
+		AuthEnabled: authEnabled,
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return listener, err
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "udp":
+		if port == "" {
+			port = "1883"
+		}
+	case "dtls":
+		listener.UseDTLS = true
+		if port == "" {
+			port = "8883"
+		}
+	default:
+		return listener, fmt.Errorf("unknown scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return listener, fmt.Errorf("missing host")
+	}
+	listener.Address = net.JoinHostPort(u.Hostname(), port)
+
+	for key, values := range u.Query() {
+		value := values[len(values)-1]
+		switch key {
+		case "auth":
+			if listener.AuthEnabled, err = strconv.ParseBool(value); err != nil {
+				return listener, fmt.Errorf("invalid auth: %s", err)
+			}
+		case "predefined-topics-file":
+			if listener.PredefinedTopics, err = topics.ReadPredefinedTopicsFile(value); err != nil {
+				return listener, err
+			}
+		default:
+			return listener, fmt.Errorf("unknown parameter %q", key)
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,281 @@
+// Topic-level authorization.
+//
+// The ACL is a list of rules, typically loaded from a YAML file:
+//
+//	default: deny
+//	rules:
+//	  - permission: deny
+//	    topics: ["sensors/+/config"]
+//	    actions: [publish]
+//	  - permission: allow
+//	    topics: ["sensors/%c/#"]
+//	  - permission: allow
+//	    cert_cn: dashboard
+//	    topics: ["sensors/#"]
+//	    actions: [subscribe]
+//
+// The rules are evaluated in order and the first rule which matches the
+// client, the action and the topic decides. If no rule matches, the default
+// permission applies.
+//
+// A rule matches a client if all its client_id, psk_identity and cert_cn
+// fields which are set equal the client's ones. The topic filters may
+// contain MQTT wildcards and the following substitutions:
+//
+//	%c	client ID
+//	%u	username (from AUTH or, if not authenticated, the PSK
+//		identity or the certificate CN)
+//
+// An allow rule permits a subscription only if its topic filter covers the
+// whole subscribed topic filter. A deny rule refuses a subscription which
+// overlaps its topic filter.
+
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ACLPermission string
+
+const (
+	ACLAllow ACLPermission = "allow"
+	ACLDeny  ACLPermission = "deny"
+)
+
+type ACLAction string
+
+const (
+	ACLPublish   ACLAction = "publish"
+	ACLSubscribe ACLAction = "subscribe"
+)
+
+type ACL struct {
+	// Permission if no rule matches. Deny if empty.
+	Default ACLPermission `yaml:"default"`
+	Rules   []ACLRule     `yaml:"rules"`
+}
+
+type ACLRule struct {
+	Permission ACLPermission `yaml:"permission"`
+	// The rule applies to the clients with all the given identities. Empty
+	// fields match any client.
+	ClientID    string `yaml:"client_id"`
+	PSKIdentity string `yaml:"psk_identity"`
+	CertCN      string `yaml:"cert_cn"`
+	// Both publish and subscribe if empty.
+	Actions []ACLAction `yaml:"actions"`
+	// Topic filters.
+	Topics []string `yaml:"topics"`
+}
+
+// aclClient identifies the client being authorized.
+type aclClient struct {
+	clientID    string
+	username    string
+	pskIdentity string
+	certCN      string
+}
+
+// ReadACLFile reads an ACL definition file in YAML format.
+func ReadACLFile(file string) (*ACL, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseACL(data)
+}
+
+// ParseACL parses and validates an ACL definition in YAML format.
+func ParseACL(data []byte) (*ACL, error) {
+	acl := &ACL{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(acl); err != nil {
+		return nil, err
+	}
+	if err := acl.Validate(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Validate checks the permissions, actions and topic filters.
+func (acl *ACL) Validate() error {
+	switch acl.Default {
+	case "", ACLAllow, ACLDeny:
+	default:
+		return fmt.Errorf("invalid default permission: %q", acl.Default)
+	}
+	for i, rule := range acl.Rules {
+		switch rule.Permission {
+		case ACLAllow, ACLDeny:
+		default:
+			return fmt.Errorf("rule %d: invalid permission: %q", i+1, rule.Permission)
+		}
+		for _, action := range rule.Actions {
+			if action != ACLPublish && action != ACLSubscribe {
+				return fmt.Errorf("rule %d: invalid action: %q", i+1, action)
+			}
+		}
+		if len(rule.Topics) == 0 {
+			return fmt.Errorf("rule %d: no topics", i+1)
+		}
+		for _, topic := range rule.Topics {
+			if !validTopicFilter(topic) {
+				return fmt.Errorf("rule %d: invalid topic filter: %q", i+1, topic)
+			}
+		}
+	}
+	return nil
+}
+
+// allowed reports whether the client may perform the action. The topic is
+// a topic name for ACLPublish and a topic filter for ACLSubscribe.
+func (acl *ACL) allowed(client *aclClient, action ACLAction, topic string) bool {
+	for i := range acl.Rules {
+		rule := &acl.Rules[i]
+		if !rule.appliesTo(client, action) {
+			continue
+		}
+		for _, filter := range rule.Topics {
+			if rule.matches(client, action, filter, topic) {
+				return rule.Permission == ACLAllow
+			}
+		}
+	}
+	return acl.Default == ACLAllow
+}
+
+func (rule *ACLRule) appliesTo(client *aclClient, action ACLAction) bool {
+	if rule.ClientID != "" && rule.ClientID != client.clientID {
+		return false
+	}
+	if rule.PSKIdentity != "" && rule.PSKIdentity != client.pskIdentity {
+		return false
+	}
+	if rule.CertCN != "" && rule.CertCN != client.certCN {
+		return false
+	}
+	if len(rule.Actions) == 0 {
+		return true
+	}
+	for _, a := range rule.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *ACLRule) matches(client *aclClient, action ACLAction, filter, topic string) bool {
+	filter, ok := expandACLFilter(filter, client)
+	if !ok {
+		// The substituted value cannot be used in a topic filter. Deny
+		// rules still apply to be on the safe side.
+		return rule.Permission == ACLDeny
+	}
+	if action == ACLPublish {
+		return topicMatches(filter, topic)
+	}
+	if rule.Permission == ACLAllow {
+		return topicFilterCovers(filter, topic)
+	}
+	return topicFiltersOverlap(filter, topic)
+}
+
+// expandACLFilter substitutes %c and %u. It returns false if a substituted
+// value is empty or contains a topic level separator or a wildcard because
+// it would change the filter meaning.
+func expandACLFilter(filter string, client *aclClient) (string, bool) {
+	for placeholder, value := range map[string]string{
+		"%c": client.clientID,
+		"%u": client.username,
+	} {
+		if strings.Contains(filter, placeholder) && (value == "" || strings.ContainsAny(value, "/+#")) {
+			return "", false
+		}
+	}
+	return strings.NewReplacer("%c", client.clientID, "%u", client.username).Replace(filter), true
+}
+
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+		if level != "#" && level != "+" && strings.ContainsAny(level, "+#") {
+			return false
+		}
+	}
+	return true
+}
+
+// topicFilterCovers reports whether every topic matched by the subscription
+// topic filter is matched by the filter too.
+func topicFilterCovers(filter, subscription string) bool {
+	if strings.HasPrefix(subscription, "$") && startsWithWildcard(filter) {
+		return false
+	}
+	// "a/#" matches "a" too, so it covers "a", "a/#" and anything below "a".
+	if parent, ok := strings.CutSuffix(filter, "/#"); ok {
+		if topicFilterCovers(parent, subscription) {
+			return true
+		}
+	}
+	filterLevels := strings.Split(filter, "/")
+	subscriptionLevels := strings.Split(subscription, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(subscriptionLevels) || subscriptionLevels[i] == "#" {
+			return false
+		}
+		if level != "+" && level != subscriptionLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(subscriptionLevels)
+}
+
+// topicFiltersOverlap reports whether some topic is matched by both filters.
+func topicFiltersOverlap(a, b string) bool {
+	if strings.HasPrefix(a, "$") && startsWithWildcard(b) ||
+		strings.HasPrefix(b, "$") && startsWithWildcard(a) {
+		return false
+	}
+	aLevels := strings.Split(a, "/")
+	bLevels := strings.Split(b, "/")
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		if aLevels[i] == "#" || bLevels[i] == "#" {
+			return true
+		}
+		if aLevels[i] != "+" && bLevels[i] != "+" && aLevels[i] != bLevels[i] {
+			return false
+		}
+	}
+	switch {
+	case len(aLevels) == len(bLevels):
+		return true
+	case len(aLevels) == len(bLevels)+1:
+		// "a/#" matches "a".
+		return aLevels[len(bLevels)] == "#"
+	case len(bLevels) == len(aLevels)+1:
+		return bLevels[len(aLevels)] == "#"
+	}
+	return false
+}
+
+func startsWithWildcard(filter string) bool {
+	return strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")
+}
@@ -0,0 +1,179 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	snPkts "github.com/energostack/bisquitt/packets"
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/topics"
+)
+
+const testACL = `
+default: deny
+rules:
+  - permission: deny
+    actions: [publish]
+    topics: ["devices/+/config"]
+  - permission: allow
+    topics: ["devices/%c/#", "users/%u/#"]
+  - permission: allow
+    cert_cn: dashboard
+    actions: [subscribe]
+    topics: ["devices/#"]
+  - permission: allow
+    psk_identity: admin
+    topics: ["#"]
+`
+
+func TestParseACL(t *testing.T) {
+	assert := assert.New(t)
+
+	acl, err := ParseACL([]byte(testACL))
+	if assert.NoError(err) {
+		assert.Equal(ACLDeny, acl.Default)
+		assert.Len(acl.Rules, 4)
+		assert.Equal([]ACLAction{ACLSubscribe}, acl.Rules[2].Actions)
+		assert.Equal("dashboard", acl.Rules[2].CertCN)
+	}
+
+	for _, invalid := range []string{
+		"default: maybe",
+		"rules: [{permission: allow}]",
+		"rules: [{permission: permit, topics: [a]}]",
+		"rules: [{permission: allow, actions: [read], topics: [a]}]",
+		"rules: [{permission: allow, topics: [a/#/b]}]",
+		"rules: [{permission: allow, topics: [a+]}]",
+		"rules: [{permission: allow, topic: [a]}]",
+	} {
+		_, err := ParseACL([]byte(invalid))
+		assert.Error(err, invalid)
+	}
+}
+
+func TestACLAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	acl, err := ParseACL([]byte(testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &aclClient{clientID: "dev1", username: "joe"}
+	assert.True(acl.allowed(client, ACLPublish, "devices/dev1/data"))
+	assert.True(acl.allowed(client, ACLSubscribe, "devices/dev1/#"))
+	// "devices/%c/#" covers the parent level too.
+	assert.True(acl.allowed(client, ACLPublish, "devices/dev1"))
+	assert.True(acl.allowed(client, ACLSubscribe, "devices/dev1"))
+	assert.False(acl.allowed(client, ACLSubscribe, "devices"))
+	assert.True(acl.allowed(client, ACLPublish, "users/joe/x"))
+	assert.False(acl.allowed(client, ACLPublish, "devices/dev1/config"))
+	assert.True(acl.allowed(client, ACLSubscribe, "devices/dev1/config"))
+	assert.False(acl.allowed(client, ACLPublish, "devices/dev2/data"))
+	assert.False(acl.allowed(client, ACLSubscribe, "devices/+/data"))
+	assert.False(acl.allowed(client, ACLSubscribe, "#"))
+
+	// Substituted values must not change the filter meaning.
+	client = &aclClient{clientID: "+"}
+	assert.False(acl.allowed(client, ACLPublish, "devices/dev1/data"))
+	assert.False(acl.allowed(client, ACLPublish, "users//x"))
+
+	client = &aclClient{clientID: "web", certCN: "dashboard"}
+	assert.True(acl.allowed(client, ACLSubscribe, "devices/+/data"))
+	assert.False(acl.allowed(client, ACLPublish, "devices/dev1/data"))
+
+	client = &aclClient{clientID: "root", pskIdentity: "admin"}
+	assert.True(acl.allowed(client, ACLPublish, "anything"))
+	assert.False(acl.allowed(client, ACLPublish, "devices/dev1/config"))
+	// The deny rule overlaps the subscription.
+	assert.True(acl.allowed(client, ACLSubscribe, "devices/dev1/config"))
+	assert.True(acl.allowed(client, ACLSubscribe, "#"))
+}
+
+func TestTopicFilterCovers(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(topicFilterCovers("a/#", "a/b/#"))
+	assert.True(topicFilterCovers("a/#", "a"))
+	assert.True(topicFilterCovers("a/#", "a/#"))
+	assert.True(topicFilterCovers("+/#", "a"))
+	assert.True(topicFilterCovers("a/+/#", "a/b"))
+	assert.False(topicFilterCovers("a/b/#", "a"))
+	assert.False(topicFilterCovers("a/#", "b"))
+	assert.True(topicFilterCovers("a/+", "a/b"))
+	assert.True(topicFilterCovers("a/+", "a/+"))
+	assert.False(topicFilterCovers("a/+", "a/#"))
+	assert.False(topicFilterCovers("a/b", "a/+"))
+	assert.False(topicFilterCovers("a/+/c", "a/b"))
+	assert.False(topicFilterCovers("#", "$SYS/a"))
+}
+
+func TestTopicFiltersOverlap(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(topicFiltersOverlap("a/b", "a/b"))
+	assert.True(topicFiltersOverlap("a/+", "+/b"))
+	assert.True(topicFiltersOverlap("#", "a/b"))
+	assert.True(topicFiltersOverlap("a/#", "a"))
+	assert.True(topicFiltersOverlap("a", "a/#"))
+	assert.False(topicFiltersOverlap("a/b", "a/c"))
+	assert.False(topicFiltersOverlap("a/+", "a/b/c"))
+	assert.False(topicFiltersOverlap("+/a", "$SYS/a"))
+}
+
+func TestACLEnforcement(t *testing.T) {
+	assert := assert.New(t)
+
+	acl, err := ParseACL([]byte(`
+default: allow
+rules:
+  - permission: deny
+    topics: ["secret/#", "sd"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.handler.cfg.ACL = acl
+
+	stp.connect()
+
+	// client --REGISTER--> GW
+	snRegister := snPkts1.NewRegister(0, "secret/a")
+	stp.snSend(snRegister, true)
+	// client <--REGACK-- GW
+	snRegack := stp.snRecv().(*snPkts1.Regack)
+	assert.Equal(snPkts1.RC_NOT_SUPPORTED, snRegack.ReturnCode)
+	assert.Equal(snRegister.MessageID(), snRegack.MessageID())
+
+	// client --SUBSCRIBE--> GW
+	snSubscribe := snPkts1.NewSubscribe("#", 0, false, 1, snPkts1.TIT_STRING)
+	stp.snSend(snSubscribe, true)
+	// client <--SUBACK-- GW
+	snSuback := stp.snRecv().(*snPkts1.Suback)
+	assert.Equal(snPkts1.RC_NOT_SUPPORTED, snSuback.ReturnCode)
+	assert.Equal(snSubscribe.MessageID(), snSuback.MessageID())
+
+	// client --PUBLISH--> GW
+	snPublish := snPkts1.NewPublish(snPkts.EncodeShortTopic("sd"), []byte("x"), false, 1, false, snPkts1.TIT_SHORT)
+	stp.snSend(snPublish, true)
+	// client <--PUBACK-- GW
+	snPuback := stp.snRecv().(*snPkts1.Puback)
+	assert.Equal(snPkts1.RC_NOT_SUPPORTED, snPuback.ReturnCode)
+	assert.Equal(snPublish.MessageID(), snPuback.MessageID())
+
+	// Nothing is passed to the broker.
+	stp.assertConnEmpty("MQTT", stp.mqttConn, connEmptyTimeout)
+	if err := stp.mqttConn.SetReadDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stp.register("public/a")
+	stp.subscribe("public/#", 1)
+
+	stp.disconnect()
+}
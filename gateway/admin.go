@@ -0,0 +1,301 @@
+// Admin HTTP API.
+//
+//	GET    /handlers               list of the client handlers (HandlerInfo)
+//	GET    /handlers/{id}          session of one client (SessionInfo)
+//	DELETE /handlers/{id}          disconnect the client
+//	POST   /handlers/{id}/publish  deliver a downlink message (PublishRequest)
+//
+// The {id} is the handler ID (client address) or the client ID.
+//
+// The publish request waits for the delivery outcome (see Gateway.Publish) at
+// most for the "timeout" query parameter duration (DefaultPublishTimeout by
+// default) and responds with:
+//
+//	204  delivered
+//	202  queued or in progress, the delivery continues
+//	400  invalid request
+//	404  unknown client
+//	409  the client is not connected
+//	502  the delivery failed
+//
+// The API has no authentication of its own. RequireBearerToken adds one.
+
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultPublishTimeout is the admin API publish request timeout used if
+// not given.
+const DefaultPublishTimeout = time.Minute
+
+// HandlerInfo describes a client handler.
+type HandlerInfo struct {
+	// Handler ID, i.e. the client address.
+	ID            string `json:"id"`
+	ClientID      string `json:"client_id"`
+	RemoteAddress string `json:"remote_address"`
+	State         string `json:"state"`
+	// Keepalive period in seconds.
+	KeepAlive uint16 `json:"keepalive"`
+	// TopicID => topic name.
+	RegisteredTopics    map[uint16]string `json:"registered_topics"`
+	PendingTransactions int               `json:"pending_transactions"`
+	SleepBufferPackets  int               `json:"sleep_buffer_packets"`
+	SleepBufferBytes    int               `json:"sleep_buffer_bytes"`
+}
+
+// SessionInfo is the detailed state of a client session.
+type SessionInfo struct {
+	HandlerInfo
+	Username          string   `json:"username,omitempty"`
+	DTLSIdentities    []string `json:"dtls_identities,omitempty"`
+	PersistentSession bool     `json:"persistent_session"`
+	// Topic filter => granted QoS.
+	Subscriptions map[string]uint8 `json:"subscriptions"`
+	// MessageIDs and packet types of the pending transactions.
+	PendingMessageIDs  []uint16 `json:"pending_message_ids"`
+	PendingPacketTypes []string `json:"pending_packet_types"`
+}
+
+// PublishRequest is the admin API publish request body.
+type PublishRequest struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	QoS     uint8  `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+// runningHandler is a handler registered for the admin API.
+type runningHandler struct {
+	handler *handler1
+	cancel  context.CancelFunc
+}
+
+func (gw *Gateway) addHandler(h *handler1, cancel context.CancelFunc) {
+	gw.handlersMutex.Lock()
+	defer gw.handlersMutex.Unlock()
+	gw.handlers[h.id] = &runningHandler{handler: h, cancel: cancel}
+}
+
+func (gw *Gateway) removeHandler(h *handler1) {
+	gw.handlersMutex.Lock()
+	defer gw.handlersMutex.Unlock()
+	if running, ok := gw.handlers[h.id]; ok && running.handler == h {
+		delete(gw.handlers, h.id)
+	}
+}
+
+// findHandler finds a handler by the handler ID or the client ID.
+func (gw *Gateway) findHandler(id string) (*runningHandler, bool) {
+	gw.handlersMutex.Lock()
+	defer gw.handlersMutex.Unlock()
+	if running, ok := gw.handlers[id]; ok {
+		return running, true
+	}
+	for _, running := range gw.handlers {
+		if running.handler.getClientID() == id {
+			return running, true
+		}
+	}
+	return nil, false
+}
+
+// runningHandlers returns a snapshot of the running handlers.
+func (gw *Gateway) runningHandlers() []*runningHandler {
+	gw.handlersMutex.Lock()
+	defer gw.handlersMutex.Unlock()
+	handlers := make([]*runningHandler, 0, len(gw.handlers))
+	for _, running := range gw.handlers {
+		handlers = append(handlers, running)
+	}
+	return handlers
+}
+
+// Handlers returns the client handlers sorted by ID.
+func (gw *Gateway) Handlers() []HandlerInfo {
+	handlers := gw.runningHandlers()
+	infos := make([]HandlerInfo, 0, len(handlers))
+	for _, running := range handlers {
+		infos = append(infos, running.handler.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Session returns the session of the client with the handler ID or the
+// client ID.
+func (gw *Gateway) Session(id string) (*SessionInfo, bool) {
+	running, ok := gw.findHandler(id)
+	if !ok {
+		return nil, false
+	}
+	return running.handler.sessionInfo(), true
+}
+
+// Disconnect stops the handler of the client with the handler ID or the
+// client ID. An active client is sent a DISCONNECT packet.
+func (gw *Gateway) Disconnect(id string) bool {
+	running, ok := gw.findHandler(id)
+	if !ok {
+		return false
+	}
+	gw.log.Info("Disconnecting client %q (admin request)", id)
+	running.cancel()
+	return true
+}
+
+// AdminHandler returns the admin HTTP API handler.
+func (gw *Gateway) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /handlers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, gw.Handlers())
+	})
+	mux.HandleFunc("GET /handlers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		session, ok := gw.Session(r.PathValue("id"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, session)
+	})
+	mux.HandleFunc("DELETE /handlers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if !gw.Disconnect(r.PathValue("id")) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /handlers/{id}/publish", gw.handlePublishRequest)
+	return mux
+}
+
+// RequireBearerToken returns a handler rejecting the requests which do not
+// carry the token in the "Authorization: Bearer" header with 401.
+func RequireBearerToken(handler http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(requestToken), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (gw *Gateway) handlePublishRequest(w http.ResponseWriter, r *http.Request) {
+	timeout := DefaultPublishTimeout
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil {
+			http.Error(w, "invalid timeout: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var req PublishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg := &DownlinkMessage{
+		Topic:   req.Topic,
+		Payload: []byte(req.Payload),
+		QoS:     req.QoS,
+		Retain:  req.Retain,
+	}
+	if err := msg.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	err := gw.Publish(ctx, r.PathValue("id"), msg)
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case context.DeadlineExceeded, context.Canceled:
+		w.WriteHeader(http.StatusAccepted)
+	case ErrClientNotFound:
+		http.NotFound(w, r)
+	case ErrClientNotConnected:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(v)
+}
+
+func (h *handler1) getClientID() string {
+	h.infoMutex.RLock()
+	defer h.infoMutex.RUnlock()
+	return h.clientID
+}
+
+func (h *handler1) info() HandlerInfo {
+	h.infoMutex.RLock()
+	info := HandlerInfo{
+		ID:        h.id,
+		ClientID:  h.clientID,
+		State:     h.state.Get().String(),
+		KeepAlive: h.keepAlive,
+	}
+	h.infoMutex.RUnlock()
+	if h.snRemoteAddr != nil {
+		info.RemoteAddress = h.snRemoteAddr.String()
+	}
+	info.RegisteredTopics = make(map[uint16]string)
+	h.registeredTopics.Range(func(key, value interface{}) bool {
+		info.RegisteredTopics[key.(uint16)] = value.(string)
+		return true
+	})
+	pktIDs, pktTypes := h.transactions.Pending()
+	info.PendingTransactions = len(pktIDs) + len(pktTypes)
+	info.SleepBufferPackets, info.SleepBufferBytes = h.sleepBuffer.size()
+	return info
+}
+
+func (h *handler1) sessionInfo() *SessionInfo {
+	session := &SessionInfo{
+		HandlerInfo:   h.info(),
+		Subscriptions: make(map[string]uint8),
+	}
+	h.infoMutex.RLock()
+	session.Username = h.username
+	session.DTLSIdentities = h.dtlsIdentities()
+	h.infoMutex.RUnlock()
+	h.sessionMutex.Lock()
+	session.PersistentSession = h.persistentSession
+	h.sessionMutex.Unlock()
+	h.subscriptions.Range(func(key, value interface{}) bool {
+		session.Subscriptions[key.(string)] = value.(uint8)
+		return true
+	})
+	pktIDs, pktTypes := h.transactions.Pending()
+	sort.Slice(pktIDs, func(i, j int) bool {
+		return pktIDs[i] < pktIDs[j]
+	})
+	session.PendingMessageIDs = pktIDs
+	session.PendingPacketTypes = make([]string, 0, len(pktTypes))
+	for _, pktType := range pktTypes {
+		session.PendingPacketTypes = append(session.PendingPacketTypes, pktType.String())
+	}
+	sort.Strings(session.PendingPacketTypes)
+	return session
+}
@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestAdminAPI(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, nil)
+	defer stp.cancel()
+
+	gw := NewGateway(util.NewDebugLogger("admin"), &GatewayConfig{})
+	stp.handler.id = "client-address"
+	gw.addHandler(stp.handler, stp.cancel)
+	server := httptest.NewServer(gw.AdminHandler())
+	defer server.Close()
+
+	stp.connect()
+	topicID := stp.register("admin/topic")
+
+	get := func(path string, v interface{}) int {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			assert.NoError(json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	var handlers []HandlerInfo
+	assert.Equal(http.StatusOK, get("/handlers", &handlers))
+	if assert.Len(handlers, 1) {
+		info := handlers[0]
+		assert.Equal("client-address", info.ID)
+		assert.Equal("test-client", info.ClientID)
+		assert.Equal(util.StateActive.String(), info.State)
+		assert.Equal(uint16(1), info.KeepAlive)
+		assert.Equal(map[uint16]string{topicID: "admin/topic"}, info.RegisteredTopics)
+		assert.Equal(0, info.PendingTransactions)
+		assert.Equal(0, info.SleepBufferPackets)
+	}
+
+	var session SessionInfo
+	assert.Equal(http.StatusOK, get("/handlers/test-client", &session))
+	assert.Equal("client-address", session.ID)
+	assert.False(session.PersistentSession)
+	assert.Empty(session.Subscriptions)
+	assert.Equal(http.StatusNotFound, get("/handlers/unknown", &session))
+
+	disconnect := func(id string) int {
+		req, err := http.NewRequest(http.MethodDelete, server.URL+"/handlers/"+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(http.StatusNotFound, disconnect("unknown"))
+	assert.Equal(http.StatusNoContent, disconnect("client-address"))
+
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snPkts1.Disconnect)
+	assert.True(ok)
+	stp.assertHandlerDone()
+
+	gw.removeHandler(stp.handler)
+	assert.Equal(http.StatusOK, get("/handlers", &handlers))
+	assert.Empty(handlers)
+}
+
+func TestRequireBearerToken(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := RequireBearerToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), "secret")
+
+	request := func(authorization string) int {
+		r := httptest.NewRequest(http.MethodGet, "/handlers", nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	assert.Equal(http.StatusNoContent, request("Bearer secret"))
+	assert.Equal(http.StatusUnauthorized, request(""))
+	assert.Equal(http.StatusUnauthorized, request("Bearer wrong"))
+	assert.Equal(http.StatusUnauthorized, request("Basic c2VjcmV0"))
+}
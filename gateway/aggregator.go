@@ -0,0 +1,1047 @@
+// Aggregating gateway.
+//
+// In the aggregating mode, all MQTT-SN clients share a single MQTT broker
+// connection, see MQTT-SN specification v. 1.2, chapter 4 Architecture.
+//
+// The aggregator implements MqttDialer. Every handler gets a virtual MQTT
+// connection (net.Pipe) and talks MQTT 3.1.1 to the aggregator as if it was
+// the broker. Hence, the handlers work exactly the same way as in the
+// transparent mode. The aggregator:
+//   - answers CONNECT, PINGREQ and DISCONNECT itself,
+//   - translates packet identifiers between the virtual connections and the
+//     broker connection,
+//   - reference-counts subscriptions: a topic filter is subscribed at the
+//     broker by the first client and unsubscribed when the last client
+//     unsubscribes it,
+//   - routes PUBLISH packets received from the broker by topic to the
+//     subscribed clients,
+//   - emulates wills: the will of a client is published by the aggregator
+//     when the virtual connection is closed without DISCONNECT.
+//
+// The packets whose order matters (SUBSCRIBE, UNSUBSCRIBE, wills) are built
+// under the aggregator mutex and queued, the queue is written to the broker
+// after the mutex is released so that a slow broker cannot block the
+// aggregator. The broker connection is reset if PINGRESP is not received
+// within the keepalive.
+//
+// PUBLISH packets received from the broker are acknowledged by the aggregator
+// as soon as they are passed to the virtual connections. The handlers then
+// deliver them to the clients with the QoS of the respective subscription.
+//
+// Limitations:
+//   - Retained messages are delivered only to the clients subscribed when the
+//     topic filter is subscribed at the broker.
+//   - Sessions with CleanSession=false keep their subscriptions while the
+//     client is disconnected, but the messages published meanwhile are
+//     dropped.
+//   - All sessions are lost when the broker connection is lost.
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+
+	snPkts "github.com/energostack/bisquitt/packets"
+	"github.com/energostack/bisquitt/util"
+)
+
+const (
+	// Keepalive of the aggregated MQTT broker connection [s].
+	aggregatorKeepAlive = 60
+	// Delay between MQTT broker connection attempts.
+	aggregatorReconnectDelay = 5 * time.Second
+	// Capacity of the virtual connection output queue. The virtual connection
+	// is closed if the handler does not keep up.
+	aggregatorQueueSize = 256
+)
+
+var ErrAggregatorNotConnected = errors.New("aggregated MQTT broker connection is not established")
+
+type aggregator struct {
+	cfg      *handlerConfig
+	clientID string
+	log      util.Logger
+
+	// Protects conn and codec and serializes writes to the broker.
+	writeMutex sync.Mutex
+	conn       *util.ConnWithContext
+	codec      mqttCodec
+
+	// Protects all the following fields and the fields of the sessions,
+	// filters and virtual connections.
+	mutex     sync.Mutex
+	connected bool
+	conns     map[*aggregatorConn]struct{}
+	sessions  map[string]*aggregatorSession
+	filters   map[string]*aggregatorFilter
+	// Subset of filters containing wildcards.
+	wildcards map[string]*aggregatorFilter
+	// Requests awaiting a broker response, by the broker packet identifier.
+	requests map[uint16]*aggregatorRequest
+	// QoS 2 PUBLISHes received from the broker awaiting PUBREL.
+	brokerQos2 map[uint16]struct{}
+	msgID      *util.IDSequence
+	connSeq    int
+	// Packets to be written to the broker by flush, in order.
+	outgoing []mqPkts.ControlPacket
+	// Time of the last PINGRESP (or CONNACK) received from the broker.
+	lastPingresp time.Time
+	// Interval between PINGREQs, aggregatorKeepAlive/2 by default.
+	pingInterval time.Duration
+}
+
+// Client session, identified by the client identifier.
+type aggregatorSession struct {
+	clientID   string
+	persistent bool
+	// Topic filter => requested QoS.
+	subscriptions map[string]uint8
+	// nil if the client is not connected.
+	conn *aggregatorConn
+}
+
+// Topic filter subscribed at the broker.
+type aggregatorFilter struct {
+	// Session => requested QoS.
+	sessions map[*aggregatorSession]uint8
+	// Whether the broker confirmed the subscription.
+	subscribed bool
+	// The highest QoS requested from the broker.
+	requested uint8
+	// QoS granted by the broker.
+	granted uint8
+}
+
+// Request sent to the broker on behalf of a virtual connection.
+type aggregatorRequest struct {
+	// nil if the response is not passed to any virtual connection (will
+	// PUBLISH, UNSUBSCRIBE of a removed session).
+	conn *aggregatorConn
+	// Packet identifier used in the virtual connection.
+	msgID uint16
+	// SUBSCRIBE only.
+	session   *aggregatorSession
+	subscribe *aggregatorSubscribe
+}
+
+// SUBSCRIBE request state. Only the topic filters not subscribed at the
+// broker yet are sent to the broker.
+type aggregatorSubscribe struct {
+	// SUBACK return codes for all the requested topic filters.
+	codes []byte
+	// Indexes of the topic filters sent to the broker.
+	indexes []int
+	filters []string
+	qoss    []uint8
+}
+
+func newAggregator(cfg *handlerConfig, clientID string, log util.Logger) *aggregator {
+	a := &aggregator{
+		cfg:          cfg,
+		clientID:     clientID,
+		log:          log,
+		msgID:        util.NewIDSequence(snPkts.MinPacketID, snPkts.MaxPacketID),
+		pingInterval: aggregatorKeepAlive * time.Second / 2,
+	}
+	a.resetState()
+	return a
+}
+
+func (a *aggregator) resetState() {
+	a.conns = make(map[*aggregatorConn]struct{})
+	a.sessions = make(map[string]*aggregatorSession)
+	a.filters = make(map[string]*aggregatorFilter)
+	a.wildcards = make(map[string]*aggregatorFilter)
+	a.requests = make(map[uint16]*aggregatorRequest)
+	a.brokerQos2 = make(map[uint16]struct{})
+	a.outgoing = nil
+}
+
+// MqttDialer.DialContext() implementation.
+func (a *aggregator) DialContext(ctx context.Context) (net.Conn, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.connected {
+		return nil, ErrAggregatorNotConnected
+	}
+	handlerEnd, aggregatorEnd := net.Pipe()
+	a.connSeq++
+	c := &aggregatorConn{
+		aggregator: a,
+		conn:       aggregatorEnd,
+		log:        a.log.WithTag(fmt.Sprintf("conn%d", a.connSeq)),
+		out:        make(chan mqPkts.ControlPacket, aggregatorQueueSize),
+		done:       make(chan struct{}),
+		published:  make(map[uint16]uint16),
+		nextMsgID:  snPkts.MaxPacketID,
+	}
+	a.conns[c] = struct{}{}
+	go c.writeLoop()
+	go c.readLoop()
+	return handlerEnd, nil
+}
+
+// MqttDialer.String() implementation.
+func (a *aggregator) String() string {
+	return fmt.Sprintf("%s (aggregated)", a.cfg.MqttDialer)
+}
+
+// run maintains the MQTT broker connection until ctx is done.
+func (a *aggregator) run(ctx context.Context) {
+	for {
+		err := a.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		a.log.Error("MQTT broker connection failed: %s", err)
+		select {
+		case <-time.After(aggregatorReconnectDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *aggregator) serve(ctx context.Context) error {
+	a.log.Debug("Connecting to MQTT broker %s", a.cfg.MqttDialer)
+	conn, err := a.cfg.MqttDialer.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	a.writeMutex.Lock()
+	a.conn = util.NewConnWithContext(connCtx, conn, connTimeout)
+	a.codec = newMqttCodec(a.cfg.MqttProtocolVersion, a.log)
+	a.writeMutex.Unlock()
+	defer a.reset()
+
+	if err := a.connect(cancel); err != nil {
+		return err
+	}
+	a.log.Info("Connected to MQTT broker %s", a.cfg.MqttDialer)
+	a.mutex.Lock()
+	a.connected = true
+	a.lastPingresp = time.Now()
+	a.mutex.Unlock()
+
+	go a.pingLoop(connCtx, cancel)
+
+	for {
+		pkt, err := a.codec.ReadPacket(a.conn)
+		if err != nil {
+			if err == io.EOF {
+				return ErrMqttConnClosed
+			}
+			return err
+		}
+		a.log.Debug("=> %v", pkt)
+		if err := a.handleBroker(pkt); err != nil {
+			return err
+		}
+	}
+}
+
+// connect sends CONNECT and waits for CONNACK. The connection is canceled
+// if CONNACK is not received in time.
+func (a *aggregator) connect(cancel context.CancelFunc) error {
+	mqConnect := mqPkts.NewControlPacket(mqPkts.Connect).(*mqPkts.ConnectPacket)
+	mqConnect.ProtocolName = "MQTT"
+	mqConnect.ProtocolVersion = MqttVersion311
+	mqConnect.ClientIdentifier = a.clientID
+	mqConnect.CleanSession = true
+	mqConnect.Keepalive = aggregatorKeepAlive
+	if a.cfg.MqttUser != nil {
+		mqConnect.UsernameFlag = true
+		mqConnect.Username = *a.cfg.MqttUser
+	}
+	if a.cfg.MqttPassword != nil {
+		mqConnect.PasswordFlag = true
+		mqConnect.Password = a.cfg.MqttPassword
+	}
+	if err := a.send(mqConnect); err != nil {
+		return err
+	}
+
+	timer := time.AfterFunc(a.cfg.MqttConnectionTimeout, cancel)
+	pkt, err := a.codec.ReadPacket(a.conn)
+	timer.Stop()
+	if err != nil {
+		return err
+	}
+	a.log.Debug("=> %v", pkt)
+	mqConnack, ok := pkt.(*mqPkts.ConnackPacket)
+	if !ok {
+		return fmt.Errorf("unexpected packet instead of CONNACK: %v", pkt)
+	}
+	if mqConnack.ReturnCode != mqPkts.Accepted {
+		returnCodeStr, ok := mqPkts.ConnackReturnCodes[mqConnack.ReturnCode]
+		if !ok {
+			returnCodeStr = "unknown code!"
+		}
+		return fmt.Errorf("CONNECT refused by MQTT broker with return code %d (%s)",
+			mqConnack.ReturnCode, returnCodeStr)
+	}
+	return nil
+}
+
+// pingLoop sends PINGREQs and cancels the broker connection if PINGRESP is
+// not received within two ping intervals (i.e. the keepalive).
+func (a *aggregator) pingLoop(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(a.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.mutex.Lock()
+			lastPingresp := a.lastPingresp
+			a.mutex.Unlock()
+			if time.Since(lastPingresp) > 2*a.pingInterval {
+				a.log.Error("PINGRESP not received from MQTT broker since %s, reconnecting.", lastPingresp.Format(time.RFC3339))
+				cancel()
+				return
+			}
+			if err := a.send(mqPkts.NewControlPacket(mqPkts.Pingreq)); err != nil {
+				a.log.Error("Error sending PINGREQ to MQTT broker: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reset closes the broker connection and all the virtual connections.
+func (a *aggregator) reset() {
+	a.mutex.Lock()
+	a.connected = false
+	conns := a.conns
+	a.resetState()
+	a.mutex.Unlock()
+
+	for c := range conns {
+		c.close()
+	}
+
+	a.writeMutex.Lock()
+	defer a.writeMutex.Unlock()
+	if err := a.conn.Close(); err != nil {
+		a.log.Error("Error closing MQTT connection: %s", err)
+	}
+}
+
+func (a *aggregator) send(pkt mqPkts.ControlPacket) error {
+	a.writeMutex.Lock()
+	defer a.writeMutex.Unlock()
+	a.log.Debug("<= %v", pkt)
+	_, err := a.codec.WritePacket(a.conn, pkt)
+	return err
+}
+
+// queue queues the packet to be written to the broker by flush. The caller
+// must hold a.mutex. The packets are written in the order they are queued.
+func (a *aggregator) queue(pkt mqPkts.ControlPacket) {
+	a.outgoing = append(a.outgoing, pkt)
+}
+
+// flush writes the queued packets to the broker. The caller must not hold
+// a.mutex.
+func (a *aggregator) flush() {
+	a.writeMutex.Lock()
+	defer a.writeMutex.Unlock()
+	for {
+		a.mutex.Lock()
+		if len(a.outgoing) == 0 {
+			a.mutex.Unlock()
+			return
+		}
+		pkt := a.outgoing[0]
+		a.outgoing = a.outgoing[1:]
+		a.mutex.Unlock()
+
+		a.log.Debug("<= %v", pkt)
+		if _, err := a.codec.WritePacket(a.conn, pkt); err != nil {
+			a.log.Error("Error sending %v to MQTT broker: %s", pkt, err)
+		}
+	}
+}
+
+// newRequest allocates a broker packet identifier for the request.
+// The caller must hold a.mutex.
+func (a *aggregator) newRequest(req *aggregatorRequest) (uint16, error) {
+	for i := 0; i < int(snPkts.MaxPacketID); i++ {
+		msgID, _ := a.msgID.Next()
+		if _, ok := a.requests[msgID]; !ok {
+			a.requests[msgID] = req
+			return msgID, nil
+		}
+	}
+	return 0, errors.New("cannot find available MsgID")
+}
+
+// takeRequest returns and forgets the request with the given broker packet
+// identifier.
+func (a *aggregator) takeRequest(msgID uint16) (*aggregatorRequest, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	req, ok := a.requests[msgID]
+	delete(a.requests, msgID)
+	return req, ok
+}
+
+// handleBroker handles a packet received from the broker.
+func (a *aggregator) handleBroker(pkt mqPkts.ControlPacket) error {
+	switch mqPkt := pkt.(type) {
+
+	case *mqPkts.PublishPacket:
+		switch mqPkt.Qos {
+		case 0:
+			a.route(mqPkt)
+			return nil
+		case 1:
+			a.route(mqPkt)
+			mqPuback := mqPkts.NewControlPacket(mqPkts.Puback).(*mqPkts.PubackPacket)
+			mqPuback.MessageID = mqPkt.MessageID
+			return a.send(mqPuback)
+		default:
+			a.mutex.Lock()
+			_, duplicate := a.brokerQos2[mqPkt.MessageID]
+			a.brokerQos2[mqPkt.MessageID] = struct{}{}
+			a.mutex.Unlock()
+			if !duplicate {
+				a.route(mqPkt)
+			}
+			mqPubrec := mqPkts.NewControlPacket(mqPkts.Pubrec).(*mqPkts.PubrecPacket)
+			mqPubrec.MessageID = mqPkt.MessageID
+			return a.send(mqPubrec)
+		}
+
+	case *mqPkts.PubrelPacket:
+		a.mutex.Lock()
+		delete(a.brokerQos2, mqPkt.MessageID)
+		a.mutex.Unlock()
+		mqPubcomp := mqPkts.NewControlPacket(mqPkts.Pubcomp).(*mqPkts.PubcompPacket)
+		mqPubcomp.MessageID = mqPkt.MessageID
+		return a.send(mqPubcomp)
+
+	case *mqPkts.PubackPacket:
+		if req, ok := a.takeRequest(mqPkt.MessageID); ok && req.conn != nil {
+			a.mutex.Lock()
+			delete(req.conn.published, req.msgID)
+			a.mutex.Unlock()
+			mqPuback := mqPkts.NewControlPacket(mqPkts.Puback).(*mqPkts.PubackPacket)
+			mqPuback.MessageID = req.msgID
+			req.conn.enqueue(mqPuback)
+		}
+		return nil
+
+	case *mqPkts.PubrecPacket:
+		a.mutex.Lock()
+		req, ok := a.requests[mqPkt.MessageID]
+		a.mutex.Unlock()
+		if !ok {
+			return nil
+		}
+		if req.conn == nil {
+			// Will PUBLISH.
+			mqPubrel := mqPkts.NewControlPacket(mqPkts.Pubrel).(*mqPkts.PubrelPacket)
+			mqPubrel.MessageID = mqPkt.MessageID
+			return a.send(mqPubrel)
+		}
+		mqPubrec := mqPkts.NewControlPacket(mqPkts.Pubrec).(*mqPkts.PubrecPacket)
+		mqPubrec.MessageID = req.msgID
+		req.conn.enqueue(mqPubrec)
+		return nil
+
+	case *mqPkts.PubcompPacket:
+		if req, ok := a.takeRequest(mqPkt.MessageID); ok && req.conn != nil {
+			a.mutex.Lock()
+			delete(req.conn.published, req.msgID)
+			a.mutex.Unlock()
+			mqPubcomp := mqPkts.NewControlPacket(mqPkts.Pubcomp).(*mqPkts.PubcompPacket)
+			mqPubcomp.MessageID = req.msgID
+			req.conn.enqueue(mqPubcomp)
+		}
+		return nil
+
+	// The failure is logged by the codec. The flow ends, the virtual
+	// connection gets the acknowledgement it waits for (MQTT 3.1.1 cannot
+	// express the failure) and its PUBREL is not sent to the broker.
+	case *mqtt5PubFailure:
+		if req, ok := a.takeRequest(mqPkt.MessageID); ok && req.conn != nil {
+			a.mutex.Lock()
+			delete(req.conn.published, req.msgID)
+			a.mutex.Unlock()
+			switch ack := mqPkt.ControlPacket.(type) {
+			case *mqPkts.PubackPacket:
+				ack.MessageID = req.msgID
+			case *mqPkts.PubrecPacket:
+				ack.MessageID = req.msgID
+			}
+			req.conn.enqueue(mqPkt.ControlPacket)
+		}
+		return nil
+
+	case *mqPkts.SubackPacket:
+		if req, ok := a.takeRequest(mqPkt.MessageID); ok && req.subscribe != nil {
+			a.suback(req, mqPkt)
+		}
+		return nil
+
+	case *mqPkts.UnsubackPacket:
+		if req, ok := a.takeRequest(mqPkt.MessageID); ok && req.conn != nil {
+			mqUnsuback := mqPkts.NewControlPacket(mqPkts.Unsuback).(*mqPkts.UnsubackPacket)
+			mqUnsuback.MessageID = req.msgID
+			req.conn.enqueue(mqUnsuback)
+		}
+		return nil
+
+	case *mqPkts.PingrespPacket:
+		a.mutex.Lock()
+		a.lastPingresp = time.Now()
+		a.mutex.Unlock()
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported MQTT packet type: %v", pkt)
+	}
+}
+
+// route passes the PUBLISH packet to all the sessions subscribed to
+// a matching topic filter. A session subscribed to more matching topic
+// filters gets the message only once, with the highest QoS.
+func (a *aggregator) route(mqPublish *mqPkts.PublishPacket) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	targets := make(map[*aggregatorSession]uint8)
+	add := func(f *aggregatorFilter) {
+		for s, qos := range f.sessions {
+			if qos > mqPublish.Qos {
+				qos = mqPublish.Qos
+			}
+			if current, ok := targets[s]; !ok || qos > current {
+				targets[s] = qos
+			}
+		}
+	}
+	if f, ok := a.filters[mqPublish.TopicName]; ok {
+		add(f)
+	}
+	for filter, f := range a.wildcards {
+		if topicMatches(filter, mqPublish.TopicName) {
+			add(f)
+		}
+	}
+
+	for s, qos := range targets {
+		if s.conn == nil {
+			continue
+		}
+		pkt := mqPkts.NewControlPacket(mqPkts.Publish).(*mqPkts.PublishPacket)
+		pkt.TopicName = mqPublish.TopicName
+		pkt.Payload = mqPublish.Payload
+		pkt.Retain = mqPublish.Retain
+		pkt.Qos = qos
+		if qos > 0 {
+			pkt.MessageID = s.conn.newMsgID()
+		}
+		s.conn.enqueue(pkt)
+	}
+}
+
+// topicMatches reports whether the topic name matches the topic filter.
+// See MQTT specification v. 3.1.1, chapter 4.7 Topic Names and Topic Filters.
+func topicMatches(filter, topic string) bool {
+	// Topics starting with "$" are not matched by filters starting with
+	// a wildcard.
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+func (a *aggregator) connectSession(c *aggregatorConn, mqConnect *mqPkts.ConnectPacket) {
+	a.mutex.Lock()
+	s, sessionPresent := a.sessions[mqConnect.ClientIdentifier]
+	var takenOver *aggregatorConn
+	if sessionPresent {
+		// Session takeover.
+		if s.conn != nil && s.conn != c {
+			takenOver = s.conn
+			s.conn = nil
+		}
+		if mqConnect.CleanSession || !s.persistent {
+			a.removeSession(s)
+			sessionPresent = false
+		}
+	}
+	if !sessionPresent {
+		s = &aggregatorSession{
+			clientID:      mqConnect.ClientIdentifier,
+			subscriptions: make(map[string]uint8),
+		}
+		a.sessions[s.clientID] = s
+	}
+	s.persistent = !mqConnect.CleanSession
+	s.conn = c
+	c.session = s
+	c.will = nil
+	if mqConnect.WillFlag {
+		will := mqPkts.NewControlPacket(mqPkts.Publish).(*mqPkts.PublishPacket)
+		will.TopicName = mqConnect.WillTopic
+		will.Payload = mqConnect.WillMessage
+		will.Qos = mqConnect.WillQos
+		will.Retain = mqConnect.WillRetain
+		c.will = will
+	}
+	a.mutex.Unlock()
+	// UNSUBSCRIBE of the removed session's topic filters.
+	a.flush()
+
+	if takenOver != nil {
+		c.log.Info("Session %q taken over.", s.clientID)
+		takenOver.close()
+	}
+
+	mqConnack := mqPkts.NewControlPacket(mqPkts.Connack).(*mqPkts.ConnackPacket)
+	mqConnack.SessionPresent = sessionPresent
+	mqConnack.ReturnCode = mqPkts.Accepted
+	c.enqueue(mqConnack)
+}
+
+// removeSession removes the session and its subscriptions.
+// The caller must hold a.mutex.
+func (a *aggregator) removeSession(s *aggregatorSession) {
+	mqUnsubscribe := mqPkts.NewControlPacket(mqPkts.Unsubscribe).(*mqPkts.UnsubscribePacket)
+	for filter := range s.subscriptions {
+		if a.removeSubscriber(s, filter) {
+			mqUnsubscribe.Topics = append(mqUnsubscribe.Topics, filter)
+		}
+	}
+	if a.sessions[s.clientID] == s {
+		delete(a.sessions, s.clientID)
+	}
+	if len(mqUnsubscribe.Topics) > 0 {
+		a.sendUnsubscribe(mqUnsubscribe, &aggregatorRequest{})
+	}
+}
+
+// removeSubscriber removes the session subscription. It returns true if the
+// topic filter has no subscribers anymore and must be unsubscribed at the
+// broker. The caller must hold a.mutex.
+func (a *aggregator) removeSubscriber(s *aggregatorSession, filter string) bool {
+	delete(s.subscriptions, filter)
+	f, ok := a.filters[filter]
+	if !ok {
+		return false
+	}
+	delete(f.sessions, s)
+	if len(f.sessions) > 0 {
+		return false
+	}
+	delete(a.filters, filter)
+	delete(a.wildcards, filter)
+	return f.subscribed
+}
+
+// sendUnsubscribe queues UNSUBSCRIBE to the broker. The caller must hold
+// a.mutex so that the UNSUBSCRIBE cannot overtake a following SUBSCRIBE of
+// the same topic filter, and flush the queue after releasing it.
+func (a *aggregator) sendUnsubscribe(mqUnsubscribe *mqPkts.UnsubscribePacket, req *aggregatorRequest) {
+	msgID, err := a.newRequest(req)
+	if err != nil {
+		a.log.Error("Cannot unsubscribe %v: %s", mqUnsubscribe.Topics, err)
+		return
+	}
+	mqUnsubscribe.MessageID = msgID
+	a.queue(mqUnsubscribe)
+}
+
+func (a *aggregator) subscribe(c *aggregatorConn, mqSubscribe *mqPkts.SubscribePacket) error {
+	a.mutex.Lock()
+	err := a.queueSubscribe(c, mqSubscribe)
+	a.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	a.flush()
+	return nil
+}
+
+// queueSubscribe queues SUBSCRIBE of the topic filters not subscribed at the
+// broker yet. The caller must hold a.mutex.
+func (a *aggregator) queueSubscribe(c *aggregatorConn, mqSubscribe *mqPkts.SubscribePacket) error {
+
+	s := c.session
+	sub := &aggregatorSubscribe{
+		codes: make([]byte, len(mqSubscribe.Topics)),
+	}
+	for i, filter := range mqSubscribe.Topics {
+		qos := mqSubscribe.Qoss[i]
+		s.subscriptions[filter] = qos
+		f, ok := a.filters[filter]
+		if !ok {
+			f = &aggregatorFilter{
+				sessions: make(map[*aggregatorSession]uint8),
+			}
+			a.filters[filter] = f
+			if hasWildcard(filter) {
+				a.wildcards[filter] = f
+			}
+		}
+		f.sessions[s] = qos
+		if f.subscribed && qos <= f.requested {
+			sub.codes[i] = min(qos, f.granted)
+			continue
+		}
+		f.requested = max(f.requested, qos)
+		sub.indexes = append(sub.indexes, i)
+		sub.filters = append(sub.filters, filter)
+		sub.qoss = append(sub.qoss, f.requested)
+	}
+
+	if len(sub.filters) == 0 {
+		mqSuback := mqPkts.NewControlPacket(mqPkts.Suback).(*mqPkts.SubackPacket)
+		mqSuback.MessageID = mqSubscribe.MessageID
+		mqSuback.ReturnCodes = sub.codes
+		c.enqueue(mqSuback)
+		return nil
+	}
+
+	msgID, err := a.newRequest(&aggregatorRequest{
+		conn:      c,
+		msgID:     mqSubscribe.MessageID,
+		session:   s,
+		subscribe: sub,
+	})
+	if err != nil {
+		return err
+	}
+	mqBrokerSubscribe := mqPkts.NewControlPacket(mqPkts.Subscribe).(*mqPkts.SubscribePacket)
+	mqBrokerSubscribe.MessageID = msgID
+	mqBrokerSubscribe.Topics = sub.filters
+	mqBrokerSubscribe.Qoss = sub.qoss
+	a.queue(mqBrokerSubscribe)
+	return nil
+}
+
+func (a *aggregator) suback(req *aggregatorRequest, mqSuback *mqPkts.SubackPacket) {
+	a.mutex.Lock()
+	sub := req.subscribe
+	// Topic filters unsubscribed while the SUBSCRIBE was in flight.
+	mqUnsubscribe := mqPkts.NewControlPacket(mqPkts.Unsubscribe).(*mqPkts.UnsubscribePacket)
+	for i, code := range mqSuback.ReturnCodes {
+		if i >= len(sub.indexes) {
+			break
+		}
+		filter := sub.filters[i]
+		requested := req.session.subscriptions[filter]
+		f, ok := a.filters[filter]
+		if code > 2 {
+			// Failure.
+			sub.codes[sub.indexes[i]] = code
+			if ok && !f.subscribed {
+				a.removeSubscriber(req.session, filter)
+			}
+			continue
+		}
+		if ok {
+			f.subscribed = true
+			f.granted = code
+		} else {
+			mqUnsubscribe.Topics = append(mqUnsubscribe.Topics, filter)
+		}
+		sub.codes[sub.indexes[i]] = min(requested, code)
+	}
+	if len(mqUnsubscribe.Topics) > 0 {
+		a.sendUnsubscribe(mqUnsubscribe, &aggregatorRequest{})
+	}
+	a.mutex.Unlock()
+	a.flush()
+
+	mqClientSuback := mqPkts.NewControlPacket(mqPkts.Suback).(*mqPkts.SubackPacket)
+	mqClientSuback.MessageID = req.msgID
+	mqClientSuback.ReturnCodes = sub.codes
+	req.conn.enqueue(mqClientSuback)
+}
+
+func (a *aggregator) unsubscribe(c *aggregatorConn, mqUnsubscribe *mqPkts.UnsubscribePacket) {
+	// Deferred calls run in reverse order => the queue is flushed after
+	// a.mutex is released.
+	defer a.flush()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	mqBrokerUnsubscribe := mqPkts.NewControlPacket(mqPkts.Unsubscribe).(*mqPkts.UnsubscribePacket)
+	for _, filter := range mqUnsubscribe.Topics {
+		if _, ok := c.session.subscriptions[filter]; !ok {
+			continue
+		}
+		if a.removeSubscriber(c.session, filter) {
+			mqBrokerUnsubscribe.Topics = append(mqBrokerUnsubscribe.Topics, filter)
+		}
+	}
+
+	if len(mqBrokerUnsubscribe.Topics) == 0 {
+		mqUnsuback := mqPkts.NewControlPacket(mqPkts.Unsuback).(*mqPkts.UnsubackPacket)
+		mqUnsuback.MessageID = mqUnsubscribe.MessageID
+		c.enqueue(mqUnsuback)
+		return
+	}
+	a.sendUnsubscribe(mqBrokerUnsubscribe, &aggregatorRequest{
+		conn:  c,
+		msgID: mqUnsubscribe.MessageID,
+	})
+}
+
+// publish sends the client's PUBLISH to the broker.
+func (a *aggregator) publish(c *aggregatorConn, mqPublish *mqPkts.PublishPacket) error {
+	mqBrokerPublish := mqPkts.NewControlPacket(mqPkts.Publish).(*mqPkts.PublishPacket)
+	mqBrokerPublish.TopicName = mqPublish.TopicName
+	mqBrokerPublish.Payload = mqPublish.Payload
+	mqBrokerPublish.Qos = mqPublish.Qos
+	mqBrokerPublish.Retain = mqPublish.Retain
+	mqBrokerPublish.Dup = mqPublish.Dup
+
+	if mqPublish.Qos > 0 {
+		a.mutex.Lock()
+		msgID, ok := c.published[mqPublish.MessageID]
+		if ok {
+			// Retransmission.
+			mqBrokerPublish.Dup = true
+		} else {
+			var err error
+			msgID, err = a.newRequest(&aggregatorRequest{
+				conn:  c,
+				msgID: mqPublish.MessageID,
+			})
+			if err != nil {
+				a.mutex.Unlock()
+				return err
+			}
+			c.published[mqPublish.MessageID] = msgID
+		}
+		a.mutex.Unlock()
+		mqBrokerPublish.MessageID = msgID
+	}
+	return a.send(mqBrokerPublish)
+}
+
+// pubrel sends the client's PUBREL to the broker.
+func (a *aggregator) pubrel(c *aggregatorConn, mqPubrel *mqPkts.PubrelPacket) error {
+	a.mutex.Lock()
+	msgID, ok := c.published[mqPubrel.MessageID]
+	a.mutex.Unlock()
+	if !ok {
+		// PUBCOMP already sent.
+		mqPubcomp := mqPkts.NewControlPacket(mqPkts.Pubcomp).(*mqPkts.PubcompPacket)
+		mqPubcomp.MessageID = mqPubrel.MessageID
+		c.enqueue(mqPubcomp)
+		return nil
+	}
+	mqBrokerPubrel := mqPkts.NewControlPacket(mqPkts.Pubrel).(*mqPkts.PubrelPacket)
+	mqBrokerPubrel.MessageID = msgID
+	return a.send(mqBrokerPubrel)
+}
+
+// detach is called when the virtual connection is closed. The client's will
+// is published unless the client sent DISCONNECT.
+func (a *aggregator) detach(c *aggregatorConn) {
+	// Deferred calls run in reverse order => the queue is flushed after
+	// a.mutex is released.
+	defer a.flush()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := a.conns[c]; !ok {
+		// The broker connection was reset.
+		return
+	}
+	delete(a.conns, c)
+
+	if s := c.session; s != nil && s.conn == c {
+		s.conn = nil
+		if !s.persistent {
+			a.removeSession(s)
+		}
+	}
+
+	if c.will == nil || c.disconnected {
+		return
+	}
+	c.log.Debug("Publishing will of %q.", c.session.clientID)
+	will := c.will
+	if will.Qos > 0 {
+		msgID, err := a.newRequest(&aggregatorRequest{})
+		if err != nil {
+			c.log.Error("Cannot publish will: %s", err)
+			return
+		}
+		will.MessageID = msgID
+	}
+	a.queue(will)
+}
+
+// Virtual MQTT connection of a handler.
+type aggregatorConn struct {
+	aggregator *aggregator
+	conn       net.Conn
+	log        util.Logger
+	out        chan mqPkts.ControlPacket
+	done       chan struct{}
+	closeOnce  sync.Once
+
+	// Following fields are protected by aggregator.mutex.
+	session *aggregatorSession
+	will    *mqPkts.PublishPacket
+	// DISCONNECT received => the will must not be published.
+	disconnected bool
+	// Client packet identifier => broker packet identifier of QoS 1 and 2
+	// PUBLISHes sent by the client.
+	published map[uint16]uint16
+	// Packet identifiers of PUBLISHes sent to the client are allocated from
+	// the top of the range because the clients usually allocate their
+	// packet identifiers from the bottom.
+	nextMsgID uint16
+}
+
+// The caller must hold aggregator.mutex.
+func (c *aggregatorConn) newMsgID() uint16 {
+	msgID := c.nextMsgID
+	c.nextMsgID--
+	if c.nextMsgID < snPkts.MinPacketID {
+		c.nextMsgID = snPkts.MaxPacketID
+	}
+	return msgID
+}
+
+// enqueue queues the packet to be sent to the handler. It never blocks.
+func (c *aggregatorConn) enqueue(pkt mqPkts.ControlPacket) {
+	select {
+	case <-c.done:
+	case c.out <- pkt:
+	default:
+		c.log.Error("Output queue full, closing connection.")
+		c.close()
+	}
+}
+
+func (c *aggregatorConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if err := c.conn.Close(); err != nil {
+			c.log.Error("Error closing connection: %s", err)
+		}
+	})
+}
+
+func (c *aggregatorConn) writeLoop() {
+	codec := mqtt311Codec{}
+	for {
+		select {
+		case pkt := <-c.out:
+			if _, err := codec.WritePacket(c.conn, pkt); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *aggregatorConn) readLoop() {
+	defer c.aggregator.detach(c)
+	defer c.close()
+	codec := mqtt311Codec{}
+	for {
+		pkt, err := codec.ReadPacket(c.conn)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, io.ErrClosedPipe) {
+				c.log.Error("MQTT decode error: %s", err)
+			}
+			return
+		}
+		if _, ok := pkt.(*mqPkts.DisconnectPacket); ok {
+			c.aggregator.mutex.Lock()
+			c.disconnected = true
+			c.aggregator.mutex.Unlock()
+			return
+		}
+		if err := c.handle(pkt); err != nil {
+			c.log.Error("%s", err)
+			return
+		}
+	}
+}
+
+// handle handles a packet received from the handler.
+func (c *aggregatorConn) handle(pkt mqPkts.ControlPacket) error {
+	a := c.aggregator
+	if mqConnect, ok := pkt.(*mqPkts.ConnectPacket); ok {
+		a.connectSession(c, mqConnect)
+		return nil
+	}
+	a.mutex.Lock()
+	session := c.session
+	a.mutex.Unlock()
+	if session == nil {
+		return fmt.Errorf("unexpected packet before CONNECT: %v", pkt)
+	}
+
+	switch mqPkt := pkt.(type) {
+	case *mqPkts.PublishPacket:
+		return a.publish(c, mqPkt)
+
+	case *mqPkts.PubrelPacket:
+		return a.pubrel(c, mqPkt)
+
+	case *mqPkts.SubscribePacket:
+		return a.subscribe(c, mqPkt)
+
+	case *mqPkts.UnsubscribePacket:
+		a.unsubscribe(c, mqPkt)
+		return nil
+
+	case *mqPkts.PingreqPacket:
+		c.enqueue(mqPkts.NewControlPacket(mqPkts.Pingresp))
+		return nil
+
+	// Acknowledgements of PUBLISHes routed to the client. They were already
+	// acknowledged to the broker.
+	case *mqPkts.PubackPacket, *mqPkts.PubcompPacket:
+		return nil
+
+	case *mqPkts.PubrecPacket:
+		mqPubrel := mqPkts.NewControlPacket(mqPkts.Pubrel).(*mqPkts.PubrelPacket)
+		mqPubrel.MessageID = mqPkt.MessageID
+		c.enqueue(mqPubrel)
+		return nil
+
+	default:
+		return fmt.Errorf("unsupported MQTT packet type: %v", pkt)
+	}
+}
@@ -0,0 +1,247 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/energostack/bisquitt/util"
+)
+
+// pipeDialer connects to an in-memory MQTT broker mockup.
+type pipeDialer struct {
+	brokerConns chan net.Conn
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	clientConn, brokerConn := net.Pipe()
+	d.brokerConns <- brokerConn
+	return clientConn, nil
+}
+
+func (d *pipeDialer) String() string {
+	return "pipe"
+}
+
+func aggregatorTestRead(t *testing.T, conn net.Conn) mqPkts.ControlPacket {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := mqPkts.ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func aggregatorTestWrite(t *testing.T, conn net.Conn, pkt mqPkts.ControlPacket) {
+	t.Helper()
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pkt.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func aggregatorTestConnect(t *testing.T, a *aggregator, clientID string, will bool) net.Conn {
+	t.Helper()
+	conn, err := a.DialContext(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mqConnect := mqPkts.NewControlPacket(mqPkts.Connect).(*mqPkts.ConnectPacket)
+	mqConnect.ProtocolName = "MQTT"
+	mqConnect.ProtocolVersion = MqttVersion311
+	mqConnect.ClientIdentifier = clientID
+	mqConnect.CleanSession = true
+	mqConnect.Keepalive = 10
+	if will {
+		mqConnect.WillFlag = true
+		mqConnect.WillTopic = "will/" + clientID
+		mqConnect.WillMessage = []byte("bye")
+	}
+	aggregatorTestWrite(t, conn, mqConnect)
+	mqConnack := aggregatorTestRead(t, conn).(*mqPkts.ConnackPacket)
+	assert.Equal(t, byte(mqPkts.Accepted), mqConnack.ReturnCode)
+	return conn
+}
+
+func TestAggregator(t *testing.T) {
+	assert := assert.New(t)
+
+	dialer := &pipeDialer{brokerConns: make(chan net.Conn, 1)}
+	cfg := &handlerConfig{
+		MqttDialer:            dialer,
+		MqttConnectionTimeout: time.Second,
+	}
+	a := newAggregator(cfg, "aggregator", util.NewDebugLogger("aggregator"))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.run(ctx)
+
+	// Aggregated broker connection.
+	broker := <-dialer.brokerConns
+	defer broker.Close()
+	mqConnect := aggregatorTestRead(t, broker).(*mqPkts.ConnectPacket)
+	assert.Equal("aggregator", mqConnect.ClientIdentifier)
+	aggregatorTestWrite(t, broker, mqPkts.NewControlPacket(mqPkts.Connack))
+	assert.Eventually(func() bool {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		return a.connected
+	}, time.Second, 10*time.Millisecond)
+
+	clientA := aggregatorTestConnect(t, a, "A", true)
+	defer clientA.Close()
+	clientB := aggregatorTestConnect(t, a, "B", false)
+	defer clientB.Close()
+
+	// The first SUBSCRIBE is passed to the broker.
+	mqSubscribe := mqPkts.NewControlPacket(mqPkts.Subscribe).(*mqPkts.SubscribePacket)
+	mqSubscribe.MessageID = 1
+	mqSubscribe.Topics = []string{"t/+"}
+	mqSubscribe.Qoss = []byte{1}
+	aggregatorTestWrite(t, clientA, mqSubscribe)
+	mqBrokerSubscribe := aggregatorTestRead(t, broker).(*mqPkts.SubscribePacket)
+	assert.Equal([]string{"t/+"}, mqBrokerSubscribe.Topics)
+	assert.Equal([]byte{1}, mqBrokerSubscribe.Qoss)
+	mqSuback := mqPkts.NewControlPacket(mqPkts.Suback).(*mqPkts.SubackPacket)
+	mqSuback.MessageID = mqBrokerSubscribe.MessageID
+	mqSuback.ReturnCodes = []byte{1}
+	aggregatorTestWrite(t, broker, mqSuback)
+	mqSuback = aggregatorTestRead(t, clientA).(*mqPkts.SubackPacket)
+	assert.Equal(uint16(1), mqSuback.MessageID)
+	assert.Equal([]byte{1}, mqSuback.ReturnCodes)
+
+	// The second one is answered by the aggregator.
+	mqSubscribe.Qoss = []byte{0}
+	aggregatorTestWrite(t, clientB, mqSubscribe)
+	mqSuback = aggregatorTestRead(t, clientB).(*mqPkts.SubackPacket)
+	assert.Equal(uint16(1), mqSuback.MessageID)
+	assert.Equal([]byte{0}, mqSuback.ReturnCodes)
+
+	// Broker PUBLISH is routed to both clients.
+	mqPublish := mqPkts.NewControlPacket(mqPkts.Publish).(*mqPkts.PublishPacket)
+	mqPublish.TopicName = "t/x"
+	mqPublish.Qos = 1
+	mqPublish.MessageID = 7
+	mqPublish.Payload = []byte("down")
+	aggregatorTestWrite(t, broker, mqPublish)
+	mqPublishA := aggregatorTestRead(t, clientA).(*mqPkts.PublishPacket)
+	assert.Equal("t/x", mqPublishA.TopicName)
+	assert.Equal(byte(1), mqPublishA.Qos)
+	assert.Equal([]byte("down"), mqPublishA.Payload)
+	mqPublishB := aggregatorTestRead(t, clientB).(*mqPkts.PublishPacket)
+	assert.Equal(byte(0), mqPublishB.Qos)
+	assert.Equal(uint16(7), aggregatorTestRead(t, broker).(*mqPkts.PubackPacket).MessageID)
+
+	// Client PUBLISH.
+	mqPublish = mqPkts.NewControlPacket(mqPkts.Publish).(*mqPkts.PublishPacket)
+	mqPublish.TopicName = "up"
+	mqPublish.Qos = 1
+	mqPublish.MessageID = 3
+	mqPublish.Payload = []byte("up")
+	aggregatorTestWrite(t, clientA, mqPublish)
+	mqBrokerPublish := aggregatorTestRead(t, broker).(*mqPkts.PublishPacket)
+	assert.Equal("up", mqBrokerPublish.TopicName)
+	mqPuback := mqPkts.NewControlPacket(mqPkts.Puback).(*mqPkts.PubackPacket)
+	mqPuback.MessageID = mqBrokerPublish.MessageID
+	aggregatorTestWrite(t, broker, mqPuback)
+	assert.Equal(uint16(3), aggregatorTestRead(t, clientA).(*mqPkts.PubackPacket).MessageID)
+
+	// The topic filter is unsubscribed at the broker by the last subscriber.
+	mqUnsubscribe := mqPkts.NewControlPacket(mqPkts.Unsubscribe).(*mqPkts.UnsubscribePacket)
+	mqUnsubscribe.MessageID = 4
+	mqUnsubscribe.Topics = []string{"t/+"}
+	aggregatorTestWrite(t, clientA, mqUnsubscribe)
+	assert.Equal(uint16(4), aggregatorTestRead(t, clientA).(*mqPkts.UnsubackPacket).MessageID)
+	aggregatorTestWrite(t, clientB, mqUnsubscribe)
+	mqBrokerUnsubscribe := aggregatorTestRead(t, broker).(*mqPkts.UnsubscribePacket)
+	assert.Equal([]string{"t/+"}, mqBrokerUnsubscribe.Topics)
+	mqUnsuback := mqPkts.NewControlPacket(mqPkts.Unsuback).(*mqPkts.UnsubackPacket)
+	mqUnsuback.MessageID = mqBrokerUnsubscribe.MessageID
+	aggregatorTestWrite(t, broker, mqUnsuback)
+	assert.Equal(uint16(4), aggregatorTestRead(t, clientB).(*mqPkts.UnsubackPacket).MessageID)
+
+	// Clean disconnect => no will.
+	aggregatorTestWrite(t, clientB, mqPkts.NewControlPacket(mqPkts.Disconnect))
+	// Lost connection => will.
+	clientA.Close()
+	mqWill := aggregatorTestRead(t, broker).(*mqPkts.PublishPacket)
+	assert.Equal("will/A", mqWill.TopicName)
+	assert.Equal([]byte("bye"), mqWill.Payload)
+
+	assert.Eventually(func() bool {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		return len(a.sessions) == 0 && len(a.conns) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestTopicMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(topicMatches("a/b", "a/b"))
+	assert.False(topicMatches("a/b", "a/c"))
+	assert.True(topicMatches("a/+", "a/b"))
+	assert.False(topicMatches("a/+", "a/b/c"))
+	assert.True(topicMatches("a/+/c", "a/b/c"))
+	assert.True(topicMatches("a/#", "a"))
+	assert.True(topicMatches("a/#", "a/b/c"))
+	assert.True(topicMatches("#", "a/b"))
+	assert.False(topicMatches("#", "$SYS/a"))
+	assert.False(topicMatches("+/a", "$SYS/a"))
+	assert.True(topicMatches("$SYS/#", "$SYS/a"))
+}
+
+func TestAggregatorPingTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	dialer := &pipeDialer{brokerConns: make(chan net.Conn, 1)}
+	cfg := &handlerConfig{
+		MqttDialer:            dialer,
+		MqttConnectionTimeout: time.Second,
+	}
+	a := newAggregator(cfg, "aggregator", util.NewDebugLogger("aggregator"))
+	a.pingInterval = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.run(ctx)
+
+	broker := <-dialer.brokerConns
+	defer broker.Close()
+	aggregatorTestRead(t, broker)
+	aggregatorTestWrite(t, broker, mqPkts.NewControlPacket(mqPkts.Connack))
+
+	// Answered PINGREQs keep the connection.
+	for i := 0; i < 4; i++ {
+		assert.IsType(&mqPkts.PingreqPacket{}, aggregatorTestRead(t, broker))
+		aggregatorTestWrite(t, broker, mqPkts.NewControlPacket(mqPkts.Pingresp))
+	}
+	select {
+	case <-dialer.brokerConns:
+		t.Fatal("unexpected reconnect")
+	default:
+	}
+
+	// Unanswered PINGREQ => reconnect.
+	assert.IsType(&mqPkts.PingreqPacket{}, aggregatorTestRead(t, broker))
+	go func() {
+		// Drain the following PINGREQ, if any.
+		_, _ = mqPkts.ReadPacket(broker)
+	}()
+	select {
+	case broker2 := <-dialer.brokerConns:
+		defer broker2.Close()
+		mqConnect := aggregatorTestRead(t, broker2).(*mqPkts.ConnectPacket)
+		assert.Equal("aggregator", mqConnect.ClientIdentifier)
+	case <-time.After(aggregatorReconnectDelay + time.Second):
+		t.Fatal("no reconnect")
+	}
+}
@@ -0,0 +1,296 @@
+// Bearer token authentication.
+//
+// The client sends a JSON Web Token (RFC 7519) in a single AUTH packet with
+// the "JWT" method. The token signature is verified locally against the
+// configured keys; supported algorithms are HS256/384/512, RS256/384/512,
+// ES256/384/512 and EdDSA (Ed25519). The token must contain the "exp" claim.
+
+package gateway
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// Allowed clock difference for the "exp" and "nbf" claims verification.
+const jwtLeeway = 30 * time.Second
+
+// JWTKey is a token verification key: an HMAC secret ([]byte),
+// *rsa.PublicKey, *ecdsa.PublicKey or ed25519.PublicKey.
+type JWTKey struct {
+	// Key ID. If both the key and the token header have a key ID, they
+	// must be equal.
+	ID  string
+	Key interface{}
+}
+
+// JWTAuthenticator implements the JWT AUTH method.
+type JWTAuthenticator struct {
+	Keys []JWTKey
+	// The "iss" claim must be equal if not empty.
+	Issuer string
+	// The "aud" claim must contain Audience if not empty.
+	Audience string
+	// Claim used as the MQTT username. "sub" if empty.
+	UsernameClaim string
+	// If true, the token is used as the MQTT password so that the broker
+	// can verify it too.
+	ForwardToken bool
+	// For testing.
+	now func() time.Time
+}
+
+// ReadJWTKeyFile reads a PEM encoded public key or certificate. A file which
+// is not PEM encoded is used as an HMAC secret.
+func ReadJWTKeyFile(file string) (JWTKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return JWTKey{}, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		secret := bytes.TrimRight(data, "\r\n")
+		if len(secret) == 0 {
+			return JWTKey{}, fmt.Errorf("%s: empty HMAC secret", file)
+		}
+		return JWTKey{Key: secret}, nil
+	}
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		err = fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return JWTKey{}, fmt.Errorf("%s: %s", file, err)
+	}
+	return JWTKey{Key: key}, nil
+}
+
+// Authenticator.Start() implementation.
+func (a *JWTAuthenticator) Start(clientID string) AuthSession {
+	return &jwtAuthSession{authenticator: a}
+}
+
+type jwtAuthSession struct {
+	authenticator *JWTAuthenticator
+}
+
+func (s *jwtAuthSession) Step(data []byte) ([]byte, *AuthResult, error) {
+	a := s.authenticator
+	token := string(data)
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	usernameClaim := a.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	username, ok := claims[usernameClaim].(string)
+	if !ok || username == "" {
+		return nil, nil, fmt.Errorf("no %q claim", usernameClaim)
+	}
+	result := &AuthResult{Username: username}
+	if a.ForwardToken {
+		result.Password = data
+	}
+	return nil, result, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify verifies the token signature and the registered claims and returns
+// the token claims.
+func (a *JWTAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, key := range a.Keys {
+		if key.ID != "" && header.Kid != "" && key.ID != header.Kid {
+			continue
+		}
+		ok, err := jwtVerifySignature(header.Alg, key.Key, signed, signature)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrAuthFailed
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(claimsJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if err := a.verifyClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (a *JWTAuthenticator) verifyClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	if a.now != nil {
+		now = a.now()
+	}
+	exp, ok := jwtTimeClaim(claims, "exp")
+	if !ok {
+		return errors.New(`missing or invalid "exp" claim`)
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if _, present := claims["nbf"]; present {
+		nbf, ok := jwtTimeClaim(claims, "nbf")
+		if !ok {
+			return errors.New(`invalid "nbf" claim`)
+		}
+		if now.Add(jwtLeeway).Before(nbf) {
+			return errors.New("token not valid yet")
+		}
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return errors.New("issuer mismatch")
+	}
+	if a.Audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == a.Audience
+		case []interface{}:
+			for _, v := range aud {
+				if v == a.Audience {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return errors.New("audience mismatch")
+		}
+	}
+	return nil
+}
+
+func jwtTimeClaim(claims map[string]interface{}, name string) (time.Time, bool) {
+	number, ok := claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// Token signature algorithms => hash functions.
+var jwtHashes = map[string]crypto.Hash{
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// jwtVerifySignature returns false if the key type does not match the
+// algorithm or the signature is invalid.
+func jwtVerifySignature(alg string, key interface{}, signed, signature []byte) (bool, error) {
+	if alg == "EdDSA" {
+		publicKey, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false, nil
+		}
+		return ed25519.Verify(publicKey, signed, signature), nil
+	}
+
+	// Including "none".
+	hashFunc, ok := jwtHashes[alg]
+	if !ok {
+		return false, fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	h := hashFunc.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false, nil
+		}
+		mac := hmac.New(hashFunc.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature), nil
+	case "RS":
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false, nil
+		}
+		return rsa.VerifyPKCS1v15(publicKey, hashFunc, digest, signature) == nil, nil
+	default: // "ES"
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false, nil
+		}
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false, nil
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(publicKey, digest, r, s), nil
+	}
+}
@@ -0,0 +1,183 @@
+package gateway
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	signed := enc(header) + "." + enc(payload)
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(signed))
+	case nil:
+	}
+	return signed + "." + enc(signature)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1700000000, 0)
+	secret := []byte("secret")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := &JWTAuthenticator{
+		Keys: []JWTKey{
+			{Key: secret},
+			{Key: &ecKey.PublicKey},
+			{Key: edPublic},
+		},
+		Issuer:   "issuer",
+		Audience: "gateway",
+		now:      func() time.Time { return now },
+	}
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		result := map[string]interface{}{
+			"sub": "dev1",
+			"iss": "issuer",
+			"aud": []string{"other", "gateway"},
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(result, k)
+			} else {
+				result[k] = v
+			}
+		}
+		return result
+	}
+	step := func(token string) (*AuthResult, error) {
+		challenge, result, err := authenticator.Start("dev1").Step([]byte(token))
+		assert.Nil(challenge)
+		return result, err
+	}
+
+	for alg, key := range map[string]interface{}{
+		"HS256": secret,
+		"ES256": ecKey,
+		"EdDSA": edKey,
+	} {
+		result, err := step(newTestJWT(t, alg, key, claims(nil)))
+		if assert.NoError(err, alg) {
+			assert.Equal("dev1", result.Username)
+			assert.Nil(result.Password)
+		}
+	}
+
+	// Invalid tokens.
+	for name, token := range map[string]string{
+		"wrong key":        newTestJWT(t, "HS256", []byte("other"), claims(nil)),
+		"alg none":         newTestJWT(t, "none", nil, claims(nil)),
+		"expired":          newTestJWT(t, "HS256", secret, claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+		"no exp":           newTestJWT(t, "HS256", secret, claims(map[string]interface{}{"exp": nil})),
+		"not valid yet":    newTestJWT(t, "HS256", secret, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+		"issuer mismatch":  newTestJWT(t, "HS256", secret, claims(map[string]interface{}{"iss": "other"})),
+		"audience missing": newTestJWT(t, "HS256", secret, claims(map[string]interface{}{"aud": "other"})),
+		"no username":      newTestJWT(t, "HS256", secret, claims(map[string]interface{}{"sub": nil})),
+		"malformed":        "garbage",
+	} {
+		result, err := step(token)
+		assert.Error(err, name)
+		assert.Nil(result, name)
+	}
+
+	// Leeway.
+	_, err = step(newTestJWT(t, "HS256", secret, claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})))
+	assert.NoError(err)
+
+	// Custom username claim and token forwarding.
+	authenticator.UsernameClaim = "device"
+	authenticator.ForwardToken = true
+	token := newTestJWT(t, "HS256", secret, claims(map[string]interface{}{"device": "dev2"}))
+	result, err := step(token)
+	if assert.NoError(err) {
+		assert.Equal("dev2", result.Username)
+		assert.Equal([]byte(token), result.Password)
+	}
+}
+
+func TestReadJWTKeyFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(ecKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "ec.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ReadJWTKeyFile(file)
+	if assert.NoError(err) {
+		assert.True(ecKey.PublicKey.Equal(key.Key.(crypto.PublicKey)))
+	}
+
+	file = filepath.Join(dir, "secret")
+	if err := os.WriteFile(file, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err = ReadJWTKeyFile(file)
+	if assert.NoError(err) {
+		assert.Equal([]byte("secret"), key.Key)
+	}
+
+	file = filepath.Join(dir, "private.pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadJWTKeyFile(file)
+	assert.Error(err)
+}
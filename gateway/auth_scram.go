@@ -0,0 +1,299 @@
+// SCRAM-SHA-256 authentication.
+//
+// See RFC 5802 (SCRAM) and RFC 7677 (SCRAM-SHA-256). Channel binding is not
+// supported. The client password is never sent over the network and the
+// gateway stores only the derived keys.
+//
+//	client --AUTH(client-first-message)--> GW
+//	client <--AUTH(AUTH_CONTINUE, server-first-message)-- GW
+//	client --AUTH(AUTH_CONTINUE, client-final-message)--> GW
+//	client <--AUTH(AUTH_SUCCESS, server-final-message)-- GW
+
+package gateway
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultScramIterations is the PBKDF2 iteration count used by
+// NewScramCredentials if zero is given.
+const DefaultScramIterations = 4096
+
+const scramNonceLength = 18
+
+// ScramCredentials are the SCRAM-SHA-256 keys of a user derived from the
+// user's password.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredentials derives the keys from the password. A random salt is
+// generated if salt is nil.
+func NewScramCredentials(password string, salt []byte, iterations int) (*ScramCredentials, error) {
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+	if iterations == 0 {
+		iterations = DefaultScramIterations
+	}
+	saltedPassword, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return nil, err
+	}
+	clientKey := scramHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  scramHMAC(saltedPassword, "Server Key"),
+	}, nil
+}
+
+// ScramAuthenticator implements the SCRAM-SHA-256 AUTH method.
+type ScramAuthenticator struct {
+	// Username => credentials.
+	credentials map[string]*ScramCredentials
+	// Used to generate stable fake credentials of unknown users so that
+	// the users cannot be enumerated.
+	fakeKey []byte
+}
+
+func NewScramAuthenticator(credentials map[string]*ScramCredentials) (*ScramAuthenticator, error) {
+	fakeKey := make([]byte, 32)
+	if _, err := rand.Read(fakeKey); err != nil {
+		return nil, err
+	}
+	return &ScramAuthenticator{
+		credentials: credentials,
+		fakeKey:     fakeKey,
+	}, nil
+}
+
+type scramFileEntry struct {
+	// Either password or all the other fields must be set.
+	Password   string `yaml:"password"`
+	Salt       string `yaml:"salt"`
+	Iterations int    `yaml:"iterations"`
+	StoredKey  string `yaml:"stored_key"`
+	ServerKey  string `yaml:"server_key"`
+}
+
+// ReadScramCredentialsFile reads SCRAM credentials in YAML format:
+//
+//	user1:
+//	  salt: <base64>
+//	  iterations: 4096
+//	  stored_key: <base64>
+//	  server_key: <base64>
+//	user2:
+//	  password: secret
+//
+// The keys are derived when the file is read if a password is given.
+func ReadScramCredentialsFile(file string) (map[string]*ScramCredentials, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]scramFileEntry
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&entries); err != nil {
+		return nil, err
+	}
+	result := make(map[string]*ScramCredentials, len(entries))
+	for user, entry := range entries {
+		if entry.Password != "" {
+			credentials, err := NewScramCredentials(entry.Password, nil, entry.Iterations)
+			if err != nil {
+				return nil, err
+			}
+			result[user] = credentials
+			continue
+		}
+		credentials := &ScramCredentials{Iterations: entry.Iterations}
+		for _, field := range []struct {
+			name  string
+			value string
+			dst   *[]byte
+		}{
+			{"salt", entry.Salt, &credentials.Salt},
+			{"stored_key", entry.StoredKey, &credentials.StoredKey},
+			{"server_key", entry.ServerKey, &credentials.ServerKey},
+		} {
+			if *field.dst, err = base64.StdEncoding.DecodeString(field.value); err != nil || len(*field.dst) == 0 {
+				return nil, fmt.Errorf("user %q: invalid %s", user, field.name)
+			}
+		}
+		if credentials.Iterations <= 0 {
+			return nil, fmt.Errorf("user %q: invalid iterations", user)
+		}
+		result[user] = credentials
+	}
+	return result, nil
+}
+
+// Authenticator.Start() implementation.
+func (a *ScramAuthenticator) Start(clientID string) AuthSession {
+	return &scramAuthSession{authenticator: a}
+}
+
+func (a *ScramAuthenticator) lookup(user string) (*ScramCredentials, bool) {
+	if credentials, ok := a.credentials[user]; ok {
+		return credentials, true
+	}
+	fakeSalt := scramHMAC(a.fakeKey, user)[:16]
+	return &ScramCredentials{
+		Salt:       fakeSalt,
+		Iterations: DefaultScramIterations,
+		StoredKey:  scramHMAC(a.fakeKey, "stored:"+user),
+		ServerKey:  scramHMAC(a.fakeKey, "server:"+user),
+	}, false
+}
+
+type scramAuthSession struct {
+	authenticator   *ScramAuthenticator
+	user            string
+	credentials     *ScramCredentials
+	known           bool
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+}
+
+func (s *scramAuthSession) Step(data []byte) ([]byte, *AuthResult, error) {
+	if s.credentials == nil {
+		return s.clientFirst(string(data))
+	}
+	return s.clientFinal(string(data))
+}
+
+func (s *scramAuthSession) clientFirst(msg string) ([]byte, *AuthResult, error) {
+	// gs2-header: "n,," or "n,a=authzid,"
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, nil, errors.New("invalid client-first-message")
+	}
+	if parts[0] != "n" {
+		// "y" or "p=...": channel binding is not supported.
+		return nil, nil, errors.New("channel binding not supported")
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+	attrs, err := scramParseAttributes(s.clientFirstBare)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, ok := attrs["n"]
+	if !ok {
+		return nil, nil, errors.New("no username")
+	}
+	s.user, err = scramDecodeName(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientNonce, ok := attrs["r"]
+	if !ok || clientNonce == "" {
+		return nil, nil, errors.New("no client nonce")
+	}
+
+	serverNonce := make([]byte, scramNonceLength)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, nil, err
+	}
+	s.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	s.credentials, s.known = s.authenticator.lookup(s.user)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d",
+		s.nonce, base64.StdEncoding.EncodeToString(s.credentials.Salt), s.credentials.Iterations)
+	return []byte(s.serverFirst), nil, nil
+}
+
+func (s *scramAuthSession) clientFinal(msg string) ([]byte, *AuthResult, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, nil, errors.New("invalid client-final-message")
+	}
+	clientFinalWithoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+len(",p="):])
+	if err != nil {
+		return nil, nil, errors.New("invalid client proof")
+	}
+	attrs, err := scramParseAttributes(clientFinalWithoutProof)
+	if err != nil {
+		return nil, nil, err
+	}
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return nil, nil, errors.New("channel binding mismatch")
+	}
+	if attrs["r"] != s.nonce {
+		return nil, nil, errors.New("nonce mismatch")
+	}
+
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + clientFinalWithoutProof
+	clientSignature := scramHMAC(s.credentials.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, nil, ErrAuthFailed
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], s.credentials.StoredKey) != 1 || !s.known {
+		return nil, nil, ErrAuthFailed
+	}
+
+	serverSignature := scramHMAC(s.credentials.ServerKey, authMessage)
+	serverFinal := "v=" + base64.StdEncoding.EncodeToString(serverSignature)
+	return []byte(serverFinal), &AuthResult{Username: s.user}, nil
+}
+
+func scramHMAC(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// scramParseAttributes parses "a=value,b=value" attributes. Unknown
+// mandatory extensions ("m=") are rejected.
+func scramParseAttributes(msg string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, fmt.Errorf("invalid SCRAM attribute: %q", attr)
+		}
+		if attr[0] == 'm' {
+			return nil, errors.New("unsupported SCRAM extension")
+		}
+		attrs[attr[:1]] = attr[2:]
+	}
+	return attrs, nil
+}
+
+// scramDecodeName decodes "=2C" and "=3D" escapes in a SCRAM username.
+func scramDecodeName(name string) (string, error) {
+	result := strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+	if strings.Count(name, "=") != strings.Count(name, "=2C")+strings.Count(name, "=3D") {
+		return "", errors.New("invalid username encoding")
+	}
+	return result, nil
+}
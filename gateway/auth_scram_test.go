@@ -0,0 +1,273 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/topics"
+	"github.com/energostack/bisquitt/util"
+)
+
+// scramTestClient is a minimal SCRAM-SHA-256 client.
+type scramTestClient struct {
+	user            string
+	password        string
+	clientFirstBare string
+	authMessage     string
+	saltedPassword  []byte
+}
+
+func (c *scramTestClient) first() []byte {
+	c.clientFirstBare = "n=" + c.user + ",r=clientnonce"
+	return []byte("n,," + c.clientFirstBare)
+}
+
+func (c *scramTestClient) final(t *testing.T, serverFirst []byte) []byte {
+	attrs, err := scramParseAttributes(string(serverFirst))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(attrs["r"], "clientnonce") {
+		t.Fatalf("invalid server nonce: %q", attrs["r"])
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.saltedPassword, err = pbkdf2.Key(sha256.New, c.password, salt, iterations, sha256.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withoutProof := "c=biws,r=" + attrs["r"]
+	c.authMessage = c.clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	clientKey := scramHMAC(c.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := scramHMAC(storedKey[:], c.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))
+}
+
+func (c *scramTestClient) verifyServer(serverFinal []byte) bool {
+	serverKey := scramHMAC(c.saltedPassword, "Server Key")
+	expected := "v=" + base64.StdEncoding.EncodeToString(scramHMAC(serverKey, c.authMessage))
+	return hmac.Equal([]byte(expected), serverFinal)
+}
+
+func newTestScramAuthenticator(t *testing.T) *ScramAuthenticator {
+	credentials, err := NewScramCredentials("secret", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator, err := NewScramAuthenticator(map[string]*ScramCredentials{
+		"joe": credentials,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authenticator
+}
+
+func TestScramAuthenticator(t *testing.T) {
+	assert := assert.New(t)
+
+	authenticator := newTestScramAuthenticator(t)
+
+	// Valid password.
+	client := &scramTestClient{user: "joe", password: "secret"}
+	session := authenticator.Start("dev1")
+	serverFirst, result, err := session.Step(client.first())
+	assert.NoError(err)
+	assert.Nil(result)
+	serverFinal, result, err := session.Step(client.final(t, serverFirst))
+	if assert.NoError(err) && assert.NotNil(result) {
+		assert.Equal("joe", result.Username)
+		assert.Nil(result.Password)
+		assert.True(client.verifyServer(serverFinal))
+	}
+
+	// Invalid password.
+	client = &scramTestClient{user: "joe", password: "wrong"}
+	session = authenticator.Start("dev1")
+	serverFirst, _, err = session.Step(client.first())
+	assert.NoError(err)
+	_, result, err = session.Step(client.final(t, serverFirst))
+	assert.Equal(ErrAuthFailed, err)
+	assert.Nil(result)
+
+	// Unknown user gets a stable fake salt.
+	client = &scramTestClient{user: "eve", password: "secret"}
+	session = authenticator.Start("dev1")
+	serverFirst, _, err = session.Step(client.first())
+	assert.NoError(err)
+	serverFirst2, _, _ := authenticator.Start("dev1").Step(client.first())
+	salt := func(msg []byte) string {
+		attrs, _ := scramParseAttributes(string(msg))
+		return attrs["s"]
+	}
+	assert.Equal(salt(serverFirst), salt(serverFirst2))
+	_, _, err = session.Step(client.final(t, serverFirst))
+	assert.Equal(ErrAuthFailed, err)
+
+	// Channel binding is not supported.
+	_, _, err = authenticator.Start("dev1").Step([]byte("p=tls-unique,,n=joe,r=x"))
+	assert.Error(err)
+	// Malformed messages.
+	_, _, err = authenticator.Start("dev1").Step([]byte("n,,r=x"))
+	assert.Error(err)
+	_, _, err = authenticator.Start("dev1").Step([]byte("garbage"))
+	assert.Error(err)
+}
+
+func TestReadScramCredentialsFile(t *testing.T) {
+	assert := assert.New(t)
+
+	credentials, err := NewScramCredentials("secret", []byte("0123456789abcdef"), 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.StdEncoding.EncodeToString
+	file := filepath.Join(t.TempDir(), "scram.yaml")
+	data := "joe:\n" +
+		"  salt: " + b64(credentials.Salt) + "\n" +
+		"  iterations: 4096\n" +
+		"  stored_key: " + b64(credentials.StoredKey) + "\n" +
+		"  server_key: " + b64(credentials.ServerKey) + "\n" +
+		"ann:\n" +
+		"  password: pwd\n"
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	result, err := ReadScramCredentialsFile(file)
+	if assert.NoError(err) {
+		assert.Equal(credentials, result["joe"])
+		if assert.Contains(result, "ann") {
+			assert.Equal(DefaultScramIterations, result["ann"].Iterations)
+		}
+	}
+
+	if err := os.WriteFile(file, []byte("joe:\n  salt: AAAA\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadScramCredentialsFile(file)
+	assert.Error(err)
+}
+
+func TestAuthScramSuccess(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, true, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.handler.cfg.Authenticators = map[string]Authenticator{
+		snPkts1.AUTH_SCRAM_SHA_256: newTestScramAuthenticator(t),
+	}
+	client := &scramTestClient{user: "joe", password: "secret"}
+
+	// client --CONNECT--> GW
+	snConnect := snPkts1.NewConnect(1, []byte("test-client"), false, true)
+	stp.snSend(snConnect, false)
+
+	// client --AUTH(client-first-message)--> GW
+	stp.snSend(snPkts1.NewAuth(snPkts1.AUTH_SUCCESS, snPkts1.AUTH_SCRAM_SHA_256, client.first()), false)
+
+	// client <--AUTH(AUTH_CONTINUE, server-first-message)-- GW
+	snAuth := stp.snRecv().(*snPkts1.Auth)
+	assert.Equal(snPkts1.AUTH_CONTINUE, snAuth.Reason)
+	assert.Equal(snPkts1.AUTH_SCRAM_SHA_256, snAuth.Method)
+
+	// client --AUTH(AUTH_CONTINUE, client-final-message)--> GW
+	stp.snSend(snPkts1.NewAuth(snPkts1.AUTH_CONTINUE, snPkts1.AUTH_SCRAM_SHA_256, client.final(t, snAuth.Data)), false)
+
+	// client <--AUTH(AUTH_SUCCESS, server-final-message)-- GW
+	snAuth = stp.snRecv().(*snPkts1.Auth)
+	assert.Equal(snPkts1.AUTH_SUCCESS, snAuth.Reason)
+	assert.True(client.verifyServer(snAuth.Data))
+
+	// GW --CONNECT--> MQTT broker
+	mqttConnect := stp.mqttRecv().(*mqPkts.ConnectPacket)
+	assert.True(mqttConnect.UsernameFlag)
+	assert.Equal("joe", mqttConnect.Username)
+	// No gateway MQTT password is configured.
+	assert.False(mqttConnect.PasswordFlag)
+
+	// GW <--CONNACK-- MQTT broker
+	mqttConnack := mqPkts.NewControlPacket(mqPkts.Connack).(*mqPkts.ConnackPacket)
+	mqttConnack.ReturnCode = mqPkts.Accepted
+	stp.mqttSend(mqttConnack, false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snPkts1.Connack)
+	assert.Equal(snPkts1.RC_ACCEPTED, snConnack.ReturnCode)
+
+	assert.Equal(util.StateActive, stp.handler.state.Get())
+}
+
+func TestAuthScramFail(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, true, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.handler.cfg.Authenticators = map[string]Authenticator{
+		snPkts1.AUTH_SCRAM_SHA_256: newTestScramAuthenticator(t),
+	}
+	client := &scramTestClient{user: "joe", password: "wrong"}
+
+	// client --CONNECT--> GW
+	snConnect := snPkts1.NewConnect(1, []byte("test-client"), false, true)
+	stp.snSend(snConnect, false)
+
+	// client --AUTH(client-first-message)--> GW
+	stp.snSend(snPkts1.NewAuth(snPkts1.AUTH_SUCCESS, snPkts1.AUTH_SCRAM_SHA_256, client.first()), false)
+
+	// client <--AUTH(AUTH_CONTINUE, server-first-message)-- GW
+	snAuth := stp.snRecv().(*snPkts1.Auth)
+
+	// client --AUTH(AUTH_CONTINUE, client-final-message)--> GW
+	stp.snSend(snPkts1.NewAuth(snPkts1.AUTH_CONTINUE, snPkts1.AUTH_SCRAM_SHA_256, client.final(t, snAuth.Data)), false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snPkts1.Connack)
+	assert.Equal(snPkts1.RC_NOT_SUPPORTED, snConnack.ReturnCode)
+
+	stp.assertHandlerDone()
+}
+
+func TestAuthPlainDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, true, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.handler.cfg.Authenticators = map[string]Authenticator{
+		snPkts1.AUTH_SCRAM_SHA_256: newTestScramAuthenticator(t),
+	}
+
+	// client --CONNECT--> GW
+	snConnect := snPkts1.NewConnect(1, []byte("test-client"), false, true)
+	stp.snSend(snConnect, false)
+
+	// client --AUTH(PLAIN)--> GW
+	stp.snSend(snPkts1.NewAuthPlain("joe", []byte("secret")), false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snPkts1.Connack)
+	assert.Equal(snPkts1.RC_NOT_SUPPORTED, snConnack.ReturnCode)
+
+	stp.assertHandlerDone()
+}
@@ -0,0 +1,89 @@
+// Client authentication.
+//
+// If authentication is enabled, the client must send an AUTH packet after
+// CONNECT. The AUTH method selects an Authenticator which may exchange
+// several AUTH packets with the client (challenge/response):
+//
+//	client --CONNECT--> GW
+//	client --AUTH(method, data)--> GW
+//	client <--AUTH(AUTH_CONTINUE, method, challenge)-- GW
+//	client --AUTH(AUTH_CONTINUE, method, response)--> GW
+//	...
+//	client <--AUTH(AUTH_SUCCESS, method, data)-- GW   (only if data is not empty)
+//	(the CONNECT transaction continues with WILLTOPICREQ or the MQTT CONNECT)
+//
+// The AuthResult of a successful authentication provides the credentials
+// used for the MQTT broker connection.
+
+package gateway
+
+import (
+	"errors"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+)
+
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Authenticator implements an AUTH method. The implementations must be safe
+// for concurrent use.
+type Authenticator interface {
+	// Start starts a new authentication exchange of a client.
+	Start(clientID string) AuthSession
+}
+
+// AuthSession is a single authentication exchange.
+type AuthSession interface {
+	// Step processes data received in an AUTH packet. If result is nil,
+	// challenge is sent to the client in an AUTH packet with
+	// snPkts1.AUTH_CONTINUE reason and the exchange continues. Otherwise,
+	// the client is authenticated and the challenge, if any, is sent in an
+	// AUTH packet with snPkts1.AUTH_SUCCESS reason.
+	Step(data []byte) (challenge []byte, result *AuthResult, err error)
+}
+
+// AuthResult contains the credentials of an authenticated client for the
+// MQTT broker connection.
+type AuthResult struct {
+	// MQTT username. It is also the ACL username (%u).
+	Username string
+	// MQTT password. The gateway MQTT password (GatewayConfig.MqttPassword)
+	// is used if nil.
+	Password []byte
+}
+
+// PlainAuthenticator implements the SASL PLAIN method. The credentials are
+// not verified by the gateway, they are passed to the MQTT broker.
+type PlainAuthenticator struct{}
+
+// Authenticator.Start() implementation.
+func (PlainAuthenticator) Start(clientID string) AuthSession {
+	return plainAuthSession{}
+}
+
+type plainAuthSession struct{}
+
+func (plainAuthSession) Step(data []byte) ([]byte, *AuthResult, error) {
+	auth := &snPkts1.Auth{Data: data}
+	user, password, err := auth.DecodePlain()
+	if err != nil {
+		return nil, nil, err
+	}
+	return nil, &AuthResult{
+		Username: user,
+		Password: password,
+	}, nil
+}
+
+// authenticator returns the Authenticator of the AUTH method. Only PLAIN is
+// supported if no authenticators are configured.
+func (h *handler1) authenticator(method string) (Authenticator, bool) {
+	if h.cfg.Authenticators == nil {
+		if method == snPkts1.AUTH_PLAIN {
+			return PlainAuthenticator{}, true
+		}
+		return nil, false
+	}
+	authenticator, ok := h.cfg.Authenticators[method]
+	return authenticator, ok
+}
@@ -27,6 +27,18 @@ type transactionWithRegack interface {
 	Regack(snRegack *snPkts1.Regack) error
 }
 
+type transactionWithPuback interface {
+	Puback(snPuback *snPkts1.Puback) error
+}
+
+type transactionWithPubrec interface {
+	Pubrec(snPubrec *snPkts1.Pubrec) error
+}
+
+type transactionWithPubcomp interface {
+	Pubcomp(snPubcomp *snPkts1.Pubcomp) error
+}
+
 type brokerPublishTransaction interface {
 	transactions.StatefulTransaction
 	SetSNPublish(*snPkts1.Publish)
@@ -56,6 +68,7 @@ func (t *brokerPublishTransactionBase) regack(snRegack *snPkts1.Regack, newState
 	}
 	snRegister := t.Data.(*snPkts1.Register)
 	t.handler.registeredTopics.Store(snRegister.TopicID, snRegister.TopicName)
+	t.handler.saveSession()
 	return t.ProceedSN(newState, t.snPublish)
 }
 
@@ -86,6 +99,7 @@ func (t *brokerPublishTransactionBase) ProceedMQTT(newState transactionState, mq
 // Resend MQTT or MQTT-SN packet.
 func (t *brokerPublishTransactionBase) resend(pktx interface{}) error {
 	t.log.Debug("Resend.")
+	t.handler.stats.retry()
 	switch pkt := pktx.(type) {
 	case snPkts.Packet:
 		// Set DUP if applicable.
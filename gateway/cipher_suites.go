@@ -0,0 +1,88 @@
+// DTLS cipher suites.
+
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+)
+
+var ErrClientCertRequired = errors.New("client certificate required")
+
+// Cipher suites supported by the DTLS library in the default order of
+// preference.
+var supportedCipherSuites = []dtls.CipherSuiteID{
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	dtls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	dtls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	dtls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM,
+	dtls.TLS_ECDHE_ECDSA_WITH_AES_128_CCM_8,
+	dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+	dtls.TLS_PSK_WITH_AES_128_CCM,
+	dtls.TLS_PSK_WITH_AES_128_CCM_8,
+	dtls.TLS_PSK_WITH_AES_256_CCM_8,
+	dtls.TLS_PSK_WITH_AES_128_CBC_SHA256,
+	dtls.TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256,
+}
+
+// Default cipher suites of the DTLS library for certificates.
+var defaultCertificateCipherSuites = supportedCipherSuites[:6]
+
+// Default cipher suite for PSK.
+const defaultPSKCipherSuite = dtls.TLS_PSK_WITH_AES_128_GCM_SHA256
+
+// ParseCipherSuites parses cipher suite names, e.g.
+// "TLS_PSK_WITH_AES_128_CCM_8". The names are case insensitive and "-" may be
+// used instead of "_".
+func ParseCipherSuites(names []string) ([]dtls.CipherSuiteID, error) {
+	suites := make([]dtls.CipherSuiteID, 0, len(names))
+NAMES:
+	for _, name := range names {
+		normalized := strings.ReplaceAll(name, "-", "_")
+		for _, id := range supportedCipherSuites {
+			if strings.EqualFold(strings.ReplaceAll(dtls.CipherSuiteName(id), "-", "_"), normalized) {
+				suites = append(suites, id)
+				continue NAMES
+			}
+		}
+		return nil, fmt.Errorf("unsupported cipher suite: %q", name)
+	}
+	return suites, nil
+}
+
+// cipherSuites returns the cipher suites for the DTLS configuration. Nil
+// means the DTLS library defaults.
+func (cfg *GatewayConfig) cipherSuites() []dtls.CipherSuiteID {
+	switch {
+	case cfg.CipherSuites != nil:
+		return cfg.CipherSuites
+	case !cfg.UsePSK:
+		return nil
+	case cfg.UseCertificate:
+		suites := append([]dtls.CipherSuiteID{}, defaultCertificateCipherSuites...)
+		return append(suites, defaultPSKCipherSuite)
+	}
+	return []dtls.CipherSuiteID{defaultPSKCipherSuite}
+}
+
+// useCertificate reports whether certificate based DTLS handshakes are
+// accepted.
+func (cfg *GatewayConfig) useCertificate() bool {
+	return cfg.UseDTLS && (!cfg.UsePSK || cfg.UseCertificate)
+}
+
+// requireClientCertificate implements dtls.Config.VerifyConnection if client
+// certificates are required. The DTLS library would require them in PSK
+// handshakes too.
+func requireClientCertificate(state *dtls.State) error {
+	if len(state.PeerCertificates) == 0 && len(state.IdentityHint) == 0 {
+		return ErrClientCertRequired
+	}
+	return nil
+}
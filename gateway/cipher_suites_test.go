@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestParseCipherSuites(t *testing.T) {
+	assert := assert.New(t)
+
+	suites, err := ParseCipherSuites([]string{
+		"TLS_PSK_WITH_AES_128_CCM_8",
+		"tls_ecdhe_psk_with_aes_128_cbc_sha256",
+	})
+	assert.NoError(err)
+	assert.Equal([]dtls.CipherSuiteID{
+		dtls.TLS_PSK_WITH_AES_128_CCM_8,
+		dtls.TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256,
+	}, suites)
+
+	_, err = ParseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	assert.Error(err)
+
+	cfg := &GatewayConfig{UseDTLS: true}
+	assert.Nil(cfg.cipherSuites())
+	assert.True(cfg.useCertificate())
+	cfg.UsePSK = true
+	assert.Equal([]dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256}, cfg.cipherSuites())
+	assert.False(cfg.useCertificate())
+	cfg.UseCertificate = true
+	assert.Contains(cfg.cipherSuites(), dtls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+	assert.Contains(cfg.cipherSuites(), dtls.TLS_PSK_WITH_AES_128_GCM_SHA256)
+	assert.True(cfg.useCertificate())
+}
+
+func TestDTLSCertificateAndPSK(t *testing.T) {
+	assert := assert.New(t)
+
+	ca := newTestCert(t, "ca", 1, nil)
+	good := newTestCert(t, "good", 2, ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := &GatewayConfig{
+		UseDTLS:        true,
+		UsePSK:         true,
+		UseCertificate: true,
+		SelfSigned:     true,
+		PSKProvider:    &testPSKProvider{keys: map[string][]byte{"dev": {1, 2, 3}}},
+		ClientCert: ClientCertConfig{
+			Auth: dtls.RequireAndVerifyClientCert,
+			CAs:  pool,
+		},
+	}
+	cfg.CipherSuites = append(cfg.cipherSuites(),
+		dtls.TLS_PSK_WITH_AES_128_CCM_8,
+		dtls.TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256,
+	)
+	listener, err := newDTLSListener(ctx, cfg, &reloadable{clientCert: cfg.ClientCert}, "udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, newStats(), util.NewDebugLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go acceptDTLS(listener)
+
+	dial := func(clientCfg *dtls.Config) error {
+		clientCfg.InsecureSkipVerify = true
+		clientCfg.ExtendedMasterSecret = dtls.RequireExtendedMasterSecret
+		clientCfg.ConnectContextMaker = func() (context.Context, func()) {
+			return context.WithTimeout(ctx, 2*time.Second)
+		}
+		conn, err := dtls.Dial("udp", listener.Addr().(*net.UDPAddr), clientCfg)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	pskConfig := func(identity string, key []byte, suite dtls.CipherSuiteID) *dtls.Config {
+		return &dtls.Config{
+			PSK: func([]byte) ([]byte, error) {
+				return key, nil
+			},
+			PSKIdentityHint: []byte(identity),
+			CipherSuites:    []dtls.CipherSuiteID{suite},
+		}
+	}
+
+	assert.NoError(dial(&dtls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{good.cert.Raw},
+			PrivateKey:  good.key,
+		}},
+	}))
+	// Certificate handshake without a client certificate.
+	assert.Error(dial(&dtls.Config{}))
+
+	for _, suite := range []dtls.CipherSuiteID{
+		dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+		dtls.TLS_PSK_WITH_AES_128_CCM_8,
+		dtls.TLS_ECDHE_PSK_WITH_AES_128_CBC_SHA256,
+	} {
+		assert.NoError(dial(pskConfig("dev", []byte{1, 2, 3}, suite)), dtls.CipherSuiteName(suite))
+	}
+	assert.Error(dial(pskConfig("dev", []byte{1, 2, 4}, dtls.TLS_PSK_WITH_AES_128_GCM_SHA256)))
+	assert.Error(dial(pskConfig("unknown", []byte{1, 2, 3}, dtls.TLS_PSK_WITH_AES_128_GCM_SHA256)))
+	// Not enabled on the server.
+	assert.Error(dial(pskConfig("dev", []byte{1, 2, 3}, dtls.TLS_PSK_WITH_AES_128_CCM)))
+}
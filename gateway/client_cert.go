@@ -0,0 +1,197 @@
+// Client certificate verification (mutual TLS) in the certificate DTLS mode.
+
+package gateway
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+)
+
+var ErrCertRevoked = errors.New("client certificate revoked")
+
+// ClientCertConfig configures client certificate verification.
+type ClientCertConfig struct {
+	// dtls.NoClientCert (default), dtls.VerifyClientCertIfGiven or
+	// dtls.RequireAndVerifyClientCert.
+	Auth dtls.ClientAuthType
+	// CAs used to verify the client certificates.
+	CAs *x509.CertPool
+	// Certificates listed in CRLs are refused. Only CRLs signed by the
+	// certificate issuer are taken into account.
+	CRLs []*x509.RevocationList
+}
+
+// ParseClientAuth parses a client certificate verification mode: "none",
+// "optional" or "required".
+func ParseClientAuth(s string) (dtls.ClientAuthType, error) {
+	switch s {
+	case "none":
+		return dtls.NoClientCert, nil
+	case "optional":
+		return dtls.VerifyClientCertIfGiven, nil
+	case "required":
+		return dtls.RequireAndVerifyClientCert, nil
+	}
+	return dtls.NoClientCert, fmt.Errorf("unknown client auth mode: %q", s)
+}
+
+// LoadCertPool reads PEM encoded CA certificates from the files and from all
+// "*.pem" and "*.crt" files in the directories.
+func LoadCertPool(files, dirs []string) (*x509.CertPool, error) {
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			if entry.IsDir() || ext != ".pem" && ext != ".crt" {
+				continue
+			}
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	pool := x509.NewCertPool()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("%s: no certificates found", file)
+		}
+	}
+	return pool, nil
+}
+
+// ReadCRLFile reads PEM ("X509 CRL" blocks) or DER encoded certificate
+// revocation lists.
+func ReadCRLFile(file string) ([]*x509.RevocationList, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		crl, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		return []*x509.RevocationList{crl}, nil
+	}
+	var crls []*x509.RevocationList
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) == 0 {
+		return nil, fmt.Errorf("%s: no CRLs found", file)
+	}
+	return crls, nil
+}
+
+// verifyPeerCertificate implements dtls.Config.VerifyPeerCertificate. The
+// DTLS library does not verify the client certificates so that the CAs can be
+// reloaded; the certificate is refused if no chain to the CAs free of revoked
+// certificates is found.
+func (c *ClientCertConfig) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		// No client certificate given (optional mode).
+		return nil
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	chains, err := c.verify(certs)
+	if err != nil {
+		return err
+	}
+	for _, chain := range chains {
+		if !c.revoked(chain) {
+			return nil
+		}
+	}
+	return ErrCertRevoked
+}
+
+// revoked reports whether any certificate of the chain is revoked.
+func (c *ClientCertConfig) revoked(chain []*x509.Certificate) bool {
+	// The last certificate is a trusted root.
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, crl := range c.CRLs {
+			if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) || crl.CheckSignatureFrom(issuer) != nil {
+				continue
+			}
+			for _, entry := range crl.RevokedCertificateEntries {
+				if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// verifyClientChain returns the verified chain of the client certificate,
+// leaf first, or nil if client certificates are not verified.
+func (c *ClientCertConfig) verifyClientChain(certs []*x509.Certificate) []*x509.Certificate {
+	if c.CAs == nil || len(certs) == 0 {
+		return nil
+	}
+	chains, err := c.verify(certs)
+	if err != nil {
+		return nil
+	}
+	for _, chain := range chains {
+		if !c.revoked(chain) {
+			return chain
+		}
+	}
+	return nil
+}
+
+// verify returns the chains of the client certificate (certs[0]) to the CAs.
+func (c *ClientCertConfig) verify(certs []*x509.Certificate) ([][]*x509.Certificate, error) {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	return certs[0].Verify(x509.VerifyOptions{
+		Roots:         c.CAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// describeCertChain formats the chain for logging.
+func describeCertChain(chain []*x509.Certificate) string {
+	parts := make([]string, 0, len(chain))
+	for _, cert := range chain {
+		parts = append(parts, fmt.Sprintf("%q (serial %s)", cert.Subject.String(), cert.SerialNumber))
+	}
+	return strings.Join(parts, " <- ")
+}
@@ -0,0 +1,237 @@
+package gateway
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/transport/v2/udp"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/energostack/bisquitt/util"
+)
+
+// acceptDTLS accepts and closes the connections until the listener is closed.
+func acceptDTLS(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, udp.ErrClosedListener) {
+			return
+		}
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, cn string, serial int64, issuer *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn + ".example.com"},
+	}
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		template.ExtKeyUsage = nil
+	} else {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func newTestCRL(t *testing.T, issuer *testCert, serials ...int64) *x509.RevocationList {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, issuer.cert, issuer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crl
+}
+
+func TestClientCertRevocation(t *testing.T) {
+	assert := assert.New(t)
+
+	ca := newTestCert(t, "ca", 1, nil)
+	otherCA := newTestCert(t, "other-ca", 1, nil)
+	good := newTestCert(t, "good", 2, ca)
+	revoked := newTestCert(t, "revoked", 3, ca)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	cfg := &ClientCertConfig{
+		Auth: dtls.RequireAndVerifyClientCert,
+		CAs:  pool,
+		CRLs: []*x509.RevocationList{
+			newTestCRL(t, ca, 3),
+			// Not signed by the issuer => ignored.
+			newTestCRL(t, otherCA, 2),
+		},
+	}
+
+	chain := cfg.verifyClientChain([]*x509.Certificate{good.cert})
+	if assert.Len(chain, 2) {
+		assert.Equal(good.cert, chain[0])
+		assert.Equal(ca.cert, chain[1])
+	}
+	assert.Nil(cfg.verifyClientChain([]*x509.Certificate{revoked.cert}))
+	assert.Nil(cfg.verifyClientChain([]*x509.Certificate{newTestCert(t, "x", 4, otherCA).cert}))
+
+	assert.NoError(cfg.verifyPeerCertificate([][]byte{good.cert.Raw}, nil))
+	assert.Equal(ErrCertRevoked, cfg.verifyPeerCertificate([][]byte{revoked.cert.Raw}, nil))
+	assert.Error(cfg.verifyPeerCertificate([][]byte{newTestCert(t, "x", 4, otherCA).cert.Raw}, nil))
+	assert.NoError(cfg.verifyPeerCertificate(nil, nil))
+}
+
+func TestLoadClientCertFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", 1, nil)
+	ca2 := newTestCert(t, "ca2", 1, nil)
+	writePEM := func(name, blockType string, der []byte) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	caFile := writePEM("ca.pem", "CERTIFICATE", ca.cert.Raw)
+	writePEM("ca2.crt", "CERTIFICATE", ca2.cert.Raw)
+	crlFile := writePEM("crl.txt", "X509 CRL", newTestCRL(t, ca, 5).Raw)
+
+	pool, err := LoadCertPool([]string{caFile}, nil)
+	if assert.NoError(err) {
+		_, err := newTestCert(t, "dev", 2, ca).cert.Verify(x509.VerifyOptions{
+			Roots:     pool,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		assert.NoError(err)
+	}
+	pool, err = LoadCertPool(nil, []string{dir})
+	if assert.NoError(err) {
+		_, err := newTestCert(t, "dev", 2, ca2).cert.Verify(x509.VerifyOptions{
+			Roots:     pool,
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		assert.NoError(err)
+	}
+	_, err = LoadCertPool([]string{crlFile}, nil)
+	assert.Error(err)
+
+	crls, err := ReadCRLFile(crlFile)
+	if assert.NoError(err) && assert.Len(crls, 1) {
+		assert.Equal(int64(5), crls[0].RevokedCertificateEntries[0].SerialNumber.Int64())
+	}
+	_, err = ReadCRLFile(caFile)
+	assert.Error(err)
+
+	auth, err := ParseClientAuth("optional")
+	assert.NoError(err)
+	assert.Equal(dtls.VerifyClientCertIfGiven, auth)
+	_, err = ParseClientAuth("maybe")
+	assert.Error(err)
+}
+
+func TestDTLSClientCert(t *testing.T) {
+	assert := assert.New(t)
+
+	ca := newTestCert(t, "ca", 1, nil)
+	good := newTestCert(t, "good", 2, ca)
+	revoked := newTestCert(t, "revoked", 3, ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := &GatewayConfig{
+		UseDTLS:    true,
+		SelfSigned: true,
+		ClientCert: ClientCertConfig{
+			Auth: dtls.RequireAndVerifyClientCert,
+			CAs:  pool,
+			CRLs: []*x509.RevocationList{newTestCRL(t, ca, 3)},
+		},
+	}
+	listener, err := newDTLSListener(ctx, cfg, &reloadable{clientCert: cfg.ClientCert}, "udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, newStats(), util.NewDebugLogger("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go acceptDTLS(listener)
+
+	dial := func(cert *testCert) error {
+		clientCfg := &dtls.Config{
+			InsecureSkipVerify:   true,
+			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+			ConnectContextMaker: func() (context.Context, func()) {
+				return context.WithTimeout(ctx, 2*time.Second)
+			},
+		}
+		if cert != nil {
+			clientCfg.Certificates = []tls.Certificate{{
+				Certificate: [][]byte{cert.cert.Raw},
+				PrivateKey:  cert.key,
+			}}
+		}
+		conn, err := dtls.Dial("udp", listener.Addr().(*net.UDPAddr), clientCfg)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	assert.NoError(dial(good))
+	assert.Error(dial(revoked))
+	assert.Error(dial(nil))
+}
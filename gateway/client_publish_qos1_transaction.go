@@ -28,6 +28,11 @@ import (
 	"github.com/energostack/bisquitt/util"
 )
 
+// Implemented by the client PUBLISH transactions.
+type transactionWithPubFailure interface {
+	PubFailure(failure *mqtt5PubFailure) error
+}
+
 type clientPublishQOS1Transaction struct {
 	*transactions.TimedTransaction
 	handler *handler1
@@ -61,3 +66,17 @@ func (t *clientPublishQOS1Transaction) Puback(mqPuback *mqPkts.PubackPacket) err
 	t.Success()
 	return t.handler.snSend(snPuback)
 }
+
+func (t *clientPublishQOS1Transaction) PubFailure(failure *mqtt5PubFailure) error {
+	return rejectClientPublish(t.TimedTransaction, t.handler, t.topicID, failure)
+}
+
+// rejectClientPublish ends the client's PUBLISH transaction rejected by the
+// MQTT broker and sends PUBACK with a rejection return code to the client.
+// See MQTT-SN specification v. 1.2, chapter 6.7.
+func rejectClientPublish(t *transactions.TimedTransaction, h *handler1, topicID uint16, failure *mqtt5PubFailure) error {
+	snPuback := snPkts1.NewPuback(topicID, failure.snReturnCode())
+	snPuback.SetMessageID(failure.MessageID)
+	t.Success()
+	return h.snSend(snPuback)
+}
@@ -0,0 +1,53 @@
+// The gateway forwards the QoS 2 flow between the client and the MQTT broker.
+// The transaction only lasts until the broker's PUBREC so that a PUBLISH
+// rejected by an MQTT 5 broker can be answered by PUBACK with a rejection
+// return code (with the TopicID, see clientPublishQOS1Transaction). PUBREL
+// and PUBCOMP are forwarded without a transaction.
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/transactions"
+	"github.com/energostack/bisquitt/util"
+)
+
+type clientPublishQOS2Transaction struct {
+	*transactions.TimedTransaction
+	handler *handler1
+	log     util.Logger
+	topicID uint16
+}
+
+func newClientPublishQOS2Transaction(ctx context.Context, h *handler1, msgID uint16, topicID uint16) *clientPublishQOS2Transaction {
+	tLog := h.log.WithTag(fmt.Sprintf("PUBLISH2c(%d)", msgID))
+	tLog.Debug("Created.")
+	return &clientPublishQOS2Transaction{
+		TimedTransaction: transactions.NewTimedTransaction(
+			ctx, h.cfg.RetryDelay,
+			func() {
+				h.transactions.Delete(msgID)
+				tLog.Debug("Deleted.")
+			},
+		),
+		handler: h,
+		log:     tLog,
+		topicID: topicID,
+	}
+}
+
+func (t *clientPublishQOS2Transaction) Pubrec(mqPubrec *mqPkts.PubrecPacket) error {
+	snPubrec := snPkts1.NewPubrec()
+	snPubrec.SetMessageID(mqPubrec.MessageID)
+	t.Success()
+	return t.handler.snSend(snPubrec)
+}
+
+func (t *clientPublishQOS2Transaction) PubFailure(failure *mqtt5PubFailure) error {
+	return rejectClientPublish(t.TimedTransaction, t.handler, t.topicID, failure)
+}
@@ -0,0 +1,128 @@
+// Lost clients detection.
+//
+// See MQTT-SN specification v. 1.2, chapter 6.14 Support of sleeping clients:
+// a client is lost if the gateway does not receive any packet from it within
+// its keepalive period or, in case of a sleeping client, within its sleep
+// duration. Both periods are extended by a grace factor (like the 1.5 factor
+// an MQTT broker applies to the keepalive) to tolerate network delays.
+//
+// The handler of a lost client quits without sending DISCONNECT to the MQTT
+// broker so that the broker publishes the client's will.
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultClientTimeoutFactor is used if the timeout factor is zero.
+const DefaultClientTimeoutFactor = 1.5
+
+var ErrClientLost = errors.New("client lost")
+
+type clientSupervisor struct {
+	factor float64
+	mutex  sync.Mutex
+	// Time of the last packet received from the client.
+	lastActivity time.Time
+	// Zero before the client connects => the client is not supervised.
+	keepAlive time.Duration
+	// Non-zero if the client is asleep or awake.
+	sleep time.Duration
+	// Signals a supervised period change.
+	changed chan struct{}
+}
+
+func newClientSupervisor(factor float64) *clientSupervisor {
+	if factor == 0 {
+		factor = DefaultClientTimeoutFactor
+	}
+	return &clientSupervisor{
+		factor:       factor,
+		lastActivity: time.Now(),
+		changed:      make(chan struct{}, 1),
+	}
+}
+
+// activity must be called whenever a packet is received from the client.
+func (s *clientSupervisor) activity() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastActivity = time.Now()
+}
+
+// connect starts supervision of the client keepalive period.
+func (s *clientSupervisor) connect(keepAlive time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keepAlive = keepAlive
+	s.sleep = 0
+	s.notify()
+}
+
+// active switches from the sleep duration back to the keepalive period.
+func (s *clientSupervisor) active() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sleep = 0
+	s.notify()
+}
+
+// asleep starts supervision of the client sleep duration.
+func (s *clientSupervisor) asleep(duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sleep = duration
+	s.notify()
+}
+
+func (s *clientSupervisor) notify() {
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// deadline returns the time after which the client is considered lost and
+// the supervised period. The deadline is zero if the client is not
+// supervised.
+func (s *clientSupervisor) deadline() (time.Time, time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.keepAlive == 0 {
+		return time.Time{}, 0
+	}
+	period := s.keepAlive
+	if s.sleep > 0 {
+		period = s.sleep
+	}
+	return s.lastActivity.Add(time.Duration(float64(period) * s.factor)), period
+}
+
+// superviseClient returns ErrClientLost when the client deadline passes.
+func (h *handler1) superviseClient(ctx context.Context) error {
+	timer := time.NewTimer(0)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		deadline, period := h.supervisor.deadline()
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				h.stats.clientLost()
+				h.log.Info("Client lost: no packet received within %v (state %q)", period, h.state.Get())
+				return ErrClientLost
+			}
+			timer.Reset(wait)
+		}
+		select {
+		case <-timer.C:
+		case <-h.supervisor.changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
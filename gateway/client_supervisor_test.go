@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"testing"
+	"time"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/topics"
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestClientSupervisorDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newClientSupervisor(0)
+	deadline, _ := s.deadline()
+	assert.True(deadline.IsZero())
+
+	s.connect(10 * time.Second)
+	deadline, period := s.deadline()
+	assert.Equal(10*time.Second, period)
+	assert.Equal(s.lastActivity.Add(15*time.Second), deadline)
+
+	s.asleep(time.Minute)
+	deadline, period = s.deadline()
+	assert.Equal(time.Minute, period)
+	assert.Equal(s.lastActivity.Add(90*time.Second), deadline)
+
+	s.active()
+	_, period = s.deadline()
+	assert.Equal(10*time.Second, period)
+}
+
+func (stp *testSetup) setClientTimeoutFactor(factor float64) {
+	stp.handler.supervisor.mutex.Lock()
+	defer stp.handler.supervisor.mutex.Unlock()
+	stp.handler.supervisor.factor = factor
+}
+
+func TestLostClient(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.setClientTimeoutFactor(1)
+
+	// Keepalive 1s.
+	stp.connect()
+
+	// The client is silent => the gateway disconnects it and closes the
+	// MQTT connection without DISCONNECT.
+	time.Sleep(time.Second)
+	snDisconnect := stp.snRecv().(*snPkts1.Disconnect)
+	assert.Equal(uint16(0), snDisconnect.Duration)
+	stp.assertHandlerDone()
+	assert.Equal(uint64(1), stp.handler.stats.clientsLost.Load())
+}
+
+func TestLostSleepingClient(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.setClientTimeoutFactor(1.2)
+
+	// Keepalive 1s.
+	stp.connect()
+
+	// client --DISCONNECT(2s)--> GW
+	stp.snSend(snPkts1.NewDisconnect(2), false)
+	// client <--DISCONNECT-- GW
+	snDisconnect := stp.snRecv().(*snPkts1.Disconnect)
+	assert.Equal(uint16(0), snDisconnect.Duration)
+	assert.Equal(util.StateAsleep, stp.handler.state.Get())
+
+	// The sleep duration is supervised instead of the keepalive and the
+	// gateway keeps the MQTT session alive.
+	_, ok := stp.mqttRecv().(*mqPkts.PingreqPacket)
+	assert.True(ok)
+	_, ok = stp.mqttRecv().(*mqPkts.PingreqPacket)
+	assert.True(ok)
+	select {
+	case <-stp.handlerDone:
+		t.Fatal("sleeping client considered lost prematurely")
+	default:
+	}
+
+	// The client does not wake up.
+	stp.assertHandlerDone()
+	assert.Equal(uint64(1), stp.handler.stats.clientsLost.Load())
+}
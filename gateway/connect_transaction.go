@@ -22,12 +22,18 @@ import (
 
 var Cancelled = errors.New("transaction cancelled")
 
+type transactionWithConnack interface {
+	Connack(mqConnack *mqPkts.ConnackPacket) error
+}
+
 type connectTransaction struct {
 	*transactions.TimedTransaction
 	handler       *handler1
 	log           util.Logger
 	authEnabled   bool
 	mqConnect     *mqPkts.ConnectPacket
+	authMethod    string
+	authSession   AuthSession
 	authenticated bool
 }
 
@@ -81,25 +87,73 @@ func (t *connectTransaction) Start(ctx context.Context) error {
 }
 
 func (t *connectTransaction) Auth(snPkt *snPkts1.Auth) error {
-	// Extract username and password from PLAIN data.
-	if snPkt.Method == snPkts1.AUTH_PLAIN {
-		user, password, err := snPkt.DecodePlain()
-		if err != nil {
+	if t.authenticated {
+		t.log.Debug("Ignoring AUTH, the client is already authenticated: %v", snPkt)
+		return nil
+	}
+
+	if t.authSession == nil {
+		authenticator, ok := t.handler.authenticator(snPkt.Method)
+		if !ok {
+			if err := t.SendConnack(snPkts1.RC_NOT_SUPPORTED); err != nil {
+				return err
+			}
+			err := fmt.Errorf("unknown auth method: %#v", snPkt.Method)
 			t.Fail(err)
 			return err
 		}
-		t.mqConnect.UsernameFlag = true
-		t.mqConnect.Username = user
-		t.mqConnect.PasswordFlag = true
-		t.mqConnect.Password = password
-	} else {
+		t.authMethod = snPkt.Method
+		t.authSession = authenticator.Start(t.mqConnect.ClientIdentifier)
+	} else if snPkt.Method != t.authMethod {
+		if err := t.SendConnack(snPkts1.RC_NOT_SUPPORTED); err != nil {
+			return err
+		}
+		err := fmt.Errorf("auth method changed from %#v to %#v", t.authMethod, snPkt.Method)
+		t.Fail(err)
+		return err
+	}
+
+	challenge, result, err := t.authSession.Step(snPkt.Data)
+	if err != nil {
+		// MQTT-SN specification v. 1.2 does not define any "not authorized"
+		// return code.
+		if err := t.SendConnack(snPkts1.RC_NOT_SUPPORTED); err != nil {
+			return err
+		}
+		err = fmt.Errorf("%s authentication failed: %s", t.authMethod, err)
+		t.Fail(err)
+		return err
+	}
+	if result == nil {
+		// Challenge/response continues.
+		return t.handler.snSend(snPkts1.NewAuth(snPkts1.AUTH_CONTINUE, t.authMethod, challenge))
+	}
+	if t.handler.cfg.IdentityBinding.MqttUsername && result.Username != t.handler.username {
 		if err := t.SendConnack(snPkts1.RC_NOT_SUPPORTED); err != nil {
 			return err
 		}
-		err := fmt.Errorf("unknown auth method: %#v", snPkt.Method)
+		err := fmt.Errorf("AUTH username %q does not match the DTLS identity %q", result.Username, t.handler.username)
 		t.Fail(err)
 		return err
 	}
+	if len(challenge) > 0 {
+		// Final data for the client, e.g. the SCRAM server signature.
+		if err := t.handler.snSend(snPkts1.NewAuth(snPkts1.AUTH_SUCCESS, t.authMethod, challenge)); err != nil {
+			return err
+		}
+	}
+	t.authenticated = true
+	t.log.Debug("Client authenticated as %q using %s.", result.Username, t.authMethod)
+
+	t.handler.infoMutex.Lock()
+	t.handler.username = result.Username
+	t.handler.infoMutex.Unlock()
+	t.mqConnect.UsernameFlag = true
+	t.mqConnect.Username = result.Username
+	if result.Password != nil {
+		t.mqConnect.PasswordFlag = true
+		t.mqConnect.Password = result.Password
+	}
 
 	if t.mqConnect.WillFlag {
 		// Continue with WILLTOPICREQ.
@@ -111,6 +165,14 @@ func (t *connectTransaction) Auth(snPkt *snPkts1.Auth) error {
 }
 
 func (t *connectTransaction) WillTopic(snWillTopic *snPkts1.WillTopic) error {
+	if !t.handler.authorize(ACLPublish, snWillTopic.WillTopic) {
+		if err := t.SendConnack(snPkts1.RC_NOT_SUPPORTED); err != nil {
+			return err
+		}
+		err := fmt.Errorf("will topic %q denied", snWillTopic.WillTopic)
+		t.Fail(err)
+		return err
+	}
 	t.mqConnect.WillQos = snWillTopic.QOS
 	t.mqConnect.WillRetain = snWillTopic.Retain
 	t.mqConnect.WillTopic = snWillTopic.WillTopic
@@ -144,6 +206,10 @@ func (t *connectTransaction) Connack(mqConnack *mqPkts.ConnackPacket) error {
 		return err
 	}
 
+	// The stored session is touched only after the broker accepts the
+	// (authenticated) CONNECT.
+	t.handler.startSession(t.mqConnect.CleanSession, mqConnack.SessionPresent)
+
 	// Must be set before snSend to avoid race condition in tests.
 	t.handler.setState(util.StateActive)
 	if err := t.SendConnack(snPkts1.RC_ACCEPTED); err != nil {
@@ -151,6 +217,8 @@ func (t *connectTransaction) Connack(mqConnack *mqPkts.ConnackPacket) error {
 		return err
 	}
 	t.Success()
+	// Downlinks queued while the client was asleep.
+	t.handler.startDownlinks()
 	return nil
 }
 
@@ -0,0 +1,129 @@
+// Gateway advertisement and discovery.
+// See MQTT-SN specification v. 1.2, chapter 6.1 Gateway Advertisement and Discovery.
+//
+// The discovery server uses its own UDP socket bound to the port of the
+// configured advertise address. If the address is a multicast one, the socket
+// joins the multicast group, otherwise it listens on all interfaces (which
+// covers the broadcast case).
+//
+// The specification says GWINFO should be broadcast, too. We reply to SEARCHGW
+// directly to the searching client instead because a client would not
+// be able to receive the GWINFO sent to a multicast group it has not joined.
+// Because the gateway does not forward packets, the SEARCHGW Radius field is
+// ignored.
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	snPkts "github.com/energostack/bisquitt/packets"
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+type discoveryServer struct {
+	conn      *net.UDPConn
+	address   *net.UDPAddr
+	gatewayID uint8
+	interval  time.Duration
+	log       util.Logger
+}
+
+func newDiscoveryServer(cfg *GatewayConfig, log util.Logger) (*discoveryServer, error) {
+	address := cfg.AdvertiseAddress
+	var conn *net.UDPConn
+	var err error
+	if address.IP.IsMulticast() {
+		conn, err = net.ListenMulticastUDP("udp", nil, address)
+	} else {
+		conn, err = net.ListenUDP("udp", &net.UDPAddr{Port: address.Port})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &discoveryServer{
+		conn:      conn,
+		address:   address,
+		gatewayID: cfg.GatewayID,
+		interval:  cfg.AdvertiseInterval,
+		log:       log,
+	}, nil
+}
+
+// run serves SEARCHGW requests and sends ADVERTISE packets every interval
+// (if the interval is not zero) until ctx is cancelled.
+func (d *discoveryServer) run(ctx context.Context) error {
+	d.log.Info("Gateway discovery on %s (GatewayID=%d)", d.address, d.gatewayID)
+
+	go func() {
+		<-ctx.Done()
+		d.conn.Close()
+	}()
+
+	if d.interval > 0 {
+		go d.advertiseLoop(ctx)
+	}
+
+	buf := make([]byte, snPkts1.MaxPacketLen)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		pkt, err := snPkts1.ReadPacket(bytes.NewReader(buf[:n]))
+		if err != nil {
+			d.log.Debug("Invalid packet from %s: %s", addr, err)
+			continue
+		}
+		switch snPkt := pkt.(type) {
+		case *snPkts1.SearchGw:
+			d.log.Debug("%s => %v", addr, snPkt)
+			d.send(snPkts1.NewGwInfo(d.gatewayID, nil), addr)
+		default:
+			// ADVERTISE and GWINFO sent by other gateways (or our own
+			// looped-back multicast) are of no interest to us.
+		}
+	}
+}
+
+func (d *discoveryServer) advertiseLoop(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.send(snPkts1.NewAdvertise(d.gatewayID, d.advertiseDuration()), d.address)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Duration field of the ADVERTISE packet: time interval until the next
+// ADVERTISE is broadcast by this gateway [seconds].
+func (d *discoveryServer) advertiseDuration() uint16 {
+	seconds := d.interval / time.Second
+	if seconds > 0xFFFF {
+		return 0xFFFF
+	}
+	return uint16(seconds)
+}
+
+func (d *discoveryServer) send(pkt snPkts.Packet, addr *net.UDPAddr) {
+	d.log.Debug("%s <- %v", addr, pkt)
+	buf, err := pkt.Pack()
+	if err != nil {
+		d.log.Error("Cannot pack %v: %s", pkt, err)
+		return
+	}
+	if _, err := d.conn.WriteToUDP(buf, addr); err != nil {
+		d.log.Error("Cannot send %v to %s: %s", pkt, addr, err)
+	}
+}
@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestDiscoverySearchGw(t *testing.T) {
+	assert := assert.New(t)
+
+	port := freeUDPPort(t)
+	cfg := &GatewayConfig{
+		GatewayID:        7,
+		AdvertiseAddress: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+	}
+	discovery, err := newDiscoveryServer(cfg, util.NewDebugLogger("discovery"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go discovery.run(ctx)
+
+	conn, err := net.DialUDP("udp", nil, cfg.AdvertiseAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf, err := snPkts1.NewSearchGw(1).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	buf = make([]byte, maxTestPktLength)
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := snPkts1.ReadPacket(bytes.NewReader(buf[:n]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gwInfo, ok := pkt.(*snPkts1.GwInfo)
+	if !assert.True(ok, "GWINFO expected, got: %v", pkt) {
+		return
+	}
+	assert.Equal(uint8(7), gwInfo.GatewayID)
+}
+
+func TestDiscoveryAdvertiseDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	d := &discoveryServer{interval: 15 * time.Minute}
+	assert.Equal(uint16(900), d.advertiseDuration())
+
+	d.interval = 100 * time.Hour
+	assert.Equal(uint16(0xFFFF), d.advertiseDuration())
+}
+
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
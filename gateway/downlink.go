@@ -0,0 +1,169 @@
+// Downlink messages.
+//
+// A downlink message is published by the gateway itself to one client,
+// regardless of the client subscriptions (e.g. a command for a sleeping
+// device). It is delivered using the same REGISTER/PUBLISH transactions as
+// the messages from the MQTT broker. If the client is asleep, the message is
+// queued until the client wakes up.
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+var ErrClientNotFound = errors.New("client not found")
+var ErrClientNotConnected = errors.New("client not connected")
+var ErrClientGone = errors.New("client disconnected before delivery")
+
+// DownlinkMessage is a message for one client.
+type DownlinkMessage struct {
+	Topic   string
+	Payload []byte
+	// 0, 1 or 2.
+	QoS    uint8
+	Retain bool
+}
+
+// Validate checks the message can be published.
+func (msg *DownlinkMessage) Validate() error {
+	if msg.Topic == "" || hasWildcard(msg.Topic) {
+		return fmt.Errorf("invalid topic: %q", msg.Topic)
+	}
+	if msg.QoS > 2 {
+		return fmt.Errorf("invalid QoS: %d", msg.QoS)
+	}
+	return nil
+}
+
+// Publish delivers the message to the client with the handler ID or the
+// client ID. Publish returns when the delivery completes, i.e. the PUBLISH
+// is sent (QoS 0) or acknowledged by the client (QoS 1 and 2). If ctx is done
+// first, the delivery continues in the background and ctx.Err() is returned.
+func (gw *Gateway) Publish(ctx context.Context, id string, msg *DownlinkMessage) error {
+	if err := msg.Validate(); err != nil {
+		return err
+	}
+	running, ok := gw.findHandler(id)
+	if !ok {
+		return ErrClientNotFound
+	}
+	d := &downlink{
+		msg:  msg,
+		done: make(chan struct{}),
+	}
+	if err := running.handler.queueDownlink(d); err != nil {
+		return err
+	}
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// downlink is a DownlinkMessage being delivered.
+type downlink struct {
+	msg *DownlinkMessage
+	// Closed when the delivery completes, err is the outcome.
+	done chan struct{}
+	err  error
+}
+
+func (d *downlink) finish(err error) {
+	d.err = err
+	close(d.done)
+}
+
+// queueDownlink starts the delivery if the client is active or awake.
+// If the client is asleep, the downlink is queued until the client wakes up.
+func (h *handler1) queueDownlink(d *downlink) error {
+	h.downlinkMutex.Lock()
+	defer h.downlinkMutex.Unlock()
+	if h.downlinksClosed {
+		return ErrClientNotConnected
+	}
+	switch h.state.Get() {
+	case util.StateActive, util.StateAwake:
+		h.startDownlink(d)
+	case util.StateAsleep:
+		h.log.Debug("Downlink to %q queued until the client wakes up", d.msg.Topic)
+		h.downlinks = append(h.downlinks, d)
+	default:
+		return ErrClientNotConnected
+	}
+	return nil
+}
+
+// startDownlinks starts the delivery of the queued downlinks. It is called
+// when the client becomes active or wakes up.
+func (h *handler1) startDownlinks() {
+	h.downlinkMutex.Lock()
+	defer h.downlinkMutex.Unlock()
+	for _, d := range h.downlinks {
+		h.startDownlink(d)
+	}
+	h.downlinks = nil
+}
+
+// closeDownlinks fails the queued downlinks and refuses the new ones. It is
+// called when the handler quits.
+func (h *handler1) closeDownlinks() {
+	h.downlinkMutex.Lock()
+	defer h.downlinkMutex.Unlock()
+	for _, d := range h.downlinks {
+		d.finish(ErrClientGone)
+	}
+	h.downlinks = nil
+	h.downlinksClosed = true
+}
+
+// startDownlink starts the downlink transaction. The caller must hold
+// downlinkMutex.
+func (h *handler1) startDownlink(d *downlink) {
+	msg := d.msg
+	topicID, topicIDType, needsRegister := h.publishTopicID(msg.Topic)
+	snPublish := snPkts1.NewPublish(topicID, msg.Payload, false, msg.QoS, msg.Retain, topicIDType)
+
+	// QoS 0 publish without topic registration does not need a transaction.
+	if msg.QoS == 0 && !needsRegister {
+		d.finish(h.snSend(snPublish))
+		return
+	}
+
+	// The MsgID is chosen the same way as for the QoS 0 broker PUBLISH
+	// with topic registration, see handleBrokerPublish.
+	h.msgIDMutex.Lock()
+	msgID, ok := h.freeMsgID()
+	if !ok {
+		h.msgIDMutex.Unlock()
+		d.finish(errors.New("cannot find available MsgID"))
+		return
+	}
+	if msg.QoS > 0 {
+		snPublish.SetMessageID(msgID)
+	}
+
+	ctx := h.mqttCtx
+	transaction := newDownlinkTransaction(ctx, h, msgID, msg.QoS)
+	h.transactions.Store(msgID, transaction)
+	h.msgIDMutex.Unlock()
+	if err := h.startPublish(ctx, transaction, msgID, msg.Topic, snPublish, needsRegister); err != nil {
+		d.finish(err)
+		return
+	}
+	go func() {
+		select {
+		case <-transaction.Done():
+			d.finish(transaction.Err())
+		case <-ctx.Done():
+			d.finish(ErrClientGone)
+		}
+	}()
+}
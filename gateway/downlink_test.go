@@ -0,0 +1,205 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	snPkts "github.com/energostack/bisquitt/packets"
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestDownlink(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, nil)
+	defer stp.cancel()
+
+	gw := NewGateway(util.NewDebugLogger("downlink"), &GatewayConfig{})
+	stp.handler.id = "client-address"
+	gw.addHandler(stp.handler, stp.cancel)
+
+	publish := func(msg *DownlinkMessage) chan error {
+		result := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			result <- gw.Publish(ctx, "test-client", msg)
+		}()
+		return result
+	}
+
+	// The client is not connected yet.
+	assert.Equal(ErrClientNotConnected, gw.Publish(context.Background(), "client-address",
+		&DownlinkMessage{Topic: "cmd", QoS: 0}))
+	stp.connect()
+
+	assert.Equal(ErrClientNotFound, gw.Publish(context.Background(), "unknown",
+		&DownlinkMessage{Topic: "cmd", QoS: 0}))
+	assert.Error(gw.Publish(context.Background(), "test-client",
+		&DownlinkMessage{Topic: "cmd/#", QoS: 0}))
+	assert.Error(gw.Publish(context.Background(), "test-client",
+		&DownlinkMessage{Topic: "cmd", QoS: 3}))
+
+	// QoS 1 to an unregistered topic.
+	result := publish(&DownlinkMessage{Topic: "device/cmd", Payload: []byte("reboot"), QoS: 1})
+
+	// client <--REGISTER-- GW
+	snRegister := stp.snRecv().(*snPkts1.Register)
+	assert.Equal("device/cmd", snRegister.TopicName)
+
+	// client --REGACK--> GW
+	snRegack := snPkts1.NewRegack(snRegister.TopicID, snPkts1.RC_ACCEPTED)
+	snRegack.CopyMessageID(snRegister)
+	stp.snSend(snRegack, false)
+
+	// client <--PUBLISH-- GW
+	snPublish := stp.snRecv().(*snPkts1.Publish)
+	assert.Equal(snRegister.TopicID, snPublish.TopicID)
+	assert.Equal([]byte("reboot"), snPublish.Data)
+	assert.Equal(uint8(1), snPublish.QOS)
+
+	// client --PUBACK--> GW
+	snPuback := snPkts1.NewPuback(snPublish.TopicID, snPkts1.RC_ACCEPTED)
+	snPuback.CopyMessageID(snPublish)
+	stp.snSend(snPuback, false)
+	assert.NoError(<-result)
+
+	// client --DISCONNECT(duration)--> GW
+	stp.snSend(snPkts1.NewDisconnect(1), false)
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snPkts1.Disconnect)
+	assert.True(ok)
+
+	// QoS 2 to the registered topic is queued while the client is asleep.
+	result = publish(&DownlinkMessage{Topic: "device/cmd", Payload: []byte("update"), QoS: 2})
+	assert.Eventually(func() bool {
+		stp.handler.downlinkMutex.Lock()
+		defer stp.handler.downlinkMutex.Unlock()
+		return len(stp.handler.downlinks) == 1
+	}, time.Second, 10*time.Millisecond)
+	packets, _ := stp.handler.sleepBuffer.size()
+	assert.Zero(packets)
+
+	// client --PINGREQ--> GW
+	stp.snSend(snPkts1.NewPingreq(nil), false)
+
+	// client <--PUBLISH-- GW
+	snPublish = stp.snRecv().(*snPkts1.Publish)
+	assert.Equal(snRegister.TopicID, snPublish.TopicID)
+	assert.Equal([]byte("update"), snPublish.Data)
+	assert.Equal(uint8(2), snPublish.QOS)
+
+	// client <--PINGRESP-- GW
+	_, ok = stp.snRecv().(*snPkts1.Pingresp)
+	assert.True(ok)
+
+	// client --PUBREC--> GW
+	snPubrec := snPkts1.NewPubrec()
+	snPubrec.CopyMessageID(snPublish)
+	stp.snSend(snPubrec, false)
+
+	// client <--PUBREL-- GW
+	snPubrel := stp.snRecv().(*snPkts1.Pubrel)
+	assert.Equal(snPublish.MessageID(), snPubrel.MessageID())
+
+	// client --PUBCOMP--> GW
+	snPubcomp := snPkts1.NewPubcomp()
+	snPubcomp.CopyMessageID(snPublish)
+	stp.snSend(snPubcomp, false)
+	assert.NoError(<-result)
+
+	// QoS 0 to a short topic using the admin API.
+	server := httptest.NewServer(gw.AdminHandler())
+	defer server.Close()
+	post := func(id, body string) int {
+		resp, err := http.Post(server.URL+"/handlers/"+id+"/publish", "application/json",
+			strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(http.StatusNotFound, post("unknown", `{"topic": "ab", "payload": "on"}`))
+	assert.Equal(http.StatusBadRequest, post("test-client", `{"topic": "ab", "qos": 5}`))
+	assert.Equal(http.StatusNoContent, post("test-client", `{"topic": "ab", "payload": "on"}`))
+
+	// client <--PUBLISH-- GW
+	snPublish = stp.snRecv().(*snPkts1.Publish)
+	assert.Equal(snPkts1.TIT_SHORT, snPublish.TopicIDType)
+	assert.Equal([]byte("on"), snPublish.Data)
+	assert.Equal(uint8(0), snPublish.QOS)
+
+	stp.disconnect()
+	assert.Equal(ErrClientNotConnected, gw.Publish(context.Background(), "test-client",
+		&DownlinkMessage{Topic: "cmd", QoS: 0}))
+}
+
+func TestDownlinkMsgIDCollision(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, nil)
+	defer stp.cancel()
+
+	gw := NewGateway(util.NewDebugLogger("downlink"), &GatewayConfig{})
+	gw.addHandler(stp.handler, stp.cancel)
+
+	stp.connect()
+	topic := "device/cmd"
+	topicID := stp.register(topic)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- gw.Publish(context.Background(), "test-client",
+			&DownlinkMessage{Topic: topic, Payload: []byte("downlink"), QoS: 1})
+	}()
+
+	// client <--PUBLISH-- GW
+	snDownlink := stp.snRecv().(*snPkts1.Publish)
+	assert.Equal(snPkts.MaxPacketID, snDownlink.MessageID())
+
+	// GW <--PUBLISH-- MQTT broker with the same MsgID
+	mqttPublish := mqPkts.NewControlPacket(mqPkts.Publish).(*mqPkts.PublishPacket)
+	mqttPublish.Qos = 1
+	mqttPublish.MessageID = snDownlink.MessageID()
+	mqttPublish.TopicName = topic
+	mqttPublish.Payload = []byte("broker")
+	stp.mqttSend(mqttPublish, false)
+
+	// The downlink transaction is not overwritten.
+	time.Sleep(100 * time.Millisecond)
+	transaction, ok := stp.handler.transactions.Get(snDownlink.MessageID())
+	assert.True(ok)
+	assert.IsType(&downlinkTransaction{}, transaction)
+
+	// client --PUBACK--> GW
+	snPuback := snPkts1.NewPuback(topicID, snPkts1.RC_ACCEPTED)
+	snPuback.CopyMessageID(snDownlink)
+	stp.snSend(snPuback, false)
+	assert.NoError(<-result)
+
+	// The broker PUBLISH is delivered after the downlink finishes.
+	// client <--PUBLISH-- GW
+	snPublish := stp.snRecv().(*snPkts1.Publish)
+	assert.Equal(mqttPublish.MessageID, snPublish.MessageID())
+	assert.Equal([]byte("broker"), snPublish.Data)
+
+	// client --PUBACK--> GW
+	snPuback = snPkts1.NewPuback(topicID, snPkts1.RC_ACCEPTED)
+	snPuback.CopyMessageID(snPublish)
+	stp.snSend(snPuback, false)
+
+	// MQTT broker <--PUBACK-- GW
+	mqttPuback := stp.mqttRecv().(*mqPkts.PubackPacket)
+	assert.Equal(mqttPublish.MessageID, mqttPuback.MessageID)
+
+	stp.disconnect()
+}
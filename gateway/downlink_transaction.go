@@ -0,0 +1,80 @@
+package gateway
+
+import (
+	"context"
+	"fmt"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/transactions"
+)
+
+// downlinkTransaction delivers a downlink message (see Gateway.Publish) to
+// the client. Unlike the broker PUBLISH transactions, there is no MQTT
+// counterpart to acknowledge.
+type downlinkTransaction struct {
+	brokerPublishTransactionBase
+	qos uint8
+}
+
+func newDownlinkTransaction(ctx context.Context, h *handler1, msgID uint16, qos uint8) *downlinkTransaction {
+	tLog := h.log.WithTag(fmt.Sprintf("DOWNLINK%d(%d)", qos, msgID))
+	tLog.Debug("Created.")
+	t := &downlinkTransaction{
+		brokerPublishTransactionBase: brokerPublishTransactionBase{
+			log:     tLog,
+			handler: h,
+		},
+		qos: qos,
+	}
+	t.RetryTransaction = transactions.NewRetryTransaction(
+		ctx, h.cfg.RetryDelay, h.cfg.RetryCount, t.resend,
+		func() {
+			h.transactions.Delete(msgID)
+			tLog.Debug("Deleted.")
+		},
+	)
+	return t
+}
+
+func (t *downlinkTransaction) Regack(snRegack *snPkts1.Regack) error {
+	switch t.qos {
+	case 0:
+		return t.regack(snRegack, transactionDone)
+	case 1:
+		return t.regack(snRegack, awaitingPuback)
+	default:
+		return t.regack(snRegack, awaitingPubrec)
+	}
+}
+
+func (t *downlinkTransaction) Puback(snPuback *snPkts1.Puback) error {
+	if t.State != awaitingPuback {
+		t.log.Debug("Unexpected packet in %d: %v", t.State, snPuback)
+		return nil
+	}
+	if snPuback.ReturnCode != snPkts1.RC_ACCEPTED {
+		t.Fail(fmt.Errorf("PUBACK return code: %d", snPuback.ReturnCode))
+		return nil
+	}
+	t.Success()
+	return nil
+}
+
+func (t *downlinkTransaction) Pubrec(snPubrec *snPkts1.Pubrec) error {
+	if t.State != awaitingPubrec {
+		t.log.Debug("Unexpected packet in %d: %v", t.State, snPubrec)
+		return nil
+	}
+	snPubrel := snPkts1.NewPubrel()
+	snPubrel.SetMessageID(snPubrec.MessageID())
+	return t.ProceedSN(awaitingPubcomp, snPubrel)
+}
+
+func (t *downlinkTransaction) Pubcomp(snPubcomp *snPkts1.Pubcomp) error {
+	if t.State != awaitingPubcomp {
+		t.log.Debug("Unexpected packet in %d: %v", t.State, snPubcomp)
+		return nil
+	}
+	t.Success()
+	return nil
+}
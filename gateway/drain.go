@@ -0,0 +1,93 @@
+// Graceful drain on shutdown.
+//
+// If GatewayConfig.DrainTimeout is non-zero, the gateway does not stop the
+// client handlers as soon as the ListenAndServe context is cancelled. It
+// stops accepting new clients and lets the handlers finish their pending
+// MsgID transactions (QoS 1 and 2 PUBLISH in both directions, SUBSCRIBE,
+// downlinks), deliver the packets buffered for sleeping clients and the
+// queued downlinks. Every handler is stopped (i.e. sends DISCONNECT to an
+// active or awake client) as soon as it has nothing pending. The handlers
+// still busy after DrainTimeout are stopped too and what they abandon is
+// logged.
+
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// How often the handlers are checked while draining.
+const drainCheckInterval = 100 * time.Millisecond
+
+// pendingWork is the work a handler has not finished yet.
+type pendingWork struct {
+	transactions int
+	buffered     int
+	downlinks    int
+}
+
+func (w pendingWork) idle() bool {
+	return w.transactions == 0 && w.buffered == 0 && w.downlinks == 0
+}
+
+func (w *pendingWork) add(w2 pendingWork) {
+	w.transactions += w2.transactions
+	w.buffered += w2.buffered
+	w.downlinks += w2.downlinks
+}
+
+func (h *handler1) pendingWork() pendingWork {
+	var work pendingWork
+	pktIDs, _ := h.transactions.Pending()
+	work.transactions = len(pktIDs)
+	work.buffered, _ = h.sleepBuffer.size()
+	h.downlinkMutex.Lock()
+	work.downlinks = len(h.downlinks)
+	h.downlinkMutex.Unlock()
+	return work
+}
+
+// drain stops the handlers as they become idle, the rest after
+// DrainTimeout, and waits for all of them to quit.
+func (gw *Gateway) drain(handlers *sync.WaitGroup) {
+	gw.log.Info("Draining %d clients for at most %s", len(gw.runningHandlers()), gw.cfg.DrainTimeout)
+	deadline := time.Now().Add(gw.cfg.DrainTimeout)
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		busy := false
+		for _, running := range gw.runningHandlers() {
+			if running.handler.pendingWork().idle() {
+				running.cancel()
+			} else {
+				busy = true
+			}
+		}
+		if !busy || time.Now().After(deadline) {
+			break
+		}
+		<-ticker.C
+	}
+
+	var abandoned pendingWork
+	abandonedClients := 0
+	for _, running := range gw.runningHandlers() {
+		work := running.handler.pendingWork()
+		running.cancel()
+		if work.idle() {
+			continue
+		}
+		running.handler.log.Info("Drain timeout, abandoned %d pending transactions, %d buffered packets and %d downlinks",
+			work.transactions, work.buffered, work.downlinks)
+		abandoned.add(work)
+		abandonedClients++
+	}
+	handlers.Wait()
+	if abandonedClients == 0 {
+		gw.log.Info("Drain finished")
+		return
+	}
+	gw.log.Info("Drain finished, %d clients abandoned %d pending transactions, %d buffered packets and %d downlinks",
+		abandonedClients, abandoned.transactions, abandoned.buffered, abandoned.downlinks)
+}
@@ -0,0 +1,124 @@
+package gateway
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+// startDrain starts draining the gateway with the test handler and returns
+// a channel closed when the drain finishes.
+func startDrain(stp *testSetup, drainTimeout time.Duration) (*Gateway, chan struct{}) {
+	gw := NewGateway(util.NewDebugLogger("drain"), &GatewayConfig{
+		DrainTimeout: drainTimeout,
+	})
+	gw.addHandler(stp.handler, stp.cancel)
+	handlers := &sync.WaitGroup{}
+	handlers.Add(1)
+	go func() {
+		<-stp.handlerDone
+		gw.removeHandler(stp.handler)
+		handlers.Done()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		gw.drain(handlers)
+		close(done)
+	}()
+	return gw, done
+}
+
+// brokerPublishQOS1 sends a QoS 1 PUBLISH from the MQTT broker and returns
+// the PUBLISH received by the client.
+func brokerPublishQOS1(stp *testSetup, topicID uint16, topic string) *snPkts1.Publish {
+	// GW <--PUBLISH-- MQTT broker
+	mqttPublish := mqPkts.NewControlPacket(mqPkts.Publish).(*mqPkts.PublishPacket)
+	mqttPublish.Qos = 1
+	mqttPublish.TopicName = topic
+	mqttPublish.Payload = []byte("message")
+	stp.mqttSend(mqttPublish, true)
+
+	// client <--PUBLISH-- GW
+	snPublish := stp.snRecv().(*snPkts1.Publish)
+	assert.Equal(stp.t, topicID, snPublish.TopicID)
+	return snPublish
+}
+
+func TestDrain(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, nil)
+	defer stp.cancel()
+
+	stp.connect()
+	topic := "drain/topic"
+	topicID := stp.register(topic)
+	snPublish := brokerPublishQOS1(stp, topicID, topic)
+
+	_, done := startDrain(stp, 5*time.Second)
+
+	// The pending PUBLISH transaction is not abandoned.
+	select {
+	case <-done:
+		t.Fatal("drain finished with a pending transaction")
+	case <-time.After(3 * drainCheckInterval):
+	}
+	assert.Equal(util.StateActive, stp.handler.state.Get())
+
+	// client --PUBACK--> GW
+	snPuback := snPkts1.NewPuback(topicID, snPkts1.RC_ACCEPTED)
+	snPuback.CopyMessageID(snPublish)
+	stp.snSend(snPuback, false)
+
+	// MQTT broker <--PUBACK-- GW
+	mqttPuback := stp.mqttRecv().(*mqPkts.PubackPacket)
+	assert.Equal(snPublish.MessageID(), mqttPuback.MessageID)
+
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snPkts1.Disconnect)
+	assert.True(ok)
+	stp.assertHandlerDone()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drain did not finish")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, nil)
+	defer stp.cancel()
+
+	stp.connect()
+	topic := "drain/topic"
+	topicID := stp.register(topic)
+	brokerPublishQOS1(stp, topicID, topic)
+
+	start := time.Now()
+	gw, done := startDrain(stp, 300*time.Millisecond)
+
+	// The PUBLISH is not acknowledged => the client is disconnected after
+	// the drain timeout.
+
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snPkts1.Disconnect)
+	assert.True(ok)
+	assert.GreaterOrEqual(time.Since(start), gw.cfg.DrainTimeout)
+	stp.assertHandlerDone()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drain did not finish")
+	}
+}
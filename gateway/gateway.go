@@ -9,11 +9,13 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/patrickmn/go-cache"
 	"github.com/pion/dtls/v2"
-	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+	transportUDP "github.com/pion/transport/v2/udp"
 	"github.com/pion/udp"
 
 	"github.com/energostack/bisquitt/topics"
@@ -25,13 +27,64 @@ type GatewayConfig struct {
 	MqttConnectionTimeout time.Duration
 	MqttUser              *string
 	MqttPassword          []byte
+	// MqttTLSConfig enables TLS for the MQTT broker connection if not nil.
+	// Because MqttBrokerAddress is an IP address, ServerName should be set
+	// to the broker host name unless InsecureSkipVerify is true.
+	MqttTLSConfig *tls.Config
+	// MqttDialer is used to connect to the MQTT broker if not nil (e.g.
+	// a WebSocketDialer). Otherwise, a TCPDialer is created from
+	// MqttBrokerAddress, MqttConnectionTimeout and MqttTLSConfig.
+	MqttDialer MqttDialer
+	// MqttProtocolVersion is MqttVersion311 (default if zero) or
+	// MqttVersion5.
+	MqttProtocolVersion uint8
+	// Aggregating enables the aggregating gateway mode: all clients share
+	// a single MQTT broker connection. The gateway is transparent (every
+	// client has its own MQTT broker connection) otherwise.
+	Aggregating bool
+	// AggregatorClientID is the MQTT client identifier of the shared MQTT
+	// broker connection in the aggregating mode.
+	AggregatorClientID string
+	// SessionStore stores the gateway-side state of persistent sessions
+	// (CleanSession=false). Persistent sessions are not stored if nil.
+	SessionStore SessionStore
+	// SleepBuffer limits the buffering of packets for sleeping clients.
+	SleepBuffer SleepBufferConfig
+	// A client is considered lost if no packet is received from it within
+	// its keepalive period (or sleep duration if it is sleeping) multiplied
+	// by ClientTimeoutFactor. DefaultClientTimeoutFactor is used if zero.
+	ClientTimeoutFactor float64
+	// ACL restricts the topics the clients may publish and subscribe to.
+	// Everything is allowed if nil.
+	ACL *ACL
+	// IdentityBinding binds the DTLS client identity (PSK identity or
+	// certificate CN/SAN) to the MQTT-SN ClientID and the MQTT username.
+	IdentityBinding IdentityBinding
+	// ClientCert configures client certificate verification in the
+	// certificate DTLS mode.
+	ClientCert ClientCertConfig
 	// UsePSK controls whether pre-shared key should be used to secure the
 	// connection to the MQTT-SN gateway. If UsePSK is true, you must provide
-	// PSKIdentityHint, PSKAPIBasicAuthUsername, PSKAPIBasicAuthPassword and
-	// PSKAPIEndpoint.
+	// PSKProvider or PSKAPIEndpoint (with PSKAPITimeout,
+	// PSKAPIBasicAuthUsername and PSKAPIBasicAuthPassword).
 	// If UsePSK is true, the client will use PSKKeys instead of the certificate
-	// and private key.
-	UsePSK                  bool
+	// and private key unless UseCertificate is true.
+	UsePSK bool
+	// UseCertificate enables certificate handshakes in addition to the PSK
+	// handshakes if UsePSK is true.
+	UseCertificate bool
+	// CipherSuites are the DTLS cipher suites in the order of preference.
+	// If nil, TLS_PSK_WITH_AES_128_GCM_SHA256 is used for PSK and the DTLS
+	// library defaults for certificates (both if UseCertificate is true).
+	CipherSuites []dtls.CipherSuiteID
+	// PSKProvider looks up the client keys. If nil, an HTTPPSKProvider is
+	// created from the PSKAPI* fields.
+	PSKProvider PSKProvider
+	// PSKNegativeCacheExpiration is how long unknown identities are cached
+	// in PSKKeys.
+	PSKNegativeCacheExpiration time.Duration
+	// PSKKeys caches the keys found for PSKCacheExpiration. Nothing is
+	// cached if PSKKeys is nil.
 	PSKKeys                 *cache.Cache
 	PSKCacheExpiration      time.Duration
 	PSKIdentityHint         string
@@ -46,15 +99,36 @@ type GatewayConfig struct {
 	PerformanceLogTime      time.Duration
 	PredefinedTopics        topics.PredefinedTopics
 	AuthEnabled             bool
+	// Authenticators maps AUTH method names to their implementations.
+	// Only PLAIN is supported if nil.
+	Authenticators map[string]Authenticator
 	// TRetry in MQTT-SN specification
 	RetryDelay time.Duration
 	// NRetry in MQTT-SN specification
 	RetryCount uint
+	// GatewayID is sent in ADVERTISE and GWINFO packets.
+	GatewayID uint8
+	// AdvertiseAddress is a broadcast or multicast address the ADVERTISE
+	// packets are sent to and the SEARCHGW packets are received on.
+	// Gateway discovery is disabled if AdvertiseAddress is nil.
+	AdvertiseAddress *net.UDPAddr
+	// T_ADV in MQTT-SN specification. No ADVERTISE packets are sent if
+	// AdvertiseInterval is zero.
+	AdvertiseInterval time.Duration
+	// DrainTimeout is how long the clients are drained (see drain.go) when
+	// the ListenAndServe context is cancelled. The clients are disconnected
+	// immediately if DrainTimeout is zero.
+	DrainTimeout time.Duration
 }
 
 type Gateway struct {
-	cfg *GatewayConfig
-	log util.Logger
+	cfg     *GatewayConfig
+	log     util.Logger
+	stats   *stats
+	current *reloadable
+	// Running handlers by ID for the admin API.
+	handlersMutex sync.Mutex
+	handlers      map[string]*runningHandler
 }
 
 // Timeout for DTLS connection establishment.
@@ -62,41 +136,18 @@ const dtlsConnectTimeout = 300 * time.Second
 
 func NewGateway(log util.Logger, cfg *GatewayConfig) *Gateway {
 	return &Gateway{
-		cfg: cfg,
-		log: log,
+		cfg:   cfg,
+		log:   log,
+		stats: newStats(),
+		current: &reloadable{
+			clientCert:       cfg.ClientCert,
+			predefinedTopics: cfg.PredefinedTopics,
+		},
+		handlers: make(map[string]*runningHandler),
 	}
 }
 
-func newDTLSListener(ctx context.Context, cfg *GatewayConfig, address *net.UDPAddr) (net.Listener, error) {
-	var certificate *tls.Certificate
-	var err error
-
-	logger := util.NewProductionLogger("gateway")
-
-	if !cfg.UsePSK && cfg.UseDTLS {
-		if cfg.SelfSigned {
-			var cert tls.Certificate
-			cert, err = selfsign.GenerateSelfSigned()
-			certificate = &cert
-		} else {
-			privateKey := cfg.PrivateKey
-			if privateKey == nil {
-				err = errors.New("private key is missing")
-			}
-
-			certificate = cfg.Certificate
-			if certificate == nil {
-				err = errors.New("TLS certificate is missing")
-			} else {
-				certificate.PrivateKey = privateKey
-			}
-		}
-	}
-
-	if err != nil {
-		return nil, err
-	}
-
+func newDTLSListener(ctx context.Context, cfg *GatewayConfig, current *reloadable, network string, address *net.UDPAddr, stats *stats, log util.Logger) (net.Listener, error) {
 	dtlsConfig := &dtls.Config{
 		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
 		ConnectContextMaker: func() (context.Context, func()) {
@@ -104,87 +155,274 @@ func newDTLSListener(ctx context.Context, cfg *GatewayConfig, address *net.UDPAd
 		},
 	}
 
-	if !cfg.UsePSK && cfg.UseDTLS && certificate != nil {
-		dtlsConfig.Certificates = []tls.Certificate{*certificate}
+	dtlsConfig.CipherSuites = cfg.cipherSuites()
+
+	if cfg.useCertificate() {
+		if err := current.initCertificate(cfg); err != nil {
+			return nil, err
+		}
+		dtlsConfig.GetCertificate = current.getCertificate
+		if cfg.ClientCert.Auth != dtls.NoClientCert {
+			// The client certificates are verified with the current CAs
+			// by verifyPeerCertificate.
+			dtlsConfig.ClientAuth = dtls.RequestClientCert
+			dtlsConfig.VerifyPeerCertificate = current.verifyPeerCertificate
+			if cfg.ClientCert.Auth == dtls.RequireAndVerifyClientCert {
+				dtlsConfig.VerifyConnection = requireClientCertificate
+			}
+		}
 	}
 
 	if cfg.UsePSK && cfg.UseDTLS {
-		dtlsConfig.CipherSuites = []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_GCM_SHA256}
-		dtlsConfig.PSK = func(hint []byte) ([]byte, error) {
-			psk, ok := cfg.PSKKeys.Get(string(hint))
-			if ok {
-				return psk.([]byte), nil
+		provider := cfg.PSKProvider
+		if provider == nil {
+			provider = &HTTPPSKProvider{
+				Endpoint: cfg.PSKAPIEndpoint,
+				Username: cfg.PSKAPIBasicAuthUsername,
+				Password: cfg.PSKAPIBasicAuthPassword,
+				Client:   &http.Client{Timeout: cfg.PSKAPITimeout},
+				Log:      log.WithTag("psk"),
 			}
-
-			psk, ok = util.GetPSKKeyFromAPI(
-				string(hint),
-				cfg.PSKAPIEndpoint,
-				cfg.PSKAPIBasicAuthUsername,
-				cfg.PSKAPIBasicAuthPassword,
-				cfg.PSKAPITimeout,
-				logger,
-			)
-
-			if ok {
-				cfg.PSKKeys.Set(string(hint), psk, cfg.PSKCacheExpiration)
-				return psk.([]byte), nil
+		}
+		psks := &pskCache{
+			provider:           provider,
+			cache:              cfg.PSKKeys,
+			expiration:         cfg.PSKCacheExpiration,
+			negativeExpiration: cfg.PSKNegativeCacheExpiration,
+			stats:              stats,
+		}
+		dtlsConfig.PSK = func(hint []byte) ([]byte, error) {
+			psk, err := psks.PSK(string(hint))
+			if err != nil && err != ErrPSKNotFound {
+				log.Error("PSK lookup of %q failed: %s", hint, err)
 			}
-
-			return nil, errors.New("PSK key not found")
+			return psk, err
 		}
 		dtlsConfig.PSKIdentityHint = []byte(cfg.PSKIdentityHint)
 	}
 
-	return dtls.Listen("udp", address, dtlsConfig)
+	return dtls.Listen(network, address, dtlsConfig)
 }
 
-func newUDPListener(ctx context.Context, address *net.UDPAddr) (net.Listener, error) {
+func newUDPListener(ctx context.Context, network string, address *net.UDPAddr) (net.Listener, error) {
 	udpConfig := &udp.ListenConfig{}
-	return udpConfig.Listen("udp", address)
+	return udpConfig.Listen(network, address)
 }
 
-// ListenAndServe starts a gateway listening on the given address. It returns
-// only on fatal internal errors or when the given context is canceled.
-func (gw *Gateway) ListenAndServe(ctx context.Context, address string) error {
-	udpAddr, err := net.ResolveUDPAddr("udp", address)
+// listenNetwork returns "udp4" or "udp6" if the address host is an IP
+// literal, "udp" otherwise. An IPv6 wildcard listener on "udp" would be
+// dual-stack and collide with an IPv4 listener on the same port.
+func listenNetwork(address string) string {
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
-		return err
+		return "udp"
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "udp"
+	case ip.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
 	}
+}
 
-	var snListener net.Listener
-	if gw.cfg.UseDTLS {
-		snListener, err = newDTLSListener(ctx, gw.cfg, udpAddr)
-	} else {
-		snListener, err = newUDPListener(ctx, udpAddr)
+// ListenerConfig configures one of the gateway listeners.
+type ListenerConfig struct {
+	// UDP address to listen on, e.g. "0.0.0.0:1883" or "[::]:8883".
+	Address string
+	// UseDTLS secures the listener with DTLS configured by the
+	// GatewayConfig DTLS fields (GatewayConfig.UseDTLS must be true).
+	// Plain UDP is used otherwise.
+	UseDTLS bool
+	// AuthEnabled requires the MQTT-SN AUTH from the listener clients.
+	AuthEnabled bool
+	// PredefinedTopics of the listener clients. The (reloadable)
+	// GatewayConfig.PredefinedTopics are used if nil. See
+	// Reloadable.ListenerPredefinedTopics.
+	PredefinedTopics topics.PredefinedTopics
+}
+
+// ListenAndServe starts a gateway listening on the given address. It returns
+// only on fatal internal errors or when the given context is canceled (after
+// the clients are drained if DrainTimeout is non-zero).
+func (gw *Gateway) ListenAndServe(ctx context.Context, address string) error {
+	return gw.Serve(ctx, []ListenerConfig{{
+		Address:     address,
+		UseDTLS:     gw.cfg.UseDTLS,
+		AuthEnabled: gw.cfg.AuthEnabled,
+	}})
+}
+
+// Serve is like ListenAndServe but it serves all the listeners at once. If
+// any of the listeners fails, all of them are closed.
+func (gw *Gateway) Serve(ctx context.Context, listeners []ListenerConfig) error {
+	if len(listeners) == 0 {
+		return errors.New("no listener configured")
 	}
-	if err != nil {
-		return err
+
+	// Closed by ctx or when any of the listeners fails.
+	listenersCtx, closeListeners := context.WithCancel(ctx)
+	defer closeListeners()
+	snListeners := make([]net.Listener, 0, len(listeners))
+	for _, lc := range listeners {
+		snListener, err := gw.listen(ctx, lc)
+		if err != nil {
+			for _, l := range snListeners {
+				l.Close()
+			}
+			return err
+		}
+		snListeners = append(snListeners, snListener)
 	}
+	gw.current.setListeners(listeners)
 	go func() {
-		<-ctx.Done()
-		snListener.Close()
+		<-listenersCtx.Done()
+		for _, snListener := range snListeners {
+			snListener.Close()
+		}
 	}()
 
-	gw.log.Info("Listening on %s", snListener.Addr().String())
+	if gw.cfg.AdvertiseAddress != nil {
+		discovery, err := newDiscoveryServer(gw.cfg, gw.log.WithTag("discovery"))
+		if err != nil {
+			return fmt.Errorf("cannot start gateway discovery: %s", err)
+		}
+		go func() {
+			if err := discovery.run(ctx); err != nil {
+				gw.log.Error("Gateway discovery error: %s", err)
+			}
+		}()
+	}
+
+	if gw.cfg.PerformanceLogTime > 0 {
+		go gw.stats.run(ctx, gw.log.WithTag("stats"), gw.cfg.PerformanceLogTime)
+	}
+
+	mqttDialer := gw.cfg.MqttDialer
+	if mqttDialer == nil {
+		mqttDialer = &TCPDialer{
+			Address:   gw.cfg.MqttBrokerAddress,
+			Timeout:   gw.cfg.MqttConnectionTimeout,
+			TLSConfig: gw.cfg.MqttTLSConfig,
+		}
+	}
 
 	handlerCfg := &handlerConfig{
-		MqttBrokerAddress:     gw.cfg.MqttBrokerAddress,
+		MqttDialer:            mqttDialer,
 		MqttUser:              gw.cfg.MqttUser,
 		MqttPassword:          gw.cfg.MqttPassword,
 		MqttConnectionTimeout: gw.cfg.MqttConnectionTimeout,
+		MqttProtocolVersion:   gw.cfg.MqttProtocolVersion,
 		AuthEnabled:           gw.cfg.AuthEnabled,
+		Authenticators:        gw.cfg.Authenticators,
 		RetryDelay:            gw.cfg.RetryDelay,
 		RetryCount:            gw.cfg.RetryCount,
+		GatewayID:             gw.cfg.GatewayID,
+		SessionStore:          gw.cfg.SessionStore,
+		SleepBuffer:           gw.cfg.SleepBuffer,
+		ClientTimeoutFactor:   gw.cfg.ClientTimeoutFactor,
+		ACL:                   gw.cfg.ACL,
+		IdentityBinding:       gw.cfg.IdentityBinding,
 	}
 
+	// While draining, the handlers (and the aggregator they use) outlive
+	// ctx.
+	var handlersCtx context.Context
+	var cancelHandlers context.CancelFunc
+	if gw.cfg.DrainTimeout > 0 {
+		handlersCtx, cancelHandlers = context.WithCancel(context.WithoutCancel(ctx))
+	} else {
+		handlersCtx, cancelHandlers = context.WithCancel(ctx)
+	}
+	defer cancelHandlers()
+	var handlers sync.WaitGroup
+
+	if gw.cfg.Aggregating {
+		aggregatorCfg := *handlerCfg
+		aggregator := newAggregator(&aggregatorCfg, gw.cfg.AggregatorClientID, gw.log.WithTag("aggregator"))
+		go aggregator.run(handlersCtx)
+		// The handlers talk MQTT 3.1.1 to the aggregator.
+		handlerCfg.MqttDialer = aggregator
+		handlerCfg.MqttProtocolVersion = MqttVersion311
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, lc := range listeners {
+		listenerCfg := *handlerCfg
+		listenerCfg.AuthEnabled = lc.AuthEnabled
+		go func(snListener net.Listener, listener int) {
+			errs <- gw.serve(handlersCtx, snListener, &listenerCfg, listener, &handlers)
+		}(snListeners[i], i)
+	}
+	var err error
+	for range listeners {
+		if listenerErr := <-errs; listenerErr != nil && err == nil {
+			err = listenerErr
+			closeListeners()
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if gw.cfg.DrainTimeout > 0 {
+		gw.drain(&handlers)
+	}
+	return nil
+}
+
+// listen creates the listener.
+func (gw *Gateway) listen(ctx context.Context, lc ListenerConfig) (net.Listener, error) {
+	network := listenNetwork(lc.Address)
+	udpAddr, err := net.ResolveUDPAddr(network, lc.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	var snListener net.Listener
+	if lc.UseDTLS {
+		if !gw.cfg.UseDTLS {
+			return nil, fmt.Errorf("DTLS listener %s requires UseDTLS", lc.Address)
+		}
+		snListener, err = newDTLSListener(ctx, gw.cfg, gw.current, network, udpAddr, gw.stats, gw.log)
+	} else {
+		snListener, err = newUDPListener(ctx, network, udpAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	transport := "UDP"
+	if lc.UseDTLS {
+		transport = "DTLS"
+	}
+	family := "IPv4 and IPv6"
+	switch network {
+	case "udp4":
+		family = "IPv4"
+	case "udp6":
+		family = "IPv6"
+	}
+	gw.log.Info("Listening on %s (%s, %s)", snListener.Addr().String(), transport, family)
+	return snListener, nil
+}
+
+// serve accepts the clients until the listener is closed. The listener is the
+// index of the listener in the Serve listeners.
+func (gw *Gateway) serve(ctx context.Context, snListener net.Listener, handlerCfg *handlerConfig,
+	listener int, handlers *sync.WaitGroup) error {
 	for {
 		clientConn, err := snListener.Accept()
 		if err != nil {
 			if _, ok := err.(*dtls.HandshakeError); ok {
+				gw.stats.dtlsHandshakeError()
 				gw.log.Error("Client TLS handshake error: %s", err)
 				continue
 			}
-			if err == udp.ErrClosedListener {
+			// The DTLS listener uses the pion/transport UDP listener.
+			if err == udp.ErrClosedListener || err == transportUDP.ErrClosedListener {
 				return nil
 			}
 			gw.log.Error("MQTT-SN Accept error: %v", err)
@@ -193,9 +431,20 @@ func (gw *Gateway) ListenAndServe(ctx context.Context, address string) error {
 		gw.log.Debug("Client connected: %s", clientConn.RemoteAddr().String())
 		handlerID := clientConn.RemoteAddr().String()
 		handlerLogger := gw.log.WithTag(fmt.Sprintf("h:%s", handlerID))
-		handler := newHandler(handlerCfg, gw.cfg.PredefinedTopics, handlerLogger)
+		clientCert, handlerTopics := gw.current.get(listener)
+		cfg := *handlerCfg
+		cfg.ClientCert = clientCert
+		handler := newHandler(&cfg, handlerTopics, gw.stats, handlerLogger)
+		handler.id = handlerID
+		handler.snRemoteAddr = clientConn.RemoteAddr()
+		handlerCtx, handlerCancel := context.WithCancel(ctx)
+		gw.addHandler(handler, handlerCancel)
+		handlers.Add(1)
 		go func() {
+			defer handlers.Done()
 			defer func() {
+				gw.removeHandler(handler)
+				handlerCancel()
 				handlerLogger.Debug("Closing MQTT-SN connection")
 				err := clientConn.Close()
 				if err != nil {
@@ -203,7 +452,7 @@ func (gw *Gateway) ListenAndServe(ctx context.Context, address string) error {
 				}
 			}()
 
-			handler.run(ctx, clientConn)
+			handler.run(handlerCtx, clientConn)
 		}()
 	}
 }
@@ -506,6 +506,42 @@ func TestClientPublishQOS2(t *testing.T) {
 	stp.disconnect()
 }
 
+func TestClientPublishQOS2Rejected(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	topicID := stp.register("test-topic-2")
+
+	// client --PUBLISH--> GW
+	snPublish := snPkts1.NewPublish(topicID, []byte("test-msg-2"), false, 2, false, snPkts1.TIT_REGISTERED)
+	stp.snSend(snPublish, true)
+
+	// GW --PUBLISH--> MQTT broker
+	mqttPublish := stp.mqttRecv().(*mqPkts.PublishPacket)
+
+	// GW <--PUBREC(Quota exceeded)-- MQTT 5 broker
+	err := stp.handler.handleMqtt(stp.ctx, &mqtt5PubFailure{
+		ControlPacket: mqPkts.NewControlPacket(mqPkts.Pubrec),
+		MessageID:     mqttPublish.MessageID,
+		ReasonCode:    0x97,
+	})
+	assert.NoError(err)
+
+	// client <--PUBACK(rejected)-- GW
+	snPuback := stp.snRecv().(*snPkts1.Puback)
+	assert.Equal(snPublish.MessageID(), snPuback.MessageID())
+	assert.Equal(topicID, snPuback.TopicID)
+	assert.Equal(snPkts1.RC_CONGESTION, snPuback.ReturnCode)
+	_, ok := stp.handler.transactions.Get(mqttPublish.MessageID)
+	assert.False(ok)
+
+	// DISCONNECT
+	stp.disconnect()
+}
+
 func TestSubscribeQOS0Wildcard(t *testing.T) {
 	assert := assert.New(t)
 
@@ -1099,6 +1135,161 @@ func TestLastWill(t *testing.T) {
 	}
 }
 
+func TestWillUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := []byte("test-client")
+	willTopic := "test/status"
+	willPayload := []byte("offline")
+	newWillTopic := "test/status2"
+	newWillPayload := []byte("gone")
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	// CONNECT with a will and a persistent session.
+
+	// client --CONNECT--> GW
+	snConnect := snPkts1.NewConnect(1, clientID, true, false)
+	stp.snSend(snConnect, false)
+
+	// client <--WILLTOPICREQ-- GW
+	_, ok := stp.snRecv().(*snPkts1.WillTopicReq)
+	assert.True(ok)
+
+	// client --WILLTOPIC--> GW
+	stp.snSend(snPkts1.NewWillTopic(willTopic, 1, false), false)
+
+	// client <--WILLMSGREQ-- GW
+	_, ok = stp.snRecv().(*snPkts1.WillMsgReq)
+	assert.True(ok)
+
+	// client --WILLMSG--> GW
+	stp.snSend(snPkts1.NewWillMsg(willPayload), false)
+
+	// GW --CONNECT--> MQTT broker
+	mqttConnect := stp.mqttRecv().(*mqPkts.ConnectPacket)
+	assert.Equal(willTopic, mqttConnect.WillTopic)
+
+	// GW <--CONNACK-- MQTT broker
+	mqttConnack := mqPkts.NewControlPacket(mqPkts.Connack).(*mqPkts.ConnackPacket)
+	mqttConnack.ReturnCode = mqPkts.Accepted
+	stp.mqttSend(mqttConnack, false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snPkts1.Connack)
+	assert.Equal(snPkts1.RC_ACCEPTED, snConnack.ReturnCode)
+
+	// WILLTOPICUPD
+
+	// client --WILLTOPICUPD--> GW
+	stp.snSend(snPkts1.NewWillTopicUpd(newWillTopic, 2, true), false)
+
+	// GW --DISCONNECT--> MQTT broker
+	_, ok = stp.mqttRecv().(*mqPkts.DisconnectPacket)
+	assert.True(ok)
+	stp.mqttReconnect()
+
+	// GW --CONNECT--> MQTT broker
+	mqttConnect = stp.mqttRecv().(*mqPkts.ConnectPacket)
+	assert.Equal(string(clientID), mqttConnect.ClientIdentifier)
+	assert.False(mqttConnect.CleanSession)
+	assert.True(mqttConnect.WillFlag)
+	assert.Equal(newWillTopic, mqttConnect.WillTopic)
+	assert.Equal(uint8(2), mqttConnect.WillQos)
+	assert.True(mqttConnect.WillRetain)
+	assert.Equal(willPayload, mqttConnect.WillMessage)
+
+	// GW <--CONNACK-- MQTT broker
+	// The broker resumes the persistent session.
+	mqttConnack.SessionPresent = true
+	stp.mqttSend(mqttConnack, false)
+
+	// client <--WILLTOPICRESP-- GW
+	snWillTopicResp := stp.snRecv().(*snPkts1.WillTopicResp)
+	assert.Equal(snPkts1.RC_ACCEPTED, snWillTopicResp.ReturnCode)
+
+	// WILLMSGUPD
+
+	// client --WILLMSGUPD--> GW
+	stp.snSend(snPkts1.NewWillMsgUpd(newWillPayload), false)
+
+	// GW --DISCONNECT--> MQTT broker
+	_, ok = stp.mqttRecv().(*mqPkts.DisconnectPacket)
+	assert.True(ok)
+	stp.mqttReconnect()
+
+	// GW --CONNECT--> MQTT broker
+	mqttConnect = stp.mqttRecv().(*mqPkts.ConnectPacket)
+	assert.Equal(newWillTopic, mqttConnect.WillTopic)
+	assert.Equal(newWillPayload, mqttConnect.WillMessage)
+
+	// GW <--CONNACK-- MQTT broker
+	stp.mqttSend(mqttConnack, false)
+
+	// client <--WILLMSGRESP-- GW
+	snWillMsgResp := stp.snRecv().(*snPkts1.WillMsgResp)
+	assert.Equal(snPkts1.RC_ACCEPTED, snWillMsgResp.ReturnCode)
+
+	assert.Equal(util.StateActive, stp.handler.state.Get())
+
+	// DISCONNECT
+	stp.disconnect()
+}
+
+// A clean session is lost on MQTT reconnect => the gateway must restore the
+// client's subscriptions. The reconnect keeps CleanSession=true so the
+// broker never keeps the session.
+func TestWillUpdateCleanSession(t *testing.T) {
+	assert := assert.New(t)
+
+	topic := "test/topic"
+	willTopic := "test/status"
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	stp.subscribe(topic, 1)
+
+	// client --WILLTOPICUPD--> GW
+	stp.snSend(snPkts1.NewWillTopicUpd(willTopic, 0, false), false)
+
+	// GW --DISCONNECT--> MQTT broker
+	_, ok := stp.mqttRecv().(*mqPkts.DisconnectPacket)
+	assert.True(ok)
+	stp.mqttReconnect()
+
+	// GW --CONNECT--> MQTT broker
+	mqttConnect := stp.mqttRecv().(*mqPkts.ConnectPacket)
+	assert.True(mqttConnect.CleanSession)
+	assert.True(mqttConnect.WillFlag)
+	assert.Equal(willTopic, mqttConnect.WillTopic)
+
+	// GW <--CONNACK-- MQTT broker
+	mqttConnack := mqPkts.NewControlPacket(mqPkts.Connack).(*mqPkts.ConnackPacket)
+	mqttConnack.ReturnCode = mqPkts.Accepted
+	stp.mqttSend(mqttConnack, false)
+
+	// GW --SUBSCRIBE--> MQTT broker
+	mqttSubscribe := stp.mqttRecv().(*mqPkts.SubscribePacket)
+	assert.Equal([]string{topic}, mqttSubscribe.Topics)
+	assert.Equal([]byte{1}, mqttSubscribe.Qoss)
+
+	// GW <--SUBACK-- MQTT broker
+	mqttSuback := mqPkts.NewControlPacket(mqPkts.Suback).(*mqPkts.SubackPacket)
+	mqttSuback.MessageID = mqttSubscribe.MessageID
+	mqttSuback.ReturnCodes = []byte{1}
+	stp.mqttSend(mqttSuback, false)
+
+	// client <--WILLTOPICRESP-- GW
+	snWillTopicResp := stp.snRecv().(*snPkts1.WillTopicResp)
+	assert.Equal(snPkts1.RC_ACCEPTED, snWillTopicResp.ReturnCode)
+
+	// DISCONNECT
+	stp.disconnect()
+}
+
 func TestConnectTimeout(t *testing.T) {
 	assert := assert.New(t)
 
@@ -1124,6 +1315,28 @@ func TestConnectTimeout(t *testing.T) {
 	stp.assertHandlerDone()
 }
 
+// A client may search for a gateway using a unicast SEARCHGW before it
+// connects.
+func TestSearchGw(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	// client --SEARCHGW--> GW
+	stp.snSend(snPkts1.NewSearchGw(1), false)
+
+	// client <--GWINFO-- GW
+	snGwInfo := stp.snRecv().(*snPkts1.GwInfo)
+	assert.Equal(uint8(0), snGwInfo.GatewayID)
+	assert.Len(snGwInfo.GatewayAddress, 0)
+
+	assert.Equal(util.StateDisconnected, stp.handler.state.Get())
+
+	stp.connect()
+	stp.disconnect()
+}
+
 func TestAuthSuccess(t *testing.T) {
 	assert := assert.New(t)
 
@@ -1227,9 +1440,17 @@ type testSetup struct {
 	cancel        context.CancelFunc
 	handler       *handler1
 	handlerDone   chan struct{}
+	mqttListener  *net.UnixListener
+	sessionStore  SessionStore
 }
 
 func newTestSetup(t *testing.T, auth bool, predefinedTopics topics.PredefinedTopics) *testSetup {
+	return newSessionTestSetup(t, auth, predefinedTopics, nil)
+}
+
+// newSessionTestSetup is like newTestSetup but the handler stores the
+// persistent sessions in sessionStore.
+func newSessionTestSetup(t *testing.T, auth bool, predefinedTopics topics.PredefinedTopics, sessionStore SessionStore) *testSetup {
 	ctx, cancel := context.WithCancel(context.Background())
 	handlerDone := make(chan struct{})
 	// Test name without "Test" prefix.
@@ -1242,6 +1463,7 @@ func newTestSetup(t *testing.T, auth bool, predefinedTopics topics.PredefinedTop
 		handlerDone:   handlerDone,
 		snNextMsgID:   1,
 		mqttNextMsgID: 1,
+		sessionStore:  sessionStore,
 	}
 	stp.newHandler(auth, predefinedTopics)
 	return stp
@@ -1254,6 +1476,7 @@ func (stp *testSetup) newHandler(auth bool, predefinedTopics topics.PredefinedTo
 	var mqttListener *net.UnixListener
 	snListener, stp.snConn = stp.createSocketPair("unixpacket")
 	mqttListener, stp.mqttConn = stp.createSocketPair("unix")
+	stp.mqttListener = mqttListener
 
 	handlerChan := make(chan *handler1)
 	go func() {
@@ -1272,10 +1495,24 @@ func (stp *testSetup) newHandler(auth bool, predefinedTopics topics.PredefinedTo
 			AuthEnabled: auth,
 			RetryDelay:  time.Second,
 			RetryCount:  2,
+			// The test clients use 1s keepalive but they are silent while
+			// the gateway retransmits.
+			ClientTimeoutFactor: 10,
+			SessionStore:        stp.sessionStore,
 		}
-		handler := newHandler(cfg, predefinedTopics, log)
+		handler := newHandler(cfg, predefinedTopics, newStats(), log)
+		firstDial := true
 		handler.mockupDialFunc = func() net.Conn {
-			return mqttConnGateway
+			if firstDial {
+				firstDial = false
+				return mqttConnGateway
+			}
+			// MQTT reconnect, see stp.mqttReconnect.
+			conn, err := mqttListener.AcceptUnix()
+			if err != nil {
+				stp.t.Fatal(err)
+			}
+			return conn
 		}
 		select {
 		case <-stp.ctx.Done():
@@ -1312,6 +1549,18 @@ func (stp *testSetup) createSocketPair(sockType string) (*net.UnixListener, *net
 	return listener, conn
 }
 
+// mqttReconnect accepts a new MQTT connection from the handler. The old
+// connection must be closed by the handler.
+func (stp *testSetup) mqttReconnect() {
+	stp.assertConnClosed("MQTT", stp.mqttConn, connEmptyTimeout)
+	addr := stp.mqttListener.Addr().(*net.UnixAddr)
+	conn, err := net.DialUnix(addr.Net, nil, addr)
+	if err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.mqttConn = conn
+}
+
 func (stp *testSetup) snSend(pkt snPkts.Packet, setMsgID bool) {
 	if setMsgID {
 		if pkt2, ok := pkt.(snPkts1.PacketWithID); ok {
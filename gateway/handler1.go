@@ -17,8 +17,8 @@
 package gateway
 
 import (
-	"bytes"
 	"context"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -28,6 +28,7 @@ import (
 	"time"
 
 	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/pion/dtls/v2"
 	"golang.org/x/sync/errgroup"
 
 	snPkts "github.com/energostack/bisquitt/packets"
@@ -45,14 +46,48 @@ type handler1 struct {
 	snConn           *util.ConnWithContext
 	snRemoteAddr     net.Addr
 	mqttConn         *util.ConnWithContext
+	mqttCodec        mqttCodec
+	mqttConnMutex    sync.RWMutex
+	mqttCtx          context.Context
+	mqConnect        *mqPkts.ConnectPacket
 	registeredTopics sync.Map // uint16 => string
+	subscriptions    sync.Map // string => uint8 (QoS)
 	predefinedTopics topics.PredefinedTopics
 	keepAlive        uint16
 	clientID         string
 	topicID          *util.IDSequence
-	pktBuffer        []snPkts.Packet
-	group            *errgroup.Group
-	transactions     *transactions.TransactionStore
+	sleepBuffer      *sleepBuffer
+	supervisor       *clientSupervisor
+	// Stops the sleep pinger, nil if it is not running.
+	cancelSleepPinger context.CancelFunc
+	group             *errgroup.Group
+	transactions      *transactions.TransactionStore
+	// Serializes the MsgID choice and the storing of the transactions
+	// started by the gateway and by the broker PUBLISHes so that a MsgID
+	// is never used by two of them.
+	msgIDMutex sync.Mutex
+	stats      *stats
+	// Protects persistentSession and serializes the session saves.
+	sessionMutex      sync.Mutex
+	persistentSession bool
+	// Protects clientID, keepAlive, username and the DTLS client identity
+	// written by the handler and read by the admin API.
+	infoMutex sync.RWMutex
+	// MQTT username from AUTH or the DTLS identity (see IdentityBinding),
+	// empty if not known.
+	username string
+	// DTLS client identity, empty if not used.
+	pskIdentity string
+	certCN      string
+	certSANs    []string
+	// Verified client certificate chain, leaf first.
+	certChain []*x509.Certificate
+	// Protects downlinks and downlinksClosed and serializes the downlink
+	// transactions start.
+	downlinkMutex sync.Mutex
+	// Downlink messages waiting for the client to wake up.
+	downlinks       []*downlink
+	downlinksClosed bool
 	// for testing
 	mockupDialFunc func() net.Conn
 }
@@ -73,6 +108,7 @@ var Shutdown = errors.New("clean shutdown")
 var ErrTopicIDsExhausted = errors.New("no more TopicIDs available")
 var ErrMqttConnClosed = errors.New("MQTT broker closed connection")
 var ErrIllegalPacketWhenDisconnected = errors.New("illegal packet in disconnected state")
+var ErrSleepBufferDrop = errors.New("packet dropped from sleeping client buffer")
 
 func hasWildcard(topic string) bool {
 	if strings.Contains(topic, "+") {
@@ -85,19 +121,35 @@ func hasWildcard(topic string) bool {
 }
 
 type handlerConfig struct {
-	MqttBrokerAddress     *net.TCPAddr
+	MqttDialer            MqttDialer
 	MqttConnectionTimeout time.Duration
-	MqttUser              *string
-	MqttPassword          []byte
-	AuthEnabled           bool
+	// MqttVersion311 or MqttVersion5.
+	MqttProtocolVersion uint8
+	MqttUser            *string
+	MqttPassword        []byte
+	AuthEnabled         bool
+	// AUTH method => Authenticator. Only PLAIN is supported if nil.
+	Authenticators map[string]Authenticator
 	// TRetry in MQTT-SN specification
 	RetryDelay time.Duration
 	// NRetry in MQTT-SN specification
 	RetryCount uint
+	GatewayID  uint8
+	// Persistent sessions are not stored if nil.
+	SessionStore SessionStore
+	SleepBuffer  SleepBufferConfig
+	// The client is lost if it is silent longer than its keepalive period
+	// or sleep duration multiplied by ClientTimeoutFactor.
+	// DefaultClientTimeoutFactor is used if zero.
+	ClientTimeoutFactor float64
+	// Topic-level authorization. Everything is allowed if nil.
+	ACL             *ACL
+	IdentityBinding IdentityBinding
+	ClientCert      ClientCertConfig
 }
 
 func newHandler(cfg *handlerConfig, predefinedTopics topics.PredefinedTopics,
-	logger util.Logger) *handler1 {
+	stats *stats, logger util.Logger) *handler1 {
 	state := util.StateDisconnected
 	h := &handler1{
 		cfg:              cfg,
@@ -106,7 +158,11 @@ func newHandler(cfg *handlerConfig, predefinedTopics topics.PredefinedTopics,
 		predefinedTopics: predefinedTopics,
 		topicID:          util.NewIDSequence(snPkts.MinTopicAlias, snPkts.MaxTopicAlias),
 		transactions:     transactions.NewTransactionStore(),
+		stats:            stats,
+		sleepBuffer:      newSleepBuffer(cfg.SleepBuffer, stats, logger),
+		supervisor:       newClientSupervisor(cfg.ClientTimeoutFactor),
 	}
+	h.sleepBuffer.onDrop = h.sleepBufferDropped
 
 	return h
 }
@@ -115,6 +171,13 @@ func (h *handler1) run(ctx context.Context, snConn net.Conn) {
 	h.log.Debug("Handler starts.")
 	defer h.log.Debug("Handler quits.")
 
+	defer h.closeDownlinks()
+
+	h.stats.handlerStarted(h.state.Get())
+	defer func() {
+		h.stats.handlerStopped(h.state.Get())
+	}()
+
 	var groupCtx context.Context
 	h.group, groupCtx = errgroup.WithContext(ctx)
 
@@ -144,35 +207,30 @@ func (h *handler1) run(ctx context.Context, snConn net.Conn) {
 		return nil
 	})
 	h.snConn = util.NewConnWithContext(snCtx, snConn, connTimeout)
+	if dtlsConn, ok := snConn.(*dtls.Conn); ok {
+		h.setDTLSIdentity(dtlsConn.ConnectionState())
+	}
 
-	var mqttConn net.Conn
-	if h.mockupDialFunc != nil {
-		// Used in tests.
-		mqttConn = h.mockupDialFunc()
-	} else {
-		h.log.Debug("Connecting to MQTT broker %s", h.cfg.MqttBrokerAddress.String())
-		dialer := &net.Dialer{
-			Timeout: h.cfg.MqttConnectionTimeout,
-		}
-		var err error
-		mqttConn, err = dialer.DialContext(ctx, "tcp", h.cfg.MqttBrokerAddress.String())
-		if err != nil {
-			h.log.Error("Error connecting to MQTT broker: %s", err)
-			snPkt := snPkts1.NewConnack(snPkts1.RC_CONGESTION)
-			if err := h.snSend(snPkt); err != nil {
-				h.log.Error("Error sending CONNACK to a connection: %s", err)
-			}
-			return
+	mqttConn, err := h.dialMqtt(ctx)
+	if err != nil {
+		h.log.Error("Error connecting to MQTT broker: %s", err)
+		snPkt := snPkts1.NewConnack(snPkts1.RC_CONGESTION)
+		if err := h.snSend(snPkt); err != nil {
+			h.log.Error("Error sending CONNACK to a connection: %s", err)
 		}
+		return
 	}
 	h.log.Debug("Connected to MQTT broker")
 	defer func() {
 		h.log.Debug("Closing MQTT connection")
-		if err := mqttConn.Close(); err != nil {
+		conn, _ := h.getMqttConn()
+		if err := conn.Close(); err != nil {
 			h.log.Error("Error closing MQTT connection: %s", err)
 		}
 	}()
+	h.mqttCtx = groupCtx
 	h.mqttConn = util.NewConnWithContext(groupCtx, mqttConn, connTimeout)
+	h.mqttCodec = newMqttCodec(h.cfg.MqttProtocolVersion, h.log)
 
 	h.group.Go(func() error {
 		return h.mqttReceiveLoop(groupCtx)
@@ -182,15 +240,112 @@ func (h *handler1) run(ctx context.Context, snConn net.Conn) {
 		return h.snReceiveLoop(snCtx)
 	})
 
-	err := h.group.Wait()
-	if err != nil && err != Shutdown {
+	h.group.Go(func() error {
+		return h.superviseClient(groupCtx)
+	})
+
+	err = h.group.Wait()
+	if err != nil && err != Shutdown && err != ErrClientLost {
 		h.log.Error("Handler quits with error: %v", err)
 	}
 }
 
+func (h *handler1) dialMqtt(ctx context.Context) (net.Conn, error) {
+	if h.mockupDialFunc != nil {
+		// Used in tests.
+		return h.mockupDialFunc(), nil
+	}
+	h.log.Debug("Connecting to MQTT broker %s", h.cfg.MqttDialer)
+	conn, err := h.cfg.MqttDialer.DialContext(ctx)
+	if err != nil {
+		h.stats.brokerDialFailure()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// authorize reports whether the ACL permits the action on the topic.
+func (h *handler1) authorize(action ACLAction, topic string) bool {
+	if h.cfg.ACL == nil {
+		return true
+	}
+	client := &aclClient{
+		clientID:    h.clientID,
+		username:    h.username,
+		pskIdentity: h.pskIdentity,
+		certCN:      h.certCN,
+	}
+	if client.username == "" {
+		client.username = h.pskIdentity
+	}
+	if client.username == "" {
+		client.username = h.certCN
+	}
+	if h.cfg.ACL.allowed(client, action, topic) {
+		return true
+	}
+	h.log.Info("ACL: %s %q denied", action, topic)
+	return false
+}
+
+func (h *handler1) getMqttConn() (*util.ConnWithContext, mqttCodec) {
+	h.mqttConnMutex.RLock()
+	defer h.mqttConnMutex.RUnlock()
+	return h.mqttConn, h.mqttCodec
+}
+
+// mqttReconnect cleanly disconnects the current MQTT connection and replaces
+// it with a new one. The MQTT CONNECT packet must be sent by the caller.
+//
+// The old connection is closed before the new one is established because
+// the broker would consider a session takeover an unclean disconnection and
+// would publish the client's will.
+func (h *handler1) mqttReconnect() error {
+	h.mqttConnMutex.Lock()
+	defer h.mqttConnMutex.Unlock()
+
+	h.log.Debug("Reconnecting to MQTT broker")
+	mqDisconnect := mqPkts.NewControlPacket(mqPkts.Disconnect)
+	if err := h.mqttWrite(h.mqttConn, mqDisconnect); err != nil {
+		h.log.Error("Error sending DISCONNECT to MQTT broker: %s", err)
+	}
+	if err := h.mqttConn.Close(); err != nil {
+		h.log.Error("Error closing MQTT connection: %s", err)
+	}
+
+	mqttConn, err := h.dialMqtt(h.mqttCtx)
+	if err != nil {
+		return err
+	}
+	h.mqttConn = util.NewConnWithContext(h.mqttCtx, mqttConn, connTimeout)
+	// The codec state (e.g. MQTT 5 topic aliases) is per connection except
+	// for the client's sleep duration.
+	oldCodec := h.mqttCodec
+	h.mqttCodec = newMqttCodec(h.cfg.MqttProtocolVersion, h.log)
+	if oldCodec5, ok := oldCodec.(*mqtt5Codec); ok {
+		h.mqttCodec.(*mqtt5Codec).setSleepDuration(oldCodec5.getSleepDuration())
+	}
+	return nil
+}
+
+// updateSessionExpiry extends the MQTT 5 Session Expiry Interval of
+// a persistent session to cover the client's sleep. The interval can only be
+// changed on disconnect, hence the handler reconnects to the MQTT broker.
+func (h *handler1) updateSessionExpiry(ctx context.Context, duration uint16) error {
+	_, codec := h.getMqttConn()
+	codec5, ok := codec.(*mqtt5Codec)
+	if !ok || !codec5.setSleepDuration(duration) {
+		return nil
+	}
+	h.log.Debug("Updating MQTT session expiry for sleep duration %ds.", duration)
+	mqConnect := *h.mqConnect
+	return h.startWillUpdate(ctx, &mqConnect, nil)
+}
+
 func (h *handler1) setState(new util.ClientState) {
 	old := h.state.Set(new)
 	if new != old {
+		h.stats.handlerStateChanged(old, new)
 		h.log.Debug("State changed to %q.", new)
 	}
 }
@@ -249,8 +404,26 @@ func (h *handler1) handleClientPublish(ctx context.Context, snPublish *snPkts1.P
 	case snPkts1.TIT_SHORT:
 		topic = snPkts.DecodeShortTopic(snPublish.TopicID)
 	}
-	if snPublish.QOS == 1 {
-		h.transactions.Store(msgID, newClientPublishQOS1Transaction(ctx, h, msgID, snPublish.TopicID))
+	if !h.authorize(ACLPublish, topic) {
+		if snPublish.QOS == 1 || snPublish.QOS == 2 {
+			// See MQTT-SN specification v. 1.2, chapter 6.7: PUBACK with
+			// a rejection return code is sent in response to a rejected
+			// PUBLISH.
+			snPuback := snPkts1.NewPuback(snPublish.TopicID, snPkts1.RC_NOT_SUPPORTED)
+			snPuback.CopyMessageID(snPublish)
+			return h.snSend(snPuback)
+		}
+		return nil
+	}
+	switch snPublish.QOS {
+	case 1:
+		transaction := newClientPublishQOS1Transaction(ctx, h, msgID, snPublish.TopicID)
+		h.transactions.Store(msgID, transaction)
+		h.stats.observePublishTransaction(ctx, transaction, 1)
+	case 2:
+		transaction := newClientPublishQOS2Transaction(ctx, h, msgID, snPublish.TopicID)
+		h.transactions.Store(msgID, transaction)
+		h.stats.observePublishTransaction(ctx, transaction, 2)
 	}
 	mqPublish.TopicName = topic
 	mqPublish.Payload = snPublish.Data
@@ -261,30 +434,18 @@ func (h *handler1) handleClientPublish(ctx context.Context, snPublish *snPkts1.P
 func (h *handler1) handleBrokerPublish(ctx context.Context, mqPublish *mqPkts.PublishPacket) error {
 	msgID := mqPublish.MessageID
 
-	// Get TopicID
-	var needsRegister bool
-	var topicID uint16
-	var topicIDType uint8
-	if snPkts.IsShortTopic(mqPublish.TopicName) {
-		topicID = snPkts.EncodeShortTopic(mqPublish.TopicName)
-		topicIDType = snPkts1.TIT_SHORT
-		needsRegister = false
-	} else {
-		var ok bool
-		topicID, topicIDType, ok = h.findTopicID(mqPublish.TopicName)
-		needsRegister = !ok
-	}
-
+	topicID, topicIDType, needsRegister := h.publishTopicID(mqPublish.TopicName)
 	snPublish := snPkts1.NewPublish(topicID, mqPublish.Payload, mqPublish.Dup,
 		mqPublish.Qos, mqPublish.Retain, topicIDType)
 	snPublish.SetMessageID(mqPublish.MessageID)
 
-	if mqPublish.Qos == 0 {
-		// QOS 0 publish without topic registration does not need a transaction
-		if !needsRegister {
-			return h.snSend(snPublish)
-		}
+	// QOS 0 publish without topic registration does not need a transaction
+	if mqPublish.Qos == 0 && !needsRegister {
+		return h.snSend(snPublish)
+	}
 
+	h.msgIDMutex.Lock()
+	if mqPublish.Qos == 0 {
 		// We are reusing PUBLISH packet's MsgID because we
 		// really want to keep MQTT-SN MsgIDs and MQTT MsgIDs in
 		// sync. If we created a new MsgID, we would need
@@ -302,17 +463,26 @@ func (h *handler1) handleBrokerPublish(ctx context.Context, mqPublish *mqPkts.Pu
 		// But there's a big problem when PUBLISH is QoS 0, i.e.
 		// its MsgID is 0. We use a very dirty hack here to choose
 		// an "almost surely available" MsgID :(
-		found := false
-		for i := snPkts.MaxPacketID; i >= snPkts.MinPacketID; i-- {
-			if _, ok := h.transactions.Get(i); !ok {
-				msgID = i
-				found = true
-				break
-			}
-		}
-		if !found {
+		var ok bool
+		if msgID, ok = h.freeMsgID(); !ok {
+			h.msgIDMutex.Unlock()
 			return errors.New("cannot find available MsgID")
 		}
+	} else if holder, taken := h.transactions.Get(msgID); taken {
+		h.msgIDMutex.Unlock()
+		// The MsgID chosen by the broker is used by a transaction started
+		// by the gateway (or a previous PUBLISH with the same MsgID) => the
+		// PUBLISH is delivered when the transaction finishes.
+		h.log.Debug("MsgID %d in use, postponing PUBLISH.", msgID)
+		h.group.Go(func() error {
+			select {
+			case <-holder.Done():
+				return h.handleBrokerPublish(ctx, mqPublish)
+			case <-ctx.Done():
+				return nil
+			}
+		})
+		return nil
 	}
 
 	var transaction brokerPublishTransaction
@@ -324,14 +494,36 @@ func (h *handler1) handleBrokerPublish(ctx context.Context, mqPublish *mqPkts.Pu
 	case 2:
 		transaction = newBrokerPublishQOS2Transaction(ctx, h, msgID)
 	default:
+		h.msgIDMutex.Unlock()
 		return fmt.Errorf("invalid QoS in %v", mqPublish)
 	}
+	h.transactions.Store(msgID, transaction)
+	h.msgIDMutex.Unlock()
+
+	return h.startPublish(ctx, transaction, msgID, mqPublish.TopicName, snPublish, needsRegister)
+}
+
+// publishTopicID returns the TopicID and TopicID type to publish to the
+// topic and whether the topic must be registered first.
+func (h *handler1) publishTopicID(topic string) (uint16, uint8, bool) {
+	if snPkts.IsShortTopic(topic) {
+		return snPkts.EncodeShortTopic(topic), snPkts1.TIT_SHORT, false
+	}
+	topicID, topicIDType, ok := h.findTopicID(topic)
+	return topicID, topicIDType, !ok
+}
 
+// startPublish sends snPublish to the client. If needsRegister is set, the
+// topic is registered first and snPublish is sent after REGACK is received.
+// The transaction must be already stored under msgID.
+func (h *handler1) startPublish(ctx context.Context, transaction brokerPublishTransaction,
+	msgID uint16, topic string, snPublish *snPkts1.Publish, needsRegister bool) error {
 	var snPkt snPkts.Packet
 	var nextState transactionState
 	if needsRegister {
 		topicID, err := h.newTopicID()
 		if err != nil {
+			transaction.Fail(err)
 			return err
 		}
 
@@ -339,13 +531,13 @@ func (h *handler1) handleBrokerPublish(ctx context.Context, mqPublish *mqPkts.Pu
 		snPublish.TopicID = topicID
 		transaction.SetSNPublish(snPublish)
 
-		snRegister := snPkts1.NewRegister(topicID, mqPublish.TopicName)
+		snRegister := snPkts1.NewRegister(topicID, topic)
 		snRegister.SetMessageID(msgID)
 		nextState = awaitingRegack
 		snPkt = snRegister
 	} else {
 		snPkt = snPublish
-		if mqPublish.Qos == 1 {
+		if snPublish.QOS == 1 {
 			nextState = awaitingPuback
 		} else {
 			// Qos must be 2.
@@ -353,18 +545,31 @@ func (h *handler1) handleBrokerPublish(ctx context.Context, mqPublish *mqPkts.Pu
 		}
 	}
 
-	h.transactions.Store(msgID, transaction)
+	h.stats.observePublishTransaction(ctx, transaction, snPublish.QOS)
 	return transaction.ProceedSN(nextState, snPkt)
 }
 
+// freeMsgID returns a MsgID not used by any transaction. The MsgIDs are
+// searched from the top of the range because the clients usually allocate
+// their MsgIDs from the bottom. The caller must hold msgIDMutex until the
+// transaction is stored.
+func (h *handler1) freeMsgID() (uint16, bool) {
+	for i := snPkts.MaxPacketID; i >= snPkts.MinPacketID; i-- {
+		if _, ok := h.transactions.Get(i); !ok {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 func (h *handler1) handleMqtt(ctx context.Context, pkt mqPkts.ControlPacket) error {
 	h.log.Debug("=> %v", pkt)
 	switch mqPkt := pkt.(type) {
 
-	// Client CONNECT transaction.
+	// Client CONNECT or will update transaction.
 	case *mqPkts.ConnackPacket:
 		transactionx, _ := h.transactions.GetByType(snPkts.CONNECT)
-		transaction, ok := transactionx.(*connectTransaction)
+		transaction, ok := transactionx.(transactionWithConnack)
 		if !ok {
 			h.log.Error("Unexpected transaction type %T for packet: %v", transactionx, mqPkt)
 			return nil
@@ -383,20 +588,36 @@ func (h *handler1) handleMqtt(ctx context.Context, pkt mqPkts.ControlPacket) err
 
 	// Client PUBLISH QoS 2 transaction.
 	case *mqPkts.PubrecPacket:
+		transactionx, _ := h.transactions.Get(mqPkt.MessageID)
+		if transaction, ok := transactionx.(*clientPublishQOS2Transaction); ok {
+			return transaction.Pubrec(mqPkt)
+		}
+		// The transaction has timed out, the client may still wait for
+		// PUBREC.
 		snPubrec := snPkts1.NewPubrec()
 		snPubrec.SetMessageID(mqPkt.MessageID)
 		return h.snSend(snPubrec)
 
+	// Client PUBLISH QoS 1 or 2 transaction rejected by MQTT 5 broker.
+	case *mqtt5PubFailure:
+		transactionx, _ := h.transactions.Get(mqPkt.MessageID)
+		transaction, ok := transactionx.(transactionWithPubFailure)
+		if !ok {
+			h.log.Error("Unexpected transaction type %T for packet: %v", transactionx, mqPkt)
+			return nil
+		}
+		return transaction.PubFailure(mqPkt)
+
 	// Client PUBLISH QoS 2 transaction.
 	case *mqPkts.PubcompPacket:
 		snPubcomp := snPkts1.NewPubcomp()
 		snPubcomp.SetMessageID(mqPkt.MessageID)
 		return h.snSend(snPubcomp)
 
-	// Client SUBSCRIBE transaction.
+	// Client SUBSCRIBE or will update transaction.
 	case *mqPkts.SubackPacket:
 		transactionx, _ := h.transactions.Get(mqPkt.MessageID)
-		transaction, ok := transactionx.(*subscribeTransaction)
+		transaction, ok := transactionx.(transactionWithSuback)
 		if !ok {
 			h.log.Error("Unexpected transaction type %T for packet: %v", transactionx, mqPkt)
 			return nil
@@ -423,7 +644,16 @@ func (h *handler1) handleMqtt(ctx context.Context, pkt mqPkts.ControlPacket) err
 
 	// MQTT broker PUBLISH QoS 2 transaction.
 	case *mqPkts.PubrelPacket:
-		transactionx, _ := h.transactions.Get(mqPkt.MessageID)
+		transactionx, found := h.transactions.Get(mqPkt.MessageID)
+		if !found {
+			// The broker resends PUBREL of a QoS 2 PUBLISH delivered before
+			// the persistent session was resumed. The message has already been
+			// delivered, hence we can complete the flow.
+			h.log.Debug("No transaction for PUBREL %d, sending PUBCOMP.", mqPkt.MessageID)
+			mqPubcomp := mqPkts.NewControlPacket(mqPkts.Pubcomp).(*mqPkts.PubcompPacket)
+			mqPubcomp.MessageID = mqPkt.MessageID
+			return h.mqttSend(mqPubcomp)
+		}
 		transaction, ok := transactionx.(*brokerPublishQOS2Transaction)
 		if !ok {
 			h.log.Error("Unexpected transaction type %T for packet: %v", transactionx, mqPkt)
@@ -448,6 +678,8 @@ func (h *handler1) snReceiveLoop(ctx context.Context) error {
 			h.log.Error("MQTT-SN receive error: %v", err)
 			return err
 		}
+		h.stats.snReceived(pkt)
+		h.supervisor.activity()
 		err = h.handleMqttSn(ctx, pkt)
 		if err != nil {
 			return err
@@ -459,11 +691,17 @@ func (h *handler1) mqttReceiveLoop(ctx context.Context) error {
 	h.log.Debug("MQTT receiver starts.")
 	defer h.log.Debug("MQTT receiver quits.")
 	for {
-		pkt, err := mqPkts.ReadPacket(h.mqttConn)
+		conn, codec := h.getMqttConn()
+		reader := &countingReader{Reader: conn}
+		pkt, err := codec.ReadPacket(reader)
 		if err != nil {
 			if err == context.Canceled {
 				return nil
 			}
+			if currentConn, _ := h.getMqttConn(); conn != currentConn {
+				// The connection was replaced by mqttReconnect.
+				continue
+			}
 			if err == io.EOF {
 				// Clean shutdown.
 				if h.state.Get() == util.StateDisconnected {
@@ -475,6 +713,7 @@ func (h *handler1) mqttReceiveLoop(ctx context.Context) error {
 			h.log.Error("MQTT decode error: %v", err)
 			return err
 		}
+		h.stats.mqttReceived(reader.n)
 		if err := h.handleMqtt(ctx, pkt); err != nil {
 			return err
 		}
@@ -487,7 +726,10 @@ func (h *handler1) newTopicID() (uint16, error) {
 		return 0, ErrTopicIDsExhausted
 	}
 	for {
-		if _, ok := h.predefinedTopics.GetTopicName(h.clientID, topicID); !ok {
+		_, predefined := h.predefinedTopics.GetTopicName(h.clientID, topicID)
+		// Registered topics may be restored from a persistent session.
+		_, registered := h.registeredTopics.Load(topicID)
+		if !predefined && !registered {
 			break
 		}
 		if topicID, overflow = h.topicID.Next(); overflow {
@@ -508,9 +750,81 @@ func (h *handler1) registerTopic(topic string) (uint16, error) {
 		return 0, err
 	}
 	h.registeredTopics.Store(topicID, topic)
+	h.saveSession()
 	return topicID, nil
 }
 
+// startSession restores the client's persistent session or deletes the
+// stored one if the client requests a clean session or the broker has not
+// kept the session. It must be called after the broker accepts the CONNECT.
+func (h *handler1) startSession(cleanSession, sessionPresent bool) {
+	if h.cfg.SessionStore == nil {
+		return
+	}
+	h.sessionMutex.Lock()
+	defer h.sessionMutex.Unlock()
+
+	h.persistentSession = !cleanSession
+	if cleanSession || !sessionPresent {
+		if !cleanSession {
+			h.log.Info("The MQTT broker has not kept the session, discarding the stored one.")
+		}
+		if err := h.cfg.SessionStore.Delete(h.clientID); err != nil {
+			h.log.Error("Cannot delete session: %s", err)
+		}
+		return
+	}
+
+	session, err := h.cfg.SessionStore.Load(h.clientID)
+	if err != nil {
+		h.log.Error("Cannot load session: %s", err)
+		return
+	}
+	if session == nil {
+		return
+	}
+	h.log.Debug("Restoring session: %d registered topics, %d subscriptions.",
+		len(session.RegisteredTopics), len(session.Subscriptions))
+	for topicID, topic := range session.RegisteredTopics {
+		h.registeredTopics.Store(topicID, topic)
+	}
+	for topic, qos := range session.Subscriptions {
+		h.subscriptions.Store(topic, qos)
+	}
+	if session.NextTopicID != 0 {
+		h.topicID.SetNext(session.NextTopicID)
+	}
+}
+
+// saveSession stores the session state if the session is persistent.
+func (h *handler1) saveSession() {
+	if h.cfg.SessionStore == nil {
+		return
+	}
+	h.sessionMutex.Lock()
+	defer h.sessionMutex.Unlock()
+	if !h.persistentSession {
+		return
+	}
+
+	session := &Session{
+		RegisteredTopics: make(map[uint16]string),
+		Subscriptions:    make(map[string]uint8),
+		NextTopicID:      h.topicID.Peek(),
+	}
+	h.registeredTopics.Range(func(key, value interface{}) bool {
+		session.RegisteredTopics[key.(uint16)] = value.(string)
+		return true
+	})
+	h.subscriptions.Range(func(key, value interface{}) bool {
+		session.Subscriptions[key.(string)] = value.(uint8)
+		return true
+	})
+	if err := h.cfg.SessionStore.Save(h.clientID, session); err != nil {
+		h.log.Error("Cannot save session: %s", err)
+	}
+}
+
 func (h *handler1) handleConnect(ctx context.Context, snConnect *snPkts1.Connect) error {
 	// The ProtocolId [...] is coded 0x01. All other values are reserved.
 	// MQTT-SN specification v. 1.2, chapter 5.3.8
@@ -522,6 +836,8 @@ func (h *handler1) handleConnect(ctx context.Context, snConnect *snPkts1.Connect
 	}
 
 	if h.state.Get() == util.StateAwake {
+		h.stopSleepPinger()
+		h.supervisor.active()
 		h.setState(util.StateActive)
 		reply := &snPkts1.Connack{
 			ReturnCode: snPkts1.RC_ACCEPTED,
@@ -543,8 +859,18 @@ func (h *handler1) handleConnect(ctx context.Context, snConnect *snPkts1.Connect
 		return h.snSend(reply)
 	}
 
+	clientID, err := h.bindIdentity(string(snConnect.ClientID))
+	if err != nil {
+		h.log.Info("CONNECT rejected: %s", err)
+		return h.snSend(snPkts1.NewConnack(snPkts1.RC_NOT_SUPPORTED))
+	}
+
+	h.stopSleepPinger()
+	h.infoMutex.Lock()
 	h.keepAlive = snConnect.Duration
-	h.clientID = string(snConnect.ClientID)
+	h.clientID = clientID
+	h.infoMutex.Unlock()
+	h.supervisor.connect(time.Duration(h.keepAlive) * time.Second)
 
 	mqConnect := &mqPkts.ConnectPacket{
 		FixedHeader: mqPkts.FixedHeader{
@@ -553,23 +879,36 @@ func (h *handler1) handleConnect(ctx context.Context, snConnect *snPkts1.Connect
 		ClientIdentifier: h.clientID,
 		CleanSession:     snConnect.CleanSession,
 		Keepalive:        h.keepAlive,
-		ProtocolVersion:  4,
-		ProtocolName:     "MQTT",
-		UsernameFlag:     h.cfg.MqttUser != nil,
-		PasswordFlag:     h.cfg.MqttPassword != nil,
-		Password:         h.cfg.MqttPassword,
-		WillFlag:         snConnect.Will,
+		// The MQTT 5 codec sets its own protocol level.
+		ProtocolVersion: MqttVersion311,
+		ProtocolName:    "MQTT",
+		UsernameFlag:    h.cfg.MqttUser != nil,
+		PasswordFlag:    h.cfg.MqttPassword != nil,
+		Password:        h.cfg.MqttPassword,
+		WillFlag:        snConnect.Will,
 	}
 	if mqConnect.UsernameFlag {
 		mqConnect.Username = *h.cfg.MqttUser
 	}
+	h.infoMutex.Lock()
+	h.username = ""
+	if h.cfg.IdentityBinding.MqttUsername {
+		h.username = h.dtlsIdentities()[0]
+	}
+	h.infoMutex.Unlock()
+	if h.cfg.IdentityBinding.MqttUsername {
+		mqConnect.UsernameFlag = true
+		mqConnect.Username = h.username
+	}
 
 	// Cancel previous transaction, if any.
 	if oldTransaction, ok := h.transactions.GetByType(snPkts.CONNECT); ok {
 		oldTransaction.Fail(Cancelled)
 	}
+	h.mqConnect = mqConnect
 	transaction := newConnectTransaction(ctx, h, h.cfg.AuthEnabled, mqConnect)
 	h.transactions.StoreByType(snPkts.CONNECT, transaction)
+	h.stats.observeTransaction(ctx, transaction)
 	return transaction.Start(ctx)
 }
 
@@ -583,25 +922,7 @@ func (h *handler1) handleSubscribe(ctx context.Context, snSubscribe *snPkts1.Sub
 	switch snSubscribe.TopicIDType {
 	case snPkts1.TIT_STRING:
 		topic = string(snSubscribe.TopicName)
-		if !hasWildcard(topic) {
-			var err error
-			topicID, err = h.newTopicID()
-			if err != nil {
-				snSuback := snPkts1.NewSuback(0, snPkts1.RC_INVALID_TOPIC_ID, 0)
-				// We are kind of misusing the "invalid topic ID" return code here.
-				// Please see note in `case *snPkts.Register`.
-				snSuback.CopyMessageID(snSubscribe)
-				return h.snSend(snSuback)
-			}
-			// We must register the topic here, even when we can get
-			// a non-successful SUBACK later because MQTT specification says
-			// explicitly:
-			// The Server is permitted to start sending PUBLISH packets matching
-			// the Subscription before the Server sends the SUBACK Packet.
-			// [MQTT v.5.0, chapter 3.8.4 SUBSCRIBE Actions]
-			h.registeredTopics.Store(topicID, topic)
-		}
-		// topicID remains zero if client is subscribing to a wildcard topic.
+		// topicID is assigned below.
 	case snPkts1.TIT_PREDEFINED:
 		var ok bool
 		topic, ok = h.predefinedTopics.GetTopicName(h.clientID, snSubscribe.TopicID)
@@ -614,9 +935,36 @@ func (h *handler1) handleSubscribe(ctx context.Context, snSubscribe *snPkts1.Sub
 		// topicID remains zero.
 	}
 
+	if !h.authorize(ACLSubscribe, topic) {
+		snSuback := snPkts1.NewSuback(0, snPkts1.RC_NOT_SUPPORTED, 0)
+		snSuback.CopyMessageID(snSubscribe)
+		return h.snSend(snSuback)
+	}
+
+	if snSubscribe.TopicIDType == snPkts1.TIT_STRING && !hasWildcard(topic) {
+		var err error
+		topicID, err = h.newTopicID()
+		if err != nil {
+			snSuback := snPkts1.NewSuback(0, snPkts1.RC_INVALID_TOPIC_ID, 0)
+			// We are kind of misusing the "invalid topic ID" return code here.
+			// Please see note in `case *snPkts.Register`.
+			snSuback.CopyMessageID(snSubscribe)
+			return h.snSend(snSuback)
+		}
+		// We must register the topic here, even when we can get
+		// a non-successful SUBACK later because MQTT specification says
+		// explicitly:
+		// The Server is permitted to start sending PUBLISH packets matching
+		// the Subscription before the Server sends the SUBACK Packet.
+		// [MQTT v.5.0, chapter 3.8.4 SUBSCRIBE Actions]
+		h.registeredTopics.Store(topicID, topic)
+	}
+	// topicID remains zero if client is subscribing to a wildcard topic.
+
 	msgID := snSubscribe.MessageID()
-	transaction := newSubscribeTransaction(ctx, h, msgID, topicID)
+	transaction := newSubscribeTransaction(ctx, h, msgID, topicID, topic)
 	h.transactions.Store(msgID, transaction)
+	h.stats.observeTransaction(ctx, transaction)
 
 	mqSubscribe := mqPkts.NewControlPacket(mqPkts.Subscribe).(*mqPkts.SubscribePacket)
 	mqSubscribe.MessageID = snSubscribe.MessageID()
@@ -626,6 +974,56 @@ func (h *handler1) handleSubscribe(ctx context.Context, snSubscribe *snPkts1.Sub
 	return h.mqttSend(mqSubscribe)
 }
 
+func (h *handler1) handleWillTopicUpd(ctx context.Context, snWillTopicUpd *snPkts1.WillTopicUpd) error {
+	mqConnect := *h.mqConnect
+	if snWillTopicUpd.WillTopic == "" {
+		// An empty WILLTOPICUPD deletes the will.
+		// See MQTT-SN specification v. 1.2, chapter 5.4.22 WILLTOPICUPD.
+		mqConnect.WillFlag = false
+		mqConnect.WillTopic = ""
+		mqConnect.WillQos = 0
+		mqConnect.WillRetain = false
+		mqConnect.WillMessage = nil
+	} else {
+		if !h.authorize(ACLPublish, snWillTopicUpd.WillTopic) {
+			return h.snSend(snPkts1.NewWillTopicResp(snPkts1.RC_NOT_SUPPORTED))
+		}
+		mqConnect.WillFlag = true
+		mqConnect.WillTopic = snWillTopicUpd.WillTopic
+		mqConnect.WillQos = snWillTopicUpd.QOS
+		mqConnect.WillRetain = snWillTopicUpd.Retain
+	}
+	return h.startWillUpdate(ctx, &mqConnect, func(code snPkts1.ReturnCode) snPkts.Packet {
+		return snPkts1.NewWillTopicResp(code)
+	})
+}
+
+func (h *handler1) handleWillMsgUpd(ctx context.Context, snWillMsgUpd *snPkts1.WillMsgUpd) error {
+	mqConnect := *h.mqConnect
+	mqConnect.WillMessage = snWillMsgUpd.WillMsg
+	if !mqConnect.WillFlag {
+		// No will topic is set => the MQTT connection need not be changed
+		// now. The message will be used if a WILLTOPICUPD follows.
+		h.mqConnect = &mqConnect
+		return h.snSend(snPkts1.NewWillMsgResp(snPkts1.RC_ACCEPTED))
+	}
+	return h.startWillUpdate(ctx, &mqConnect, func(code snPkts1.ReturnCode) snPkts.Packet {
+		return snPkts1.NewWillMsgResp(code)
+	})
+}
+
+func (h *handler1) startWillUpdate(ctx context.Context, mqConnect *mqPkts.ConnectPacket, newResp willRespFunc) error {
+	// Cancel previous transaction, if any (the client probably did not
+	// receive our response and repeats the request).
+	if oldTransaction, ok := h.transactions.GetByType(snPkts.CONNECT); ok {
+		oldTransaction.Fail(Cancelled)
+	}
+	transaction := newWillUpdateTransaction(ctx, h, mqConnect, newResp)
+	h.transactions.StoreByType(snPkts.CONNECT, transaction)
+	h.stats.observeTransaction(ctx, transaction)
+	return transaction.Start(ctx)
+}
+
 func (h *handler1) handleUnsubscribe(snUnsubscribe *snPkts1.Unsubscribe) error {
 	var topic string
 	switch snUnsubscribe.TopicIDType {
@@ -641,6 +1039,9 @@ func (h *handler1) handleUnsubscribe(snUnsubscribe *snPkts1.Unsubscribe) error {
 		topic = snPkts.DecodeShortTopic(snUnsubscribe.TopicID)
 	}
 
+	h.subscriptions.Delete(topic)
+	h.saveSession()
+
 	mqUnsubscribe := mqPkts.NewControlPacket(mqPkts.Unsubscribe).(*mqPkts.UnsubscribePacket)
 	mqUnsubscribe.MessageID = snUnsubscribe.MessageID()
 	mqUnsubscribe.Topics = []string{topic}
@@ -675,6 +1076,9 @@ func (h *handler1) checkPacketLegal(pkt snPkts.Packet) error {
 	// responds to DISCONNECT => we must enable DISCONNECT packet.
 	case *snPkts1.Disconnect:
 		return nil
+	// A client may look for a gateway before it connects.
+	case *snPkts1.SearchGw:
+		return nil
 	case *snPkts1.Publish:
 		// QOS 3 packets with short or predefined topics are allowed
 		// without prior CONNECT.
@@ -703,6 +1107,12 @@ func (h *handler1) handleMqttSn(ctx context.Context, pkt snPkts.Packet) error {
 	case *snPkts1.Connect:
 		return h.handleConnect(ctx, snPkt)
 
+	// Gateway discovery (unicast SEARCHGW). The GwAdd field is
+	// only present if GWINFO is sent by a client.
+	// See MQTT-SN specification v. 1.2, chapter 5.4.3 GWINFO.
+	case *snPkts1.SearchGw:
+		return h.snSend(snPkts1.NewGwInfo(h.cfg.GatewayID, nil))
+
 	// Client CONNECT transaction.
 	case *snPkts1.Auth:
 		transactionx, _ := h.transactions.GetByType(snPkts.CONNECT)
@@ -730,8 +1140,22 @@ func (h *handler1) handleMqttSn(ctx context.Context, pkt snPkts.Packet) error {
 		h.log.Error("Unexpected transaction type %T for packet: %v", transactionx, snPkt)
 		return nil
 
+	// Client will update transaction.
+	case *snPkts1.WillTopicUpd:
+		return h.handleWillTopicUpd(ctx, snPkt)
+
+	// Client will update transaction.
+	case *snPkts1.WillMsgUpd:
+		return h.handleWillMsgUpd(ctx, snPkt)
+
 	// Client REGISTER transaction.
 	case *snPkts1.Register:
+		// The client registers topics to publish to.
+		if !h.authorize(ACLPublish, snPkt.TopicName) {
+			m2 := snPkts1.NewRegack(0, snPkts1.RC_NOT_SUPPORTED)
+			m2.CopyMessageID(snPkt)
+			return h.snSend(m2)
+		}
 		returnCode := snPkts1.RC_ACCEPTED
 		topicID, err := h.registerTopic(snPkt.TopicName)
 		if err != nil {
@@ -772,14 +1196,16 @@ func (h *handler1) handleMqttSn(ctx context.Context, pkt snPkts.Packet) error {
 	// Client PING transaction (going AWAKE or just a keepalive).
 	case *snPkts1.Pingreq:
 		if h.state.Get() == util.StateAsleep {
+			h.stopSleepPinger()
 			// Must be set before snSend otherwise the packets will be queued...
 			h.setState(util.StateAwake)
-			for _, m2 := range h.pktBuffer {
-				if err := h.snSend(m2); err != nil {
+			for _, entry := range h.sleepBuffer.take() {
+				h.log.Debug("<- %v", entry.pkt)
+				if err := h.snWrite(entry.pkt, entry.data); err != nil {
 					return err
 				}
 			}
-			h.pktBuffer = nil
+			h.startDownlinks()
 			return h.snSend(snPkts1.NewPingresp())
 		} else {
 			mqPkt := mqPkts.NewControlPacket(mqPkts.Pingreq).(*mqPkts.PingreqPacket)
@@ -788,6 +1214,7 @@ func (h *handler1) handleMqttSn(ctx context.Context, pkt snPkts.Packet) error {
 
 	// Client DISCONNECT transaction.
 	case *snPkts1.Disconnect:
+		h.stopSleepPinger()
 		if snPkt.Duration == 0 {
 			mqPkt := mqPkts.NewControlPacket(mqPkts.Disconnect).(*mqPkts.DisconnectPacket)
 			h.mqttSend(mqPkt)
@@ -800,18 +1227,20 @@ func (h *handler1) handleMqttSn(ctx context.Context, pkt snPkts.Packet) error {
 		} else {
 			h.log.Debug("Going to sleep for %vs", snPkt.Duration)
 			if h.keepAlive != 0 && snPkt.Duration > h.keepAlive {
-				// We must ensure MQTT gateway considers client alive during sleep period.
-				cancelPinger := h.startSleepPinger(ctx)
-				time.AfterFunc(time.Duration(snPkt.Duration)*time.Second, cancelPinger)
+				// We must ensure MQTT gateway considers client alive during
+				// sleep period. The pinger is stopped when the client wakes
+				// up or the handler quits because the client is lost.
+				h.cancelSleepPinger = h.startSleepPinger(ctx)
 			}
-			h.pktBuffer = nil
+			h.supervisor.asleep(time.Duration(snPkt.Duration) * time.Second)
+			h.sleepBuffer.clear()
 			m2 := snPkts1.NewDisconnect(0)
 			if err := h.snSend(m2); err != nil {
 				return err
 			}
 			// Must be set after snSend otherwise the packet will be queued...
 			h.setState(util.StateAsleep)
-			return nil
+			return h.updateSessionExpiry(ctx, snPkt.Duration)
 		}
 
 	// MQTT-SN gateway REGISTER transaction.
@@ -827,28 +1256,28 @@ func (h *handler1) handleMqttSn(ctx context.Context, pkt snPkts.Packet) error {
 		h.log.Error("Unexpected transaction type %T for packet: %v", transactionx, snPkt)
 		return nil
 
-	// MQTT broker PUBLISH QoS 1 transaction.
+	// MQTT broker PUBLISH QoS 1 or downlink transaction.
 	case *snPkts1.Puback:
 		transactionx, _ := h.transactions.Get(snPkt.MessageID())
-		if transaction, ok := transactionx.(*brokerPublishQOS1Transaction); ok {
+		if transaction, ok := transactionx.(transactionWithPuback); ok {
 			return transaction.Puback(snPkt)
 		}
 		h.log.Error("Unexpected transaction type %T for packet: %v", transactionx, snPkt)
 		return nil
 
-	// MQTT broker PUBLISH QoS 2 transaction.
+	// MQTT broker PUBLISH QoS 2 or downlink transaction.
 	case *snPkts1.Pubrec:
 		transactionx, _ := h.transactions.Get(snPkt.MessageID())
-		if transaction, ok := transactionx.(*brokerPublishQOS2Transaction); ok {
+		if transaction, ok := transactionx.(transactionWithPubrec); ok {
 			return transaction.Pubrec(snPkt)
 		}
 		h.log.Error("Unexpected transaction type %T for packet: %v", transactionx, snPkt)
 		return nil
 
-	// MQTT broker PUBLISH QoS 2 transaction.
+	// MQTT broker PUBLISH QoS 2 or downlink transaction.
 	case *snPkts1.Pubcomp:
 		transactionx, _ := h.transactions.Get(snPkt.MessageID())
-		if transaction, ok := transactionx.(*brokerPublishQOS2Transaction); ok {
+		if transaction, ok := transactionx.(transactionWithPubcomp); ok {
 			return transaction.Pubcomp(snPkt)
 		}
 		h.log.Error("Unexpected transaction type %T for packet: %v", transactionx, snPkt)
@@ -879,36 +1308,69 @@ func (h *handler1) startSleepPinger(ctx context.Context) context.CancelFunc {
 	return cancel
 }
 
+func (h *handler1) stopSleepPinger() {
+	if h.cancelSleepPinger != nil {
+		h.cancelSleepPinger()
+		h.cancelSleepPinger = nil
+	}
+}
+
 func (h *handler1) snSend(pkt snPkts.Packet) error {
+	buf, err := pkt.Pack()
+	if err != nil {
+		return err
+	}
 	if h.state.Get() == util.StateAsleep {
 		h.log.Debug("Queued %v", pkt)
-		h.pktBuffer = append(h.pktBuffer, pkt)
-		// TODO: Potentional serialization errors will be delayed!
+		h.sleepBuffer.add(pkt, buf)
 		return nil
 	}
 	h.log.Debug("<- %v", pkt)
-	buf, err := pkt.Pack()
-	if err != nil {
-		return err
+	return h.snWrite(pkt, buf)
+}
+
+// sleepBufferDropped fails the transaction which sent the dropped packet.
+// Otherwise, the transaction would keep resending the packet until it runs
+// out of retries and the MsgID would stay in use.
+func (h *handler1) sleepBufferDropped(pkt snPkts.Packet) {
+	pktWithID, ok := pkt.(snPkts1.PacketWithID)
+	if !ok {
+		return
+	}
+	transactionx, ok := h.transactions.Get(pktWithID.MessageID())
+	if !ok {
+		return
 	}
-	_, err = h.snConn.Write(buf)
+	if transaction, ok := transactionx.(brokerPublishTransaction); ok {
+		transaction.Fail(ErrSleepBufferDrop)
+	}
+}
+
+// snWrite writes the packed packet to the MQTT-SN connection.
+func (h *handler1) snWrite(pkt snPkts.Packet, buf []byte) error {
+	_, err := h.snConn.Write(buf)
 	if err != nil {
 		return err
 	}
+	h.stats.snSent(pkt, len(buf))
 
 	return nil
 }
 
 func (h *handler1) mqttSend(pkt mqPkts.ControlPacket) error {
+	h.mqttConnMutex.RLock()
+	defer h.mqttConnMutex.RUnlock()
+	return h.mqttWrite(h.mqttConn, pkt)
+}
+
+// mqttWrite writes the packet to the MQTT connection. The caller must hold
+// mqttConnMutex.
+func (h *handler1) mqttWrite(conn *util.ConnWithContext, pkt mqPkts.ControlPacket) error {
 	h.log.Debug("<= %v", pkt)
-	buff := &bytes.Buffer{}
-	err := pkt.Write(buff)
-	if err != nil {
-		return err
-	}
-	_, err = h.mqttConn.Write(buff.Bytes())
+	n, err := h.mqttCodec.WritePacket(conn, pkt)
 	if err != nil {
 		return err
 	}
+	h.stats.mqttSent(n)
 	return nil
 }
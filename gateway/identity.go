@@ -0,0 +1,103 @@
+// DTLS identity binding.
+//
+// The DTLS identities of a client are its PSK identity or the CN and the
+// DNS, e-mail and URI SANs of its certificate. The primary identity is the
+// PSK identity or the certificate CN (the first SAN if there is no CN).
+
+package gateway
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pion/dtls/v2"
+)
+
+var ErrNoDTLSIdentity = errors.New("no DTLS client identity")
+
+// IdentityBinding binds the DTLS client identity to the MQTT-SN ClientID and
+// to the MQTT username.
+type IdentityBinding struct {
+	// ClientIDTemplate enables the ClientID check if not empty. The CONNECT
+	// ClientID must be equal to the template with "%i" replaced by one of
+	// the DTLS identities of the client, e.g. "%i" or "sensor-%i". If the
+	// ClientID is empty, the template expanded with the primary identity is
+	// used.
+	ClientIDTemplate string
+	// MqttUsername sets the MQTT username to the primary identity. An AUTH
+	// username must be equal to it.
+	MqttUsername bool
+}
+
+func (b *IdentityBinding) enabled() bool {
+	return b.ClientIDTemplate != "" || b.MqttUsername
+}
+
+func (h *handler1) setDTLSIdentity(state dtls.State) {
+	h.infoMutex.Lock()
+	defer h.infoMutex.Unlock()
+	h.pskIdentity = string(state.IdentityHint)
+	if len(state.PeerCertificates) > 0 {
+		certs := make([]*x509.Certificate, 0, len(state.PeerCertificates))
+		for _, raw := range state.PeerCertificates {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				h.log.Error("Invalid client certificate: %s", err)
+				return
+			}
+			certs = append(certs, cert)
+		}
+		h.certChain = h.cfg.ClientCert.verifyClientChain(certs)
+		if h.certChain == nil {
+			h.log.Error("Client certificate %q not verified", certs[0].Subject.String())
+			return
+		}
+		h.log.Info("Client certificate verified: %s", describeCertChain(h.certChain))
+		cert := certs[0]
+		h.certCN = cert.Subject.CommonName
+		h.certSANs = append(h.certSANs, cert.DNSNames...)
+		h.certSANs = append(h.certSANs, cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			h.certSANs = append(h.certSANs, uri.String())
+		}
+	}
+}
+
+// dtlsIdentities returns all the DTLS identities of the client, the primary
+// one first.
+func (h *handler1) dtlsIdentities() []string {
+	var identities []string
+	for _, identity := range append([]string{h.pskIdentity, h.certCN}, h.certSANs...) {
+		if identity != "" {
+			identities = append(identities, identity)
+		}
+	}
+	return identities
+}
+
+// bindIdentity checks the CONNECT ClientID against the IdentityBinding and
+// returns the ClientID to use.
+func (h *handler1) bindIdentity(clientID string) (string, error) {
+	binding := &h.cfg.IdentityBinding
+	if !binding.enabled() {
+		return clientID, nil
+	}
+	identities := h.dtlsIdentities()
+	if len(identities) == 0 {
+		return "", ErrNoDTLSIdentity
+	}
+	if binding.ClientIDTemplate == "" {
+		return clientID, nil
+	}
+	if clientID == "" {
+		return strings.ReplaceAll(binding.ClientIDTemplate, "%i", identities[0]), nil
+	}
+	for _, identity := range identities {
+		if strings.ReplaceAll(binding.ClientIDTemplate, "%i", identity) == clientID {
+			return clientID, nil
+		}
+	}
+	return "", fmt.Errorf("ClientID %q does not match the DTLS client identity", clientID)
+}
@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"testing"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/topics"
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestBindIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	h := &handler1{cfg: &handlerConfig{}}
+
+	// Binding disabled.
+	clientID, err := h.bindIdentity("anything")
+	assert.NoError(err)
+	assert.Equal("anything", clientID)
+
+	h.cfg.IdentityBinding.ClientIDTemplate = "sensor-%i"
+	_, err = h.bindIdentity("sensor-1")
+	assert.Equal(ErrNoDTLSIdentity, err)
+
+	h.certCN = "1"
+	h.certSANs = []string{"1.example.com"}
+	clientID, err = h.bindIdentity("sensor-1")
+	assert.NoError(err)
+	assert.Equal("sensor-1", clientID)
+	clientID, err = h.bindIdentity("sensor-1.example.com")
+	assert.NoError(err)
+	assert.Equal("sensor-1.example.com", clientID)
+	_, err = h.bindIdentity("sensor-2")
+	assert.Error(err)
+
+	// Derived from the primary identity.
+	clientID, err = h.bindIdentity("")
+	assert.NoError(err)
+	assert.Equal("sensor-1", clientID)
+
+	h.pskIdentity = "psk"
+	assert.Equal([]string{"psk", "1", "1.example.com"}, h.dtlsIdentities())
+}
+
+func TestIdentityBindingConnect(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.handler.cfg.IdentityBinding = IdentityBinding{
+		ClientIDTemplate: "test-%i",
+		MqttUsername:     true,
+	}
+	stp.handler.pskIdentity = "device"
+
+	// client --CONNECT--> GW
+	snConnect := snPkts1.NewConnect(1, []byte("test-other"), false, true)
+	stp.snSend(snConnect, false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snPkts1.Connack)
+	assert.Equal(snPkts1.RC_NOT_SUPPORTED, snConnack.ReturnCode)
+	assert.Equal(util.StateDisconnected, stp.handler.state.Get())
+
+	// client --CONNECT--> GW
+	snConnect = snPkts1.NewConnect(1, []byte("test-device"), false, true)
+	stp.snSend(snConnect, false)
+
+	// GW --CONNECT--> MQTT broker
+	mqttConnect := stp.mqttRecv().(*mqPkts.ConnectPacket)
+	assert.Equal("test-device", mqttConnect.ClientIdentifier)
+	assert.True(mqttConnect.UsernameFlag)
+	assert.Equal("device", mqttConnect.Username)
+
+	// GW <--CONNACK-- MQTT broker
+	mqttConnack := mqPkts.NewControlPacket(mqPkts.Connack).(*mqPkts.ConnackPacket)
+	mqttConnack.ReturnCode = mqPkts.Accepted
+	stp.mqttSend(mqttConnack, false)
+
+	// client <--CONNACK-- GW
+	snConnack = stp.snRecv().(*snPkts1.Connack)
+	assert.Equal(snPkts1.RC_ACCEPTED, snConnack.ReturnCode)
+
+	stp.disconnect()
+}
+
+func TestIdentityBindingAuthMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, true, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.handler.cfg.IdentityBinding = IdentityBinding{MqttUsername: true}
+	stp.handler.pskIdentity = "device"
+
+	// client --CONNECT--> GW
+	snConnect := snPkts1.NewConnect(1, []byte("test-client"), false, true)
+	stp.snSend(snConnect, false)
+
+	// client --AUTH--> GW
+	stp.snSend(snPkts1.NewAuthPlain("other", []byte("pwd")), false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snPkts1.Connack)
+	assert.Equal(snPkts1.RC_NOT_SUPPORTED, snConnack.ReturnCode)
+
+	stp.assertHandlerDone()
+}
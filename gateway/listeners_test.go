@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/topics"
+	"github.com/energostack/bisquitt/util"
+)
+
+// blockingDialer never connects to the MQTT broker.
+type blockingDialer struct{}
+
+func (blockingDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingDialer) String() string {
+	return "blocking"
+}
+
+func TestListeners(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gatewayTopics := topics.PredefinedTopics{}
+	gatewayTopics.Add("", "gateway/topic", 1)
+	listenerTopics := topics.PredefinedTopics{}
+	listenerTopics.Add("", "listener/topic", 1)
+	gw := NewGateway(util.NewDebugLogger("listeners"), &GatewayConfig{
+		PredefinedTopics: gatewayTopics,
+	})
+
+	assert.Error(gw.Serve(ctx, nil))
+	_, err := gw.listen(ctx, ListenerConfig{Address: "127.0.0.1:0", UseDTLS: true})
+	assert.Error(err)
+
+	listeners := []ListenerConfig{
+		{Address: "127.0.0.1:0"},
+		{Address: "127.0.0.1:0", AuthEnabled: true, PredefinedTopics: listenerTopics},
+	}
+	if conn, err := net.ListenPacket("udp", "[::1]:0"); err == nil {
+		conn.Close()
+		listeners = append(listeners, ListenerConfig{Address: "[::1]:0", PredefinedTopics: listenerTopics})
+	} else {
+		t.Log("IPv6 not available")
+	}
+
+	gw.current.setListeners(listeners)
+	var handlers sync.WaitGroup
+	for i, lc := range listeners {
+		snListener, err := gw.listen(ctx, lc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handlerCfg := &handlerConfig{
+			MqttDialer:  blockingDialer{},
+			AuthEnabled: lc.AuthEnabled,
+		}
+		served := make(chan error)
+		go func() {
+			served <- gw.serve(ctx, snListener, handlerCfg, i, &handlers)
+		}()
+
+		client, err := net.Dial("udp", snListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := snPkts1.NewConnect(1, []byte("test-client"), false, true).Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		var running *runningHandler
+		assert.Eventually(func() bool {
+			var ok bool
+			running, ok = gw.findHandler(client.LocalAddr().String())
+			return ok
+		}, time.Second, 10*time.Millisecond)
+		if running != nil {
+			assert.Equal(lc.AuthEnabled, running.handler.cfg.AuthEnabled)
+			if lc.PredefinedTopics != nil {
+				assert.Equal(listenerTopics, running.handler.predefinedTopics)
+			} else {
+				assert.Equal(gatewayTopics, running.handler.predefinedTopics)
+			}
+		}
+
+		snListener.Close()
+		assert.NoError(<-served)
+		client.Close()
+	}
+
+	cancel()
+	handlers.Wait()
+
+	reloadedTopics := topics.PredefinedTopics{}
+	reloadedTopics.Add("", "reloaded/topic", 1)
+	assert.NoError(gw.Reload(&Reloadable{
+		PredefinedTopics:         gatewayTopics,
+		ListenerPredefinedTopics: []topics.PredefinedTopics{reloadedTopics, reloadedTopics},
+	}))
+	_, predefinedTopics := gw.current.get(0)
+	assert.Equal(gatewayTopics, predefinedTopics)
+	_, predefinedTopics = gw.current.get(1)
+	assert.Equal(reloadedTopics, predefinedTopics)
+}
+
+func TestListenNetwork(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("udp4", listenNetwork("0.0.0.0:1883"))
+	assert.Equal("udp6", listenNetwork("[::]:1883"))
+	assert.Equal("udp6", listenNetwork("[::1]:1883"))
+	assert.Equal("udp", listenNetwork("localhost:1883"))
+	assert.Equal("udp", listenNetwork(":1883"))
+}
+
+func TestListenersSamePort(t *testing.T) {
+	assert := assert.New(t)
+
+	if conn, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skip("IPv6 not available")
+	} else {
+		conn.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gw := NewGateway(util.NewDebugLogger("listeners"), &GatewayConfig{})
+	ipv4, err := gw.listen(ctx, ListenerConfig{Address: "0.0.0.0:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ipv4.Close()
+	port := ipv4.Addr().(*net.UDPAddr).Port
+
+	ipv6, err := gw.listen(ctx, ListenerConfig{Address: net.JoinHostPort("::", strconv.Itoa(port))})
+	if assert.NoError(err) {
+		ipv6.Close()
+	}
+}
@@ -0,0 +1,129 @@
+// Prometheus metrics.
+//
+// The metrics are computed from the gateway statistics on every scrape.
+
+package gateway
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	snPkts "github.com/energostack/bisquitt/packets"
+	"github.com/energostack/bisquitt/util"
+)
+
+const metricsNamespace = "bisquitt"
+
+type metricsCollector struct {
+	stats *stats
+}
+
+var metricsDescs = []*prometheus.Desc{
+	clientsDesc, snPacketsReceivedDesc, snPacketsSentDesc,
+	snBytesReceivedDesc, snBytesSentDesc,
+	mqttPacketsReceivedDesc, mqttPacketsSentDesc,
+	mqttBytesReceivedDesc, mqttBytesSentDesc,
+	transactionsDesc, retriesDesc, dtlsHandshakeErrorsDesc,
+	pskCacheHitsDesc, pskCacheMissesDesc, brokerDialFailuresDesc,
+	sleepBufferDropsDesc, clientsLostDesc,
+}
+
+var (
+	clientsDesc = newMetricsDesc("clients",
+		"Number of MQTT-SN clients by state.", "state")
+	snPacketsReceivedDesc = newMetricsDesc("mqttsn_packets_received_total",
+		"Number of MQTT-SN packets received from clients by packet type.", "type")
+	snPacketsSentDesc = newMetricsDesc("mqttsn_packets_sent_total",
+		"Number of MQTT-SN packets sent to clients by packet type.", "type")
+	snBytesReceivedDesc = newMetricsDesc("mqttsn_received_bytes_total",
+		"Number of MQTT-SN bytes received from clients.")
+	snBytesSentDesc = newMetricsDesc("mqttsn_sent_bytes_total",
+		"Number of MQTT-SN bytes sent to clients.")
+	mqttPacketsReceivedDesc = newMetricsDesc("mqtt_packets_received_total",
+		"Number of MQTT packets received from the broker.")
+	mqttPacketsSentDesc = newMetricsDesc("mqtt_packets_sent_total",
+		"Number of MQTT packets sent to the broker.")
+	mqttBytesReceivedDesc = newMetricsDesc("mqtt_received_bytes_total",
+		"Number of MQTT bytes received from the broker.")
+	mqttBytesSentDesc = newMetricsDesc("mqtt_sent_bytes_total",
+		"Number of MQTT bytes sent to the broker.")
+	transactionsDesc = newMetricsDesc("transactions_total",
+		"Number of finished transactions by result.", "result")
+	retriesDesc = newMetricsDesc("retries_total",
+		"Number of packets resent because of a missing response.")
+	dtlsHandshakeErrorsDesc = newMetricsDesc("dtls_handshake_errors_total",
+		"Number of failed DTLS handshakes.")
+	pskCacheHitsDesc = newMetricsDesc("psk_cache_hits_total",
+		"Number of PSK lookups served from the cache.")
+	pskCacheMissesDesc = newMetricsDesc("psk_cache_misses_total",
+		"Number of PSK lookups not served from the cache.")
+	brokerDialFailuresDesc = newMetricsDesc("broker_dial_failures_total",
+		"Number of failed connection attempts to the MQTT broker.")
+	sleepBufferDropsDesc = newMetricsDesc("sleep_buffer_dropped_total",
+		"Number of packets for sleeping clients dropped because of a full buffer or expired.")
+	clientsLostDesc = newMetricsDesc("clients_lost_total",
+		"Number of clients which were silent longer than their keepalive period or sleep duration.")
+)
+
+func newMetricsDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, labels, nil)
+}
+
+// Collector returns a Prometheus collector of the gateway metrics.
+func (gw *Gateway) Collector() prometheus.Collector {
+	return &metricsCollector{
+		stats: gw.stats,
+	}
+}
+
+// prometheus.Collector.Describe() implementation.
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range metricsDescs {
+		ch <- desc
+	}
+	c.stats.publishDuration.Describe(ch)
+}
+
+// prometheus.Collector.Collect() implementation.
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stats
+
+	for state := range s.handlers {
+		ch <- prometheus.MustNewConstMetric(clientsDesc, prometheus.GaugeValue,
+			float64(s.handlers[state].Load()), util.ClientState(state).String())
+	}
+	for pktType := range s.snPktsIn {
+		if n := s.snPktsIn[pktType].Load(); n > 0 {
+			ch <- prometheus.MustNewConstMetric(snPacketsReceivedDesc, prometheus.CounterValue,
+				float64(n), snPkts.PacketType(pktType).String())
+		}
+	}
+	for pktType := range s.snPktsOut {
+		if n := s.snPktsOut[pktType].Load(); n > 0 {
+			ch <- prometheus.MustNewConstMetric(snPacketsSentDesc, prometheus.CounterValue,
+				float64(n), snPkts.PacketType(pktType).String())
+		}
+	}
+
+	counter := func(desc *prometheus.Desc, value uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(value), labels...)
+	}
+	counter(snBytesReceivedDesc, s.snBytesIn.Load())
+	counter(snBytesSentDesc, s.snBytesOut.Load())
+	counter(mqttPacketsReceivedDesc, s.mqttPktsIn.Load())
+	counter(mqttPacketsSentDesc, s.mqttPktsOut.Load())
+	counter(mqttBytesReceivedDesc, s.mqttBytesIn.Load())
+	counter(mqttBytesSentDesc, s.mqttBytesOut.Load())
+	counter(transactionsDesc, s.transactionsSucceeded.Load(), "succeeded")
+	counter(transactionsDesc, s.transactionsFailed.Load(), "failed")
+	counter(transactionsDesc, s.transactionsTimedOut.Load(), "timed_out")
+	counter(transactionsDesc, s.noMoreRetries.Load(), "no_more_retries")
+	counter(retriesDesc, s.retries.Load())
+	counter(dtlsHandshakeErrorsDesc, s.dtlsHandshakeErrors.Load())
+	counter(pskCacheHitsDesc, s.pskCacheHits.Load())
+	counter(pskCacheMissesDesc, s.pskCacheMisses.Load())
+	counter(brokerDialFailuresDesc, s.brokerDialFailures.Load())
+	counter(sleepBufferDropsDesc, s.sleepBufferDrops.Load())
+	counter(clientsLostDesc, s.clientsLost.Load())
+
+	s.publishDuration.Collect(ch)
+}
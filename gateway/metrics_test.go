@@ -0,0 +1,61 @@
+package gateway
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestMetricsCollector(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := NewGateway(util.NewDebugLogger("metrics"), &GatewayConfig{})
+	gw.stats.handlerStarted(util.StateActive)
+	gw.stats.snReceived(snPkts1.NewPingreq(nil))
+	gw.stats.pskCacheMiss()
+	gw.stats.publishDuration.WithLabelValues("1").Observe(0.5)
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(gw.Collector()); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := make(map[string][]string)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var value float64
+			switch {
+			case metric.GetGauge() != nil:
+				value = metric.GetGauge().GetValue()
+			case metric.GetCounter() != nil:
+				value = metric.GetCounter().GetValue()
+			case metric.GetHistogram() != nil:
+				value = float64(metric.GetHistogram().GetSampleCount())
+			}
+			if value == 0 {
+				continue
+			}
+			var labels string
+			for _, label := range metric.GetLabel() {
+				labels += label.GetName() + "=" + label.GetValue()
+			}
+			metrics[family.GetName()] = append(metrics[family.GetName()], labels)
+		}
+	}
+
+	assert.Equal(map[string][]string{
+		"bisquitt_clients":                              {"state=active"},
+		"bisquitt_mqttsn_packets_received_total":        {"type=PINGREQ"},
+		"bisquitt_mqttsn_received_bytes_total":          {""},
+		"bisquitt_psk_cache_misses_total":               {""},
+		"bisquitt_publish_transaction_duration_seconds": {"qos=1"},
+	}, metrics)
+}
@@ -0,0 +1,791 @@
+// MQTT 5.0 codec.
+//
+// The handler speaks MQTT 3.1.1 internally (paho packets). This codec
+// translates the packets to and from MQTT 5.0 wire format, see MQTT
+// specification v. 5.0, chapter 3 MQTT Control Packets.
+//
+// Features used:
+//   - Session Expiry Interval is set in CONNECT. A clean session expires
+//     immediately, a persistent one expires 1.5 times the longer of the
+//     MQTT-SN keepalive and the longest sleep duration after the connection
+//     is closed, or never if the keepalive is 0. When the client goes to
+//     sleep for longer than the keepalive, the handler sets the sleep
+//     duration and reconnects to the broker (see updateSessionExpiry); the
+//     new interval is sent in the DISCONNECT closing the old connection and
+//     in the new CONNECT.
+//   - Topic aliases are accepted from the broker (up to
+//     mqtt5TopicAliasMaximum) and used for PUBLISH packets sent to the broker
+//     (up to the Topic Alias Maximum from CONNACK).
+//   - Reason codes and reason strings are logged. They are mapped to MQTT
+//     3.1.1 return codes where such codes exist (CONNACK, SUBACK). A PUBACK or
+//     PUBREC with a failure reason code is decoded as mqtt5PubFailure, which
+//     ends the client's PUBLISH flow. The other reason codes are only logged.
+//
+// MQTT 5.0 features without an MQTT-SN 1.2 counterpart (user properties,
+// message expiry, ...) are ignored.
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+// Topic Alias Maximum sent to the broker in CONNECT.
+const mqtt5TopicAliasMaximum = 1024
+
+// MQTT 5.0 property identifiers.
+// See MQTT specification v. 5.0, chapter 2.2.2.2 Property.
+const (
+	propPayloadFormatIndicator     = 0x01
+	propMessageExpiryInterval      = 0x02
+	propContentType                = 0x03
+	propResponseTopic              = 0x08
+	propCorrelationData            = 0x09
+	propSubscriptionIdentifier     = 0x0B
+	propSessionExpiryInterval      = 0x11
+	propAssignedClientIdentifier   = 0x12
+	propServerKeepAlive            = 0x13
+	propAuthenticationMethod       = 0x15
+	propAuthenticationData         = 0x16
+	propRequestProblemInformation  = 0x17
+	propWillDelayInterval          = 0x18
+	propRequestResponseInformation = 0x19
+	propResponseInformation        = 0x1A
+	propServerReference            = 0x1C
+	propReasonString               = 0x1F
+	propReceiveMaximum             = 0x21
+	propTopicAliasMaximum          = 0x22
+	propTopicAlias                 = 0x23
+	propMaximumQoS                 = 0x24
+	propRetainAvailable            = 0x25
+	propUserProperty               = 0x26
+	propMaximumPacketSize          = 0x27
+	propWildcardSubscription       = 0x28
+	propSubscriptionIdentifierAv   = 0x29
+	propSharedSubscriptionAv       = 0x2A
+)
+
+// MQTT 5.0 reason codes names.
+// See MQTT specification v. 5.0, chapter 2.4 Reason Code.
+var mqtt5ReasonCodes = map[byte]string{
+	0x00: "Success",
+	0x01: "Granted QoS 1",
+	0x02: "Granted QoS 2",
+	0x04: "Disconnect with Will Message",
+	0x10: "No matching subscribers",
+	0x11: "No subscription existed",
+	0x80: "Unspecified error",
+	0x81: "Malformed Packet",
+	0x82: "Protocol Error",
+	0x83: "Implementation specific error",
+	0x84: "Unsupported Protocol Version",
+	0x85: "Client Identifier not valid",
+	0x86: "Bad User Name or Password",
+	0x87: "Not authorized",
+	0x88: "Server unavailable",
+	0x89: "Server busy",
+	0x8A: "Banned",
+	0x8B: "Server shutting down",
+	0x8C: "Bad authentication method",
+	0x8D: "Keep Alive timeout",
+	0x8E: "Session taken over",
+	0x8F: "Topic Filter invalid",
+	0x90: "Topic Name invalid",
+	0x91: "Packet Identifier in use",
+	0x92: "Packet Identifier not found",
+	0x93: "Receive Maximum exceeded",
+	0x94: "Topic Alias invalid",
+	0x95: "Packet too large",
+	0x96: "Message rate too high",
+	0x97: "Quota exceeded",
+	0x98: "Administrative action",
+	0x99: "Payload format invalid",
+	0x9A: "Retain not supported",
+	0x9B: "QoS not supported",
+	0x9C: "Use another server",
+	0x9D: "Server moved",
+	0x9E: "Shared Subscriptions not supported",
+	0x9F: "Connection rate exceeded",
+	0xA0: "Maximum connect time",
+	0xA1: "Subscription Identifiers not supported",
+	0xA2: "Wildcard Subscriptions not supported",
+}
+
+func mqtt5ReasonCodeString(code byte) string {
+	if s, ok := mqtt5ReasonCodes[code]; ok {
+		return s
+	}
+	return "unknown reason code"
+}
+
+var errMqtt5Malformed = errors.New("malformed MQTT 5 packet")
+
+// mqtt5PubFailure is a PUBACK or PUBREC with a failure reason code (0x80 or
+// greater). MQTT 3.1.1 has no such packet. The PUBLISH flow ends with it,
+// i.e. no PUBREL follows a failed PUBREC.
+// See MQTT specification v. 5.0, chapter 4.3.3 QoS 2: Exactly once delivery.
+type mqtt5PubFailure struct {
+	// The PUBACK or PUBREC packet.
+	mqPkts.ControlPacket
+	MessageID  uint16
+	ReasonCode byte
+}
+
+// snReturnCode maps the reason code to the MQTT-SN return code rejecting
+// the client's PUBLISH.
+func (p *mqtt5PubFailure) snReturnCode() snPkts1.ReturnCode {
+	switch p.ReasonCode {
+	// Server busy, Quota exceeded, Message rate too high
+	case 0x89, 0x97, 0x96:
+		return snPkts1.RC_CONGESTION
+	// Topic Name invalid
+	case 0x90:
+		return snPkts1.RC_INVALID_TOPIC_ID
+	default:
+		return snPkts1.RC_NOT_SUPPORTED
+	}
+}
+
+type mqtt5Properties struct {
+	sessionExpiryInterval uint32
+	topicAliasMaximum     uint16
+	topicAlias            uint16
+	reasonString          string
+}
+
+type mqtt5Codec struct {
+	log util.Logger
+	// Protects the outgoing topic aliases. It is held during the whole
+	// WritePacket call so that a PUBLISH establishing an alias is always
+	// written before the PUBLISHes using it.
+	mutex sync.Mutex
+	// Topic Alias Maximum received from the broker in CONNACK.
+	aliasMaximum uint16
+	// Topic aliases for PUBLISH packets sent to the broker.
+	aliases map[string]uint16
+	// Topic aliases for PUBLISH packets received from the broker. Accessed
+	// from ReadPacket only, which is never called concurrently.
+	brokerAliases map[uint16]string
+	// Keepalive sent in CONNECT.
+	keepalive uint16
+	// Session Expiry Interval sent in CONNECT, zero for a clean session.
+	sessionExpiry uint32
+	// The longest MQTT-SN sleep duration of the client [s].
+	sleepDuration uint16
+}
+
+func newMqtt5Codec(log util.Logger) *mqtt5Codec {
+	return &mqtt5Codec{
+		log:           log,
+		aliases:       make(map[string]uint16),
+		brokerAliases: make(map[uint16]string),
+	}
+}
+
+// mqtt5SessionExpiry returns the Session Expiry Interval of a persistent
+// session.
+func mqtt5SessionExpiry(keepalive, sleepDuration uint16) uint32 {
+	if keepalive == 0 {
+		// The client is never considered lost => the session never expires.
+		return 0xFFFFFFFF
+	}
+	duration := keepalive
+	if sleepDuration > duration {
+		duration = sleepDuration
+	}
+	return uint32(duration) * 3 / 2
+}
+
+// setSleepDuration extends the Session Expiry Interval of a persistent
+// session to cover the client's sleep duration. It returns true if the
+// interval sent to the broker has become too short.
+func (c *mqtt5Codec) setSleepDuration(duration uint16) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if duration > c.sleepDuration {
+		c.sleepDuration = duration
+	}
+	return c.sessionExpiry != 0 &&
+		c.sessionExpiry < mqtt5SessionExpiry(c.keepalive, c.sleepDuration)
+}
+
+func (c *mqtt5Codec) getSleepDuration() uint16 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.sleepDuration
+}
+
+//
+// Encoding
+//
+
+func encodeVarint(n int) []byte {
+	var result []byte
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		result = append(result, b)
+		if n == 0 {
+			return result
+		}
+	}
+}
+
+func writeUint16(buf *bytes.Buffer, n uint16) {
+	_ = binary.Write(buf, binary.BigEndian, n)
+}
+
+func writeUint32(buf *bytes.Buffer, n uint32) {
+	_ = binary.Write(buf, binary.BigEndian, n)
+}
+
+func writeBinary(buf *bytes.Buffer, b []byte) {
+	writeUint16(buf, uint16(len(b)))
+	buf.Write(b)
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeBinary(buf, []byte(s))
+}
+
+// writeProperties writes the properties length followed by the properties.
+func writeProperties(buf *bytes.Buffer, props []byte) {
+	buf.Write(encodeVarint(len(props)))
+	buf.Write(props)
+}
+
+// mqttCodec.WritePacket() implementation.
+func (c *mqtt5Codec) WritePacket(w io.Writer, pkt mqPkts.ControlPacket) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var firstByte byte
+	body := &bytes.Buffer{}
+
+	switch p := pkt.(type) {
+	case *mqPkts.ConnectPacket:
+		firstByte = mqPkts.Connect << 4
+		c.encodeConnect(body, p)
+
+	case *mqPkts.PublishPacket:
+		firstByte = mqPkts.Publish<<4 | p.Qos<<1
+		if p.Dup {
+			firstByte |= 0x08
+		}
+		if p.Retain {
+			firstByte |= 0x01
+		}
+		props := &bytes.Buffer{}
+		topic := p.TopicName
+		if alias, ok := c.aliases[topic]; ok {
+			topic = ""
+			props.WriteByte(propTopicAlias)
+			writeUint16(props, alias)
+		} else if len(c.aliases) < int(c.aliasMaximum) {
+			alias := uint16(len(c.aliases) + 1)
+			c.aliases[topic] = alias
+			props.WriteByte(propTopicAlias)
+			writeUint16(props, alias)
+		}
+		writeString(body, topic)
+		if p.Qos > 0 {
+			writeUint16(body, p.MessageID)
+		}
+		writeProperties(body, props.Bytes())
+		body.Write(p.Payload)
+
+	case *mqPkts.PubackPacket:
+		firstByte = mqPkts.Puback << 4
+		writeUint16(body, p.MessageID)
+
+	case *mqPkts.PubrecPacket:
+		firstByte = mqPkts.Pubrec << 4
+		writeUint16(body, p.MessageID)
+
+	case *mqPkts.PubrelPacket:
+		firstByte = mqPkts.Pubrel<<4 | 0x02
+		writeUint16(body, p.MessageID)
+
+	case *mqPkts.PubcompPacket:
+		firstByte = mqPkts.Pubcomp << 4
+		writeUint16(body, p.MessageID)
+
+	case *mqPkts.SubscribePacket:
+		firstByte = mqPkts.Subscribe<<4 | 0x02
+		writeUint16(body, p.MessageID)
+		writeProperties(body, nil)
+		for i, topic := range p.Topics {
+			writeString(body, topic)
+			// Subscription options: only the maximum QoS is used.
+			body.WriteByte(p.Qoss[i] & 0x03)
+		}
+
+	case *mqPkts.UnsubscribePacket:
+		firstByte = mqPkts.Unsubscribe<<4 | 0x02
+		writeUint16(body, p.MessageID)
+		writeProperties(body, nil)
+		for _, topic := range p.Topics {
+			writeString(body, topic)
+		}
+
+	case *mqPkts.PingreqPacket:
+		firstByte = mqPkts.Pingreq << 4
+
+	case *mqPkts.DisconnectPacket:
+		// Empty body means reason code 0x00 (Normal disconnection).
+		firstByte = mqPkts.Disconnect << 4
+		// The Session Expiry Interval of a persistent session can be
+		// updated on disconnect.
+		// See MQTT specification v. 5.0, chapter 3.14.2.2.2 Session Expiry Interval.
+		if c.sessionExpiry != 0 {
+			if expiry := mqtt5SessionExpiry(c.keepalive, c.sleepDuration); expiry != c.sessionExpiry {
+				props := &bytes.Buffer{}
+				props.WriteByte(propSessionExpiryInterval)
+				writeUint32(props, expiry)
+				// Normal disconnection
+				body.WriteByte(0x00)
+				writeProperties(body, props.Bytes())
+			}
+		}
+
+	default:
+		return 0, fmt.Errorf("unsupported MQTT packet type: %v", pkt)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(firstByte)
+	buf.Write(encodeVarint(body.Len()))
+	buf.Write(body.Bytes())
+	return w.Write(buf.Bytes())
+}
+
+func (c *mqtt5Codec) encodeConnect(body *bytes.Buffer, p *mqPkts.ConnectPacket) {
+	writeString(body, "MQTT")
+	body.WriteByte(MqttVersion5)
+
+	var flags byte
+	if p.UsernameFlag {
+		flags |= 0x80
+	}
+	if p.PasswordFlag {
+		flags |= 0x40
+	}
+	if p.WillFlag {
+		flags |= 0x04 | p.WillQos<<3
+		if p.WillRetain {
+			flags |= 0x20
+		}
+	}
+	if p.CleanSession {
+		// Clean Start
+		flags |= 0x02
+	}
+	body.WriteByte(flags)
+	writeUint16(body, p.Keepalive)
+
+	c.keepalive = p.Keepalive
+	c.sessionExpiry = 0
+	props := &bytes.Buffer{}
+	if !p.CleanSession {
+		c.sessionExpiry = mqtt5SessionExpiry(p.Keepalive, c.sleepDuration)
+		props.WriteByte(propSessionExpiryInterval)
+		writeUint32(props, c.sessionExpiry)
+	}
+	props.WriteByte(propTopicAliasMaximum)
+	writeUint16(props, mqtt5TopicAliasMaximum)
+	writeProperties(body, props.Bytes())
+
+	writeString(body, p.ClientIdentifier)
+	if p.WillFlag {
+		writeProperties(body, nil)
+		writeString(body, p.WillTopic)
+		writeBinary(body, p.WillMessage)
+	}
+	if p.UsernameFlag {
+		writeString(body, p.Username)
+	}
+	if p.PasswordFlag {
+		writeBinary(body, p.Password)
+	}
+}
+
+//
+// Decoding
+//
+
+func readVarint(r io.ByteReader) (int, error) {
+	var n int
+	multiplier := 1
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			return n, nil
+		}
+		multiplier *= 128
+	}
+	return 0, errMqtt5Malformed
+}
+
+func readUint16(r *bytes.Reader) (uint16, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return 0, errMqtt5Malformed
+	}
+	return n, nil
+}
+
+func readUint32(r *bytes.Reader) (uint32, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return 0, errMqtt5Malformed
+	}
+	return n, nil
+}
+
+func readBinary(r *bytes.Reader) ([]byte, error) {
+	length, err := readUint16(r)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errMqtt5Malformed
+	}
+	return b, nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	b, err := readBinary(r)
+	return string(b), err
+}
+
+func readProperties(r *bytes.Reader) (*mqtt5Properties, error) {
+	length, err := readVarint(r)
+	if err != nil {
+		return nil, errMqtt5Malformed
+	}
+	if length > r.Len() {
+		return nil, errMqtt5Malformed
+	}
+	propsBuf := make([]byte, length)
+	_, _ = r.Read(propsBuf)
+	pr := bytes.NewReader(propsBuf)
+
+	props := &mqtt5Properties{}
+	for pr.Len() > 0 {
+		id, err := readVarint(pr)
+		if err != nil {
+			return nil, errMqtt5Malformed
+		}
+		switch id {
+		// Byte
+		case propPayloadFormatIndicator, propRequestProblemInformation,
+			propRequestResponseInformation, propMaximumQoS, propRetainAvailable,
+			propWildcardSubscription, propSubscriptionIdentifierAv,
+			propSharedSubscriptionAv:
+			if _, err := pr.ReadByte(); err != nil {
+				return nil, errMqtt5Malformed
+			}
+		// Two Byte Integer
+		case propServerKeepAlive, propReceiveMaximum, propTopicAliasMaximum, propTopicAlias:
+			n, err := readUint16(pr)
+			if err != nil {
+				return nil, err
+			}
+			switch id {
+			case propTopicAliasMaximum:
+				props.topicAliasMaximum = n
+			case propTopicAlias:
+				props.topicAlias = n
+			}
+		// Four Byte Integer
+		case propMessageExpiryInterval, propSessionExpiryInterval,
+			propWillDelayInterval, propMaximumPacketSize:
+			n, err := readUint32(pr)
+			if err != nil {
+				return nil, err
+			}
+			if id == propSessionExpiryInterval {
+				props.sessionExpiryInterval = n
+			}
+		// Variable Byte Integer
+		case propSubscriptionIdentifier:
+			if _, err := readVarint(pr); err != nil {
+				return nil, errMqtt5Malformed
+			}
+		// UTF-8 Encoded String or Binary Data
+		case propContentType, propResponseTopic, propCorrelationData,
+			propAssignedClientIdentifier, propAuthenticationMethod,
+			propAuthenticationData, propResponseInformation,
+			propServerReference, propReasonString:
+			s, err := readString(pr)
+			if err != nil {
+				return nil, err
+			}
+			if id == propReasonString {
+				props.reasonString = s
+			}
+		// UTF-8 String Pair
+		case propUserProperty:
+			if _, err := readString(pr); err != nil {
+				return nil, err
+			}
+			if _, err := readString(pr); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown MQTT 5 property: %#x", id)
+		}
+	}
+	return props, nil
+}
+
+// logReason logs the reason code and reason string received from the broker.
+func (c *mqtt5Codec) logReason(pktName string, code byte, reasonString string) {
+	msg := fmt.Sprintf("%s reason code %#02x (%s)", pktName, code, mqtt5ReasonCodeString(code))
+	if reasonString != "" {
+		msg += ": " + reasonString
+	}
+	if code >= 0x80 {
+		c.log.Error("%s", msg)
+	} else if reasonString != "" {
+		c.log.Debug("%s", msg)
+	}
+}
+
+// mqttCodec.ReadPacket() implementation.
+func (c *mqtt5Codec) ReadPacket(r io.Reader) (mqPkts.ControlPacket, error) {
+	var firstByte [1]byte
+	if _, err := io.ReadFull(r, firstByte[:]); err != nil {
+		return nil, err
+	}
+	length, err := readVarint(byteReader{r})
+	if err != nil {
+		return nil, err
+	}
+	bodyBuf := make([]byte, length)
+	if _, err := io.ReadFull(r, bodyBuf); err != nil {
+		return nil, err
+	}
+	body := bytes.NewReader(bodyBuf)
+
+	pktType := firstByte[0] >> 4
+	switch pktType {
+	case mqPkts.Connack:
+		return c.decodeConnack(body)
+	case mqPkts.Publish:
+		return c.decodePublish(firstByte[0], body)
+	case mqPkts.Puback, mqPkts.Pubrec, mqPkts.Pubrel, mqPkts.Pubcomp:
+		return c.decodePubResponse(pktType, body)
+	case mqPkts.Suback:
+		return c.decodeSuback(body)
+	case mqPkts.Unsuback:
+		return c.decodeUnsuback(body)
+	case mqPkts.Pingresp:
+		return mqPkts.NewControlPacket(mqPkts.Pingresp), nil
+	case mqPkts.Disconnect:
+		code := byte(0)
+		if body.Len() > 0 {
+			code, _ = body.ReadByte()
+		}
+		reasonString := ""
+		if body.Len() > 0 {
+			if props, err := readProperties(body); err == nil {
+				reasonString = props.reasonString
+			}
+		}
+		c.logReason("DISCONNECT", code, reasonString)
+		return nil, fmt.Errorf("MQTT broker sent DISCONNECT with reason code %#02x (%s)",
+			code, mqtt5ReasonCodeString(code))
+	default:
+		return nil, fmt.Errorf("unsupported MQTT 5 packet type: %d", pktType)
+	}
+}
+
+func (c *mqtt5Codec) decodeConnack(body *bytes.Reader) (mqPkts.ControlPacket, error) {
+	flags, err := body.ReadByte()
+	if err != nil {
+		return nil, errMqtt5Malformed
+	}
+	code, err := body.ReadByte()
+	if err != nil {
+		return nil, errMqtt5Malformed
+	}
+	props, err := readProperties(body)
+	if err != nil {
+		return nil, err
+	}
+	c.logReason("CONNACK", code, props.reasonString)
+
+	c.mutex.Lock()
+	c.aliasMaximum = props.topicAliasMaximum
+	c.mutex.Unlock()
+
+	connack := mqPkts.NewControlPacket(mqPkts.Connack).(*mqPkts.ConnackPacket)
+	connack.SessionPresent = flags&0x01 != 0
+	switch {
+	case code < 0x80:
+		connack.ReturnCode = mqPkts.Accepted
+	case code == 0x84:
+		connack.ReturnCode = mqPkts.ErrRefusedBadProtocolVersion
+	case code == 0x85:
+		connack.ReturnCode = mqPkts.ErrRefusedIDRejected
+	case code == 0x86:
+		connack.ReturnCode = mqPkts.ErrRefusedBadUsernameOrPassword
+	case code == 0x87, code == 0x8A, code == 0x8C:
+		connack.ReturnCode = mqPkts.ErrRefusedNotAuthorised
+	default:
+		connack.ReturnCode = mqPkts.ErrRefusedServerUnavailable
+	}
+	return connack, nil
+}
+
+func (c *mqtt5Codec) decodePublish(firstByte byte, body *bytes.Reader) (mqPkts.ControlPacket, error) {
+	publish := mqPkts.NewControlPacket(mqPkts.Publish).(*mqPkts.PublishPacket)
+	publish.Dup = firstByte&0x08 != 0
+	publish.Qos = (firstByte >> 1) & 0x03
+	publish.Retain = firstByte&0x01 != 0
+
+	topic, err := readString(body)
+	if err != nil {
+		return nil, err
+	}
+	if publish.Qos > 0 {
+		if publish.MessageID, err = readUint16(body); err != nil {
+			return nil, err
+		}
+	}
+	props, err := readProperties(body)
+	if err != nil {
+		return nil, err
+	}
+	if props.topicAlias != 0 {
+		if props.topicAlias > mqtt5TopicAliasMaximum {
+			return nil, fmt.Errorf("invalid MQTT 5 topic alias: %d", props.topicAlias)
+		}
+		if topic == "" {
+			var ok bool
+			topic, ok = c.brokerAliases[props.topicAlias]
+			if !ok {
+				return nil, fmt.Errorf("unknown MQTT 5 topic alias: %d", props.topicAlias)
+			}
+		} else {
+			c.brokerAliases[props.topicAlias] = topic
+		}
+	}
+	publish.TopicName = topic
+	publish.Payload = make([]byte, body.Len())
+	_, _ = body.Read(publish.Payload)
+	return publish, nil
+}
+
+// decodePubResponse decodes PUBACK, PUBREC, PUBREL and PUBCOMP packets.
+func (c *mqtt5Codec) decodePubResponse(pktType byte, body *bytes.Reader) (mqPkts.ControlPacket, error) {
+	msgID, err := readUint16(body)
+	if err != nil {
+		return nil, err
+	}
+	code := byte(0)
+	reasonString := ""
+	if body.Len() > 0 {
+		code, _ = body.ReadByte()
+		if body.Len() > 0 {
+			props, err := readProperties(body)
+			if err != nil {
+				return nil, err
+			}
+			reasonString = props.reasonString
+		}
+	}
+	c.logReason(fmt.Sprintf("%s(%d)", mqPkts.PacketNames[pktType], msgID), code, reasonString)
+
+	pkt := mqPkts.NewControlPacket(pktType)
+	if code >= 0x80 && (pktType == mqPkts.Puback || pktType == mqPkts.Pubrec) {
+		return &mqtt5PubFailure{
+			ControlPacket: pkt,
+			MessageID:     msgID,
+			ReasonCode:    code,
+		}, nil
+	}
+	switch p := pkt.(type) {
+	case *mqPkts.PubackPacket:
+		p.MessageID = msgID
+	case *mqPkts.PubrecPacket:
+		p.MessageID = msgID
+	case *mqPkts.PubrelPacket:
+		p.MessageID = msgID
+	case *mqPkts.PubcompPacket:
+		p.MessageID = msgID
+	}
+	return pkt, nil
+}
+
+func (c *mqtt5Codec) decodeSuback(body *bytes.Reader) (mqPkts.ControlPacket, error) {
+	msgID, err := readUint16(body)
+	if err != nil {
+		return nil, err
+	}
+	props, err := readProperties(body)
+	if err != nil {
+		return nil, err
+	}
+	suback := mqPkts.NewControlPacket(mqPkts.Suback).(*mqPkts.SubackPacket)
+	suback.MessageID = msgID
+	for body.Len() > 0 {
+		code, _ := body.ReadByte()
+		c.logReason(fmt.Sprintf("SUBACK(%d)", msgID), code, props.reasonString)
+		if code >= 0x80 {
+			// The only MQTT 3.1.1 failure return code.
+			code = 0x80
+		}
+		suback.ReturnCodes = append(suback.ReturnCodes, code)
+	}
+	return suback, nil
+}
+
+func (c *mqtt5Codec) decodeUnsuback(body *bytes.Reader) (mqPkts.ControlPacket, error) {
+	msgID, err := readUint16(body)
+	if err != nil {
+		return nil, err
+	}
+	props, err := readProperties(body)
+	if err != nil {
+		return nil, err
+	}
+	for body.Len() > 0 {
+		code, _ := body.ReadByte()
+		c.logReason(fmt.Sprintf("UNSUBACK(%d)", msgID), code, props.reasonString)
+	}
+	unsuback := mqPkts.NewControlPacket(mqPkts.Unsuback).(*mqPkts.UnsubackPacket)
+	unsuback.MessageID = msgID
+	return unsuback, nil
+}
+
+// byteReader is an io.ByteReader reading from an io.Reader.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
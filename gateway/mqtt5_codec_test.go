@@ -0,0 +1,199 @@
+package gateway
+
+import (
+	"bytes"
+	"testing"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestMqtt5CodecConnect(t *testing.T) {
+	assert := assert.New(t)
+	codec := newMqtt5Codec(util.NewDebugLogger("MQTT5"))
+
+	connect := mqPkts.NewControlPacket(mqPkts.Connect).(*mqPkts.ConnectPacket)
+	connect.ProtocolVersion = MqttVersion311
+	connect.ProtocolName = "MQTT"
+	connect.ClientIdentifier = "c"
+	connect.Keepalive = 10
+	connect.WillFlag = true
+	connect.WillQos = 1
+	connect.WillTopic = "w"
+	connect.WillMessage = []byte("m")
+
+	buf := &bytes.Buffer{}
+	n, err := codec.WritePacket(buf, connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(buf.Len(), n)
+	assert.Equal([]byte{
+		0x10, 29,
+		0, 4, 'M', 'Q', 'T', 'T',
+		5,     // protocol level
+		0x0C,  // flags: will QoS 1, will
+		0, 10, // keepalive
+		8,                 // properties length
+		0x11, 0, 0, 0, 15, // session expiry interval
+		0x22, 0x04, 0x00, // topic alias maximum
+		0, 1, 'c',
+		0, // will properties length
+		0, 1, 'w',
+		0, 1, 'm',
+	}, buf.Bytes())
+}
+
+func TestMqtt5CodecSessionExpiry(t *testing.T) {
+	assert := assert.New(t)
+	codec := newMqtt5Codec(util.NewDebugLogger("MQTT5"))
+
+	write := func(pkt mqPkts.ControlPacket) []byte {
+		buf := &bytes.Buffer{}
+		if _, err := codec.WritePacket(buf, pkt); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	connect := mqPkts.NewControlPacket(mqPkts.Connect).(*mqPkts.ConnectPacket)
+	connect.ClientIdentifier = "c"
+	disconnect := mqPkts.NewControlPacket(mqPkts.Disconnect)
+
+	// Keepalive 0 => the session never expires.
+	assert.Equal([]byte{0x11, 0xFF, 0xFF, 0xFF, 0xFF}, write(connect)[13:18])
+	assert.False(codec.setSleepDuration(100))
+	assert.Equal([]byte{0xE0, 0}, write(disconnect))
+
+	// The sleep duration longer than the keepalive extends the interval.
+	connect.Keepalive = 10
+	assert.Equal([]byte{0x11, 0, 0, 0, 150}, write(connect)[13:18])
+	assert.False(codec.setSleepDuration(50))
+	assert.True(codec.setSleepDuration(200))
+	assert.Equal([]byte{0xE0, 7, 0x00, 5, 0x11, 0, 0, 1, 44}, write(disconnect))
+	assert.Equal([]byte{0x11, 0, 0, 1, 44}, write(connect)[13:18])
+	assert.Equal([]byte{0xE0, 0}, write(disconnect))
+
+	// Clean session.
+	connect.CleanSession = true
+	assert.Equal([]byte{0x22, 0x04, 0x00}, write(connect)[13:16])
+	assert.False(codec.setSleepDuration(300))
+	assert.Equal([]byte{0xE0, 0}, write(disconnect))
+}
+
+func TestMqtt5CodecConnack(t *testing.T) {
+	assert := assert.New(t)
+	codec := newMqtt5Codec(util.NewDebugLogger("MQTT5"))
+
+	pkt, err := codec.ReadPacket(bytes.NewReader([]byte{
+		0x20, 8,
+		0x01, // session present
+		0x00, // success
+		5, 0x1F, 0, 2, 'o', 'k',
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	connack := pkt.(*mqPkts.ConnackPacket)
+	assert.True(connack.SessionPresent)
+	assert.Equal(byte(mqPkts.Accepted), connack.ReturnCode)
+
+	pkt, err = codec.ReadPacket(bytes.NewReader([]byte{0x20, 3, 0x00, 0x87, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(byte(mqPkts.ErrRefusedNotAuthorised), pkt.(*mqPkts.ConnackPacket).ReturnCode)
+}
+
+func TestMqtt5CodecPubFailure(t *testing.T) {
+	assert := assert.New(t)
+	codec := newMqtt5Codec(util.NewDebugLogger("MQTT5"))
+
+	// PUBACK with Not authorized.
+	pkt, err := codec.ReadPacket(bytes.NewReader([]byte{0x40, 3, 0, 7, 0x87}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := pkt.(*mqtt5PubFailure)
+	assert.IsType(&mqPkts.PubackPacket{}, failure.ControlPacket)
+	assert.Equal(uint16(7), failure.MessageID)
+	assert.Equal(snPkts1.RC_NOT_SUPPORTED, failure.snReturnCode())
+
+	// PUBREC with Quota exceeded.
+	pkt, err = codec.ReadPacket(bytes.NewReader([]byte{0x50, 4, 0, 8, 0x97, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure = pkt.(*mqtt5PubFailure)
+	assert.IsType(&mqPkts.PubrecPacket{}, failure.ControlPacket)
+	assert.Equal(uint16(8), failure.MessageID)
+	assert.Equal(snPkts1.RC_CONGESTION, failure.snReturnCode())
+
+	// PUBACK with No matching subscribers is a success.
+	pkt, err = codec.ReadPacket(bytes.NewReader([]byte{0x40, 3, 0, 9, 0x10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(uint16(9), pkt.(*mqPkts.PubackPacket).MessageID)
+}
+
+func TestMqtt5CodecSuback(t *testing.T) {
+	assert := assert.New(t)
+	codec := newMqtt5Codec(util.NewDebugLogger("MQTT5"))
+
+	pkt, err := codec.ReadPacket(bytes.NewReader([]byte{0x90, 5, 0, 7, 0, 0x01, 0x97}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	suback := pkt.(*mqPkts.SubackPacket)
+	assert.Equal(uint16(7), suback.MessageID)
+	assert.Equal([]byte{0x01, 0x80}, suback.ReturnCodes)
+}
+
+func TestMqtt5CodecPublishTopicAlias(t *testing.T) {
+	assert := assert.New(t)
+	codec := newMqtt5Codec(util.NewDebugLogger("MQTT5"))
+
+	// Broker allows one topic alias.
+	if _, err := codec.ReadPacket(bytes.NewReader([]byte{0x20, 6, 0, 0, 3, 0x22, 0, 1})); err != nil {
+		t.Fatal(err)
+	}
+
+	publish := func(topic string, msgID uint16) []byte {
+		pkt := mqPkts.NewControlPacket(mqPkts.Publish).(*mqPkts.PublishPacket)
+		pkt.Qos = 1
+		pkt.TopicName = topic
+		pkt.MessageID = msgID
+		pkt.Payload = []byte("x")
+		buf := &bytes.Buffer{}
+		if _, err := codec.WritePacket(buf, pkt); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// The alias is established.
+	assert.Equal([]byte{0x32, 10, 0, 1, 'a', 0, 1, 3, 0x23, 0, 1, 'x'}, publish("a", 1))
+	// The alias is used.
+	assert.Equal([]byte{0x32, 9, 0, 0, 0, 2, 3, 0x23, 0, 1, 'x'}, publish("a", 2))
+	// No more aliases available.
+	assert.Equal([]byte{0x32, 7, 0, 1, 'b', 0, 3, 0, 'x'}, publish("b", 3))
+
+	// Aliases used by the broker.
+	pkt, err := codec.ReadPacket(bytes.NewReader([]byte{0x30, 8, 0, 1, 'c', 3, 0x23, 0, 5, 'y'}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("c", pkt.(*mqPkts.PublishPacket).TopicName)
+	pkt, err = codec.ReadPacket(bytes.NewReader([]byte{0x30, 7, 0, 0, 3, 0x23, 0, 5, 'z'}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("c", pkt.(*mqPkts.PublishPacket).TopicName)
+	assert.Equal([]byte("z"), pkt.(*mqPkts.PublishPacket).Payload)
+
+	_, err = codec.ReadPacket(bytes.NewReader([]byte{0x30, 7, 0, 0, 3, 0x23, 0, 6, 'z'}))
+	assert.Error(err)
+}
@@ -0,0 +1,50 @@
+package gateway
+
+import (
+	"bytes"
+	"io"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+
+	"github.com/energostack/bisquitt/util"
+)
+
+// MQTT protocol versions (protocol level byte of the CONNECT packet).
+const (
+	MqttVersion311 uint8 = 4
+	MqttVersion5   uint8 = 5
+)
+
+// mqttCodec reads and writes MQTT packets from/to the MQTT broker connection.
+//
+// The handler works with MQTT 3.1.1 packets only. Codecs of the other protocol
+// versions translate the packets to and from the respective wire format.
+type mqttCodec interface {
+	ReadPacket(r io.Reader) (mqPkts.ControlPacket, error)
+	// WritePacket returns the number of bytes written.
+	WritePacket(w io.Writer, pkt mqPkts.ControlPacket) (int, error)
+}
+
+func newMqttCodec(version uint8, log util.Logger) mqttCodec {
+	if version == MqttVersion5 {
+		return newMqtt5Codec(log.WithTag("MQTT5"))
+	}
+	return mqtt311Codec{}
+}
+
+// mqtt311Codec is a trivial MQTT 3.1.1 codec.
+type mqtt311Codec struct{}
+
+// mqttCodec.ReadPacket() implementation.
+func (mqtt311Codec) ReadPacket(r io.Reader) (mqPkts.ControlPacket, error) {
+	return mqPkts.ReadPacket(r)
+}
+
+// mqttCodec.WritePacket() implementation.
+func (mqtt311Codec) WritePacket(w io.Writer, pkt mqPkts.ControlPacket) (int, error) {
+	buff := &bytes.Buffer{}
+	if err := pkt.Write(buff); err != nil {
+		return 0, err
+	}
+	return w.Write(buff.Bytes())
+}
@@ -0,0 +1,81 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/energostack/bisquitt/util"
+)
+
+// MqttDialer establishes connections to the MQTT broker.
+type MqttDialer interface {
+	DialContext(ctx context.Context) (net.Conn, error)
+	// String returns the broker address to be used in log messages.
+	String() string
+}
+
+// TCPDialer connects to the MQTT broker over TCP, optionally secured by TLS.
+type TCPDialer struct {
+	Address *net.TCPAddr
+	Timeout time.Duration
+	// TLSConfig enables TLS if not nil.
+	TLSConfig *tls.Config
+}
+
+// MqttDialer.DialContext() implementation.
+func (d *TCPDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: d.Timeout,
+	}
+	if d.TLSConfig != nil {
+		tlsDialer := &tls.Dialer{
+			NetDialer: dialer,
+			Config:    d.TLSConfig,
+		}
+		return tlsDialer.DialContext(ctx, "tcp", d.Address.String())
+	}
+	return dialer.DialContext(ctx, "tcp", d.Address.String())
+}
+
+// MqttDialer.String() implementation.
+func (d *TCPDialer) String() string {
+	return d.Address.String()
+}
+
+// WebSocketDialer connects to the MQTT broker over WebSocket.
+// See MQTT specification v. 3.1.1, chapter 6 Using WebSocket as a network
+// transport.
+type WebSocketDialer struct {
+	// URL of the broker WebSocket endpoint ("ws://..." or "wss://...").
+	URL     string
+	Timeout time.Duration
+	// TLSConfig is used for "wss://" URLs. Default configuration is used
+	// if nil.
+	TLSConfig *tls.Config
+	// Header contains additional HTTP headers sent in the handshake request.
+	Header http.Header
+}
+
+// MqttDialer.DialContext() implementation.
+func (d *WebSocketDialer) DialContext(ctx context.Context) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: d.Timeout,
+		TLSClientConfig:  d.TLSConfig,
+		Subprotocols:     []string{"mqtt"},
+	}
+	ws, _, err := dialer.DialContext(ctx, d.URL, d.Header)
+	if err != nil {
+		return nil, err
+	}
+	return util.NewWebSocketConn(ws), nil
+}
+
+// MqttDialer.String() implementation.
+func (d *WebSocketDialer) String() string {
+	return d.URL
+}
@@ -0,0 +1,141 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestDialMqttTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	cert, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Echo one packet back.
+				buf := make([]byte, maxTestPktLength)
+				n, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				_, _ = conn.Write(buf[:n])
+			}()
+		}
+	}()
+
+	dialer := &TCPDialer{
+		Address: listener.Addr().(*net.TCPAddr),
+		Timeout: time.Second,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+	}
+	cfg := &handlerConfig{
+		MqttDialer: dialer,
+	}
+	h := newHandler(cfg, nil, newStats(), util.NewDebugLogger("DialMqttTLS"))
+	conn, err := h.dialMqtt(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, ok := conn.(*tls.Conn)
+	assert.True(ok)
+	assertEcho(t, conn)
+
+	// The self-signed certificate must be refused without InsecureSkipVerify.
+	dialer.TLSConfig = &tls.Config{}
+	_, err = h.dialMqtt(context.Background())
+	assert.Error(err)
+	assert.Equal(uint64(1), h.stats.brokerDialFailures.Load())
+}
+
+func TestDialMqttWebSocket(t *testing.T) {
+	assert := assert.New(t)
+
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"mqtt"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		assert.Equal("mqtt", ws.Subprotocol())
+		// Echo one message back.
+		msgType, data, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = ws.WriteMessage(msgType, data)
+		_, _, _ = ws.ReadMessage()
+	}))
+	defer server.Close()
+
+	cfg := &handlerConfig{
+		MqttDialer: &WebSocketDialer{
+			URL:     "ws" + strings.TrimPrefix(server.URL, "http") + "/mqtt",
+			Timeout: time.Second,
+		},
+	}
+	h := newHandler(cfg, nil, newStats(), util.NewDebugLogger("DialMqttWebSocket"))
+	conn, err := h.dialMqtt(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Read deadline expiration must not break the connection.
+	connWithContext := util.NewConnWithContext(context.Background(), conn, connTimeout)
+	if err := conn.SetReadDeadline(time.Now().Add(connTimeout)); err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); assert.True(ok) {
+		assert.True(netErr.Timeout())
+	}
+	assertEcho(t, connWithContext)
+}
+
+func assertEcho(t *testing.T, conn interface {
+	Read([]byte) (int, error)
+	Write([]byte) (int, error)
+}) {
+	assert := assert.New(t)
+	_, err := conn.Write([]byte("test"))
+	assert.NoError(err)
+	buf := make([]byte, maxTestPktLength)
+	n, err := conn.Read(buf)
+	assert.NoError(err)
+	assert.Equal("test", string(buf[:n]))
+}
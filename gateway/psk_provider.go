@@ -0,0 +1,358 @@
+// Pre-shared key lookup.
+
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"gopkg.in/yaml.v3"
+
+	"github.com/energostack/bisquitt/util"
+)
+
+var ErrPSKNotFound = errors.New("PSK not found")
+
+// PSKProvider looks up pre-shared keys of the clients. The implementations
+// must be safe for concurrent use.
+type PSKProvider interface {
+	// PSK returns the key of the PSK identity or ErrPSKNotFound.
+	PSK(identity string) ([]byte, error)
+}
+
+// PSKProviderChain asks the providers in order and returns the first key
+// found.
+type PSKProviderChain []PSKProvider
+
+// PSKProvider.PSK() implementation.
+func (c PSKProviderChain) PSK(identity string) ([]byte, error) {
+	var firstErr error
+	for _, provider := range c {
+		psk, err := provider.PSK(identity)
+		if err == nil {
+			return psk, nil
+		}
+		if err != ErrPSKNotFound && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrPSKNotFound
+}
+
+// FilePSKProvider reads the keys from a YAML file (identity => key map) or,
+// if the file name ends with ".csv", from a CSV file ("identity,key" lines).
+// The keys are hex encoded or base64 encoded with a "base64:" prefix. Lines
+// starting with "#" are ignored in CSV files.
+//
+// The file is reloaded on lookup if its modification time has changed, at
+// most once per ReloadInterval.
+type FilePSKProvider struct {
+	file string
+	// Zero disables the automatic reload.
+	ReloadInterval time.Duration
+	log            util.Logger
+
+	mutex     sync.RWMutex
+	keys      map[string][]byte
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewFilePSKProvider reads the keys from the file.
+func NewFilePSKProvider(file string, reloadInterval time.Duration, log util.Logger) (*FilePSKProvider, error) {
+	p := &FilePSKProvider{
+		file:           file,
+		ReloadInterval: reloadInterval,
+		log:            log,
+	}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// PSKFile holds the keys read by FilePSKProvider.Read until they are used.
+type PSKFile struct {
+	provider *FilePSKProvider
+	keys     map[string][]byte
+	modTime  time.Time
+}
+
+// Reload reads the file. The current keys are kept on error.
+func (p *FilePSKProvider) Reload() error {
+	file, err := p.Read()
+	if err != nil {
+		return err
+	}
+	file.use()
+	return nil
+}
+
+// Read reads the file but keeps the current keys. The keys read are used by
+// Gateway.Reload (see Reloadable.PSKFiles).
+func (p *FilePSKProvider) Read() (*PSKFile, error) {
+	info, err := os.Stat(p.file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p.file)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string][]byte
+	if strings.EqualFold(filepath.Ext(p.file), ".csv") {
+		keys, err = parsePSKCSV(data)
+	} else {
+		keys, err = parsePSKYAML(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", p.file, err)
+	}
+	return &PSKFile{
+		provider: p,
+		keys:     keys,
+		modTime:  info.ModTime(),
+	}, nil
+}
+
+// use replaces the keys of the provider.
+func (f *PSKFile) use() {
+	p := f.provider
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.keys = f.keys
+	p.modTime = f.modTime
+	p.lastCheck = time.Now()
+}
+
+// PSKProvider.PSK() implementation.
+func (p *FilePSKProvider) PSK(identity string) ([]byte, error) {
+	p.reloadIfChanged()
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	psk, ok := p.keys[identity]
+	if !ok {
+		return nil, ErrPSKNotFound
+	}
+	return psk, nil
+}
+
+func (p *FilePSKProvider) reloadIfChanged() {
+	if p.ReloadInterval <= 0 {
+		return
+	}
+	p.mutex.Lock()
+	if time.Since(p.lastCheck) < p.ReloadInterval {
+		p.mutex.Unlock()
+		return
+	}
+	p.lastCheck = time.Now()
+	modTime := p.modTime
+	p.mutex.Unlock()
+
+	info, err := os.Stat(p.file)
+	if err != nil {
+		p.log.Error("Cannot check PSK file: %s", err)
+		return
+	}
+	if info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := p.Reload(); err != nil {
+		p.log.Error("Cannot reload PSK file: %s", err)
+		return
+	}
+	p.log.Info("PSK file %s reloaded", p.file)
+}
+
+func parsePSKYAML(data []byte) (map[string][]byte, error) {
+	var entries map[string]string
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte, len(entries))
+	for identity, value := range entries {
+		psk, err := decodePSK(value)
+		if err != nil {
+			return nil, fmt.Errorf("identity %q: %s", identity, err)
+		}
+		keys[identity] = psk
+	}
+	return keys, nil
+}
+
+func parsePSKCSV(data []byte) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ',')
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected \"identity,key\"", lineNo)
+		}
+		psk, err := decodePSK(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		keys[strings.TrimSpace(line[:i])] = psk
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func decodePSK(value string) ([]byte, error) {
+	var psk []byte
+	var err error
+	if strings.HasPrefix(value, "base64:") {
+		psk, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "base64:"))
+	} else {
+		psk, err = hex.DecodeString(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %s", err)
+	}
+	if len(psk) == 0 {
+		return nil, errors.New("empty key")
+	}
+	return psk, nil
+}
+
+// HTTPPSKProvider gets the keys from the PSK API: GET <Endpoint>/<identity>
+// returns {"client": "<identity>", "psk": "<base64>"} or 404 Not Found.
+type HTTPPSKProvider struct {
+	Endpoint string
+	// Basic authentication is used if Username is not empty.
+	Username string
+	Password string
+	// Bearer token authentication is used if BearerToken is not empty.
+	BearerToken string
+	// HTTP client, e.g. with a custom TLS configuration and timeout.
+	// http.DefaultClient is used if nil.
+	Client *http.Client
+	// Number of retries after a network error or a 5xx response.
+	Retries    int
+	RetryDelay time.Duration
+	Log        util.Logger
+}
+
+// PSKProvider.PSK() implementation.
+func (p *HTTPPSKProvider) PSK(identity string) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		if attempt > 0 {
+			p.Log.Debug("Retrying PSK API request (%d/%d) after error: %s", attempt, p.Retries, err)
+			time.Sleep(p.RetryDelay)
+		}
+		var psk []byte
+		var retry bool
+		psk, retry, err = p.request(identity)
+		if err == nil || !retry {
+			return psk, err
+		}
+	}
+	return nil, err
+}
+
+// request returns retry=true if the request failed and may be retried.
+func (p *HTTPPSKProvider) request(identity string) (psk []byte, retry bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(p.Endpoint, "/")+"/"+url.PathEscape(identity), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if p.Username != "" {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+	if p.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.BearerToken)
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, false, ErrPSKNotFound
+	case resp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("PSK API: %s", resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("PSK API: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	var response struct {
+		Client string `json:"client"`
+		PSK    []byte `json:"psk"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, false, fmt.Errorf("PSK API: invalid response: %s", err)
+	}
+	if len(response.PSK) == 0 {
+		return nil, false, ErrPSKNotFound
+	}
+	return response.PSK, false, nil
+}
+
+// pskCache caches the keys and, for negativeExpiration, also the unknown
+// identities.
+type pskCache struct {
+	provider           PSKProvider
+	cache              *cache.Cache
+	expiration         time.Duration
+	negativeExpiration time.Duration
+	stats              *stats
+}
+
+func (c *pskCache) PSK(identity string) ([]byte, error) {
+	if c.cache == nil {
+		return c.provider.PSK(identity)
+	}
+	if psk, ok := c.cache.Get(identity); ok {
+		c.stats.pskCacheHit()
+		if psk == nil {
+			return nil, ErrPSKNotFound
+		}
+		return psk.([]byte), nil
+	}
+	c.stats.pskCacheMiss()
+
+	psk, err := c.provider.PSK(identity)
+	switch {
+	case err == nil:
+		c.cache.Set(identity, psk, c.expiration)
+	case err == ErrPSKNotFound && c.negativeExpiration > 0:
+		c.cache.Set(identity, nil, c.negativeExpiration)
+	}
+	return psk, err
+}
@@ -0,0 +1,239 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestFilePSKProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	log := util.NewDebugLogger("psk")
+
+	yamlFile := filepath.Join(dir, "keys.yaml")
+	if err := os.WriteFile(yamlFile, []byte("dev1: 0102ff\ndev2: base64:AQI=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider, err := NewFilePSKProvider(yamlFile, 0, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, err := provider.PSK("dev1")
+	assert.NoError(err)
+	assert.Equal([]byte{1, 2, 0xff}, psk)
+	psk, err = provider.PSK("dev2")
+	assert.NoError(err)
+	assert.Equal([]byte{1, 2}, psk)
+	_, err = provider.PSK("dev3")
+	assert.Equal(ErrPSKNotFound, err)
+
+	csvFile := filepath.Join(dir, "keys.csv")
+	if err := os.WriteFile(csvFile, []byte("# identity,key\ndev,1,01\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	provider, err = NewFilePSKProvider(csvFile, time.Millisecond, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, err = provider.PSK("dev,1")
+	assert.NoError(err)
+	assert.Equal([]byte{1}, psk)
+
+	// Hot reload.
+	if err := os.WriteFile(csvFile, []byte("dev2,02\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(csvFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	_, err = provider.PSK("dev,1")
+	assert.Equal(ErrPSKNotFound, err)
+	psk, err = provider.PSK("dev2")
+	assert.NoError(err)
+	assert.Equal([]byte{2}, psk)
+
+	// Read keys are not used until Gateway.Reload.
+	if err := os.WriteFile(csvFile, []byte("dev3,03\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The same modification time => no hot reload.
+	if err := os.Chtimes(csvFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	file, err := provider.Read()
+	assert.NoError(err)
+	_, err = provider.PSK("dev3")
+	assert.Equal(ErrPSKNotFound, err)
+	gw := NewGateway(log, &GatewayConfig{})
+	assert.NoError(gw.Reload(&Reloadable{PSKFiles: []*PSKFile{file}}))
+	psk, err = provider.PSK("dev3")
+	assert.NoError(err)
+	assert.Equal([]byte{3}, psk)
+
+	// Invalid file keeps the current keys.
+	if err := os.WriteFile(csvFile, []byte("dev3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(provider.Reload())
+	psk, err = provider.PSK("dev3")
+	assert.NoError(err)
+	assert.Equal([]byte{3}, psk)
+
+	for _, invalid := range []string{"dev: xyz\n", "dev: \"\"\n", "- dev\n"} {
+		if err := os.WriteFile(yamlFile, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := NewFilePSKProvider(yamlFile, 0, log)
+		assert.Error(err, invalid)
+	}
+}
+
+func TestHTTPPSKProvider(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests atomic.Int32
+	var failures atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if failures.Load() > 0 {
+			failures.Add(-1)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.URL.EscapedPath() != "/psk/dev%2F1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"client": "dev/1",
+			"psk":    []byte{1, 2, 3},
+		})
+	}))
+	defer server.Close()
+
+	provider := &HTTPPSKProvider{
+		Endpoint:    server.URL + "/psk",
+		BearerToken: "token",
+		Retries:     2,
+		Log:         util.NewDebugLogger("psk"),
+	}
+
+	psk, err := provider.PSK("dev/1")
+	assert.NoError(err)
+	assert.Equal([]byte{1, 2, 3}, psk)
+
+	_, err = provider.PSK("dev2")
+	assert.Equal(ErrPSKNotFound, err)
+
+	// Server errors are retried.
+	failures.Store(2)
+	requests.Store(0)
+	psk, err = provider.PSK("dev/1")
+	assert.NoError(err)
+	assert.Equal([]byte{1, 2, 3}, psk)
+	assert.Equal(int32(3), requests.Load())
+
+	failures.Store(3)
+	_, err = provider.PSK("dev/1")
+	assert.Error(err)
+	assert.NotEqual(ErrPSKNotFound, err)
+
+	// Client errors are not retried.
+	provider.BearerToken = "wrong"
+	requests.Store(0)
+	_, err = provider.PSK("dev/1")
+	assert.Error(err)
+	assert.Equal(int32(1), requests.Load())
+}
+
+type testPSKProvider struct {
+	keys  map[string][]byte
+	err   error
+	calls int
+}
+
+func (p *testPSKProvider) PSK(identity string) ([]byte, error) {
+	p.calls++
+	if p.err != nil {
+		return nil, p.err
+	}
+	if psk, ok := p.keys[identity]; ok {
+		return psk, nil
+	}
+	return nil, ErrPSKNotFound
+}
+
+func TestPSKProviderChain(t *testing.T) {
+	assert := assert.New(t)
+
+	failing := &testPSKProvider{err: errors.New("failed")}
+	chain := PSKProviderChain{
+		&testPSKProvider{keys: map[string][]byte{"a": {1}}},
+		failing,
+		&testPSKProvider{keys: map[string][]byte{"b": {2}}},
+	}
+	psk, err := chain.PSK("a")
+	assert.NoError(err)
+	assert.Equal([]byte{1}, psk)
+	psk, err = chain.PSK("b")
+	assert.NoError(err)
+	assert.Equal([]byte{2}, psk)
+	_, err = chain.PSK("c")
+	assert.Equal(failing.err, err)
+
+	failing.err = nil
+	_, err = chain.PSK("c")
+	assert.Equal(ErrPSKNotFound, err)
+}
+
+func TestPSKCache(t *testing.T) {
+	assert := assert.New(t)
+
+	provider := &testPSKProvider{keys: map[string][]byte{"a": {1}}}
+	stats := newStats()
+	psks := &pskCache{
+		provider:           provider,
+		cache:              cache.New(time.Minute, time.Minute),
+		expiration:         time.Minute,
+		negativeExpiration: time.Minute,
+		stats:              stats,
+	}
+	for i := 0; i < 2; i++ {
+		psk, err := psks.PSK("a")
+		assert.NoError(err)
+		assert.Equal([]byte{1}, psk)
+		_, err = psks.PSK("b")
+		assert.Equal(ErrPSKNotFound, err)
+	}
+	assert.Equal(2, provider.calls)
+	assert.Equal(uint64(2), stats.pskCacheHits.Load())
+	assert.Equal(uint64(2), stats.pskCacheMisses.Load())
+
+	// Errors are not cached.
+	provider.err = errors.New("failed")
+	_, err := psks.PSK("c")
+	assert.Error(err)
+	provider.err = nil
+	_, err = psks.PSK("c")
+	assert.Equal(ErrPSKNotFound, err)
+	assert.Equal(4, provider.calls)
+}
@@ -0,0 +1,171 @@
+// Configuration reload.
+
+package gateway
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+
+	"github.com/energostack/bisquitt/topics"
+)
+
+// Reloadable is the part of the gateway configuration which Gateway.Reload
+// can change without dropping the existing client connections. New DTLS
+// handshakes and new handlers use the reloaded configuration.
+type Reloadable struct {
+	// Certificate and PrivateKey replace the DTLS certificate if Certificate
+	// is not nil.
+	Certificate *tls.Certificate
+	PrivateKey  crypto.PrivateKey
+	// ClientCert replaces the client certificate CAs and CRLs. The
+	// verification mode (ClientCert.Auth) cannot be changed.
+	ClientCert       ClientCertConfig
+	PredefinedTopics topics.PredefinedTopics
+	// ListenerPredefinedTopics replace the predefined topics of the
+	// Gateway.Serve listeners with the same index. Only the listeners with
+	// their own ListenerConfig.PredefinedTopics are changed.
+	ListenerPredefinedTopics []topics.PredefinedTopics
+	// PSKFiles replace the keys of their FilePSKProviders.
+	PSKFiles []*PSKFile
+}
+
+// reloadable holds the current reloadable configuration.
+type reloadable struct {
+	mutex            sync.RWMutex
+	certificate      *tls.Certificate
+	clientCert       ClientCertConfig
+	predefinedTopics topics.PredefinedTopics
+	// listenerTopics are indexed by the Gateway.Serve listeners. A nil
+	// item means the listener uses predefinedTopics.
+	listenerTopics []topics.PredefinedTopics
+}
+
+// Reload replaces the reloadable configuration. The PSK cache is flushed so
+// that the keys are looked up again.
+func (gw *Gateway) Reload(r *Reloadable) error {
+	var certificate *tls.Certificate
+	if r.Certificate != nil {
+		var err error
+		certificate, err = newCertificate(r.Certificate, r.PrivateKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	gw.current.mutex.Lock()
+	if certificate != nil {
+		gw.current.certificate = certificate
+	}
+	auth := gw.current.clientCert.Auth
+	gw.current.clientCert = r.ClientCert
+	gw.current.clientCert.Auth = auth
+	gw.current.predefinedTopics = r.PredefinedTopics
+	for i, listenerTopics := range r.ListenerPredefinedTopics {
+		if i < len(gw.current.listenerTopics) && gw.current.listenerTopics[i] != nil && listenerTopics != nil {
+			gw.current.listenerTopics[i] = listenerTopics
+		}
+	}
+	gw.current.mutex.Unlock()
+
+	for _, file := range r.PSKFiles {
+		file.use()
+	}
+	if gw.cfg.PSKKeys != nil {
+		gw.cfg.PSKKeys.Flush()
+	}
+	gw.log.Info("Configuration reloaded")
+	return nil
+}
+
+// initCertificate sets the DTLS certificate from the configuration unless it
+// is already set.
+func (r *reloadable) initCertificate(cfg *GatewayConfig) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.certificate != nil {
+		return nil
+	}
+	if cfg.SelfSigned {
+		cert, err := selfsign.GenerateSelfSigned()
+		if err != nil {
+			return err
+		}
+		r.certificate = &cert
+		return nil
+	}
+	certificate, err := newCertificate(cfg.Certificate, cfg.PrivateKey)
+	if err != nil {
+		return err
+	}
+	r.certificate = certificate
+	return nil
+}
+
+// newCertificate returns a copy of the certificate with the private key.
+func newCertificate(certificate *tls.Certificate, privateKey crypto.PrivateKey) (*tls.Certificate, error) {
+	if certificate == nil || len(certificate.Certificate) == 0 {
+		return nil, errors.New("TLS certificate is missing")
+	}
+	if privateKey == nil {
+		return nil, errors.New("private key is missing")
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key")
+	}
+	publicKey, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(signer.Public()) {
+		return nil, errors.New("private key does not match the TLS certificate")
+	}
+	cert := *certificate
+	cert.PrivateKey = privateKey
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// getCertificate implements dtls.Config.GetCertificate.
+func (r *reloadable) getCertificate(*dtls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.certificate, nil
+}
+
+// verifyPeerCertificate implements dtls.Config.VerifyPeerCertificate with the
+// current client certificate configuration.
+func (r *reloadable) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	r.mutex.RLock()
+	clientCert := r.clientCert
+	r.mutex.RUnlock()
+	return clientCert.verifyPeerCertificate(rawCerts, verifiedChains)
+}
+
+// get returns the configuration for a new handler of the given listener.
+func (r *reloadable) get(listener int) (ClientCertConfig, topics.PredefinedTopics) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if listener < len(r.listenerTopics) && r.listenerTopics[listener] != nil {
+		return r.clientCert, r.listenerTopics[listener]
+	}
+	return r.clientCert, r.predefinedTopics
+}
+
+// setListeners sets the listener predefined topics.
+func (r *reloadable) setListeners(listeners []ListenerConfig) {
+	listenerTopics := make([]topics.PredefinedTopics, len(listeners))
+	for i, lc := range listeners {
+		listenerTopics[i] = lc.PredefinedTopics
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.listenerTopics = listenerTopics
+}
@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/pion/dtls/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/energostack/bisquitt/topics"
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+
+	ca1 := newTestCert(t, "ca1", 1, nil)
+	ca2 := newTestCert(t, "ca2", 1, nil)
+	server1 := newTestCert(t, "server1", 2, ca1)
+	server2 := newTestCert(t, "server2", 3, ca2)
+	client1 := newTestCert(t, "client1", 4, ca1)
+	client2 := newTestCert(t, "client2", 5, ca2)
+	certPool := func(ca *testCert) *x509.CertPool {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca.cert)
+		return pool
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pskKeys := cache.New(time.Minute, time.Minute)
+	pskKeys.Set("dev", []byte{1}, time.Minute)
+	cfg := &GatewayConfig{
+		UseDTLS:     true,
+		Certificate: &tls.Certificate{Certificate: [][]byte{server1.cert.Raw}},
+		PrivateKey:  server1.key,
+		ClientCert: ClientCertConfig{
+			Auth: dtls.RequireAndVerifyClientCert,
+			CAs:  certPool(ca1),
+		},
+		PredefinedTopics: topics.PredefinedTopics{},
+		PSKKeys:          pskKeys,
+	}
+	gw := NewGateway(util.NewDebugLogger("test"), cfg)
+	listener, err := newDTLSListener(ctx, cfg, gw.current, "udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, newStats(), gw.log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go acceptDTLS(listener)
+
+	// dial returns the server certificate CN.
+	dial := func(cert *testCert) (string, error) {
+		conn, err := dtls.Dial("udp", listener.Addr().(*net.UDPAddr), &dtls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{cert.cert.Raw},
+				PrivateKey:  cert.key,
+			}},
+			InsecureSkipVerify:   true,
+			ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+			ConnectContextMaker: func() (context.Context, func()) {
+				return context.WithTimeout(ctx, 2*time.Second)
+			},
+		})
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		serverCert, err := x509.ParseCertificate(conn.ConnectionState().PeerCertificates[0])
+		if err != nil {
+			return "", err
+		}
+		return serverCert.Subject.CommonName, nil
+	}
+
+	cn, err := dial(client1)
+	assert.NoError(err)
+	assert.Equal("server1", cn)
+	_, err = dial(client2)
+	assert.Error(err)
+
+	// The key must match the certificate.
+	assert.Error(gw.Reload(&Reloadable{
+		Certificate: &tls.Certificate{Certificate: [][]byte{server2.cert.Raw}},
+		PrivateKey:  server1.key,
+	}))
+
+	predefinedTopics := topics.PredefinedTopics{}
+	assert.NoError(gw.Reload(&Reloadable{
+		Certificate: &tls.Certificate{Certificate: [][]byte{server2.cert.Raw}},
+		PrivateKey:  server2.key,
+		ClientCert: ClientCertConfig{
+			CAs: certPool(ca2),
+		},
+		PredefinedTopics: predefinedTopics,
+	}))
+	cn, err = dial(client2)
+	assert.NoError(err)
+	assert.Equal("server2", cn)
+	_, err = dial(client1)
+	assert.Error(err)
+
+	clientCert, reloadedTopics := gw.current.get(0)
+	assert.Equal(dtls.RequireAndVerifyClientCert, clientCert.Auth)
+	assert.Equal(predefinedTopics, reloadedTopics)
+	assert.Zero(pskKeys.ItemCount())
+}
@@ -0,0 +1,294 @@
+// Persistent sessions.
+//
+// The MQTT broker resumes sessions of clients connected with
+// CleanSession=false, but the gateway-side state (topic IDs registered in
+// both directions, the TopicID sequence and subscriptions) lives in the
+// handler which is destroyed when the client disconnects. Hence, the handler
+// stores the state of persistent sessions in a SessionStore whenever it
+// changes and restores it when the client connects again with
+// CleanSession=false.
+//
+// The stored session is restored (or deleted if the client requests a clean
+// session) only after the broker accepts the CONNECT, i.e. after the
+// authentication, so that a client cannot wipe another client's session. If
+// the broker has not kept the session (SessionPresent is not set in CONNACK),
+// the stored session is discarded because the broker no longer has the
+// subscriptions.
+//
+// In-flight transactions are deliberately not stored. They are owned by the
+// MQTT broker and the client, which repeat them when the session is resumed:
+// the client repeats its unfinished PUBLISH transactions and the broker
+// resends the unacknowledged PUBLISH and PUBREL packets (the gateway answers
+// a PUBREL of a lost QoS 2 transaction with PUBCOMP itself).
+//
+// A client which never connects again would keep its session forever, so the
+// stores expire the sessions not saved for longer than the configured expiry.
+// The expired sessions are removed when loaded and, at most once per
+// sessionPurgeInterval, when any session is saved.
+
+package gateway
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSessionExpiry is the recommended expiry of the stored sessions.
+const DefaultSessionExpiry = 7 * 24 * time.Hour
+
+// The stores look for expired sessions at most this often.
+const sessionPurgeInterval = time.Minute
+
+// Session is the gateway-side state of a persistent client session.
+type Session struct {
+	// TopicID => topic name of the registered topics.
+	RegisteredTopics map[uint16]string `json:"registered_topics"`
+	// Topic filter => granted QoS.
+	Subscriptions map[string]uint8 `json:"subscriptions"`
+	// The next TopicID to be assigned, zero if not known.
+	NextTopicID uint16 `json:"next_topic_id,omitempty"`
+}
+
+// SessionStore stores persistent client sessions. The implementations must
+// be safe for concurrent use.
+type SessionStore interface {
+	// Load returns nil if no session is stored for the client.
+	Load(clientID string) (*Session, error)
+	Save(clientID string, session *Session) error
+	// Delete does not return an error if no session is stored.
+	Delete(clientID string) error
+}
+
+// MemorySessionStore stores the sessions in memory. The sessions are lost
+// when the gateway stops.
+type MemorySessionStore struct {
+	expiry    time.Duration
+	mutex     sync.Mutex
+	sessions  map[string]*memorySession
+	lastPurge time.Time
+	// For testing.
+	now func() time.Time
+}
+
+type memorySession struct {
+	session *Session
+	saved   time.Time
+}
+
+// NewMemorySessionStore creates a store expiring the sessions not saved for
+// longer than expiry. The sessions never expire if expiry is zero.
+func NewMemorySessionStore(expiry time.Duration) *MemorySessionStore {
+	return &MemorySessionStore{
+		expiry:   expiry,
+		sessions: make(map[string]*memorySession),
+		now:      time.Now,
+	}
+}
+
+// SessionStore.Load() implementation.
+func (s *MemorySessionStore) Load(clientID string) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.sessions[clientID]
+	if !ok {
+		return nil, nil
+	}
+	if sessionExpired(entry.saved, s.now(), s.expiry) {
+		delete(s.sessions, clientID)
+		return nil, nil
+	}
+	return entry.session.clone(), nil
+}
+
+// SessionStore.Save() implementation.
+func (s *MemorySessionStore) Save(clientID string, session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := s.now()
+	s.sessions[clientID] = &memorySession{
+		session: session.clone(),
+		saved:   now,
+	}
+	if s.expiry > 0 && now.Sub(s.lastPurge) >= sessionPurgeInterval {
+		s.lastPurge = now
+		for id, entry := range s.sessions {
+			if sessionExpired(entry.saved, now, s.expiry) {
+				delete(s.sessions, id)
+			}
+		}
+	}
+	return nil
+}
+
+// SessionStore.Delete() implementation.
+func (s *MemorySessionStore) Delete(clientID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, clientID)
+	return nil
+}
+
+// FileSessionStore stores every session in a JSON file in a directory. The
+// modification time of the file is the time the session was saved.
+type FileSessionStore struct {
+	dir       string
+	expiry    time.Duration
+	mutex     sync.Mutex
+	lastPurge time.Time
+}
+
+// NewFileSessionStore creates the directory if it does not exist and removes
+// the sessions which have expired while the gateway was stopped. The sessions
+// not saved for longer than expiry expire, they never expire if expiry is
+// zero.
+func NewFileSessionStore(dir string, expiry time.Duration) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &FileSessionStore{
+		dir:    dir,
+		expiry: expiry,
+	}
+	if err := s.purge(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// The client ID is hex-encoded because it may contain any characters.
+func (s *FileSessionStore) path(clientID string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(clientID))+".json")
+}
+
+// SessionStore.Load() implementation.
+func (s *FileSessionStore) Load(clientID string) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	info, err := os.Stat(s.path(clientID))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if sessionExpired(info.ModTime(), time.Now(), s.expiry) {
+		return nil, removeFile(s.path(clientID))
+	}
+	data, err := os.ReadFile(s.path(clientID))
+	if err != nil {
+		return nil, err
+	}
+	session := &Session{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, fmt.Errorf("invalid session file %s: %s", s.path(clientID), err)
+	}
+	return session, nil
+}
+
+// SessionStore.Save() implementation.
+//
+// The file is replaced atomically so that a crash cannot leave a truncated
+// session file behind.
+func (s *FileSessionStore) Save(clientID string, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tmp, err := os.CreateTemp(s.dir, "session-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path(clientID)); err != nil {
+		return err
+	}
+	if now := time.Now(); now.Sub(s.lastPurge) >= sessionPurgeInterval {
+		return s.purge(now)
+	}
+	return nil
+}
+
+// SessionStore.Delete() implementation.
+func (s *FileSessionStore) Delete(clientID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return removeFile(s.path(clientID))
+}
+
+// purge removes the expired session files and the temporary files left
+// behind by a crash. The caller must hold the mutex.
+func (s *FileSessionStore) purge(now time.Time) error {
+	s.lastPurge = now
+	if s.expiry == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !(strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".tmp")) {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if sessionExpired(info.ModTime(), now, s.expiry) {
+			if err := removeFile(filepath.Join(s.dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeFile does not return an error if the file does not exist.
+func removeFile(path string) error {
+	err := os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// sessionExpired returns true if a session saved at the given time has
+// expired. The sessions never expire if expiry is zero.
+func sessionExpired(saved, now time.Time, expiry time.Duration) bool {
+	return expiry > 0 && now.Sub(saved) > expiry
+}
+
+func (s *Session) clone() *Session {
+	result := &Session{
+		RegisteredTopics: make(map[uint16]string, len(s.RegisteredTopics)),
+		Subscriptions:    make(map[string]uint8, len(s.Subscriptions)),
+		NextTopicID:      s.NextTopicID,
+	}
+	for topicID, topic := range s.RegisteredTopics {
+		result.RegisteredTopics[topicID] = topic
+	}
+	for topic, qos := range s.Subscriptions {
+		result.Subscriptions[topic] = qos
+	}
+	return result
+}
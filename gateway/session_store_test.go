@@ -0,0 +1,271 @@
+package gateway
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+
+	snPkts "github.com/energostack/bisquitt/packets"
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	assert := assert.New(t)
+
+	session, err := store.Load("client/1")
+	assert.NoError(err)
+	assert.Nil(session)
+
+	saved := &Session{
+		RegisteredTopics: map[uint16]string{1: "a/b", 2: "c"},
+		Subscriptions:    map[string]uint8{"a/#": 1},
+	}
+	assert.NoError(store.Save("client/1", saved))
+	session, err = store.Load("client/1")
+	assert.NoError(err)
+	assert.Equal(saved, session)
+
+	session, err = store.Load("client/2")
+	assert.NoError(err)
+	assert.Nil(session)
+
+	assert.NoError(store.Delete("client/1"))
+	session, err = store.Load("client/1")
+	assert.NoError(err)
+	assert.Nil(session)
+	assert.NoError(store.Delete("client/1"))
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, NewMemorySessionStore(0))
+}
+
+func TestFileSessionStore(t *testing.T) {
+	store, err := NewFileSessionStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSessionStore(t, store)
+}
+
+func TestMemorySessionStoreExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Unix(1700000000, 0)
+	store := NewMemorySessionStore(time.Hour)
+	store.now = func() time.Time { return now }
+
+	assert.NoError(store.Save("client/1", &Session{}))
+	now = now.Add(time.Hour)
+	session, err := store.Load("client/1")
+	assert.NoError(err)
+	assert.NotNil(session)
+
+	// Saving a session purges the expired ones.
+	now = now.Add(time.Second)
+	assert.NoError(store.Save("client/2", &Session{}))
+	assert.Len(store.sessions, 1)
+	now = now.Add(time.Hour + time.Second)
+	session, err = store.Load("client/2")
+	assert.NoError(err)
+	assert.Nil(session)
+	assert.Len(store.sessions, 0)
+}
+
+func TestFileSessionStoreExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	store, err := NewFileSessionStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(store.Save("client/1", &Session{}))
+	assert.NoError(store.Save("client/2", &Session{}))
+	tmpFile := filepath.Join(dir, "session-1.tmp")
+	assert.NoError(os.WriteFile(tmpFile, nil, 0o600))
+	session, err := store.Load("client/1")
+	assert.NoError(err)
+	assert.NotNil(session)
+
+	old := time.Now().Add(-time.Hour - time.Minute)
+	for _, file := range []string{store.path("client/1"), store.path("client/2"), tmpFile} {
+		assert.NoError(os.Chtimes(file, old, old))
+	}
+	session, err = store.Load("client/1")
+	assert.NoError(err)
+	assert.Nil(session)
+	assert.NoFileExists(store.path("client/1"))
+
+	// Saving a session purges the expired ones.
+	store.lastPurge = old
+	assert.NoError(store.Save("client/3", &Session{}))
+	assert.NoFileExists(store.path("client/2"))
+	assert.NoFileExists(tmpFile)
+	assert.FileExists(store.path("client/3"))
+
+	// The sessions expired while the gateway was stopped are removed.
+	assert.NoError(os.Chtimes(store.path("client/3"), old, old))
+	_, err = NewFileSessionStore(dir, time.Hour)
+	assert.NoError(err)
+	assert.NoFileExists(store.path("client/3"))
+}
+
+func TestSessionRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	store := NewMemorySessionStore(0)
+	err := store.Save("client", &Session{
+		RegisteredTopics: map[uint16]string{snPkts.MinTopicAlias: "a/b"},
+		Subscriptions:    map[string]uint8{"a/#": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &handlerConfig{
+		SessionStore: store,
+	}
+	h := newHandler(cfg, nil, newStats(), util.NewDebugLogger("session"))
+	h.clientID = "client"
+	h.startSession(false, true)
+
+	topicID, ok := h.findRegisteredTopicID("a/b")
+	assert.True(ok)
+	assert.Equal(snPkts.MinTopicAlias, topicID)
+	qos, ok := h.subscriptions.Load("a/#")
+	assert.True(ok)
+	assert.Equal(uint8(1), qos)
+
+	// The restored TopicID is not reused and the new topic is stored.
+	topicID, err = h.registerTopic("c/d")
+	assert.NoError(err)
+	assert.Equal(snPkts.MinTopicAlias+1, topicID)
+	session, err := store.Load("client")
+	assert.NoError(err)
+	assert.Equal(map[uint16]string{
+		snPkts.MinTopicAlias:     "a/b",
+		snPkts.MinTopicAlias + 1: "c/d",
+	}, session.RegisteredTopics)
+
+	assert.Equal(snPkts.MinTopicAlias+2, session.NextTopicID)
+
+	// Clean session deletes the stored one.
+	h.startSession(true, false)
+	session, err = store.Load("client")
+	assert.NoError(err)
+	assert.Nil(session)
+}
+
+// connectPersistent connects the test client with CleanSession=false.
+func connectPersistent(stp *testSetup, sessionPresent bool) {
+	assert := assert.New(stp.t)
+
+	// client --CONNECT--> GW
+	snConnect := snPkts1.NewConnect(1, []byte("test-client"), false, false)
+	stp.snSend(snConnect, false)
+
+	// GW --CONNECT--> MQTT broker
+	mqttConnect := stp.mqttRecv().(*mqPkts.ConnectPacket)
+	assert.False(mqttConnect.CleanSession)
+
+	// GW <--CONNACK-- MQTT broker
+	mqttConnack := mqPkts.NewControlPacket(mqPkts.Connack).(*mqPkts.ConnackPacket)
+	mqttConnack.ReturnCode = mqPkts.Accepted
+	mqttConnack.SessionPresent = sessionPresent
+	stp.mqttSend(mqttConnack, false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snPkts1.Connack)
+	assert.Equal(snPkts1.RC_ACCEPTED, snConnack.ReturnCode)
+}
+
+func newStoredSession(t *testing.T) SessionStore {
+	store := NewMemorySessionStore(0)
+	err := store.Save("test-client", &Session{
+		RegisteredTopics: map[uint16]string{snPkts.MinTopicAlias: "a/b"},
+		Subscriptions:    map[string]uint8{"a/#": 1},
+		NextTopicID:      snPkts.MinTopicAlias + 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestSessionResumed(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newStoredSession(t)
+	stp := newSessionTestSetup(t, false, nil, store)
+	defer stp.cancel()
+
+	connectPersistent(stp, true)
+
+	topicID, ok := stp.handler.findRegisteredTopicID("a/b")
+	assert.True(ok)
+	assert.Equal(snPkts.MinTopicAlias, topicID)
+	_, ok = stp.handler.subscriptions.Load("a/#")
+	assert.True(ok)
+	// The TopicID sequence continues where it stopped.
+	assert.Equal(snPkts.MinTopicAlias+5, stp.register("c/d"))
+
+	// GW <--PUBREL-- MQTT broker (QoS 2 PUBLISH delivered before resume)
+	mqttPubrel := mqPkts.NewControlPacket(mqPkts.Pubrel).(*mqPkts.PubrelPacket)
+	mqttPubrel.MessageID = 1234
+	stp.mqttSend(mqttPubrel, false)
+
+	// MQTT broker <--PUBCOMP-- GW
+	mqttPubcomp := stp.mqttRecv().(*mqPkts.PubcompPacket)
+	assert.Equal(uint16(1234), mqttPubcomp.MessageID)
+}
+
+func TestSessionNotPresent(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newStoredSession(t)
+	stp := newSessionTestSetup(t, false, nil, store)
+	defer stp.cancel()
+
+	// The broker has lost the session => the stored one is discarded.
+	connectPersistent(stp, false)
+
+	_, ok := stp.handler.findRegisteredTopicID("a/b")
+	assert.False(ok)
+	_, ok = stp.handler.subscriptions.Load("a/#")
+	assert.False(ok)
+	session, err := store.Load("test-client")
+	assert.NoError(err)
+	assert.Nil(session)
+}
+
+func TestSessionUnauthenticated(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newStoredSession(t)
+	stp := newSessionTestSetup(t, true, nil, store)
+	defer stp.cancel()
+	stp.handler.cfg.Authenticators = map[string]Authenticator{}
+
+	// client --CONNECT(clean session)--> GW
+	snConnect := snPkts1.NewConnect(1, []byte("test-client"), false, true)
+	stp.snSend(snConnect, false)
+
+	// client --AUTH(PLAIN)--> GW
+	stp.snSend(snPkts1.NewAuthPlain("joe", []byte("secret")), false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snPkts1.Connack)
+	assert.Equal(snPkts1.RC_NOT_SUPPORTED, snConnack.ReturnCode)
+	stp.assertHandlerDone()
+
+	// The stored session of the client is kept.
+	session, err := store.Load("test-client")
+	assert.NoError(err)
+	assert.NotNil(session)
+}
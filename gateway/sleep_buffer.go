@@ -0,0 +1,245 @@
+// Buffering of packets for sleeping clients.
+//
+// See MQTT-SN specification v. 1.2, chapter 6.14 Support of sleeping clients:
+// the gateway buffers the messages for an asleep client and sends them when
+// the client wakes up. The buffer is bounded both in the number of packets
+// and in bytes so that a flood of messages for a sleeping client cannot
+// exhaust the gateway memory.
+
+package gateway
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	snPkts "github.com/energostack/bisquitt/packets"
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/util"
+)
+
+// Defaults used if the SleepBufferConfig limits are zero.
+const (
+	DefaultSleepBufferMaxMessages = 100
+	DefaultSleepBufferMaxBytes    = 64 * 1024
+)
+
+// BufferOverflowPolicy decides which packet is dropped if the sleeping client
+// buffer is full.
+type BufferOverflowPolicy int
+
+const (
+	// DropOldest drops the oldest buffered packet.
+	DropOldest BufferOverflowPolicy = iota
+	// DropNewest drops the packet being buffered.
+	DropNewest
+	// DropQoS0First drops the oldest buffered QoS 0 (or -1) PUBLISH. If there
+	// is none, a new QoS 0 PUBLISH is dropped, otherwise the oldest packet
+	// is dropped.
+	DropQoS0First
+)
+
+var bufferOverflowPolicyNames = map[BufferOverflowPolicy]string{
+	DropOldest:    "drop-oldest",
+	DropNewest:    "drop-newest",
+	DropQoS0First: "drop-qos0",
+}
+
+func (p BufferOverflowPolicy) String() string {
+	if name, ok := bufferOverflowPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("BufferOverflowPolicy(%d)", int(p))
+}
+
+// ParseBufferOverflowPolicy parses the policy name as returned by
+// BufferOverflowPolicy.String().
+func ParseBufferOverflowPolicy(name string) (BufferOverflowPolicy, error) {
+	for policy, policyName := range bufferOverflowPolicyNames {
+		if policyName == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown buffer overflow policy: %q", name)
+}
+
+type SleepBufferConfig struct {
+	// Maximum number of buffered packets per client.
+	// DefaultSleepBufferMaxMessages is used if zero.
+	MaxMessages int
+	// Maximum size of buffered packets per client.
+	// DefaultSleepBufferMaxBytes is used if zero.
+	MaxBytes int
+	Policy   BufferOverflowPolicy
+	// Buffered packets older than Expiry are dropped. Packets never expire
+	// if zero.
+	Expiry time.Duration
+}
+
+type sleepBufferEntry struct {
+	pkt snPkts.Packet
+	// Packed pkt. The packets are packed when buffered so that the
+	// serialization errors are reported immediately.
+	data    []byte
+	qos0    bool
+	expires time.Time
+}
+
+type sleepBuffer struct {
+	cfg   SleepBufferConfig
+	stats *stats
+	log   util.Logger
+	// Called with every dropped or expired packet (without the mutex held).
+	onDrop  func(snPkts.Packet)
+	mutex   sync.Mutex
+	entries []*sleepBufferEntry
+	bytes   int
+	// Dropped packets to be passed to onDrop once the mutex is released.
+	dropped []snPkts.Packet
+}
+
+func newSleepBuffer(cfg SleepBufferConfig, stats *stats, log util.Logger) *sleepBuffer {
+	if cfg.MaxMessages == 0 {
+		cfg.MaxMessages = DefaultSleepBufferMaxMessages
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = DefaultSleepBufferMaxBytes
+	}
+	return &sleepBuffer{
+		cfg:   cfg,
+		stats: stats,
+		log:   log,
+	}
+}
+
+// add buffers the packed packet. A retransmitted packet replaces its buffered
+// original.
+func (b *sleepBuffer) add(pkt snPkts.Packet, data []byte) {
+	b.mutex.Lock()
+	defer b.notifyDropped()
+	defer b.mutex.Unlock()
+
+	for _, entry := range b.entries {
+		if entry.pkt == pkt {
+			b.bytes += len(data) - len(entry.data)
+			entry.data = data
+			return
+		}
+	}
+
+	entry := &sleepBufferEntry{
+		pkt:  pkt,
+		data: data,
+	}
+	if publish, ok := pkt.(*snPkts1.Publish); ok {
+		entry.qos0 = publish.QOS == 0 || publish.QOS == 3
+	}
+	if b.cfg.Expiry > 0 {
+		entry.expires = time.Now().Add(b.cfg.Expiry)
+	}
+
+	if len(data) > b.cfg.MaxBytes {
+		b.drop(entry, "Sleeping client buffer full")
+		return
+	}
+	b.removeExpired()
+	for len(b.entries) >= b.cfg.MaxMessages || b.bytes+len(data) > b.cfg.MaxBytes {
+		i := b.victim(entry)
+		if i < 0 {
+			b.drop(entry, "Sleeping client buffer full")
+			return
+		}
+		b.drop(b.entries[i], "Sleeping client buffer full")
+		b.remove(i)
+	}
+
+	b.entries = append(b.entries, entry)
+	b.bytes += len(data)
+}
+
+// victim returns the index of the buffered packet to be dropped to make room
+// for the new entry or -1 if the new entry should be dropped.
+func (b *sleepBuffer) victim(entry *sleepBufferEntry) int {
+	switch b.cfg.Policy {
+	case DropNewest:
+		return -1
+	case DropQoS0First:
+		for i, e := range b.entries {
+			if e.qos0 {
+				return i
+			}
+		}
+		if entry.qos0 {
+			return -1
+		}
+	}
+	return 0
+}
+
+// drop counts and logs the dropped entry. The caller must hold the mutex.
+func (b *sleepBuffer) drop(entry *sleepBufferEntry, reason string) {
+	b.stats.sleepBufferDrop()
+	b.log.Info("%s, packet dropped: %v", reason, entry.pkt)
+	b.dropped = append(b.dropped, entry.pkt)
+}
+
+// notifyDropped passes the dropped packets to onDrop. The caller must not
+// hold the mutex.
+func (b *sleepBuffer) notifyDropped() {
+	b.mutex.Lock()
+	dropped := b.dropped
+	b.dropped = nil
+	b.mutex.Unlock()
+	if b.onDrop == nil {
+		return
+	}
+	for _, pkt := range dropped {
+		b.onDrop(pkt)
+	}
+}
+
+func (b *sleepBuffer) remove(i int) {
+	b.bytes -= len(b.entries[i].data)
+	b.entries = append(b.entries[:i], b.entries[i+1:]...)
+}
+
+func (b *sleepBuffer) removeExpired() {
+	if b.cfg.Expiry == 0 {
+		return
+	}
+	now := time.Now()
+	for i := 0; i < len(b.entries); {
+		if now.After(b.entries[i].expires) {
+			b.drop(b.entries[i], "Buffered packet expired")
+			b.remove(i)
+		} else {
+			i++
+		}
+	}
+}
+
+// take returns all the unexpired buffered packets and empties the buffer.
+func (b *sleepBuffer) take() []*sleepBufferEntry {
+	b.mutex.Lock()
+	defer b.notifyDropped()
+	defer b.mutex.Unlock()
+	b.removeExpired()
+	entries := b.entries
+	b.entries = nil
+	b.bytes = 0
+	return entries
+}
+
+// size returns the number of the buffered packets and their total size.
+func (b *sleepBuffer) size() (int, int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.entries), b.bytes
+}
+
+func (b *sleepBuffer) clear() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.entries = nil
+	b.bytes = 0
+}
@@ -0,0 +1,157 @@
+package gateway
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	snPkts "github.com/energostack/bisquitt/packets"
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/topics"
+	"github.com/energostack/bisquitt/util"
+)
+
+func sleepBufferTestAdd(t *testing.T, b *sleepBuffer, qos uint8, size int) *snPkts1.Publish {
+	t.Helper()
+	pkt := snPkts1.NewPublish(1, make([]byte, size), false, qos, false, 0)
+	data, err := pkt.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.add(pkt, data)
+	return pkt
+}
+
+func sleepBufferTestPkts(b *sleepBuffer) []interface{} {
+	var result []interface{}
+	for _, entry := range b.take() {
+		result = append(result, entry.pkt)
+	}
+	return result
+}
+
+func TestSleepBufferPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := SleepBufferConfig{MaxMessages: 2, Policy: DropOldest}
+	stats := newStats()
+	b := newSleepBuffer(cfg, stats, util.NewDebugLogger("buffer"))
+	sleepBufferTestAdd(t, b, 1, 1)
+	p2 := sleepBufferTestAdd(t, b, 1, 1)
+	p3 := sleepBufferTestAdd(t, b, 1, 1)
+	assert.Equal([]interface{}{p2, p3}, sleepBufferTestPkts(b))
+	assert.Equal(uint64(1), stats.sleepBufferDrops.Load())
+
+	cfg.Policy = DropNewest
+	b = newSleepBuffer(cfg, newStats(), util.NewDebugLogger("buffer"))
+	p1 := sleepBufferTestAdd(t, b, 1, 1)
+	p2 = sleepBufferTestAdd(t, b, 1, 1)
+	sleepBufferTestAdd(t, b, 1, 1)
+	assert.Equal([]interface{}{p1, p2}, sleepBufferTestPkts(b))
+
+	cfg.Policy = DropQoS0First
+	b = newSleepBuffer(cfg, newStats(), util.NewDebugLogger("buffer"))
+	sleepBufferTestAdd(t, b, 1, 1)
+	sleepBufferTestAdd(t, b, 0, 1)
+	p3 = sleepBufferTestAdd(t, b, 1, 1)
+	// No QoS 0 packet buffered => a new QoS 0 packet is dropped...
+	sleepBufferTestAdd(t, b, 0, 1)
+	// ...and a QoS 1 one replaces the oldest packet.
+	p5 := sleepBufferTestAdd(t, b, 1, 1)
+	assert.Equal([]interface{}{p3, p5}, sleepBufferTestPkts(b))
+}
+
+func TestSleepBufferBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newSleepBuffer(SleepBufferConfig{MaxBytes: 100}, newStats(), util.NewDebugLogger("buffer"))
+	// Larger than the whole buffer.
+	sleepBufferTestAdd(t, b, 1, 200)
+	sleepBufferTestAdd(t, b, 1, 40)
+	p3 := sleepBufferTestAdd(t, b, 1, 40)
+	p4 := sleepBufferTestAdd(t, b, 1, 40)
+	assert.Equal([]interface{}{p3, p4}, sleepBufferTestPkts(b))
+	assert.Equal(0, b.bytes)
+}
+
+func TestSleepBufferResend(t *testing.T) {
+	assert := assert.New(t)
+
+	b := newSleepBuffer(SleepBufferConfig{}, newStats(), util.NewDebugLogger("buffer"))
+	p1 := sleepBufferTestAdd(t, b, 1, 1)
+	p1.SetDUP(true)
+	data, err := p1.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.add(p1, data)
+	entries := b.take()
+	if assert.Len(entries, 1) {
+		assert.Equal(data, entries[0].data)
+	}
+}
+
+func TestSleepBufferExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	stats := newStats()
+	b := newSleepBuffer(SleepBufferConfig{Expiry: 50 * time.Millisecond}, stats, util.NewDebugLogger("buffer"))
+	var dropped []interface{}
+	b.onDrop = func(pkt snPkts.Packet) {
+		dropped = append(dropped, pkt)
+	}
+	p1 := sleepBufferTestAdd(t, b, 1, 1)
+	time.Sleep(100 * time.Millisecond)
+	p2 := sleepBufferTestAdd(t, b, 1, 1)
+	assert.Equal([]interface{}{p2}, sleepBufferTestPkts(b))
+	assert.Equal([]interface{}{p1}, dropped)
+	assert.Equal(uint64(1), stats.sleepBufferDrops.Load())
+}
+
+// The transaction of a dropped packet must not wait for the client's reply.
+func TestSleepBufferDropTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newHandler(&handlerConfig{
+		SleepBuffer: SleepBufferConfig{MaxMessages: 1, Policy: DropOldest},
+		RetryDelay:  time.Minute,
+	}, topics.PredefinedTopics{}, newStats(), util.NewDebugLogger("handler"))
+	transaction := newDownlinkTransaction(ctx, h, 5, 1)
+	h.transactions.Store(5, transaction)
+
+	p1 := snPkts1.NewPublish(1, []byte("1"), false, 1, false, 0)
+	p1.SetMessageID(5)
+	transaction.Proceed(awaitingPuback, p1)
+	data, err := p1.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.sleepBuffer.add(p1, data)
+	sleepBufferTestAdd(t, h.sleepBuffer, 0, 1)
+
+	select {
+	case <-transaction.Done():
+		assert.Equal(ErrSleepBufferDrop, transaction.Err())
+	case <-time.After(time.Second):
+		t.Fatal("transaction not finished")
+	}
+	_, ok := h.transactions.Get(5)
+	assert.False(ok)
+}
+
+func TestParseBufferOverflowPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, policy := range []BufferOverflowPolicy{DropOldest, DropNewest, DropQoS0First} {
+		parsed, err := ParseBufferOverflowPolicy(policy.String())
+		assert.NoError(err)
+		assert.Equal(policy, parsed)
+	}
+	_, err := ParseBufferOverflowPolicy("drop-all")
+	assert.Error(err)
+}
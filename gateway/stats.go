@@ -0,0 +1,239 @@
+// Gateway statistics.
+//
+// The counters are shared by all handlers and updated atomically. They are
+// cumulative since the gateway start, except for the handler counts which
+// reflect the current state. The statistics are logged periodically (see
+// GatewayConfig.PerformanceLogTime) and exported as Prometheus metrics (see
+// Gateway.Collector).
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	snPkts "github.com/energostack/bisquitt/packets"
+	"github.com/energostack/bisquitt/transactions"
+	"github.com/energostack/bisquitt/util"
+)
+
+// Number of util.ClientState values.
+const clientStatesCount = int(util.StateAwake) + 1
+
+type stats struct {
+	// Indexed by util.ClientState.
+	handlers [clientStatesCount]atomic.Int64
+	// Indexed by snPkts.PacketType.
+	snPktsIn              [256]atomic.Uint64
+	snPktsOut             [256]atomic.Uint64
+	snBytesIn             atomic.Uint64
+	snBytesOut            atomic.Uint64
+	mqttPktsIn            atomic.Uint64
+	mqttPktsOut           atomic.Uint64
+	mqttBytesIn           atomic.Uint64
+	mqttBytesOut          atomic.Uint64
+	transactionsSucceeded atomic.Uint64
+	transactionsFailed    atomic.Uint64
+	transactionsTimedOut  atomic.Uint64
+	noMoreRetries         atomic.Uint64
+	retries               atomic.Uint64
+	dtlsHandshakeErrors   atomic.Uint64
+	pskCacheHits          atomic.Uint64
+	pskCacheMisses        atomic.Uint64
+	brokerDialFailures    atomic.Uint64
+	sleepBufferDrops      atomic.Uint64
+	clientsLost           atomic.Uint64
+	// Successful QoS 1 and 2 PUBLISH transactions duration.
+	publishDuration *prometheus.HistogramVec
+}
+
+func newStats() *stats {
+	return &stats{
+		publishDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: metricsNamespace,
+				Name:      "publish_transaction_duration_seconds",
+				Help:      "Duration of successful QoS 1 and 2 PUBLISH transactions.",
+				Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+			},
+			[]string{"qos"},
+		),
+	}
+}
+
+// Packet header accessors, implemented by all MQTT-SN packets.
+type packetWithHeader interface {
+	PacketType() snPkts.PacketType
+	PacketLength() uint16
+}
+
+func (s *stats) handlerStateChanged(old, new util.ClientState) {
+	s.handlers[old].Add(-1)
+	s.handlers[new].Add(1)
+}
+
+func (s *stats) handlerStarted(state util.ClientState) {
+	s.handlers[state].Add(1)
+}
+
+func (s *stats) handlerStopped(state util.ClientState) {
+	s.handlers[state].Add(-1)
+}
+
+func (s *stats) snReceived(pkt snPkts.Packet) {
+	if p, ok := pkt.(packetWithHeader); ok {
+		s.snPktsIn[p.PacketType()].Add(1)
+		s.snBytesIn.Add(uint64(p.PacketLength()))
+	}
+}
+
+func (s *stats) snSent(pkt snPkts.Packet, length int) {
+	if p, ok := pkt.(packetWithHeader); ok {
+		s.snPktsOut[p.PacketType()].Add(1)
+	}
+	s.snBytesOut.Add(uint64(length))
+}
+
+func (s *stats) mqttReceived(length int) {
+	s.mqttPktsIn.Add(1)
+	s.mqttBytesIn.Add(uint64(length))
+}
+
+func (s *stats) mqttSent(length int) {
+	s.mqttPktsOut.Add(1)
+	s.mqttBytesOut.Add(uint64(length))
+}
+
+func (s *stats) retry() {
+	s.retries.Add(1)
+}
+
+func (s *stats) dtlsHandshakeError() {
+	s.dtlsHandshakeErrors.Add(1)
+}
+
+func (s *stats) pskCacheHit() {
+	s.pskCacheHits.Add(1)
+}
+
+func (s *stats) pskCacheMiss() {
+	s.pskCacheMisses.Add(1)
+}
+
+func (s *stats) brokerDialFailure() {
+	s.brokerDialFailures.Add(1)
+}
+
+func (s *stats) sleepBufferDrop() {
+	s.sleepBufferDrops.Add(1)
+}
+
+func (s *stats) clientLost() {
+	s.clientsLost.Add(1)
+}
+
+// observeTransaction counts the transaction result once it finishes.
+// Transactions unfinished when ctx is done are not counted.
+func (s *stats) observeTransaction(ctx context.Context, t transactions.Transaction) {
+	s.observe(ctx, t, nil)
+}
+
+// observePublishTransaction is like observeTransaction but it also records
+// the duration of a successful QoS 1 or 2 PUBLISH transaction.
+func (s *stats) observePublishTransaction(ctx context.Context, t transactions.Transaction, qos uint8) {
+	var duration prometheus.Observer
+	if qos > 0 {
+		duration = s.publishDuration.WithLabelValues(fmt.Sprint(qos))
+	}
+	s.observe(ctx, t, duration)
+}
+
+func (s *stats) observe(ctx context.Context, t transactions.Transaction, duration prometheus.Observer) {
+	start := time.Now()
+	go func() {
+		select {
+		case <-t.Done():
+		case <-ctx.Done():
+			return
+		}
+		switch t.Err() {
+		case nil:
+			s.transactionsSucceeded.Add(1)
+			if duration != nil {
+				duration.Observe(time.Since(start).Seconds())
+			}
+		case transactions.ErrTimeout:
+			s.transactionsTimedOut.Add(1)
+		case transactions.ErrNoMoreRetries:
+			s.noMoreRetries.Add(1)
+		default:
+			s.transactionsFailed.Add(1)
+		}
+	}()
+}
+
+// run logs the statistics every interval until ctx is done.
+func (s *stats) run(ctx context.Context, log util.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.log(log)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *stats) log(log util.Logger) {
+	var handlers []string
+	for state := range s.handlers {
+		handlers = append(handlers, fmt.Sprintf("%s=%d", util.ClientState(state), s.handlers[state].Load()))
+	}
+	log.Info("Handlers: %s", strings.Join(handlers, " "))
+	log.Info("MQTT-SN in: %s (%d B)", formatPacketCounts(&s.snPktsIn), s.snBytesIn.Load())
+	log.Info("MQTT-SN out: %s (%d B)", formatPacketCounts(&s.snPktsOut), s.snBytesOut.Load())
+	log.Info("MQTT in: %d (%d B), out: %d (%d B)",
+		s.mqttPktsIn.Load(), s.mqttBytesIn.Load(), s.mqttPktsOut.Load(), s.mqttBytesOut.Load())
+	log.Info("Transactions: succeeded=%d failed=%d timed out=%d no more retries=%d, retries=%d",
+		s.transactionsSucceeded.Load(), s.transactionsFailed.Load(),
+		s.transactionsTimedOut.Load(), s.noMoreRetries.Load(), s.retries.Load())
+	log.Info("DTLS handshake errors: %d, PSK cache hits: %d, misses: %d, broker dial failures: %d",
+		s.dtlsHandshakeErrors.Load(), s.pskCacheHits.Load(), s.pskCacheMisses.Load(),
+		s.brokerDialFailures.Load())
+	log.Info("Lost clients: %d, sleeping clients buffer drops: %d",
+		s.clientsLost.Load(), s.sleepBufferDrops.Load())
+}
+
+// formatPacketCounts returns non-zero counts in the form "PUBLISH=3 PUBACK=2".
+func formatPacketCounts(counts *[256]atomic.Uint64) string {
+	var result []string
+	for pktType := range counts {
+		if n := counts[pktType].Load(); n > 0 {
+			result = append(result, fmt.Sprintf("%s=%d", snPkts.PacketType(pktType), n))
+		}
+	}
+	if len(result) == 0 {
+		return "-"
+	}
+	return strings.Join(result, " ")
+}
+
+// countingReader counts bytes read from the underlying reader.
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
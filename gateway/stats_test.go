@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/transactions"
+	"github.com/energostack/bisquitt/util"
+)
+
+func TestStatsPackets(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStats()
+	assert.Equal("-", formatPacketCounts(&s.snPktsIn))
+
+	pingreq := snPkts1.NewPingreq(nil)
+	s.snReceived(pingreq)
+	s.snReceived(pingreq)
+	s.snReceived(snPkts1.NewDisconnect(0))
+	assert.Equal("PINGREQ=2 DISCONNECT=1", formatPacketCounts(&s.snPktsIn))
+	assert.Equal(uint64(2*2+2), s.snBytesIn.Load())
+
+	s.snSent(snPkts1.NewPingresp(), 2)
+	assert.Equal("PINGRESP=1", formatPacketCounts(&s.snPktsOut))
+	assert.Equal(uint64(2), s.snBytesOut.Load())
+}
+
+func TestStatsHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStats()
+	s.handlerStarted(util.StateDisconnected)
+	s.handlerStateChanged(util.StateDisconnected, util.StateActive)
+	s.handlerStarted(util.StateDisconnected)
+	assert.Equal(int64(1), s.handlers[util.StateDisconnected].Load())
+	assert.Equal(int64(1), s.handlers[util.StateActive].Load())
+
+	s.handlerStopped(util.StateActive)
+	assert.Equal(int64(0), s.handlers[util.StateActive].Load())
+}
+
+func TestStatsTransactions(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStats()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	succeeded := transactions.NewTransactionBase(nil)
+	failed := transactions.NewTransactionBase(nil)
+	timedOut := transactions.NewTransactionBase(nil)
+	unfinished := transactions.NewTransactionBase(nil)
+	for _, transaction := range []transactions.Transaction{succeeded, failed, timedOut, unfinished} {
+		s.observeTransaction(ctx, transaction)
+	}
+	succeeded.Success()
+	failed.Fail(errors.New("test"))
+	timedOut.Fail(transactions.ErrTimeout)
+
+	assert.Eventually(func() bool {
+		return s.transactionsSucceeded.Load() == 1 &&
+			s.transactionsFailed.Load() == 1 &&
+			s.transactionsTimedOut.Load() == 1
+	}, time.Second, 10*time.Millisecond)
+}
@@ -14,14 +14,19 @@ import (
 	"github.com/energostack/bisquitt/util"
 )
 
+type transactionWithSuback interface {
+	Suback(mqSuback *mqPkts.SubackPacket) error
+}
+
 type subscribeTransaction struct {
 	*transactions.TimedTransaction
 	handler *handler1
 	log     util.Logger
 	topicID uint16
+	topic   string
 }
 
-func newSubscribeTransaction(ctx context.Context, h *handler1, msgID uint16, topicID uint16) *subscribeTransaction {
+func newSubscribeTransaction(ctx context.Context, h *handler1, msgID uint16, topicID uint16, topic string) *subscribeTransaction {
 	tLog := h.log.WithTag(fmt.Sprintf("REGISTERc(%d)", msgID))
 	tLog.Debug("Created.")
 	return &subscribeTransaction{
@@ -35,6 +40,7 @@ func newSubscribeTransaction(ctx context.Context, h *handler1, msgID uint16, top
 		handler: h,
 		log:     tLog,
 		topicID: topicID,
+		topic:   topic,
 	}
 }
 
@@ -49,6 +55,10 @@ func (t *subscribeTransaction) Suback(mqSuback *mqPkts.SubackPacket) error {
 	var returnCode snPkts1.ReturnCode
 	if mqSuback.ReturnCodes[0] <= 2 {
 		returnCode = snPkts1.RC_ACCEPTED
+		// Remembered to be able to restore the subscriptions on MQTT
+		// reconnect.
+		t.handler.subscriptions.Store(t.topic, mqSuback.ReturnCodes[0])
+		t.handler.saveSession()
 		t.Success()
 	} else {
 		returnCode = snPkts1.RC_NOT_SUPPORTED
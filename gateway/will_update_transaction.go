@@ -0,0 +1,165 @@
+// MQTT 3.1.1 does not support a will change in an established connection.
+// Hence, the gateway must cleanly disconnect from the MQTT broker and connect
+// again with the updated will.
+//
+// The CleanSession flag of the original CONNECT is preserved so the broker
+// never keeps a session the client has not asked for. If the broker has not
+// kept the session (the client requested a clean session), the gateway
+// restores the client's subscriptions itself before it confirms the will
+// update.
+//
+// The transaction is also used to update the MQTT 5 Session Expiry Interval
+// when the client goes to sleep (see updateSessionExpiry). Nothing is sent to
+// the client then.
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+
+	mqPkts "github.com/eclipse/paho.mqtt.golang/packets"
+
+	snPkts "github.com/energostack/bisquitt/packets"
+	snPkts1 "github.com/energostack/bisquitt/packets1"
+	"github.com/energostack/bisquitt/transactions"
+	"github.com/energostack/bisquitt/util"
+)
+
+// Constructs WILLTOPICRESP or WILLMSGRESP packet. Nil if no response is
+// sent.
+type willRespFunc func(snPkts1.ReturnCode) snPkts.Packet
+
+type willUpdateTransaction struct {
+	*transactions.TimedTransaction
+	handler   *handler1
+	log       util.Logger
+	mqConnect *mqPkts.ConnectPacket
+	newResp   willRespFunc
+	// SUBSCRIBE restoring the subscriptions of a clean session.
+	mqSubscribe *mqPkts.SubscribePacket
+}
+
+func newWillUpdateTransaction(ctx context.Context, h *handler1, mqConnect *mqPkts.ConnectPacket, newResp willRespFunc) *willUpdateTransaction {
+	tLog := h.log.WithTag("WILLUPD")
+	tLog.Debug("Created.")
+	t := &willUpdateTransaction{
+		handler:   h,
+		log:       tLog,
+		mqConnect: mqConnect,
+		newResp:   newResp,
+	}
+	t.TimedTransaction = transactions.NewTimedTransaction(
+		// The MQTT broker connection is established within the transaction.
+		ctx, h.cfg.MqttConnectionTimeout+connectTransactionTimeout,
+		func() {
+			h.transactions.DeleteByType(snPkts.CONNECT)
+			if t.mqSubscribe != nil {
+				h.transactions.Delete(t.mqSubscribe.MessageID)
+			}
+			tLog.Debug("Deleted.")
+		},
+	)
+	return t
+}
+
+func (t *willUpdateTransaction) Start(ctx context.Context) error {
+	t.handler.group.Go(func() error {
+		select {
+		case <-t.Done():
+			if err := t.Err(); err != nil {
+				if err == Cancelled {
+					return nil
+				}
+				return fmt.Errorf("will update: %s", err)
+			}
+			t.log.Debug("Will update transaction finished successfully.")
+			return nil
+		case <-ctx.Done():
+			t.log.Debug("Will update transaction cancelled.")
+			return nil
+		}
+	})
+
+	if err := t.handler.mqttReconnect(); err != nil {
+		return t.fail(err)
+	}
+	return t.handler.mqttSend(t.mqConnect)
+}
+
+func (t *willUpdateTransaction) Connack(mqConnack *mqPkts.ConnackPacket) error {
+	if mqConnack.ReturnCode != mqPkts.Accepted {
+		returnCodeStr, ok := mqPkts.ConnackReturnCodes[mqConnack.ReturnCode]
+		if !ok {
+			returnCodeStr = "unknown code!"
+		}
+		return t.fail(fmt.Errorf(
+			"CONNECT refused by MQTT broker with return code %d (%s).",
+			mqConnack.ReturnCode, returnCodeStr))
+	}
+	t.handler.mqConnect = t.mqConnect
+
+	if mqConnack.SessionPresent {
+		return t.finish()
+	}
+
+	mqSubscribe := mqPkts.NewControlPacket(mqPkts.Subscribe).(*mqPkts.SubscribePacket)
+	t.handler.subscriptions.Range(func(key, value interface{}) bool {
+		mqSubscribe.Topics = append(mqSubscribe.Topics, key.(string))
+		mqSubscribe.Qoss = append(mqSubscribe.Qoss, value.(uint8))
+		return true
+	})
+	if len(mqSubscribe.Topics) == 0 {
+		return t.finish()
+	}
+	t.handler.msgIDMutex.Lock()
+	msgID, ok := t.handler.freeMsgID()
+	if !ok {
+		t.handler.msgIDMutex.Unlock()
+		return t.fail(fmt.Errorf("cannot find available MsgID"))
+	}
+	mqSubscribe.MessageID = msgID
+	t.mqSubscribe = mqSubscribe
+	t.handler.transactions.Store(msgID, t)
+	t.handler.msgIDMutex.Unlock()
+	return t.handler.mqttSend(mqSubscribe)
+}
+
+func (t *willUpdateTransaction) Suback(mqSuback *mqPkts.SubackPacket) error {
+	for i, code := range mqSuback.ReturnCodes {
+		// MQTT return codes 0-2 means "Success, QoS 0-2".
+		if code > 2 && i < len(t.mqSubscribe.Topics) {
+			topic := t.mqSubscribe.Topics[i]
+			t.log.Error("Cannot restore subscription %q: MQTT SUBACK return code: %d", topic, code)
+			t.handler.subscriptions.Delete(topic)
+		}
+	}
+	return t.finish()
+}
+
+func (t *willUpdateTransaction) finish() error {
+	if t.newResp == nil {
+		t.Success()
+		return nil
+	}
+	if err := t.handler.snSend(t.newResp(snPkts1.RC_ACCEPTED)); err != nil {
+		t.Fail(err)
+		return err
+	}
+	t.Success()
+	return nil
+}
+
+// The MQTT connection is lost or not usable anymore at this point => the
+// handler must quit.
+func (t *willUpdateTransaction) fail(err error) error {
+	// We misuse RC_CONGESTION here because MQTT-SN spec v. 1.2 does not define
+	// any suitable return code.
+	if t.newResp != nil {
+		if err := t.handler.snSend(t.newResp(snPkts1.RC_CONGESTION)); err != nil {
+			t.log.Error("Error sending will update response: %s", err)
+		}
+	}
+	t.Fail(err)
+	return err
+}
@@ -16,7 +16,10 @@ const (
 
 // Auth method constants.
 const (
-	AUTH_PLAIN = "PLAIN"
+	AUTH_PLAIN         = "PLAIN"
+	AUTH_SCRAM_SHA_256 = "SCRAM-SHA-256"
+	// Bearer token (JWT) authentication.
+	AUTH_JWT = "JWT"
 )
 
 const authHeaderLength uint16 = 2
@@ -35,6 +38,18 @@ type Auth struct {
 	Data   []byte
 }
 
+// NewAuth creates a new Auth with the given method-specific data.
+func NewAuth(reason uint8, method string, data []byte) *Auth {
+	p := &Auth{
+		Header: *pkts.NewHeader(pkts.AUTH, 0),
+		Reason: reason,
+		Method: method,
+		Data:   data,
+	}
+	p.computeLength()
+	return p
+}
+
 // NewAuthPlain creates a new Auth with "PLAIN" method encoded
 // authentication data.
 func NewAuthPlain(user string, password []byte) *Auth {
@@ -62,6 +62,22 @@ func (ts *TransactionStore) Delete(pktID uint16) {
 	delete(ts.bypktID, pktID)
 }
 
+// Pending returns the MessageIDs and the PacketTypes of the stored
+// transactions.
+func (ts *TransactionStore) Pending() ([]uint16, []pkts.PacketType) {
+	ts.RLock()
+	defer ts.RUnlock()
+	pktIDs := make([]uint16, 0, len(ts.bypktID))
+	for pktID := range ts.bypktID {
+		pktIDs = append(pktIDs, pktID)
+	}
+	pktTypes := make([]pkts.PacketType, 0, len(ts.bypktType))
+	for pktType := range ts.bypktType {
+		pktTypes = append(pktTypes, pktType)
+	}
+	return pktIDs, pktTypes
+}
+
 // DeleteByType removes a transaction from the store by the PacketType.
 func (ts *TransactionStore) DeleteByType(pktType pkts.PacketType) {
 	ts.Lock()
@@ -47,3 +47,24 @@ func (c *IDSequence) Next() (id uint16, overflow bool) {
 
 	return
 }
+
+// Peek returns the ID the following Next() call will return.
+func (c *IDSequence) Peek() uint16 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.next
+}
+
+// SetNext sets the ID the following Next() call will return. IDs outside the
+// (minID, maxID) range are ignored.
+func (c *IDSequence) SetNext(id uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if id < c.min || id > c.max {
+		return
+	}
+	c.next = id
+	c.overflow = false
+}
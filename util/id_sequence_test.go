@@ -55,6 +55,21 @@ func TestIDSequence_Single(t *testing.T) {
 	assert.Equal(true, overflow)
 }
 
+func TestIDSequence_SetNext(t *testing.T) {
+	assert := assert.New(t)
+
+	uint16ID := NewIDSequence(5, 7)
+	uint16ID.SetNext(7)
+	assert.Equal(uint16(7), uint16ID.Peek())
+	uint16ID.SetNext(8)
+	assert.Equal(uint16(7), uint16ID.Peek())
+
+	id, overflow := uint16ID.Next()
+	assert.Equal(uint16(7), id)
+	assert.Equal(false, overflow)
+	assert.Equal(uint16(5), uint16ID.Peek())
+}
+
 func ExampleIDSequence_Next() {
 	s := NewIDSequence(1, 3)
 
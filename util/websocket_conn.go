@@ -0,0 +1,146 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketConn adapts a WebSocket connection to the net.Conn interface. The
+// data are sent as binary messages and the received messages are read as
+// a continuous stream.
+//
+// Unlike websocket.Conn, read deadline expiration does not break the
+// connection so that WebSocketConn can be used with ConnWithContext.
+type WebSocketConn struct {
+	ws         *websocket.Conn
+	writeMutex sync.Mutex
+	readCh     chan []byte
+	closed     chan struct{}
+	closeOnce  sync.Once
+	readErr    error
+	readBuf    []byte
+	// Read deadline, protected by deadlineMutex.
+	deadline      time.Time
+	deadlineMutex sync.Mutex
+}
+
+// NewWebSocketConn creates a new WebSocketConn instance and starts reading
+// messages from the given connection.
+func NewWebSocketConn(ws *websocket.Conn) *WebSocketConn {
+	c := &WebSocketConn{
+		ws:     ws,
+		readCh: make(chan []byte),
+		closed: make(chan struct{}),
+	}
+	go c.receiveLoop()
+	return c
+}
+
+func (c *WebSocketConn) receiveLoop() {
+	defer close(c.readCh)
+	for {
+		msgType, data, err := c.ws.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code == websocket.CloseNormalClosure {
+				err = io.EOF
+			}
+			c.readErr = err
+			return
+		}
+		if msgType != websocket.BinaryMessage {
+			continue
+		}
+		select {
+		case c.readCh <- data:
+		case <-c.closed:
+			c.readErr = net.ErrClosed
+			return
+		}
+	}
+}
+
+// webSocketTimeoutError is returned by Read when the read deadline expires.
+type webSocketTimeoutError struct{}
+
+func (webSocketTimeoutError) Error() string   { return "i/o timeout" }
+func (webSocketTimeoutError) Timeout() bool   { return true }
+func (webSocketTimeoutError) Temporary() bool { return true }
+
+func (c *WebSocketConn) Read(p []byte) (int, error) {
+	if len(c.readBuf) == 0 {
+		c.deadlineMutex.Lock()
+		deadline := c.deadline
+		c.deadlineMutex.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case data, ok := <-c.readCh:
+			if !ok {
+				return 0, c.readErr
+			}
+			c.readBuf = data
+		case <-timeout:
+			return 0, webSocketTimeoutError{}
+		}
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+func (c *WebSocketConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends a WebSocket close message and closes the underlying connection.
+func (c *WebSocketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = c.ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	return c.ws.Close()
+}
+
+func (c *WebSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	defer c.deadlineMutex.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}